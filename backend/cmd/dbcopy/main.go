@@ -0,0 +1,49 @@
+// Command dbcopy copies the metadata database (users, groups, repositories, tags) from one engine
+// to another, typically from the SQLite file of a single instance to a PostgreSQL database shared
+// by several replicas. The destination is created and migrated if needed and must hold no rows.
+// Stop refity first so no push lands in the source after the copy; then set DATABASE_URL to the
+// destination and start it again.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"refity/backend/internal/database"
+)
+
+func main() {
+	from := flag.String("from", "data/refity.db", "source database: SQLite file path or postgres:// URL")
+	to := flag.String("to", "", "destination database: postgres:// URL or SQLite file path")
+	flag.Parse()
+	if *to == "" {
+		log.Fatalf("Missing -to: the destination database")
+	}
+
+	if database.EngineFor(*from) == "sqlite" {
+		// Opening a missing SQLite file would create an empty one and copy nothing.
+		if _, err := os.Stat(*from); err != nil {
+			log.Fatalf("Source database: %v", err)
+		}
+	}
+	src, err := database.Open(*from)
+	if err != nil {
+		log.Fatalf("Failed to open source database %s: %v", *from, err)
+	}
+	defer src.Close()
+	dst, err := database.Open(*to)
+	if err != nil {
+		log.Fatalf("Failed to open destination database: %v", err)
+	}
+	defer dst.Close()
+
+	stats, err := database.Copy(dst, src)
+	if err != nil {
+		log.Fatalf("Copy failed, destination left unchanged: %v", err)
+	}
+	for _, s := range stats {
+		log.Printf("%-15s %d rows", s.Table, s.Rows)
+	}
+	log.Printf("Copied %s database to %s", src.Engine(), dst.Engine())
+}
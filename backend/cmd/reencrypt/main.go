@@ -0,0 +1,66 @@
+// Command reencrypt rewrites stored objects with the active encryption key. Run it after enabling
+// encryption (to encrypt existing plaintext objects) and after rotating ENCRYPTION_ACTIVE_KEY (to
+// move content off the old key, which can then be removed from the keyring). It reads the same
+// environment as the server. Objects are rewritten in place, so run it while pushes are paused.
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"refity/backend/internal/config"
+	_ "refity/backend/internal/driver/ftp"
+	_ "refity/backend/internal/driver/local"
+	_ "refity/backend/internal/driver/mirror"
+	_ "refity/backend/internal/driver/s3"
+	_ "refity/backend/internal/driver/sftp"
+	_ "refity/backend/internal/driver/webdav"
+	"refity/backend/internal/storage"
+	"refity/backend/internal/storage/crypt"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "only count the objects that would be rewritten")
+	flag.Parse()
+
+	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	keys, err := crypt.LoadKeyring(cfg.EncryptionKeys, cfg.EncryptionKeyFile, cfg.EncryptionActiveKey)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	if keys == nil {
+		log.Fatalf("No encryption keys configured: set ENCRYPTION_KEYS or ENCRYPTION_KEYFILE")
+	}
+	backend, err := storage.New(cfg.StorageDriver, cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize %s storage: %v", cfg.StorageDriver, err)
+	}
+	if c, ok := backend.(io.Closer); ok {
+		defer c.Close()
+	}
+	driver := crypt.New(backend, keys)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	rep, err := driver.Reencrypt(ctx, *dryRun)
+	verb := "rewrote"
+	if *dryRun {
+		verb = "would rewrite"
+	}
+	log.Printf("Scanned %d objects: %d already on key %s, %s %d (%d bytes), %d failed, in %s",
+		rep.Scanned, rep.Current, keys.Active(), verb, rep.Rewritten, rep.Bytes, rep.Failed, rep.Elapsed.Round(time.Second))
+	if err != nil {
+		log.Fatalf("Re-encryption stopped: %v", err)
+	}
+	if rep.Failed > 0 {
+		log.Fatalf("%d object(s) could not be rewritten; the old keys are still needed", rep.Failed)
+	}
+}
@@ -1,18 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"refity/backend/internal/api"
 	"refity/backend/internal/auth"
+	"refity/backend/internal/backup"
+	"refity/backend/internal/capacity"
 	"refity/backend/internal/config"
 	"refity/backend/internal/database"
+	_ "refity/backend/internal/driver/ftp"
 	"refity/backend/internal/driver/local"
-	"refity/backend/internal/driver/sftp"
+	"refity/backend/internal/driver/mirror"
+	_ "refity/backend/internal/driver/s3"
+	_ "refity/backend/internal/driver/sftp"
+	_ "refity/backend/internal/driver/webdav"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/reconcile"
+	"refity/backend/internal/retention"
 	"refity/backend/internal/registry"
+	"refity/backend/internal/scrub"
+	"refity/backend/internal/storage"
+	"refity/backend/internal/storage/cache"
+	"refity/backend/internal/storage/crypt"
 )
 
 func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
@@ -43,30 +62,39 @@ func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
 	}
 }
 
+// scrubTargets lists what the integrity scrubber verifies: each mirror replica on its own, so a
+// corrupt copy is found even while reads are served from a good one, or else the backend. Both
+// bypass the read cache.
+func scrubTargets(backend storage.Driver, keys *crypt.Keyring) []scrub.Target {
+	wrap := func(d storage.Driver) storage.Driver {
+		if keys != nil {
+			return crypt.New(d, keys)
+		}
+		return d
+	}
+	if m, ok := backend.(*mirror.Driver); ok {
+		targets := make([]scrub.Target, len(m.Replicas))
+		for i, r := range m.Replicas {
+			targets[i] = scrub.Target{Name: r.Name, Driver: wrap(r.Driver)}
+		}
+		return targets
+	}
+	return []scrub.Target{{Name: backend.Name(), Driver: wrap(backend)}}
+}
+
 func main() {
 	log.Println("Starting Refity Docker Registry Backend...")
 
 	cfg := config.LoadConfig()
-	if cfg.FTPHost == "" || cfg.FTPUsername == "" || cfg.FTPPassword == "" {
-		log.Fatal("FTP config must be set in environment variables")
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 	auth.InitSecret(cfg.JWTSecret)
-
-	sftpPort := cfg.FTPPort
-	if sftpPort == "" {
-		sftpPort = "22"
+	if cfg.ReadOnly {
+		readonly.Enable(cfg.ReadOnlyReason, "config")
 	}
-	log.Printf("Connecting to SFTP: host=%s port=%s user=%s", cfg.FTPHost, sftpPort, cfg.FTPUsername)
 
-	localRoot := "/tmp/refity"
-	localDriver := local.NewDriver(localRoot)
-	driver, err := sftp.NewDriverWithConfig(cfg)
-	if err != nil {
-		log.Fatalf("Failed to connect to SFTP: %v", err)
-	}
-	log.Println("SFTP connection established successfully")
-
-	// Initialize database (use /app/data in container for consistent persistence with volume)
+	// Data directory (use /app/data in container for consistent persistence with volume)
 	dataDir := "data"
 	if _, err := os.Stat("/app/data"); err == nil {
 		dataDir = "/app/data"
@@ -74,17 +102,124 @@ func main() {
 	if err := os.MkdirAll(dataDir, 0755); err != nil {
 		log.Printf("Warning: Failed to create data directory: %v", err)
 	}
-	dbPath := dataDir + "/refity.db"
+	if cfg.LocalStorageRoot == "" {
+		cfg.LocalStorageRoot = dataDir + "/storage"
+	}
+
+	if cfg.StorageDriver == "sftp" {
+		sftpPort := cfg.FTPPort
+		if sftpPort == "" {
+			sftpPort = "22"
+		}
+		log.Printf("Connecting to SFTP: host=%s port=%s user=%s", cfg.FTPHost, sftpPort, cfg.FTPUsername)
+	}
+	if cfg.StorageDriver == "ftp" || cfg.StorageDriver == "ftps" {
+		log.Printf("Connecting to %s: host=%s port=%s user=%s tls=%s", strings.ToUpper(cfg.StorageDriver), cfg.FTPHost, cfg.FTPPort, cfg.FTPUsername, cfg.FTPTLSMode)
+	}
+
+	localDriver := local.NewDriver(cfg.StagingDir)
+	driver, err := storage.New(cfg.StorageDriver, cfg)
+	if err != nil {
+		log.Fatalf("Failed to initialize %s storage: %v", cfg.StorageDriver, err)
+	}
+	if rc, ok := driver.(storage.RootChecker); ok {
+		if err := rc.CheckRoot(context.Background()); err != nil {
+			log.Fatalf("Storage root check failed: %v", err)
+		}
+	}
+	log.Printf("Storage backend ready: %s", driver.Name())
+	backend := driver
+	keys, err := crypt.LoadKeyring(cfg.EncryptionKeys, cfg.EncryptionKeyFile, cfg.EncryptionActiveKey)
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	if keys != nil {
+		driver = crypt.New(driver, keys)
+	}
+	if cfg.CacheDir != "" {
+		cached, err := cache.New(driver, cfg.CacheDir, cfg.CacheMaxSize)
+		if err != nil {
+			log.Fatalf("Failed to initialize read cache: %v", err)
+		}
+		driver = cached
+	}
+
+	// Initialize database
+	dbPath := cfg.DatabaseURL
+	if dbPath == "" {
+		dbPath = dataDir + "/refity.db"
+	}
+	sqlite := database.EngineFor(dbPath) == "sqlite"
+	restored := false
+	if _, err := os.Stat(dbPath); sqlite && os.IsNotExist(err) && cfg.DBRestore {
+		b, err := backup.Restore(context.Background(), driver, cfg.DBBackupDir, dbPath)
+		if err != nil {
+			log.Fatalf("Failed to restore database from %s: %v (set DB_RESTORE_ON_MISSING=false to start empty)", cfg.DBBackupDir, err)
+		}
+		if b != nil {
+			log.Printf("Database restored from backup %s", b.Path)
+			restored = true
+		}
+	}
 	db, err := database.NewDatabase(dbPath)
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
-	defer db.Close()
-	log.Println("Database initialized successfully")
+	log.Printf("Database initialized successfully (%s)", db.Engine())
 
 	apiRouter := api.NewAPIRouter(driver, db, cfg)
+	scrubber := scrub.New(scrubTargets(backend, keys), localDriver, db, scrub.Options{
+		Interval:  cfg.ScrubInterval,
+		RateLimit: cfg.ScrubRateLimit,
+		Repair:    cfg.ScrubRepair,
+	})
+	scrubber.Start()
+	apiRouter.SetScrubber(scrubber)
+	reconciler := reconcile.New(driver, db, reconcile.Options{
+		Interval:  cfg.ReconcileInterval,
+		OnStartup: cfg.ReconcileOnStartup,
+		Repair:    cfg.ReconcileRepair,
+		// Tags pushed after the backup was taken are only in storage.
+		StartupRepair: restored,
+	}, apiRouter.InvalidateDashboardCache)
+	reconciler.Start()
+	apiRouter.SetReconciler(reconciler)
+	backups := backup.New(driver, db, backup.Options{
+		Dir:      cfg.DBBackupDir,
+		Interval: cfg.DBBackupInterval,
+		Keep:     cfg.DBBackupKeep,
+	})
+	if sqlite {
+		backups.Start()
+		apiRouter.SetBackups(backups)
+	}
+	cleaner := retention.New(driver, db, retention.Options{Interval: cfg.RetentionInterval, Grace: cfg.GCGrace}, apiRouter.InvalidateDashboardCache)
+	cleaner.Start()
+	apiRouter.SetRetention(cleaner)
+	provider, err := capacity.New(cfg.CapacityProvider, driver, db, cfg.HetznerToken, cfg.HetznerBoxID, cfg.CapacityTotal)
+	if err != nil {
+		log.Fatalf("Capacity: %v", err)
+	}
+	var monitor *capacity.Monitor
+	if provider != nil {
+		monitor = capacity.NewMonitor(provider, capacity.Options{
+			Interval:        cfg.CapacityInterval,
+			WarnPercent:     cfg.CapacityWarnPercent,
+			ReadOnlyPercent: cfg.CapacityReadOnlyPercent,
+		}, readonly.SetLowSpace)
+		monitor.Start()
+		apiRouter.SetCapacity(monitor)
+	}
 	regRouter := registry.NewRouterWithDeps(localDriver, driver, cfg, db, apiRouter.InvalidateDashboardCache)
 
+	// Re-queue SFTP uploads that were still pending when the previous process shut down.
+	pendingPath := dataDir + "/pending-uploads.json"
+	if n, err := registry.ReplayPendingUploads(pendingPath); err != nil {
+		log.Printf("Warning: failed to replay pending uploads from %s: %v", pendingPath, err)
+	} else if n > 0 {
+		log.Printf("Replaying %d pending SFTP upload(s) from previous run", n)
+	}
+
 	// Create main router
 	mainRouter := http.NewServeMux()
 
@@ -113,9 +248,66 @@ func main() {
 		ReadHeaderTimeout: 10 * time.Second,
 		IdleTimeout:       120 * time.Second,
 	}
-	log.Printf("Backend server listening on :%s", port)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("Server error: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Backend server listening on :%s", port)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server error: %v", err)
+		}
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Graceful shutdown: refuse new pushes, let in-flight requests finish, then wait for
+	// background SFTP uploads, each phase with its own budget. Whatever is still running at the
+	// upload deadline is journaled for replay.
+	log.Printf("Shutting down (timeout %s, uploads %s)...", cfg.ShutdownTimeout, cfg.ShutdownUploadTimeout)
+	registry.BeginShutdown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: HTTP shutdown incomplete: %v", err)
+	}
+	uploadCtx, cancelUploads := context.WithTimeout(context.Background(), cfg.ShutdownUploadTimeout)
+	defer cancelUploads()
+	pending := registry.WaitForUploads(uploadCtx)
+	if len(pending) > 0 {
+		log.Printf("Shutdown deadline reached with %d SFTP upload(s) pending:", len(pending))
+		for _, p := range pending {
+			log.Printf("  pending %s: %s", p.Kind, p.RemotePath)
+		}
+		if err := registry.SavePendingUploads(pendingPath, pending); err != nil {
+			log.Printf("Warning: failed to save pending uploads to %s: %v", pendingPath, err)
+		} else {
+			log.Printf("Pending uploads saved to %s; they will be replayed on next start (requires STAGING_DIR to persist)", pendingPath)
+		}
+	} else {
+		log.Println("All background SFTP uploads completed")
+	}
+
+	scrubber.Stop()
+	reconciler.Stop()
+	cleaner.Stop()
+	backups.Stop()
+	if monitor != nil {
+		monitor.Stop()
+	}
+	if c, ok := driver.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Warning: failed to close storage driver: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		log.Printf("Warning: failed to close database: %v", err)
 	}
+	log.Println("Shutdown complete")
 }
 
@@ -1,30 +1,47 @@
 package api
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
-	"refity/backend/internal/driver/sftp"
+	"refity/backend/internal/storage"
+	"refity/backend/internal/storage/cache"
+	"refity/backend/internal/backup"
+	"refity/backend/internal/capacity"
+	"refity/backend/internal/reconcile"
+	"refity/backend/internal/retention"
+	"refity/backend/internal/scrub"
 	"refity/backend/internal/database"
 	"refity/backend/internal/config"
+	"refity/backend/internal/auth"
+	"refity/backend/internal/quota"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/tagrule"
 	"log"
+	"regexp"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type APIHandler struct {
-	sftpDriver    sftp.StorageDriver
+	storageDriver storage.Driver
 	db            *database.Database
 	config        *config.Config
 	cache         map[string]cachedData
 	cacheMutex    sync.RWMutex
-	ftpUsageCache *cachedFTPUsage
-	ftpCacheMutex sync.RWMutex
 	lastUpdate    time.Time
+	scrubber      *scrub.Scrubber
+	reconciler    *reconcile.Reconciler
+	backups       *backup.Manager
+	retention     *retention.Cleaner
+	capacity      *capacity.Monitor
 }
 
 type cachedData struct {
@@ -32,23 +49,15 @@ type cachedData struct {
 	timestamp time.Time
 }
 
-type cachedFTPUsage struct {
-	data            FTPUsageResponse
-	timestamp       time.Time
-	rateLimitReset  time.Time // When rate limit resets
-	rateLimitRemain int       // Remaining requests
-}
-
 const cacheDuration = 30 * time.Second // Cache for 30 seconds
-const ftpUsageCacheDuration = 5 * time.Minute // Cache FTP usage for 5 minutes (12 requests/hour max, safe for 3600/hour limit)
 
-func NewAPIHandler(sftpDriver sftp.StorageDriver, db *database.Database, cfg *config.Config) *APIHandler {
+func NewAPIHandler(storageDriver storage.Driver, db *database.Database, cfg *config.Config) *APIHandler {
 	return &APIHandler{
-		sftpDriver: sftpDriver,
-		db:         db,
-		config:     cfg,
-		cache:      make(map[string]cachedData),
-		lastUpdate: time.Now(),
+		storageDriver: storageDriver,
+		db:            db,
+		config:        cfg,
+		cache:         make(map[string]cachedData),
+		lastUpdate:    time.Now(),
 	}
 }
 
@@ -67,11 +76,15 @@ type DashboardData struct {
 	Groups       []Group      `json:"groups"`
 	TotalImages  int          `json:"total_images"`
 	TotalSize    int64        `json:"total_size"`
+	UserQuotas   []quota.Usage `json:"user_quotas"`
+	ReadOnly     readonly.State `json:"read_only"`
 }
 
 type Group struct {
-	Name         string `json:"name"`
-	Repositories int    `json:"repositories"`
+	Name         string       `json:"name"`
+	Repositories int          `json:"repositories"`
+	UsedBytes    int64        `json:"used_bytes"`
+	Quota        *quota.Usage `json:"quota,omitempty"`
 }
 
 func (h *APIHandler) getDashboardData() DashboardData {
@@ -97,16 +110,37 @@ func (h *APIHandler) getDashboardData() DashboardData {
 			log.Printf("Failed to get repositories for group %s: %v", groupName, err)
 			continue
 		}
-		groups = append(groups, Group{
+		group := Group{
 			Name:         groupName,
 			Repositories: len(repos),
-		})
+		}
+		if usage, err := quota.Get(h.db, quota.Group, groupName); err != nil {
+			log.Printf("Failed to get storage usage for group %s: %v", groupName, err)
+		} else {
+			group.UsedBytes = usage.UsedBytes
+			if usage.LimitBytes > 0 {
+				group.Quota = &usage
+			}
+		}
+		groups = append(groups, group)
+	}
+
+	userQuotas := []quota.Usage{}
+	if all, err := quota.All(h.db); err != nil {
+		log.Printf("Failed to get quotas: %v", err)
+	} else {
+		for _, u := range all {
+			if u.Kind == quota.User {
+				userQuotas = append(userQuotas, u)
+			}
+		}
 	}
 
 	return DashboardData{
 		Groups:      groups,
 		TotalImages: totalImages,
 		TotalSize:   totalSize,
+		UserQuotas:  userQuotas,
 	}
 }
 
@@ -120,8 +154,10 @@ func (h *APIHandler) DashboardHandler(w http.ResponseWriter, r *http.Request) {
 	h.cacheMutex.RLock()
 	if cached, exists := h.cache["dashboard"]; exists && time.Since(cached.timestamp) < cacheDuration {
 		h.cacheMutex.RUnlock()
+		data := cached.data
+		data.ReadOnly = readonly.Get()
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(cached.data)
+		json.NewEncoder(w).Encode(data)
 		return
 	}
 	h.cacheMutex.RUnlock()
@@ -138,10 +174,56 @@ func (h *APIHandler) DashboardHandler(w http.ResponseWriter, r *http.Request) {
 	h.lastUpdate = time.Now()
 	h.cacheMutex.Unlock()
 
+	data.ReadOnly = readonly.Get()
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
 
+// HealthHandler serves GET /api/health without authentication: status is "ok", "read-only"
+// while writes are refused, or "error" with 503 when the database does not answer.
+func (h *APIHandler) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	state := readonly.Get()
+	resp := map[string]interface{}{"status": "ok", "read_only": state}
+	if state.ReadOnly {
+		resp["status"] = "read-only"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := h.db.Version(); err != nil {
+		log.Printf("Health check: database: %v", err)
+		resp["status"] = "error"
+		resp["error"] = "database unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ReadOnlyHandler serves GET /api/system/read-only.
+func (h *APIHandler) ReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readonly.Get())
+}
+
+// SetReadOnlyHandler serves PUT /api/system/read-only with {"enabled": true, "reason": "..."}:
+// it switches maintenance mode, in which pushes, deletes and other writes get 503 while pulls
+// and reads keep working. Low-space mode follows the storage capacity and cannot be switched.
+func (h *APIHandler) SetReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled bool   `json:"enabled"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	if req.Enabled {
+		readonly.Enable(strings.TrimSpace(req.Reason), username)
+	} else {
+		readonly.Disable(username)
+	}
+	h.ReadOnlyHandler(w, r)
+}
+
 // InvalidateDashboardCache clears the dashboard cache (e.g. after push so total images/size refresh).
 func (h *APIHandler) InvalidateDashboardCache() {
 	h.cacheMutex.Lock()
@@ -216,7 +298,7 @@ func (h *APIHandler) CreateRepositoryHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Create repository folder structure in SFTP
-	err = h.sftpDriver.CreateRepositoryFolder(context.TODO(), req.Name)
+	err = h.storageDriver.CreateRepositoryFolder(context.TODO(), req.Name)
 	if err != nil {
 		log.Printf("Failed to create repository folder in SFTP: %v", err)
 		// Don't fail the request, just log the error
@@ -268,7 +350,7 @@ func (h *APIHandler) DeleteRepositoryHandler(w http.ResponseWriter, r *http.Requ
 	}
 
 	// Delete repository folder structure from SFTP
-	err = h.sftpDriver.DeleteRepositoryFolder(context.TODO(), repo)
+	err = h.storageDriver.DeleteRepositoryFolder(context.TODO(), repo)
 	if err != nil {
 		log.Printf("Failed to delete repository folder in SFTP: %v", err)
 		// Don't fail the request, just log the error
@@ -315,13 +397,32 @@ func (h *APIHandler) DeleteTagHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !h.checkTagRule(w, r, repo, tag, tagrule.Delete) {
+		return
+	}
+
 	// Delete from database
+	img, _ := h.db.GetImage(repo, tag)
 	err := h.db.DeleteImage(repo, tag)
 	if err != nil {
 		log.Printf("Failed to delete tag %s for repo %s: %v", tag, repo, err)
 		http.Error(w, "Failed to delete tag", http.StatusInternalServerError)
 		return
 	}
+	if img != nil {
+		_, username, _ := auth.GetUserFromRequest(r)
+		event := &database.TagEvent{Name: repo, Tag: tag, Digest: img.Digest, Action: database.TagDeleted, Username: username, IP: clientIP(r)}
+		if err := h.db.RecordTagEvent(event); err != nil {
+			log.Printf("Failed to record tag history for %s:%s: %v", repo, tag, err)
+		}
+	}
+
+	// Remove the tag manifest too, or reconciliation would restore the tag. The by-digest manifest
+	// stays: other tags may point at it.
+	tagPath := strings.TrimLeft(repo+"/manifests/"+tag, "/")
+	if err := h.storageDriver.Delete(r.Context(), tagPath); err != nil && !storage.IsNotExist(err) {
+		log.Printf("Failed to delete tag manifest %s: %v", tagPath, err)
+	}
 
 	// Invalidate cache
 	h.cacheMutex.Lock()
@@ -335,6 +436,288 @@ func (h *APIHandler) DeleteTagHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// digestPattern matches the manifest digests a tag can be rolled back to.
+var digestPattern = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// tagFromPath parses /api/repositories/{repo}/tags/{tag}{suffix}.
+func tagFromPath(path, suffix string) (repo, tag string, ok bool) {
+	path = strings.TrimSuffix(strings.TrimPrefix(path, "/api/repositories/"), suffix)
+	repo, tag, ok = strings.Cut(path, "/tags/")
+	return repo, tag, ok && repo != "" && tag != "" && !strings.Contains(tag, "/")
+}
+
+// TagHistoryResponse lists every digest a tag has pointed at, newest first.
+type TagHistoryResponse struct {
+	Repository string               `json:"repository"`
+	Tag        string               `json:"tag"`
+	Current    string               `json:"current,omitempty"` // digest the tag points at now; empty if deleted
+	History    []*database.TagEvent `json:"history"`
+}
+
+// TagHistoryHandler serves GET /api/repositories/{repo}/tags/{tag}/history.
+func (h *APIHandler) TagHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	repo, tag, ok := tagFromPath(r.URL.Path, "/history")
+	if !ok {
+		http.Error(w, "Invalid URL format", http.StatusBadRequest)
+		return
+	}
+	events, err := h.db.GetTagHistory(repo, tag)
+	if err != nil {
+		log.Printf("Failed to load tag history for %s:%s: %v", repo, tag, err)
+		http.Error(w, "Failed to load tag history", http.StatusInternalServerError)
+		return
+	}
+	resp := TagHistoryResponse{Repository: repo, Tag: tag, History: events}
+	if resp.History == nil {
+		resp.History = []*database.TagEvent{}
+	}
+	if img, err := h.db.GetImage(repo, tag); err == nil {
+		resp.Current = img.Digest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RollbackTagHandler serves POST /api/repositories/{repo}/tags/{tag}/rollback with body
+// {"digest": "sha256:..."}. It re-points the tag at a digest from its history, provided the
+// manifest is still in storage, and works for deleted tags too.
+func (h *APIHandler) RollbackTagHandler(w http.ResponseWriter, r *http.Request) {
+	repo, tag, ok := tagFromPath(r.URL.Path, "/rollback")
+	if !ok {
+		http.Error(w, "Invalid URL format", http.StatusBadRequest)
+		return
+	}
+	var req struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !digestPattern.MatchString(req.Digest) {
+		http.Error(w, "Body must be {\"digest\": \"sha256:...\"}", http.StatusBadRequest)
+		return
+	}
+	if img, err := h.db.GetImage(repo, tag); err == nil && img.Digest == req.Digest {
+		http.Error(w, fmt.Sprintf("%s:%s already points at %s", repo, tag, req.Digest), http.StatusConflict)
+		return
+	}
+	if !h.checkTagRule(w, r, repo, tag, tagrule.Overwrite) {
+		return
+	}
+	events, err := h.db.GetTagHistory(repo, tag)
+	if err != nil {
+		log.Printf("Failed to load tag history for %s:%s: %v", repo, tag, err)
+		http.Error(w, "Failed to load tag history", http.StatusInternalServerError)
+		return
+	}
+	known := false
+	for _, e := range events {
+		known = known || e.Digest == req.Digest
+	}
+	if !known {
+		http.Error(w, fmt.Sprintf("%s:%s never pointed at %s", repo, tag, req.Digest), http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	content, err := h.storageDriver.GetContent(ctx, repo+"/manifests/"+req.Digest)
+	if storage.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("Manifest %s is no longer in storage", req.Digest), http.StatusGone)
+		return
+	}
+	if err != nil {
+		log.Printf("Rollback %s:%s: read manifest %s: %v", repo, tag, req.Digest, err)
+		http.Error(w, "Failed to read manifest", http.StatusInternalServerError)
+		return
+	}
+	if sum := sha256.Sum256(content); "sha256:"+hex.EncodeToString(sum[:]) != req.Digest {
+		log.Printf("Rollback %s:%s: stored manifest %s does not match its digest", repo, tag, req.Digest)
+		http.Error(w, "Stored manifest is corrupt", http.StatusInternalServerError)
+		return
+	}
+	if err := h.storageDriver.PutContent(ctx, repo+"/manifests/"+tag, content, nil); err != nil {
+		log.Printf("Rollback %s:%s: write tag manifest: %v", repo, tag, err)
+		http.Error(w, "Failed to write tag manifest", http.StatusInternalServerError)
+		return
+	}
+	if err := reconcile.RecordImage(ctx, h.storageDriver, h.db, repo, tag, req.Digest, content); err != nil {
+		log.Printf("Rollback %s:%s: update database: %v", repo, tag, err)
+		http.Error(w, "Failed to update database", http.StatusInternalServerError)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	event := &database.TagEvent{Name: repo, Tag: tag, Digest: req.Digest, Action: database.TagRolledBack, Username: username, IP: clientIP(r)}
+	if err := h.db.RecordTagEvent(event); err != nil {
+		log.Printf("Failed to record tag history for %s:%s: %v", repo, tag, err)
+	}
+	log.Printf("Tag %s:%s rolled back to %s by %s", repo, tag, req.Digest, username)
+	h.InvalidateDashboardCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Tag %s of repository %s now points at %s", tag, repo, req.Digest),
+		"event":   event,
+	})
+}
+
+// checkTagRule answers 403 and returns false if a tag rule forbids the request's user to do
+// action to repo:tag.
+func (h *APIHandler) checkTagRule(w http.ResponseWriter, r *http.Request, repo, tag string, action tagrule.Action) bool {
+	_, username, role := auth.GetUserFromRequest(r)
+	err := tagrule.Check(h.db, repo, tag, role, action)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, tagrule.ErrDenied) {
+		log.Printf("Tag %s by %s: %v", action, username, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+	} else {
+		log.Printf("Failed to check tag rules: %v", err)
+		http.Error(w, "Failed to check tag rules", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// TagRulesHandler serves GET /api/tag-rules.
+func (h *APIHandler) TagRulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := h.db.GetTagRules()
+	if err != nil {
+		log.Printf("Failed to load tag rules: %v", err)
+		http.Error(w, "Failed to load tag rules", http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		rules = []*database.TagRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// CreateTagRuleHandler serves POST /api/tag-rules with a rule as body, e.g.
+// {"scope": "team/app", "pattern": "release-*", "mode": "immutable"}.
+func (h *APIHandler) CreateTagRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule database.TagRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := tagrule.Validate(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.CreateTagRule(&rule); err != nil {
+		log.Printf("Failed to create tag rule: %v", err)
+		http.Error(w, "Failed to create tag rule", http.StatusInternalServerError)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	log.Printf("Tag rule %d created by %s: %s %s:%s", rule.ID, username, rule.Mode, rule.Scope, rule.Pattern)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// DeleteTagRuleHandler serves DELETE /api/tag-rules/{id}.
+func (h *APIHandler) DeleteTagRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/tag-rules/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rule id", http.StatusBadRequest)
+		return
+	}
+	found, err := h.db.DeleteTagRule(id)
+	if err != nil {
+		log.Printf("Failed to delete tag rule %d: %v", id, err)
+		http.Error(w, "Failed to delete tag rule", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Tag rule not found", http.StatusNotFound)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	log.Printf("Tag rule %d deleted by %s", id, username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Tag rule %d deleted", id),
+	})
+}
+
+// QuotasHandler serves GET /api/quotas: every quota with its usage.
+func (h *APIHandler) QuotasHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := quota.All(h.db)
+	if err != nil {
+		log.Printf("Failed to load quotas: %v", err)
+		http.Error(w, "Failed to load quotas", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// SetQuotaHandler serves POST /api/quotas with a quota as body, e.g.
+// {"kind": "group", "name": "team", "limit_bytes": 107374182400, "soft_bytes": 0}. It creates
+// the quota or replaces the limits of an existing one.
+func (h *APIHandler) SetQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	var q database.Quota
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := quota.Validate(&q, h.config.QuotaSoftPercent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Kind == quota.User {
+		if _, err := h.db.GetUserByUsername(q.Name); err != nil {
+			http.Error(w, fmt.Sprintf("User %s not found", q.Name), http.StatusNotFound)
+			return
+		}
+	}
+	if err := h.db.SetQuota(&q); err != nil {
+		log.Printf("Failed to set quota: %v", err)
+		http.Error(w, "Failed to set quota", http.StatusInternalServerError)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	log.Printf("Quota for %s %s set to %d bytes (soft %d) by %s", q.Kind, q.Name, q.LimitBytes, q.SoftBytes, username)
+	h.InvalidateDashboardCache()
+
+	usage, err := quota.Get(h.db, q.Kind, q.Name)
+	if err != nil {
+		log.Printf("Failed to get storage usage for %s %s: %v", q.Kind, q.Name, err)
+		http.Error(w, "Quota set, but failed to get usage", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// DeleteQuotaHandler serves DELETE /api/quotas/{id}.
+func (h *APIHandler) DeleteQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/quotas/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid quota id", http.StatusBadRequest)
+		return
+	}
+	found, err := h.db.DeleteQuota(id)
+	if err != nil {
+		log.Printf("Failed to delete quota %d: %v", id, err)
+		http.Error(w, "Failed to delete quota", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Quota not found", http.StatusNotFound)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	log.Printf("Quota %d deleted by %s", id, username)
+	h.InvalidateDashboardCache()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Quota %d deleted", id),
+	})
+}
+
 // GetGroupsHandler returns all groups
 func (h *APIHandler) GetGroupsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -349,10 +732,21 @@ func (h *APIHandler) GetGroupsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	usage := make(map[string]quota.Usage)
+	for _, group := range groups {
+		u, err := quota.Get(h.db, quota.Group, group)
+		if err != nil {
+			log.Printf("Failed to get storage usage for group %s: %v", group, err)
+			continue
+		}
+		usage[group] = u
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"groups": groups,
 		"total":  len(groups),
+		"usage":  usage,
 	})
 }
 
@@ -413,7 +807,7 @@ func (h *APIHandler) CreateGroupHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Create group folder structure in SFTP
-	err = h.sftpDriver.CreateGroupFolder(context.TODO(), req.Name)
+	err = h.storageDriver.CreateGroupFolder(context.TODO(), req.Name)
 	if err != nil {
 		log.Printf("Failed to create group folder in SFTP: %v", err)
 		// Don't fail the request, just log the error
@@ -496,11 +890,17 @@ func (h *APIHandler) GetRepositoriesByGroupHandler(w http.ResponseWriter, r *htt
 		})
 	}
 
+	usage, err := quota.Get(h.db, quota.Group, decodedGroup)
+	if err != nil {
+		log.Printf("Failed to get storage usage for group %s: %v", decodedGroup, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"group":        decodedGroup,
 		"repositories": repoList,
 		"total":        len(repoList),
+		"usage":        usage,
 	})
 }
 
@@ -569,254 +969,340 @@ type FTPUsageResponse struct {
 	UsedSizeTB   float64 `json:"used_size_tb"`  // size_data in TB
 	TotalSizeTB  float64 `json:"total_size_tb"` // size in TB
 	UsagePercent float64 `json:"usage_percent"` // percentage used
+	Provider     string  `json:"provider"`      // what measured it: statvfs, hetzner or database
 }
 
-func (h *APIHandler) FTPUsageHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// StorageCapacityHandler returns the capacity provider, thresholds and latest measurement, or
+// enabled=false when capacity is not measured.
+func (h *APIHandler) StorageCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.capacity == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
 		return
 	}
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+		capacity.Status
+	}{true, h.capacity.Status()})
+}
 
-	// FTP usage (Hetzner Storage Box) can be disabled for non-Hetzner deployments
-	if !h.config.EnableFTPUsage {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+// CheckCapacityHandler measures the storage space now and returns the status.
+func (h *APIHandler) CheckCapacityHandler(w http.ResponseWriter, r *http.Request) {
+	if h.capacity == nil {
+		http.Error(w, "Capacity monitoring not enabled", http.StatusServiceUnavailable)
 		return
 	}
-
-	// Check if Hetzner config is available
-	if h.config.HetznerToken == "" || h.config.HetznerBoxID == 0 {
-		log.Printf("Hetzner config not available")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": "Hetzner configuration not available",
-		})
+	if _, err := h.capacity.Check(r.Context()); err != nil {
+		http.Error(w, "Failed to measure storage space: "+err.Error(), http.StatusBadGateway)
 		return
 	}
+	h.StorageCapacityHandler(w, r)
+}
 
-	// Check cache first
-	h.ftpCacheMutex.RLock()
-	if h.ftpUsageCache != nil && time.Since(h.ftpUsageCache.timestamp) < ftpUsageCacheDuration {
-		cached := h.ftpUsageCache
-		h.ftpCacheMutex.RUnlock()
-		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("X-Cache", "HIT")
-		w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", cached.rateLimitRemain))
-		if !cached.rateLimitReset.IsZero() {
-			w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", cached.rateLimitReset.Unix()))
-		}
-		json.NewEncoder(w).Encode(cached.data)
+// StorageCacheHandler returns read cache hit/miss statistics, or enabled=false without CACHE_DIR.
+func (h *APIHandler) StorageCacheHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := h.storageDriver.(interface{ Stats() cache.Stats })
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
 		return
 	}
-	h.ftpCacheMutex.RUnlock()
-
-	// Cache miss or expired, fetch from API
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+		cache.Stats
+	}{true, c.Stats()})
+}
 
-	// Storage Boxes use a separate API endpoint, not the hcloud-go SDK
-	apiURL := fmt.Sprintf("https://api.hetzner.com/v1/storage_boxes/%d", h.config.HetznerBoxID)
-	log.Printf("Fetching storage box from: %s", apiURL)
-	
-	req, err := http.NewRequestWithContext(context.TODO(), "GET", apiURL, nil)
+// StorageScrubHandler returns the integrity scrubber's schedule, recent runs and the findings of
+// the newest run, or enabled=false without a scrubber.
+func (h *APIHandler) StorageScrubHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.scrubber == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
+	}
+	rep, err := h.scrubber.Report()
 	if err != nil {
-		log.Printf("Failed to create request: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("Failed to create request: %v", err),
-		})
+		log.Printf("Failed to build scrub report: %v", err)
+		http.Error(w, "Failed to load scrub report", http.StatusInternalServerError)
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+h.config.HetznerToken)
-	req.Header.Set("Accept", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+		*scrub.Report
+	}{true, rep})
+}
 
-	httpClient := &http.Client{
-		Timeout: 10 * time.Second,
+// StartScrubHandler starts a scrub run now.
+func (h *APIHandler) StartScrubHandler(w http.ResponseWriter, r *http.Request) {
+	if h.scrubber == nil {
+		http.Error(w, "Scrubber not available", http.StatusServiceUnavailable)
+		return
+	}
+	run, err := h.scrubber.Trigger()
+	if errors.Is(err, scrub.ErrRunning) {
+		http.Error(w, "A scrub is already running", http.StatusConflict)
+		return
 	}
-	resp, err := httpClient.Do(req)
 	if err != nil {
-		log.Printf("Failed to get storage box from Hetzner API: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("Failed to fetch storage box: %v", err),
-		})
+		log.Printf("Failed to start scrub: %v", err)
+		http.Error(w, "Failed to start scrub", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(run)
+}
 
-	// Read the full response body first
-	var bodyBuf bytes.Buffer
-	_, err = bodyBuf.ReadFrom(resp.Body)
-	if err != nil {
-		log.Printf("Failed to read response body: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("Failed to read response: %v", err),
-		})
+// CancelScrubHandler stops the running scrub.
+func (h *APIHandler) CancelScrubHandler(w http.ResponseWriter, r *http.Request) {
+	if h.scrubber == nil || !h.scrubber.Cancel() {
+		http.Error(w, "No scrub is running", http.StatusConflict)
 		return
 	}
-	
-	log.Printf("Hetzner API response status: %d", resp.StatusCode)
-
-	// Parse rate limit headers before checking status
-	rateLimitRemain := 0
-	rateLimitReset := time.Time{}
-	if remainStr := resp.Header.Get("RateLimit-Remaining"); remainStr != "" {
-		fmt.Sscanf(remainStr, "%d", &rateLimitRemain)
-	}
-	if resetStr := resp.Header.Get("RateLimit-Reset"); resetStr != "" {
-		var resetUnix int64
-		if _, err := fmt.Sscanf(resetStr, "%d", &resetUnix); err == nil {
-			rateLimitReset = time.Unix(resetUnix, 0)
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"cancelled": true})
+}
+
+// StorageReconcileHandler returns the reconciliation schedule and the last report, or
+// enabled=false without a reconciler.
+func (h *APIHandler) StorageReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.reconciler == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
 	}
-	log.Printf("Rate limit status - Remaining: %d, Reset: %v", rateLimitRemain, rateLimitReset)
-
-	if resp.StatusCode == http.StatusTooManyRequests {
-		// Rate limit exceeded - return cached data if available, or error
-		log.Printf("Hetzner API rate limit exceeded (429)")
-		h.ftpCacheMutex.RLock()
-		if h.ftpUsageCache != nil {
-			cached := h.ftpUsageCache
-			h.ftpCacheMutex.RUnlock()
-			// Return cached data even if expired
-			w.Header().Set("Content-Type", "application/json")
-			w.Header().Set("X-Cache", "STALE")
-			w.Header().Set("X-RateLimit-Exceeded", "true")
-			w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", rateLimitRemain))
-			if !rateLimitReset.IsZero() {
-				w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", rateLimitReset.Unix()))
-			}
-			json.NewEncoder(w).Encode(cached.data)
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+		reconcile.Status
+	}{true, h.reconciler.Status()})
+}
+
+// RunReconcileHandler reconciles the database with storage and returns the report. The body
+// {"repair": true} fixes the differences; without it they are only reported.
+func (h *APIHandler) RunReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if h.reconciler == nil {
+		http.Error(w, "Reconciliation not available", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		Repair bool `json:"repair"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
 			return
 		}
-		h.ftpCacheMutex.RUnlock()
-		
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusTooManyRequests)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": "Rate limit exceeded. Please try again later.",
-		})
+	}
+	rep, err := h.reconciler.Run(r.Context(), req.Repair)
+	if errors.Is(err, reconcile.ErrRunning) {
+		http.Error(w, "A reconciliation is already running", http.StatusConflict)
 		return
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Hetzner API returned non-200 status: %d", resp.StatusCode)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("Hetzner API error: status %d", resp.StatusCode),
-		})
+	if errors.Is(err, readonly.ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-
-
-	// Try to decode the response - handle different possible structures
-	var apiResponse map[string]interface{}
-	if err := json.Unmarshal(bodyBuf.Bytes(), &apiResponse); err != nil {
-		log.Printf("Failed to decode Hetzner API response as JSON: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("Failed to decode response: %v", err),
-		})
+	if err != nil {
+		log.Printf("Reconciliation failed: %v", err)
+		http.Error(w, "Reconciliation failed", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
 
-	log.Printf("Hetzner API response decoded successfully")
-
-	// Extract storage_box data - handle nested structure
-	var storageBox map[string]interface{}
-	if sb, ok := apiResponse["storage_box"].(map[string]interface{}); ok {
-		storageBox = sb
-	} else {
-		// Maybe the response is directly the storage_box?
-		storageBox = apiResponse
+// RetentionHandler returns the retention schedule and the last applied run, or enabled=false
+// without a cleaner.
+func (h *APIHandler) RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.retention == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
 	}
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+		retention.Status
+	}{true, h.retention.Status()})
+}
 
-	// Extract used_size from stats.size_data
-	var usedSize int64 = 0
-	var totalSize int64 = 0
-	
-	// Get used_size from stats.size_data
-	if stats, ok := storageBox["stats"].(map[string]interface{}); ok {
-		if sizeData, ok := stats["size_data"].(float64); ok {
-			usedSize = int64(sizeData)
-		} else if sizeData, ok := stats["size_data"].(int64); ok {
-			usedSize = sizeData
-		}
-		log.Printf("Storage box used size (stats.size_data): %d bytes", usedSize)
-	} else {
-		log.Printf("Warning: Storage box stats not found for box ID %d", h.config.HetznerBoxID)
+// RunRetentionHandler evaluates the retention policies and returns the report. The body
+// {"apply": true} deletes the tags and files; without it the run is a preview.
+func (h *APIHandler) RunRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	if h.retention == nil {
+		http.Error(w, "Retention not available", http.StatusServiceUnavailable)
+		return
 	}
-	
-	// Get total_size from storage_box.storage_box_type.size
-	if storageBoxType, ok := storageBox["storage_box_type"].(map[string]interface{}); ok {
-		if size, ok := storageBoxType["size"].(float64); ok {
-			totalSize = int64(size)
-		} else if size, ok := storageBoxType["size"].(int64); ok {
-			totalSize = size
-		}
-		log.Printf("Storage box total size (storage_box_type.size): %d bytes", totalSize)
-	} else {
-		// Log available keys for debugging
-		keys := make([]string, 0, len(storageBox))
-		for k := range storageBox {
-			keys = append(keys, k)
+	var req struct {
+		Apply bool `json:"apply"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
 		}
-		log.Printf("Warning: Storage box type not found for box ID %d. Available keys: %v", h.config.HetznerBoxID, keys)
-		// Return error response instead of empty data
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error": fmt.Sprintf("Storage box type not found in response for box ID %d", h.config.HetznerBoxID),
-		})
+	}
+	rep, err := h.retention.Run(r.Context(), req.Apply)
+	if errors.Is(err, retention.ErrRunning) {
+		http.Error(w, "A retention run is already in progress", http.StatusConflict)
 		return
 	}
-	
-	// Validate that we got some data
-	if totalSize == 0 {
-		log.Printf("Warning: Total size is 0, which might indicate an issue")
+	if errors.Is(err, readonly.ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
-	
-	log.Printf("Storage box - Used: %d bytes, Total: %d bytes", usedSize, totalSize)
+	if err != nil {
+		log.Printf("Retention run failed: %v", err)
+		http.Error(w, "Retention run failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rep)
+}
 
-	// Convert to TB (1 TB = 1024^4 bytes)
-	const bytesPerTB = 1024 * 1024 * 1024 * 1024
-	usedSizeTB := float64(usedSize) / float64(bytesPerTB)
-	totalSizeTB := float64(totalSize) / float64(bytesPerTB)
+// RetentionPoliciesHandler serves GET /api/retention/policies.
+func (h *APIHandler) RetentionPoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	policies, err := h.db.GetRetentionPolicies()
+	if err != nil {
+		log.Printf("Failed to load retention policies: %v", err)
+		http.Error(w, "Failed to load retention policies", http.StatusInternalServerError)
+		return
+	}
+	if policies == nil {
+		policies = []*database.RetentionPolicy{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
 
-	// Calculate usage percentage
-	usagePercent := 0.0
-	if totalSize > 0 {
-		usagePercent = (float64(usedSize) / float64(totalSize)) * 100.0
+// CreateRetentionPolicyHandler serves POST /api/retention/policies with a policy as body, e.g.
+// {"scope": "team/app", "keep_last": 20, "keep_days": 30, "keep_patterns": ["v*", "latest"]}.
+// Each scope has at most one policy.
+func (h *APIHandler) CreateRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var p database.RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := retention.Validate(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	existing, err := h.db.GetRetentionPolicies()
+	if err != nil {
+		log.Printf("Failed to load retention policies: %v", err)
+		http.Error(w, "Failed to load retention policies", http.StatusInternalServerError)
+		return
+	}
+	for _, e := range existing {
+		if e.Scope == p.Scope {
+			http.Error(w, fmt.Sprintf("Scope %q already has policy %d", p.Scope, e.ID), http.StatusConflict)
+			return
+		}
 	}
+	if err := h.db.CreateRetentionPolicy(&p); err != nil {
+		log.Printf("Failed to create retention policy: %v", err)
+		http.Error(w, "Failed to create retention policy", http.StatusInternalServerError)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	log.Printf("Retention policy %d created by %s for scope %q", p.ID, username, p.Scope)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
 
-	response := FTPUsageResponse{
-		UsedSize:     usedSize,
-		TotalSize:    totalSize,
-		UsedSizeTB:   usedSizeTB,
-		TotalSizeTB:  totalSizeTB,
-		UsagePercent: usagePercent,
+// DeleteRetentionPolicyHandler serves DELETE /api/retention/policies/{id}.
+func (h *APIHandler) DeleteRetentionPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/retention/policies/"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid policy id", http.StatusBadRequest)
+		return
+	}
+	found, err := h.db.DeleteRetentionPolicy(id)
+	if err != nil {
+		log.Printf("Failed to delete retention policy %d: %v", id, err)
+		http.Error(w, "Failed to delete retention policy", http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "Retention policy not found", http.StatusNotFound)
+		return
+	}
+	_, username, _ := auth.GetUserFromRequest(r)
+	log.Printf("Retention policy %d deleted by %s", id, username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"message": fmt.Sprintf("Retention policy %d deleted", id),
+	})
+}
+
+// StorageBackupHandler lists the database backups in storage with the schedule and the outcome of
+// the last backup, or enabled=false without a backup manager.
+func (h *APIHandler) StorageBackupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if h.backups == nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
 	}
+	st, err := h.backups.Status(r.Context())
+	if err != nil {
+		log.Printf("Failed to list database backups: %v", err)
+		http.Error(w, "Failed to list backups", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool `json:"enabled"`
+		*backup.Status
+	}{true, st})
+}
 
-	// Cache the response with rate limit info
-	h.ftpCacheMutex.Lock()
-	h.ftpUsageCache = &cachedFTPUsage{
-		data:            response,
-		timestamp:       time.Now(),
-		rateLimitRemain: rateLimitRemain,
-		rateLimitReset:  rateLimitReset,
+// RunBackupHandler backs up the database to storage now.
+func (h *APIHandler) RunBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if h.backups == nil {
+		http.Error(w, "Backups not available", http.StatusServiceUnavailable)
+		return
+	}
+	b, err := h.backups.Run(r.Context())
+	if errors.Is(err, backup.ErrRunning) {
+		http.Error(w, "A backup is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Database backup failed: %v", err)
+		http.Error(w, "Backup failed", http.StatusInternalServerError)
+		return
 	}
-	h.ftpCacheMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
 
+// FTPUsageHandler returns the latest storage capacity measurement for the dashboard's usage
+// card, or enabled=false when capacity is not measured or no provider has answered yet.
+func (h *APIHandler) FTPUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Cache", "MISS")
-	w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", rateLimitRemain))
-	if !rateLimitReset.IsZero() {
-		w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", rateLimitReset.Unix()))
+	var rep *capacity.Report
+	if h.capacity != nil {
+		rep = h.capacity.Latest()
+	}
+	if rep == nil || rep.TotalBytes == 0 {
+		json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false})
+		return
 	}
-	json.NewEncoder(w).Encode(response)
+
+	// Convert to TB (1 TB = 1024^4 bytes)
+	const bytesPerTB = 1024 * 1024 * 1024 * 1024
+	json.NewEncoder(w).Encode(FTPUsageResponse{
+		UsedSize:     rep.UsedBytes,
+		TotalSize:    rep.TotalBytes,
+		UsedSizeTB:   float64(rep.UsedBytes) / float64(bytesPerTB),
+		TotalSizeTB:  float64(rep.TotalBytes) / float64(bytesPerTB),
+		UsagePercent: rep.UsedPercent,
+		Provider:     rep.Provider,
+	})
 }
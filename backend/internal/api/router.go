@@ -3,10 +3,16 @@ package api
 import (
 	"net/http"
 	"strings"
-	"refity/backend/internal/driver/sftp"
+	"refity/backend/internal/storage"
 	"refity/backend/internal/database"
 	"refity/backend/internal/auth"
 	"refity/backend/internal/config"
+	"refity/backend/internal/backup"
+	"refity/backend/internal/capacity"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/reconcile"
+	"refity/backend/internal/retention"
+	"refity/backend/internal/scrub"
 )
 
 type APIRouter struct {
@@ -14,13 +20,38 @@ type APIRouter struct {
 	authHandler *AuthHandler
 }
 
-func NewAPIRouter(sftpDriver sftp.StorageDriver, db *database.Database, cfg *config.Config) *APIRouter {
+func NewAPIRouter(storageDriver storage.Driver, db *database.Database, cfg *config.Config) *APIRouter {
 	return &APIRouter{
-		apiHandler:  NewAPIHandler(sftpDriver, db, cfg),
+		apiHandler:  NewAPIHandler(storageDriver, db, cfg),
 		authHandler: NewAuthHandler(db),
 	}
 }
 
+// SetScrubber enables the /api/storage/scrub routes.
+func (r *APIRouter) SetScrubber(s *scrub.Scrubber) {
+	r.apiHandler.scrubber = s
+}
+
+// SetReconciler enables the /api/storage/reconcile routes.
+func (r *APIRouter) SetReconciler(rc *reconcile.Reconciler) {
+	r.apiHandler.reconciler = rc
+}
+
+// SetBackups enables the /api/storage/backup routes.
+func (r *APIRouter) SetBackups(m *backup.Manager) {
+	r.apiHandler.backups = m
+}
+
+// SetCapacity enables the /api/storage/capacity routes and the dashboard usage card.
+func (r *APIRouter) SetCapacity(m *capacity.Monitor) {
+	r.apiHandler.capacity = m
+}
+
+// SetRetention enables the /api/retention routes that run policies.
+func (r *APIRouter) SetRetention(c *retention.Cleaner) {
+	r.apiHandler.retention = c
+}
+
 // InvalidateDashboardCache forwards to the API handler so registry can invalidate after push.
 func (r *APIRouter) InvalidateDashboardCache() {
 	r.apiHandler.InvalidateDashboardCache()
@@ -40,6 +71,31 @@ func (r *APIRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if path == "/api/health" && req.Method == http.MethodGet {
+		r.apiHandler.HealthHandler(w, req)
+		return
+	}
+
+	if path == "/api/system/read-only" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.ReadOnlyHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPut {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.SetReadOnlyHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+
+	// Everything below that writes is refused in read-only mode. It all requires a login, so
+	// callers without one get 401 rather than the maintenance reason.
+	if msg := readonly.Refusal(req.Method, false); msg != "" {
+		auth.JWTMiddleware(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, msg, http.StatusServiceUnavailable)
+		})).ServeHTTP(w, req)
+		return
+	}
+
 	// Protected routes (require JWT)
 	if path == "/api/auth/me" && req.Method == http.MethodGet {
 		auth.JWTMiddleware(http.HandlerFunc(r.authHandler.MeHandler)).ServeHTTP(w, req)
@@ -56,11 +112,118 @@ func (r *APIRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if path == "/api/storage/capacity" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.StorageCapacityHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.CheckCapacityHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+	if path == "/api/storage/cache" && req.Method == http.MethodGet {
+		auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.StorageCacheHandler)).ServeHTTP(w, req)
+		return
+	}
+
+	if path == "/api/storage/scrub" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.StorageScrubHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.StartScrubHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodDelete {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.CancelScrubHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+
+	if path == "/api/storage/reconcile" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.StorageReconcileHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.RunReconcileHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+
+	if path == "/api/storage/backup" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.StorageBackupHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.RunBackupHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+
+	if path == "/api/retention" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.RetentionHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.RunRetentionHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+	if path == "/api/retention/policies" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.RetentionPoliciesHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.CreateRetentionPolicyHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+	if strings.HasPrefix(path, "/api/retention/policies/") && req.Method == http.MethodDelete {
+		auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.DeleteRetentionPolicyHandler)).ServeHTTP(w, req)
+		return
+	}
+
+	if path == "/api/tag-rules" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.TagRulesHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.CreateTagRuleHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+	if strings.HasPrefix(path, "/api/tag-rules/") && req.Method == http.MethodDelete {
+		auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.DeleteTagRuleHandler)).ServeHTTP(w, req)
+		return
+	}
+
 	if path == "/api/ftp/usage" && req.Method == http.MethodGet {
 		auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.FTPUsageHandler)).ServeHTTP(w, req)
 		return
 	}
 
+	if path == "/api/quotas" {
+		if req.Method == http.MethodGet {
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.QuotasHandler)).ServeHTTP(w, req)
+			return
+		}
+		if req.Method == http.MethodPost {
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.SetQuotaHandler)).ServeHTTP(w, req)
+			return
+		}
+	}
+	if strings.HasPrefix(path, "/api/quotas/") && req.Method == http.MethodDelete {
+		auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.DeleteQuotaHandler)).ServeHTTP(w, req)
+		return
+	}
+
 	// Groups routes (require JWT)
 	if path == "/api/groups" {
 		if req.Method == http.MethodGet {
@@ -95,6 +258,14 @@ func (r *APIRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 				auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.CreateRepositoryHandler)).ServeHTTP(w, req)
 				return
 			}
+		} else if strings.Contains(repoPath, "/tags/") && strings.HasSuffix(repoPath, "/history") && req.Method == http.MethodGet {
+			// GET /api/repositories/{repo}/tags/{tag}/history
+			auth.JWTMiddleware(http.HandlerFunc(r.apiHandler.TagHistoryHandler)).ServeHTTP(w, req)
+			return
+		} else if strings.Contains(repoPath, "/tags/") && strings.HasSuffix(repoPath, "/rollback") && req.Method == http.MethodPost {
+			// POST /api/repositories/{repo}/tags/{tag}/rollback
+			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.RollbackTagHandler)).ServeHTTP(w, req)
+			return
 		} else if strings.Contains(repoPath, "/tags/") && req.Method == http.MethodDelete {
 			// DELETE /api/repositories/{repo}/tags/{tag}
 			auth.AdminMiddleware(http.HandlerFunc(r.apiHandler.DeleteTagHandler)).ServeHTTP(w, req)
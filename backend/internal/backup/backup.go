@@ -0,0 +1,299 @@
+// Package backup copies the SQLite database to the storage backend and restores it from there.
+// Blobs and manifests already live in storage; with the database beside them a lost volume costs
+// at most the changes since the last backup.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"refity/backend/internal/database"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/storage"
+)
+
+const (
+	namePrefix = "refity-"
+	nameSuffix = ".db.gz"
+	timeLayout = "20060102T150405Z"
+)
+
+// sqliteMagic starts every SQLite database file.
+var sqliteMagic = []byte("SQLite format 3\x00")
+
+// ErrRunning is returned by Run while another backup is being made.
+var ErrRunning = errors.New("a backup is already running")
+
+// Options configure where backups go and how many are kept.
+type Options struct {
+	Dir      string        // storage folder holding the backups
+	Interval time.Duration // time between scheduled backups; 0 = off
+	Keep     int           // newest backups kept; older ones are deleted after each backup (0 = all)
+}
+
+// Backup is one database copy in storage.
+type Backup struct {
+	Name string    `json:"name"`
+	Path string    `json:"path"`
+	Size int64     `json:"size,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// Manager makes backups on demand and on a schedule, one at a time.
+type Manager struct {
+	driver storage.Driver
+	db     *database.Database
+	opts   Options
+
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *Backup
+	lastErr string
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+func New(driver storage.Driver, db *database.Database, opts Options) *Manager {
+	return &Manager{driver: driver, db: db, opts: opts, stopCh: make(chan struct{})}
+}
+
+// Start schedules backups if an interval is set.
+func (m *Manager) Start() {
+	if m.opts.Interval <= 0 {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+				// A backup taken while maintenance mode is on, e.g. during a restore, could save and
+				// keep a half-restored database in place of a good one.
+				if err := readonly.CheckMaintenance(); err != nil {
+					log.Printf("[Backup] Skipping scheduled backup: %v", err)
+					continue
+				}
+				if _, err := m.Run(context.Background()); err != nil && !errors.Is(err, ErrRunning) {
+					log.Printf("[Backup] Scheduled backup failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the schedule and waits for a scheduled backup in progress.
+func (m *Manager) Stop() {
+	m.stopOnce.Do(func() { close(m.stopCh) })
+	m.wg.Wait()
+}
+
+// Run snapshots the database, uploads it compressed and prunes old backups.
+func (m *Manager) Run(ctx context.Context) (*Backup, error) {
+	if !m.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer m.running.Unlock()
+
+	b, err := m.run(ctx)
+	m.mu.Lock()
+	if err != nil {
+		m.lastErr = err.Error()
+	} else {
+		m.last, m.lastErr = b, ""
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Backup] Database saved to %s (%d bytes)", b.Path, b.Size)
+	if err := m.prune(ctx); err != nil {
+		log.Printf("[Backup] Failed to delete old backups: %v", err)
+	}
+	return b, nil
+}
+
+func (m *Manager) run(ctx context.Context) (*Backup, error) {
+	dir, err := os.MkdirTemp("", "refity-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "refity.db")
+	if err := m.db.BackupTo(snapshot); err != nil {
+		return nil, fmt.Errorf("snapshot database: %w", err)
+	}
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	now := time.Now().UTC()
+	b := &Backup{Name: namePrefix + now.Format(timeLayout) + nameSuffix, Time: now}
+	b.Path = m.opts.Dir + "/" + b.Name
+	w, err := m.driver.Writer(ctx, b.Path, false)
+	if err != nil {
+		return nil, err
+	}
+	zw := gzip.NewWriter(w)
+	if _, err := io.Copy(zw, f); err != nil {
+		w.Cancel(ctx)
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		w.Cancel(ctx)
+		return nil, err
+	}
+	b.Size = w.Size()
+	if err := w.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// prune deletes all but the newest Keep backups.
+func (m *Manager) prune(ctx context.Context) error {
+	if m.opts.Keep <= 0 {
+		return nil
+	}
+	backups, err := List(ctx, m.driver, m.opts.Dir)
+	if err != nil || len(backups) <= m.opts.Keep {
+		return err
+	}
+	for _, b := range backups[m.opts.Keep:] {
+		if err := m.driver.Delete(ctx, b.Path); err != nil && !storage.IsNotExist(err) {
+			return err
+		}
+		log.Printf("[Backup] Deleted old backup %s", b.Path)
+	}
+	return nil
+}
+
+// Status is the schedule, the outcome of the last backup and the backups in storage.
+type Status struct {
+	Dir       string   `json:"dir"`
+	Interval  string   `json:"interval"`
+	Keep      int      `json:"keep"`
+	Running   bool     `json:"running"`
+	Last      *Backup  `json:"last,omitempty"`
+	LastError string   `json:"last_error,omitempty"`
+	Backups   []Backup `json:"backups"`
+}
+
+func (m *Manager) Status(ctx context.Context) (*Status, error) {
+	backups, err := List(ctx, m.driver, m.opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	st := &Status{Dir: m.opts.Dir, Interval: m.opts.Interval.String(), Keep: m.opts.Keep, Backups: backups}
+	if st.Backups == nil {
+		st.Backups = []Backup{}
+	}
+	if m.running.TryLock() {
+		m.running.Unlock()
+	} else {
+		st.Running = true
+	}
+	m.mu.Lock()
+	st.Last, st.LastError = m.last, m.lastErr
+	m.mu.Unlock()
+	return st, nil
+}
+
+// List returns the backups in dir, newest first. Sizes are left zero: they would cost a Stat each.
+func List(ctx context.Context, driver storage.Driver, dir string) ([]Backup, error) {
+	names, err := driver.List(ctx, dir)
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var backups []Backup
+	for _, name := range names {
+		if !strings.HasPrefix(name, namePrefix) || !strings.HasSuffix(name, nameSuffix) {
+			continue
+		}
+		t, err := time.Parse(timeLayout, strings.TrimSuffix(strings.TrimPrefix(name, namePrefix), nameSuffix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{Name: name, Path: dir + "/" + name, Time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+	return backups, nil
+}
+
+// Restore writes the newest backup in dir to dbPath, which must not exist. It returns the backup
+// restored, or nil if there is none.
+func Restore(ctx context.Context, driver storage.Driver, dir, dbPath string) (*Backup, error) {
+	backups, err := List(ctx, driver, dir)
+	if err != nil || len(backups) == 0 {
+		return nil, err
+	}
+	b := backups[0]
+	rc, err := driver.Reader(ctx, b.Path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Path, err)
+	}
+
+	tmp := dbPath + ".restore"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	_, err = io.Copy(f, zr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Path, err)
+	}
+	if err := checkSQLite(tmp); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Path, err)
+	}
+	// Journal files left beside a lost database belong to it, not to the backup.
+	os.Remove(dbPath + "-wal")
+	os.Remove(dbPath + "-shm")
+	if err := os.Rename(tmp, dbPath); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func checkSQLite(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, len(sqliteMagic))
+	if _, err := io.ReadFull(f, head); err != nil || !bytes.Equal(head, sqliteMagic) {
+		return errors.New("not an SQLite database")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Package capacity reports how full the storage backend is and watches it: a provider measures
+// the space (statvfs over SFTP, the Hetzner Storage Box API, or the sizes recorded in the
+// database), and the Monitor logs low-space alerts and can make the registry read-only before
+// writes start failing.
+package capacity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"refity/backend/internal/database"
+	"refity/backend/internal/storage"
+)
+
+// Report is one measurement of the backend's space, in bytes.
+type Report struct {
+	Provider    string    `json:"provider"`
+	TotalBytes  int64     `json:"total_bytes"` // 0 = unknown
+	FreeBytes   int64     `json:"free_bytes"`
+	UsedBytes   int64     `json:"used_bytes"`
+	UsedPercent float64   `json:"used_percent"` // 0 when the total is unknown
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+func newReport(provider string, total, used int64) *Report {
+	rep := &Report{Provider: provider, TotalBytes: total, UsedBytes: used, CheckedAt: time.Now().UTC()}
+	if total > 0 {
+		rep.FreeBytes = max(total-used, 0)
+		rep.UsedPercent = float64(used) * 100 / float64(total)
+	}
+	return rep
+}
+
+// Provider measures the space of the storage backend.
+type Provider interface {
+	Name() string
+	Capacity(ctx context.Context) (*Report, error)
+}
+
+// New returns the provider named by CAPACITY_PROVIDER: statvfs, hetzner, database, or auto,
+// which uses the first of them that answers. It returns nil for off.
+func New(name string, driver storage.Driver, db *database.Database, hetznerToken string, hetznerBoxID int, total int64) (Provider, error) {
+	var hetzner Provider
+	if hetznerToken != "" && hetznerBoxID != 0 {
+		hetzner = NewHetzner(hetznerToken, hetznerBoxID)
+	}
+	switch name {
+	case "off":
+		return nil, nil
+	case "statvfs":
+		return StatVFS{Driver: driver}, nil
+	case "hetzner":
+		if hetzner == nil {
+			return nil, errors.New("CAPACITY_PROVIDER=hetzner needs HCLOUD_TOKEN and HETZNER_BOX_ID")
+		}
+		return hetzner, nil
+	case "database":
+		return Database{DB: db, Total: total}, nil
+	case "", "auto":
+		var chain Auto
+		if hetzner != nil {
+			chain = append(chain, hetzner)
+		}
+		return append(chain, StatVFS{Driver: driver}, Database{DB: db, Total: total}), nil
+	}
+	return nil, fmt.Errorf("unknown capacity provider %q (available: auto, statvfs, hetzner, database, off)", name)
+}
+
+// StatVFS asks the storage driver, which for SFTP uses the statvfs@openssh.com extension.
+type StatVFS struct {
+	Driver storage.Driver
+}
+
+func (StatVFS) Name() string { return "statvfs" }
+
+func (p StatVFS) Capacity(ctx context.Context) (*Report, error) {
+	cr, ok := p.Driver.(storage.CapacityReporter)
+	if !ok {
+		return nil, storage.ErrNoCapacity
+	}
+	c, err := cr.Capacity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newReport(p.Name(), c.Total, c.Total-c.Free), nil
+}
+
+// Database sums the image sizes recorded in the database. It knows the total only when it is
+// configured (CAPACITY_TOTAL).
+type Database struct {
+	DB    *database.Database
+	Total int64
+}
+
+func (Database) Name() string { return "database" }
+
+func (p Database) Capacity(ctx context.Context) (*Report, error) {
+	_, used, err := p.DB.GetStatistics()
+	if err != nil {
+		return nil, err
+	}
+	return newReport(p.Name(), p.Total, used), nil
+}
+
+// Auto tries each provider in turn and returns the first report.
+type Auto []Provider
+
+func (Auto) Name() string { return "auto" }
+
+func (a Auto) Capacity(ctx context.Context) (*Report, error) {
+	var errs []error
+	for _, p := range a {
+		rep, err := p.Capacity(ctx)
+		if err == nil {
+			return rep, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+	}
+	return nil, errors.Join(errs...)
+}
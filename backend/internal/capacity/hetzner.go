@@ -0,0 +1,66 @@
+package capacity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Hetzner reads a Storage Box's size and usage from the Hetzner API (HCLOUD_TOKEN,
+// HETZNER_BOX_ID). The API allows 3600 requests an hour.
+type Hetzner struct {
+	Token  string
+	BoxID  int
+	client *http.Client
+}
+
+func NewHetzner(token string, boxID int) *Hetzner {
+	return &Hetzner{Token: token, BoxID: boxID, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (*Hetzner) Name() string { return "hetzner" }
+
+func (h *Hetzner) Capacity(ctx context.Context) (*Report, error) {
+	// Storage Boxes use a separate API endpoint, not the hcloud-go SDK
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://api.hetzner.com/v1/storage_boxes/%d", h.BoxID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.Token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+			return nil, fmt.Errorf("Hetzner API rate limit exceeded until %s", time.Unix(reset, 0).UTC().Format(time.RFC3339))
+		}
+		return nil, fmt.Errorf("Hetzner API rate limit exceeded")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Hetzner API error: status %d", resp.StatusCode)
+	}
+	var body struct {
+		StorageBox struct {
+			Stats struct {
+				SizeData int64 `json:"size_data"`
+			} `json:"stats"`
+			StorageBoxType struct {
+				Size int64 `json:"size"`
+			} `json:"storage_box_type"`
+		} `json:"storage_box"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode Hetzner API response: %w", err)
+	}
+	if body.StorageBox.StorageBoxType.Size == 0 {
+		return nil, fmt.Errorf("storage box type not found in response for box ID %d", h.BoxID)
+	}
+	return newReport(h.Name(), body.StorageBox.StorageBoxType.Size, body.StorageBox.Stats.SizeData), nil
+}
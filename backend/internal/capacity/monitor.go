@@ -0,0 +1,171 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Space levels.
+const (
+	LevelOK       = "ok"
+	LevelWarning  = "warning"   // at or above the warning threshold
+	LevelReadOnly = "read-only" // at or above the read-only threshold: pushes are refused
+)
+
+// Options configure the schedule and the thresholds, in percent of the total; 0 disables one.
+type Options struct {
+	Interval        time.Duration
+	WarnPercent     int
+	ReadOnlyPercent int
+}
+
+// Monitor measures the backend's space on a schedule and raises the level as it fills up.
+type Monitor struct {
+	provider   Provider
+	opts       Options
+	onReadOnly func(reason string)
+
+	mu      sync.Mutex
+	last    *Report
+	lastErr string
+	level   string
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewMonitor creates a monitor. onReadOnly, if set, is called with the reason when the level
+// becomes read-only and with "" when it no longer is.
+func NewMonitor(p Provider, opts Options, onReadOnly func(reason string)) *Monitor {
+	return &Monitor{provider: p, opts: opts, onReadOnly: onReadOnly, level: LevelOK, stopCh: make(chan struct{})}
+}
+
+// Start measures once, then every interval if one is set.
+func (m *Monitor) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-m.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		m.Check(ctx)
+		if m.opts.Interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopCh:
+				return
+			case <-ticker.C:
+				m.Check(ctx)
+			}
+		}
+	}()
+}
+
+// Stop ends the schedule and waits for a measurement in progress.
+func (m *Monitor) Stop() {
+	m.stopOnce.Do(func() { close(m.stopCh) })
+	m.wg.Wait()
+}
+
+// Check measures the space now. When the provider fails, the previous report and level stay.
+func (m *Monitor) Check(ctx context.Context) (*Report, error) {
+	rep, err := m.provider.Capacity(ctx)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("[Capacity] Failed to measure storage space: %v", err)
+		}
+		m.mu.Lock()
+		m.lastErr = err.Error()
+		m.mu.Unlock()
+		return nil, err
+	}
+	level := m.levelOf(rep)
+	m.mu.Lock()
+	prev := m.level
+	m.last, m.lastErr, m.level = rep, "", level
+	m.mu.Unlock()
+
+	if level == prev {
+		return rep, nil
+	}
+	switch level {
+	case LevelReadOnly:
+		log.Printf("[Capacity] ALERT: storage %.1f%% full (%s free of %s), at or above %d%%: refusing pushes until space is freed",
+			rep.UsedPercent, gib(rep.FreeBytes), gib(rep.TotalBytes), m.opts.ReadOnlyPercent)
+	case LevelWarning:
+		log.Printf("[Capacity] WARNING: storage %.1f%% full (%s free of %s), at or above %d%%",
+			rep.UsedPercent, gib(rep.FreeBytes), gib(rep.TotalBytes), m.opts.WarnPercent)
+	default:
+		log.Printf("[Capacity] Storage %.1f%% full (%s free of %s), back below the thresholds", rep.UsedPercent, gib(rep.FreeBytes), gib(rep.TotalBytes))
+	}
+	if m.onReadOnly != nil {
+		if level == LevelReadOnly {
+			m.onReadOnly(fmt.Sprintf("storage is %.1f%% full (%s free)", rep.UsedPercent, gib(rep.FreeBytes)))
+		} else if prev == LevelReadOnly {
+			m.onReadOnly("")
+		}
+	}
+	return rep, nil
+}
+
+func (m *Monitor) levelOf(rep *Report) string {
+	switch {
+	case rep.TotalBytes <= 0:
+		return LevelOK
+	case m.opts.ReadOnlyPercent > 0 && rep.UsedPercent >= float64(m.opts.ReadOnlyPercent):
+		return LevelReadOnly
+	case m.opts.WarnPercent > 0 && rep.UsedPercent >= float64(m.opts.WarnPercent):
+		return LevelWarning
+	}
+	return LevelOK
+}
+
+// Status is the provider, the thresholds and the latest measurement.
+type Status struct {
+	Provider        string  `json:"provider"`
+	Interval        string  `json:"interval"`
+	WarnPercent     int     `json:"warn_percent"`
+	ReadOnlyPercent int     `json:"read_only_percent"`
+	Level           string  `json:"level"`
+	Last            *Report `json:"last"`
+	Error           string  `json:"error,omitempty"` // of the latest measurement, if it failed
+}
+
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return Status{
+		Provider:        m.provider.Name(),
+		Interval:        m.opts.Interval.String(),
+		WarnPercent:     m.opts.WarnPercent,
+		ReadOnlyPercent: m.opts.ReadOnlyPercent,
+		Level:           m.level,
+		Last:            m.last,
+		Error:           m.lastErr,
+	}
+}
+
+// Latest returns the most recent report, or nil before the first successful measurement.
+func (m *Monitor) Latest() *Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+func gib(n int64) string {
+	return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+}
@@ -6,10 +6,15 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
+	StorageDriver    string // Storage backend name; from STORAGE_DRIVER, else STORAGE_PROTOCOL (default "sftp")
+	StorageProtocol  string // Protocol spoken to FTP_HOST: sftp, ftp or ftps; from STORAGE_PROTOCOL
+	LocalStorageRoot string // Root directory when STORAGE_DRIVER=local; from LOCAL_STORAGE_ROOT (default <data dir>/storage)
 	FTPHost         string
 	FTPPort         string
 	FTPUsername     string
@@ -19,10 +24,172 @@ type Config struct {
 	JWTSecret       string   // Required in production; from JWT_SECRET
 	CORSOrigins     []string // Allowed origins for CORS; from CORS_ORIGINS (comma-sep)
 	FTPKnownHosts   string   // Optional path to known_hosts for SSH host key verification
-	SFTPSyncUpload  bool     // If true, upload to SFTP before responding (file on FTP when push completes). If false, upload in background (async).
-	EnableFTPUsage  bool     // If true, dashboard fetches Hetzner Storage Box usage (FTP Usage card). Set false if not using Hetzner to avoid API errors.
+	FTPPrivateKey           string // Path to SSH private key; from SFTP_PRIVATE_KEY
+	FTPPrivateKeyPassphrase string // Passphrase for an encrypted private key; from SFTP_PRIVATE_KEY_PASSPHRASE
+	FTPCertificate          string // Path to OpenSSH user certificate (id_ed25519-cert.pub) signed for the key; from SFTP_CERTIFICATE
+	FTPUseAgent             bool   // Authenticate with keys held by ssh-agent at SSH_AUTH_SOCK; from SFTP_USE_AGENT
+	SFTPRoot                string // Remote directory holding all registry data; from SFTP_ROOT (default "registry", relative to the login dir)
+	SFTPSyncUpload        bool          // If true, upload to SFTP before responding (file on FTP when push completes). If false, upload in background (async).
+	StagingDir            string        // Local staging directory for uploads; from STAGING_DIR (default /tmp/refity). Persist it to replay pending uploads after restart.
+	ShutdownTimeout       time.Duration // How long shutdown waits for in-flight requests; from SHUTDOWN_TIMEOUT (default 60s)
+	ShutdownUploadTimeout time.Duration // How long shutdown then waits for background SFTP uploads; from SHUTDOWN_UPLOAD_TIMEOUT (default 60s)
+
+	SFTPPoolSize       int           // Connections for reads/metadata; from SFTP_POOL_SIZE (default 4)
+	SFTPUploadPoolSize int           // Separate connections for blob/manifest writes; from SFTP_UPLOAD_POOL_SIZE (default 2, 0 = share the read pool)
+	SFTPPoolTimeout    time.Duration // Max wait to check out a pooled connection; from SFTP_POOL_TIMEOUT (default 30s, 0 = no limit)
+
+	SFTPParallelStreams   int   // Concurrent range transfers for large objects; from SFTP_PARALLEL_STREAMS (default 4, 1 = single stream)
+	SFTPParallelChunkSize int64 // Range size for parallel transfers; from SFTP_PARALLEL_CHUNK_SIZE (default 8M)
+	SFTPParallelThreshold int64 // Objects smaller than this use a single stream; from SFTP_PARALLEL_THRESHOLD (default 64M)
+
+	S3Endpoint      string        // S3-compatible endpoint URL; from S3_ENDPOINT (default AWS for S3_REGION)
+	S3Region        string        // from S3_REGION (default us-east-1)
+	S3Bucket        string        // from S3_BUCKET
+	S3AccessKey     string        // from S3_ACCESS_KEY_ID
+	S3SecretKey     string        // from S3_SECRET_ACCESS_KEY
+	S3Prefix        string        // Key prefix for all registry data; from S3_PREFIX (default "registry")
+	S3PathStyle     bool          // Use path-style URLs (MinIO, Ceph); from S3_FORCE_PATH_STYLE
+	S3PartSize      int64         // Multipart upload part size in bytes; from S3_PART_SIZE, e.g. "32M" (default 16 MiB, min 5 MiB)
+	S3Redirect      bool          // Redirect blob pulls to presigned bucket URLs; from S3_REDIRECT
+	S3PresignExpiry time.Duration // Lifetime of presigned URLs; from S3_PRESIGN_EXPIRY (default 20m)
+
+	WebDAVURL      string // WebDAV server URL (e.g. https://u123456.your-storagebox.de); from WEBDAV_URL
+	WebDAVUsername string // from WEBDAV_USERNAME (default FTP_USERNAME)
+	WebDAVPassword string // from WEBDAV_PASSWORD (default FTP_PASSWORD)
+	WebDAVRoot     string // Collection holding all registry data, relative to WEBDAV_URL; from WEBDAV_ROOT (default "registry")
+
+	FTPRoot        string        // Remote directory for STORAGE_PROTOCOL=ftp/ftps; from FTP_ROOT (default "registry", relative to the login dir)
+	FTPTLSMode     string        // "explicit" (AUTH TLS, default) or "implicit"; from FTP_TLS_MODE
+	FTPTLSInsecure bool          // Skip FTPS certificate verification; from FTP_TLS_INSECURE_SKIP_VERIFY
+	FTPDisableEPSV bool          // Use PASV instead of EPSV for passive data connections; from FTP_DISABLE_EPSV
+	FTPPoolSize    int           // FTP control connections; from FTP_POOL_SIZE (default 4)
+	FTPPoolTimeout time.Duration // Max wait to check out a pooled connection; from FTP_POOL_TIMEOUT (default 30s, 0 = no limit)
+
+	MirrorBackends       []string      // Replicas for STORAGE_DRIVER=mirror as "name:driver"; from MIRROR_BACKENDS (comma-sep)
+	MirrorWriteQuorum    int           // Replicas that must accept a write; from MIRROR_WRITE_QUORUM (default 0 = all)
+	MirrorRepairInterval time.Duration // How often missing objects are copied between replicas; from MIRROR_REPAIR_INTERVAL (default 6h, 0 = off)
+
+	CacheDir     string // Local read cache for blobs and by-digest manifests; from CACHE_DIR (empty = disabled)
+	CacheMaxSize int64  // Cache size bound in bytes; from CACHE_MAX_SIZE ("50G", "500M" or bytes; default 10G)
+
+	EncryptionKeys      string // Comma-separated "id:key" AES-256 keys (base64 or hex); from ENCRYPTION_KEYS
+	EncryptionKeyFile   string // File with one "id:key" per line; from ENCRYPTION_KEYFILE
+	EncryptionActiveKey string // Key ID for new objects; from ENCRYPTION_ACTIVE_KEY (default: the last key listed)
+
+	ScrubInterval  time.Duration // Time between scheduled integrity scrubs; from SCRUB_INTERVAL (default 0 = only on demand)
+	ScrubRateLimit int64         // Bytes per second a scrub reads; from SCRUB_RATE_LIMIT ("10M" or bytes; default 10M, 0 = unlimited)
+	ScrubRepair    bool          // Rewrite corrupt or missing objects from a verified copy; from SCRUB_REPAIR
+
+	ReconcileInterval  time.Duration // Time between database/storage reconciliations; from RECONCILE_INTERVAL (default 0 = off)
+	ReconcileOnStartup bool          // Reconcile once at startup; from RECONCILE_ON_STARTUP (an empty database is always rebuilt)
+	ReconcileRepair    bool          // Scheduled and startup reconciliations fix the database instead of only reporting; from RECONCILE_REPAIR
+
+	RetentionInterval time.Duration // Time between runs applying tag retention policies; from RETENTION_INTERVAL (default 24h, 0 = off)
+	GCGrace           time.Duration // How old an unreferenced manifest or blob must be before retention deletes it; from GC_GRACE (default 24h)
+
+	ReadOnly       bool   // Start in read-only (maintenance) mode; from READ_ONLY. Admins can lift it at runtime.
+	ReadOnlyReason string // Message returned to refused writes; from READ_ONLY_REASON (default "maintenance")
+
+	CapacityProvider        string        // How storage space is measured: auto, statvfs, hetzner, database or off; from CAPACITY_PROVIDER (default auto)
+	CapacityInterval        time.Duration // Time between measurements; from CAPACITY_CHECK_INTERVAL (default 5m)
+	CapacityTotal           int64         // Storage size for the database provider, which cannot measure it; from CAPACITY_TOTAL ("2T" or bytes; default 0 = unknown)
+	CapacityWarnPercent     int           // Log a low-space alert at this fill level; from CAPACITY_WARN_PERCENT (default 85, 0 = off)
+	CapacityReadOnlyPercent int           // Refuse pushes at this fill level; from CAPACITY_READ_ONLY_PERCENT (default 0 = off)
+
+	QuotaSoftPercent int // Default soft limit of a quota, in percent of its limit; from QUOTA_SOFT_PERCENT (default 80)
+
+	DatabaseURL string // Metadata database: a postgres:// URL or an SQLite file path; from DATABASE_URL (default data/refity.db)
+
+	DBBackupDir      string        // Storage folder for database backups; from DB_BACKUP_PATH (default "_backups/db")
+	DBBackupInterval time.Duration // Time between database backups; from DB_BACKUP_INTERVAL (default 24h, 0 = off)
+	DBBackupKeep     int           // Backups kept in storage; from DB_BACKUP_KEEP (default 7, 0 = all)
+	DBRestore        bool          // Restore the newest backup when the local database is missing; from DB_RESTORE_ON_MISSING (default true)
 }
 
+// envSource looks up configuration variables. osEnv reads the process environment; replica
+// configs (ForReplica) overlay per-replica variables on top of it.
+type envSource func(key string) (string, bool)
+
+var osEnv envSource = os.LookupEnv
+
+func (e envSource) get(key string) string {
+	v, _ := e(key)
+	return v
+}
+
+// bool reports whether key is set to true/1/yes.
+func (e envSource) bool(key string) bool {
+	s := strings.ToLower(strings.TrimSpace(e.get(key)))
+	return s == "true" || s == "1" || s == "yes"
+}
+
+// int parses an integer variable; returns def if unset or invalid.
+func (e envSource) int(key string, def int) int {
+	s := strings.TrimSpace(e.get(key))
+	if s == "" {
+		return def
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		log.Printf("WARNING: invalid %s=%q, using default %d", key, s, def)
+		return def
+	}
+	return n
+}
+
+// duration parses a duration variable ("90s", "5m") or plain seconds ("90"); returns def if unset or invalid.
+func (e envSource) duration(key string, def time.Duration) time.Duration {
+	s := strings.TrimSpace(e.get(key))
+	if s == "" {
+		return def
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return time.Duration(n) * time.Second
+	}
+	log.Printf("WARNING: invalid %s=%q, using default %s", key, s, def)
+	return def
+}
+
+// size parses a byte size with an optional binary suffix ("500M", "20G", "1T") or plain bytes; returns def if unset or invalid.
+func (e envSource) size(key string, def int64) int64 {
+	s := strings.ToUpper(strings.TrimSpace(e.get(key)))
+	if s == "" {
+		return def
+	}
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		log.Printf("WARNING: invalid %s=%q, using default %d", key, e.get(key), def)
+		return def
+	}
+	return n * mult
+}
+
+// envInt parses an integer env var; returns def if unset or invalid.
+func envInt(key string, def int) int { return osEnv.int(key, def) }
+
+// envDuration parses a duration env var ("90s", "5m") or plain seconds ("90"); returns def if unset or invalid.
+func envDuration(key string, def time.Duration) time.Duration { return osEnv.duration(key, def) }
+
 func LoadConfig() *Config {
 	boxID := 0
 	if boxIDStr := os.Getenv("HETZNER_BOX_ID"); boxIDStr != "" {
@@ -45,22 +212,350 @@ func LoadConfig() *Config {
 		}
 	}
 	syncUpload := strings.ToLower(os.Getenv("SFTP_SYNC_UPLOAD")) == "true" || os.Getenv("SFTP_SYNC_UPLOAD") == "1"
-	enableFTPUsage := false
-	if s := os.Getenv("FTP_USAGE_ENABLED"); s != "" {
-		enableFTPUsage = strings.ToLower(s) == "true" || s == "1" || strings.ToLower(s) == "yes"
+	capacityProvider := strings.ToLower(strings.TrimSpace(os.Getenv("CAPACITY_PROVIDER")))
+	if capacityProvider == "" {
+		capacityProvider = "auto"
+		// FTP_USAGE_ENABLED=true predates CAPACITY_PROVIDER and meant the Hetzner API.
+		if s := strings.ToLower(os.Getenv("FTP_USAGE_ENABLED")); s == "true" || s == "1" || s == "yes" {
+			capacityProvider = "hetzner"
+		}
+	}
+	dbRestore := true
+	if s := strings.ToLower(strings.TrimSpace(os.Getenv("DB_RESTORE_ON_MISSING"))); s == "false" || s == "0" || s == "no" {
+		dbRestore = false
+	}
+	dbBackupDir := strings.Trim(strings.TrimSpace(os.Getenv("DB_BACKUP_PATH")), "/")
+	if dbBackupDir == "" {
+		dbBackupDir = "_backups/db"
+	}
+	stagingDir := os.Getenv("STAGING_DIR")
+	if stagingDir == "" {
+		stagingDir = "/tmp/refity"
+	}
+	c := &Config{
+		HetznerToken:          os.Getenv("HCLOUD_TOKEN"),
+		HetznerBoxID:          boxID,
+		JWTSecret:             jwtSecret,
+		CORSOrigins:           corsOrigins,
+		SFTPSyncUpload:        syncUpload,
+		StagingDir:            stagingDir,
+		ShutdownTimeout:       envDuration("SHUTDOWN_TIMEOUT", 60*time.Second),
+		ShutdownUploadTimeout: envDuration("SHUTDOWN_UPLOAD_TIMEOUT", 60*time.Second),
+
+		MirrorBackends:       splitList(os.Getenv("MIRROR_BACKENDS")),
+		MirrorWriteQuorum:    envInt("MIRROR_WRITE_QUORUM", 0),
+		MirrorRepairInterval: envDuration("MIRROR_REPAIR_INTERVAL", 6*time.Hour),
+
+		CacheDir:     strings.TrimSpace(os.Getenv("CACHE_DIR")),
+		CacheMaxSize: osEnv.size("CACHE_MAX_SIZE", 10<<30),
+
+		EncryptionKeys:      strings.TrimSpace(os.Getenv("ENCRYPTION_KEYS")),
+		EncryptionKeyFile:   strings.TrimSpace(os.Getenv("ENCRYPTION_KEYFILE")),
+		EncryptionActiveKey: strings.TrimSpace(os.Getenv("ENCRYPTION_ACTIVE_KEY")),
+
+		ScrubInterval:  envDuration("SCRUB_INTERVAL", 0),
+		ScrubRateLimit: osEnv.size("SCRUB_RATE_LIMIT", 10<<20),
+		ScrubRepair:    osEnv.bool("SCRUB_REPAIR"),
+
+		ReconcileInterval:  envDuration("RECONCILE_INTERVAL", 0),
+		ReconcileOnStartup: osEnv.bool("RECONCILE_ON_STARTUP"),
+		ReconcileRepair:    osEnv.bool("RECONCILE_REPAIR"),
+
+		RetentionInterval: envDuration("RETENTION_INTERVAL", 24*time.Hour),
+		GCGrace:           envDuration("GC_GRACE", 24*time.Hour),
+
+		ReadOnly:       osEnv.bool("READ_ONLY"),
+		ReadOnlyReason: strings.TrimSpace(os.Getenv("READ_ONLY_REASON")),
+
+		CapacityProvider:        capacityProvider,
+		CapacityInterval:        envDuration("CAPACITY_CHECK_INTERVAL", 5*time.Minute),
+		CapacityTotal:           osEnv.size("CAPACITY_TOTAL", 0),
+		CapacityWarnPercent:     envInt("CAPACITY_WARN_PERCENT", 85),
+		CapacityReadOnlyPercent: envInt("CAPACITY_READ_ONLY_PERCENT", 0),
+
+		QuotaSoftPercent: envInt("QUOTA_SOFT_PERCENT", 80),
+
+		DatabaseURL: strings.TrimSpace(os.Getenv("DATABASE_URL")),
+
+		DBBackupDir:      dbBackupDir,
+		DBBackupInterval: envDuration("DB_BACKUP_INTERVAL", 24*time.Hour),
+		DBBackupKeep:     envInt("DB_BACKUP_KEEP", 7),
+		DBRestore:        dbRestore,
+	}
+	c.loadStorage(osEnv)
+	return c
+}
+
+// loadStorage reads the storage backend settings (STORAGE_DRIVER and the SFTP, FTP, S3 and WebDAV variables) from e.
+func (c *Config) loadStorage(e envSource) {
+	sftpRoot := strings.TrimSpace(e.get("SFTP_ROOT"))
+	if sftpRoot == "" {
+		sftpRoot = "registry"
+	}
+	if sftpRoot != "/" {
+		sftpRoot = strings.TrimSuffix(sftpRoot, "/")
+	}
+	s3Region := e.get("S3_REGION")
+	if s3Region == "" {
+		s3Region = "us-east-1"
+	}
+	s3Prefix, ok := e("S3_PREFIX")
+	if !ok {
+		s3Prefix = "registry"
+	}
+	webdavUser := e.get("WEBDAV_USERNAME")
+	if webdavUser == "" {
+		webdavUser = e.get("FTP_USERNAME")
 	}
-	return &Config{
-		FTPHost:        os.Getenv("FTP_HOST"),
-		FTPPort:        os.Getenv("FTP_PORT"),
-		FTPUsername:    os.Getenv("FTP_USERNAME"),
-		FTPPassword:    os.Getenv("FTP_PASSWORD"),
-		HetznerToken:   os.Getenv("HCLOUD_TOKEN"),
-		HetznerBoxID:   boxID,
-		JWTSecret:      jwtSecret,
-		CORSOrigins:    corsOrigins,
-		FTPKnownHosts:   os.Getenv("FTP_KNOWN_HOSTS"),
-		SFTPSyncUpload:  syncUpload,
-		EnableFTPUsage:  enableFTPUsage,
+	webdavPassword := e.get("WEBDAV_PASSWORD")
+	if webdavPassword == "" {
+		webdavPassword = e.get("FTP_PASSWORD")
 	}
+	webdavRoot, ok := e("WEBDAV_ROOT")
+	if !ok {
+		webdavRoot = "registry"
+	}
+	ftpRoot := strings.TrimSpace(e.get("FTP_ROOT"))
+	if ftpRoot == "" {
+		ftpRoot = "registry"
+	}
+	if ftpRoot != "/" {
+		ftpRoot = strings.TrimSuffix(ftpRoot, "/")
+	}
+	ftpTLSMode := strings.ToLower(strings.TrimSpace(e.get("FTP_TLS_MODE")))
+	if ftpTLSMode == "" {
+		ftpTLSMode = "explicit"
+	}
+	storageProtocol := strings.ToLower(strings.TrimSpace(e.get("STORAGE_PROTOCOL")))
+	storageDriver := strings.ToLower(strings.TrimSpace(e.get("STORAGE_DRIVER")))
+	if storageDriver == "" {
+		storageDriver = storageProtocol
+	}
+	if storageDriver == "" {
+		storageDriver = "sftp"
+	}
+	c.StorageDriver = storageDriver
+	c.StorageProtocol = storageProtocol
+	c.LocalStorageRoot = e.get("LOCAL_STORAGE_ROOT")
+	c.FTPHost = e.get("FTP_HOST")
+	c.FTPPort = e.get("FTP_PORT")
+	c.FTPUsername = e.get("FTP_USERNAME")
+	c.FTPPassword = e.get("FTP_PASSWORD")
+	c.FTPKnownHosts = e.get("FTP_KNOWN_HOSTS")
+	c.FTPPrivateKey = e.get("SFTP_PRIVATE_KEY")
+	c.FTPPrivateKeyPassphrase = e.get("SFTP_PRIVATE_KEY_PASSPHRASE")
+	c.FTPCertificate = e.get("SFTP_CERTIFICATE")
+	c.FTPUseAgent = e.bool("SFTP_USE_AGENT")
+	c.SFTPRoot = sftpRoot
+
+	c.SFTPPoolSize = e.int("SFTP_POOL_SIZE", 4)
+	c.SFTPUploadPoolSize = e.int("SFTP_UPLOAD_POOL_SIZE", 2)
+	c.SFTPPoolTimeout = e.duration("SFTP_POOL_TIMEOUT", 30*time.Second)
+	c.SFTPParallelStreams = e.int("SFTP_PARALLEL_STREAMS", 4)
+	c.SFTPParallelChunkSize = e.size("SFTP_PARALLEL_CHUNK_SIZE", 8<<20)
+	c.SFTPParallelThreshold = e.size("SFTP_PARALLEL_THRESHOLD", 64<<20)
+
+	c.S3Endpoint = strings.TrimSuffix(e.get("S3_ENDPOINT"), "/")
+	c.S3Region = s3Region
+	c.S3Bucket = e.get("S3_BUCKET")
+	c.S3AccessKey = e.get("S3_ACCESS_KEY_ID")
+	c.S3SecretKey = e.get("S3_SECRET_ACCESS_KEY")
+	c.S3Prefix = strings.Trim(s3Prefix, "/")
+	c.S3PathStyle = e.bool("S3_FORCE_PATH_STYLE")
+	c.S3PartSize = e.size("S3_PART_SIZE", 16<<20)
+	c.S3Redirect = e.bool("S3_REDIRECT")
+	c.S3PresignExpiry = e.duration("S3_PRESIGN_EXPIRY", 20*time.Minute)
+
+	c.WebDAVURL = strings.TrimSpace(e.get("WEBDAV_URL"))
+	c.WebDAVUsername = webdavUser
+	c.WebDAVPassword = webdavPassword
+	c.WebDAVRoot = strings.Trim(webdavRoot, "/")
+
+	c.FTPRoot = ftpRoot
+	c.FTPTLSMode = ftpTLSMode
+	c.FTPTLSInsecure = e.bool("FTP_TLS_INSECURE_SKIP_VERIFY")
+	c.FTPDisableEPSV = e.bool("FTP_DISABLE_EPSV")
+	c.FTPPoolSize = e.int("FTP_POOL_SIZE", 4)
+	c.FTPPoolTimeout = e.duration("FTP_POOL_TIMEOUT", 30*time.Second)
+}
+
+// ParseMirrorBackend splits a MIRROR_BACKENDS entry "name:driver" (or just "driver", named after it).
+func ParseMirrorBackend(entry string) (name, driver string) {
+	name, driver, found := strings.Cut(entry, ":")
+	if !found {
+		driver = name
+	}
+	return strings.TrimSpace(name), strings.ToLower(strings.TrimSpace(driver))
+}
+
+// ForReplica returns a copy of c whose storage settings are re-read with MIRROR_<NAME>_<VAR>
+// overriding <VAR>, e.g. MIRROR_BOX2_FTP_HOST for replica "box2". StorageDriver is set to driver.
+func (c *Config) ForReplica(name, driver string) *Config {
+	prefix := "MIRROR_" + envName(name) + "_"
+	r := *c
+	r.loadStorage(func(key string) (string, bool) {
+		if v, ok := os.LookupEnv(prefix + key); ok {
+			return v, true
+		}
+		return os.LookupEnv(key)
+	})
+	r.StorageDriver = driver
+	r.StorageProtocol = ""
+	if r.LocalStorageRoot == "" {
+		r.LocalStorageRoot = c.LocalStorageRoot
+	}
+	return &r
+}
+
+// envName upper-cases name and replaces anything but letters and digits with '_'.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
 }
 
+// Validate checks that the settings of the selected storage backend are usable.
+func (c *Config) Validate() error {
+	switch c.StorageProtocol {
+	case "", "sftp", "ftp", "ftps":
+	default:
+		return fmt.Errorf("STORAGE_PROTOCOL must be sftp, ftp or ftps, got %q", c.StorageProtocol)
+	}
+	if c.StorageProtocol != "" && c.StorageDriver != c.StorageProtocol {
+		return fmt.Errorf("STORAGE_PROTOCOL=%s conflicts with STORAGE_DRIVER=%s; set only one", c.StorageProtocol, c.StorageDriver)
+	}
+	if c.CapacityWarnPercent < 0 || c.CapacityWarnPercent > 100 || c.CapacityReadOnlyPercent < 0 || c.CapacityReadOnlyPercent > 100 {
+		return fmt.Errorf("CAPACITY_WARN_PERCENT and CAPACITY_READ_ONLY_PERCENT must be between 0 and 100")
+	}
+	if c.QuotaSoftPercent < 1 || c.QuotaSoftPercent > 100 {
+		return fmt.Errorf("QUOTA_SOFT_PERCENT must be between 1 and 100, got %d", c.QuotaSoftPercent)
+	}
+	if strings.Contains(c.DBBackupDir, "..") {
+		return fmt.Errorf("DB_BACKUP_PATH must not contain '..'")
+	}
+	switch c.StorageDriver {
+	case "sftp":
+		return c.validateSFTP()
+	case "local":
+		return nil
+	case "s3":
+		return c.validateS3()
+	case "ftp", "ftps":
+		return c.validateFTP()
+	case "mirror":
+		return c.validateMirror()
+	case "webdav":
+		if c.WebDAVURL == "" {
+			return fmt.Errorf("WEBDAV_URL must be set")
+		}
+		if strings.Contains(c.WebDAVRoot, "..") {
+			return fmt.Errorf("WEBDAV_ROOT must not contain '..'")
+		}
+		return nil
+	}
+	return nil
+}
+
+// validateMirror checks the replica list and quorum, then validates each replica's own settings.
+func (c *Config) validateMirror() error {
+	if len(c.MirrorBackends) < 2 {
+		return fmt.Errorf("MIRROR_BACKENDS must list at least two replicas, e.g. box1:sftp,box2:sftp")
+	}
+	if c.MirrorWriteQuorum > len(c.MirrorBackends) {
+		return fmt.Errorf("MIRROR_WRITE_QUORUM=%d exceeds the %d replicas in MIRROR_BACKENDS", c.MirrorWriteQuorum, len(c.MirrorBackends))
+	}
+	seen := make(map[string]bool)
+	for _, entry := range c.MirrorBackends {
+		name, driver := ParseMirrorBackend(entry)
+		if name == "" || driver == "" {
+			return fmt.Errorf("MIRROR_BACKENDS: invalid entry %q", entry)
+		}
+		if driver == "mirror" {
+			return fmt.Errorf("MIRROR_BACKENDS: replica %s cannot itself be a mirror", name)
+		}
+		if seen[envName(name)] {
+			return fmt.Errorf("MIRROR_BACKENDS: duplicate replica name %q", name)
+		}
+		seen[envName(name)] = true
+		if err := c.ForReplica(name, driver).Validate(); err != nil {
+			return fmt.Errorf("mirror replica %s (%s): %w", name, driver, err)
+		}
+	}
+	return nil
+}
+
+// validateFTP requires host and user; the password may be empty for anonymous servers.
+func (c *Config) validateFTP() error {
+	if c.FTPHost == "" || c.FTPUsername == "" {
+		return fmt.Errorf("FTP_HOST and FTP_USERNAME must be set")
+	}
+	if c.FTPTLSMode != "explicit" && c.FTPTLSMode != "implicit" {
+		return fmt.Errorf("FTP_TLS_MODE must be explicit or implicit, got %q", c.FTPTLSMode)
+	}
+	if strings.Contains(c.FTPRoot, "..") {
+		return fmt.Errorf("FTP_ROOT must not contain '..'")
+	}
+	if c.StorageDriver == "ftp" {
+		log.Println("WARNING: STORAGE_PROTOCOL=ftp sends credentials and image data unencrypted. Use ftps where the server supports it.")
+	}
+	return nil
+}
+
+// validateS3 requires a bucket and a static key pair.
+func (c *Config) validateS3() error {
+	if c.S3Bucket == "" {
+		return fmt.Errorf("S3_BUCKET must be set")
+	}
+	if c.S3AccessKey == "" || c.S3SecretKey == "" {
+		return fmt.Errorf("S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY must be set")
+	}
+	if c.S3PartSize < 5<<20 {
+		return fmt.Errorf("S3_PART_SIZE must be at least 5242880 (5 MiB)")
+	}
+	return nil
+}
+
+// validateSFTP requires host, user and any one SSH auth method: password (also used for
+// keyboard-interactive), private key file, or ssh-agent.
+func (c *Config) validateSFTP() error {
+	if c.FTPHost == "" || c.FTPUsername == "" {
+		return fmt.Errorf("FTP_HOST and FTP_USERNAME must be set")
+	}
+	if c.FTPPassword == "" && c.FTPPrivateKey == "" && !c.FTPUseAgent {
+		return fmt.Errorf("no SFTP authentication configured: set FTP_PASSWORD, SFTP_PRIVATE_KEY or SFTP_USE_AGENT=true")
+	}
+	if strings.Contains(c.SFTPRoot, "..") {
+		return fmt.Errorf("SFTP_ROOT must not contain '..'")
+	}
+	if c.FTPCertificate != "" && c.FTPPrivateKey == "" {
+		return fmt.Errorf("SFTP_CERTIFICATE requires SFTP_PRIVATE_KEY")
+	}
+	if c.FTPPrivateKey != "" {
+		if _, err := os.Stat(c.FTPPrivateKey); err != nil {
+			return fmt.Errorf("SFTP_PRIVATE_KEY: %w", err)
+		}
+	}
+	if c.SFTPParallelStreams > 1 && c.SFTPParallelChunkSize < 1<<20 {
+		return fmt.Errorf("SFTP_PARALLEL_CHUNK_SIZE must be at least 1M")
+	}
+	if c.FTPUseAgent && os.Getenv("SSH_AUTH_SOCK") == "" {
+		return fmt.Errorf("SFTP_USE_AGENT is set but SSH_AUTH_SOCK is empty")
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// copyTables lists every table with data, parents before children, for Copy. A migration that
+// adds a table must add it here too. Child rows whose parent is gone are skipped: SQLite does not
+// enforce foreign keys, PostgreSQL does.
+var copyTables = []struct {
+	name, columns, where string
+}{
+	{"users", "id, username, password_hash, role, created_at", ""},
+	{"groups", "id, name, created_at", ""},
+	{"repositories", "id, name, created_at", ""},
+	{"images", "id, name, tag, digest, size, created_at", ""},
+	{"layers", "id, image_id, digest, size, media_type", "image_id IN (SELECT id FROM images)"},
+	{"manifests", "id, image_id, digest, content", "image_id IN (SELECT id FROM images)"},
+	{"scrub_runs", "id, started_at, finished_at, status, target, cursor, objects, bytes, corrupt, missing, unreadable, repaired, error", ""},
+	{"scrub_findings", "id, run_id, target, path, problem, detail, repaired_from, found_at", "run_id IN (SELECT id FROM scrub_runs)"},
+	{"tag_history", "id, name, tag, digest, action, username, ip, created_at", ""},
+	{"tag_rules", "id, scope, pattern, pattern_type, mode, roles, created_at", ""},
+	{"retention_policies", "id, scope, keep_last, keep_days, keep_patterns, created_at", ""},
+	{"quotas", "id, kind, name, limit_bytes, soft_bytes, created_at", ""},
+}
+
+// CopyStat is how many rows of one table Copy wrote.
+type CopyStat struct {
+	Table string
+	Rows  int64
+}
+
+// Copy writes every row of src into dst in one transaction, keeping ids so references between
+// tables hold. Both databases must be at the same schema version and dst must be empty.
+func Copy(dst, src *Database) ([]CopyStat, error) {
+	sv, err := src.Version()
+	if err != nil {
+		return nil, err
+	}
+	dv, err := dst.Version()
+	if err != nil {
+		return nil, err
+	}
+	if sv != dv {
+		return nil, fmt.Errorf("schema versions differ: source %d, destination %d", sv, dv)
+	}
+	for _, t := range copyTables {
+		var n int
+		if err := dst.queryRow(`SELECT COUNT(*) FROM ` + t.name).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			return nil, fmt.Errorf("destination is not empty: %s has %d rows", t.name, n)
+		}
+	}
+
+	t, err := dst.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	var stats []CopyStat
+	for _, table := range copyTables {
+		n, err := copyTable(t, src, table.name, table.columns, table.where)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", table.name, err)
+		}
+		stats = append(stats, CopyStat{Table: table.name, Rows: n})
+		if t.dl == postgresDialect {
+			// Rows came with their ids, so the id sequence has to catch up.
+			_, err := t.exec(`SELECT setval(pg_get_serial_sequence('` + table.name + `', 'id'), MAX(id)) FROM ` + table.name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", table.name, err)
+			}
+		}
+	}
+	return stats, t.Commit()
+}
+
+func copyTable(t *tx, src *Database, table, columns, where string) (int64, error) {
+	query := `SELECT ` + columns + ` FROM ` + table
+	if where != "" {
+		query += ` WHERE ` + where
+	}
+	rows, err := src.query(query + ` ORDER BY id`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	ncol := len(strings.Split(columns, ","))
+	insert := `INSERT INTO ` + table + ` (` + columns + `) VALUES (?` + strings.Repeat(", ?", ncol-1) + `)`
+	values := make([]any, ncol)
+	ptrs := make([]any, ncol)
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	var n int64
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return n, err
+		}
+		if _, err := t.exec(insert, values...); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
+	"fmt"
 	"strings"
 	"time"
 	"golang.org/x/crypto/bcrypt"
@@ -14,6 +15,7 @@ import (
 
 type Database struct {
 	db *sql.DB
+	querier
 }
 
 type Image struct {
@@ -54,21 +56,15 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func NewDatabase(dbPath string) (*Database, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+// NewDatabase opens the database named by dsn, migrates its schema and creates the default admin
+// account if there are no users. A postgres:// URL selects PostgreSQL; anything else is the path
+// of an SQLite file.
+func NewDatabase(dsn string) (*Database, error) {
+	database, err := Open(dsn)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := db.Ping(); err != nil {
-		return nil, err
-	}
-
-	database := &Database{db: db}
-	if err := database.createTables(); err != nil {
-		return nil, err
-	}
-
 	// Create default admin user if it doesn't exist
 	if err := database.createDefaultAdmin(); err != nil {
 		log.Printf("Warning: Failed to create default admin user: %v", err)
@@ -77,138 +73,41 @@ func NewDatabase(dbPath string) (*Database, error) {
 	return database, nil
 }
 
-func (d *Database) createTables() error {
-	// Create users table
-	_, err := d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT NOT NULL UNIQUE,
-			password_hash TEXT NOT NULL,
-			role TEXT DEFAULT 'user',
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
+// Open opens and migrates the database named by dsn without adding any rows.
+func Open(dsn string) (*Database, error) {
+	dl := dialectFor(dsn)
+	db, err := dl.open(dsn)
 	if err != nil {
-		return err
-	}
-
-	// Create images table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS images (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL,
-			tag TEXT NOT NULL,
-			digest TEXT NOT NULL,
-			size INTEGER NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			UNIQUE(name, tag)
-		)
-	`)
-	if err != nil {
-		return err
-	}
-
-	// Migration: remove UNIQUE constraint from digest column (if old schema)
-	// SQLite doesn't support ALTER TABLE DROP CONSTRAINT, so recreate the table.
-	var hasUniqueDigest bool
-	{
-		migRows, qErr := d.db.Query(`SELECT sql FROM sqlite_master WHERE type='table' AND name='images'`)
-		if qErr == nil {
-			for migRows.Next() {
-				var ddl string
-				if migRows.Scan(&ddl) == nil {
-					if strings.Contains(ddl, "digest TEXT NOT NULL UNIQUE") {
-						hasUniqueDigest = true
-					}
-				}
-			}
-			migRows.Close()
-		}
-	}
-	if hasUniqueDigest {
-		log.Println("Migrating images table: removing UNIQUE constraint from digest column...")
-		_, err = d.db.Exec(`
-			CREATE TABLE images_new (
-				id INTEGER PRIMARY KEY AUTOINCREMENT,
-				name TEXT NOT NULL,
-				tag TEXT NOT NULL,
-				digest TEXT NOT NULL,
-				size INTEGER NOT NULL,
-				created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-				UNIQUE(name, tag)
-			);
-			INSERT INTO images_new (id, name, tag, digest, size, created_at)
-				SELECT id, name, tag, digest, size, created_at FROM images;
-			DROP TABLE images;
-			ALTER TABLE images_new RENAME TO images;
-		`)
-		if err != nil {
-			log.Printf("Warning: migration failed: %v", err)
-		} else {
-			log.Println("Migration complete: images table updated")
-		}
-	}
-
-	// Create repositories table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS repositories (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL UNIQUE,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Create layers table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS layers (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			image_id INTEGER NOT NULL,
-			digest TEXT NOT NULL,
-			size INTEGER NOT NULL,
-			media_type TEXT NOT NULL,
-			FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
-		)
-	`)
-	if err != nil {
-		return err
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	// Create manifests table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS manifests (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			image_id INTEGER NOT NULL,
-			digest TEXT NOT NULL,
-			content TEXT NOT NULL,
-			FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
-		)
-	`)
-	if err != nil {
-		return err
+	database := &Database{db: db, querier: querier{dl: dl, q: db}}
+	if err := database.migrate(); err != nil {
+		db.Close()
+		return nil, err
 	}
+	return database, nil
+}
 
-	// Create groups table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS groups (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT NOT NULL UNIQUE,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		return err
-	}
+// Engine is the SQL engine in use: "sqlite" or "postgres".
+func (d *Database) Engine() string {
+	return d.dl.name
+}
 
-	return nil
+// EngineFor returns the SQL engine dsn selects: "sqlite" or "postgres".
+func EngineFor(dsn string) string {
+	return dialectFor(dsn).name
 }
 
 func (d *Database) createDefaultAdmin() error {
 	// Check if any user exists
 	var count int
-	err := d.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	err := d.queryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
 	if err != nil {
 		return err
 	}
@@ -229,7 +128,7 @@ func (d *Database) createDefaultAdmin() error {
 		return err
 	}
 
-	_, err = d.db.Exec(`
+	_, err = d.exec(`
 		INSERT INTO users (username, password_hash, role, created_at)
 		VALUES (?, ?, 'admin', CURRENT_TIMESTAMP)
 	`, "admin", string(hashedPassword))
@@ -246,6 +145,16 @@ func (d *Database) createDefaultAdmin() error {
 	return nil
 }
 
+// BackupTo writes a consistent copy of the live database to path, which must not exist yet.
+// Only SQLite databases can be copied this way; back up PostgreSQL with its own tools.
+func (d *Database) BackupTo(path string) error {
+	if d.dl != sqliteDialect {
+		return fmt.Errorf("backups to storage are not supported for %s databases", d.dl.name)
+	}
+	_, err := d.exec(`VACUUM INTO ?`, path)
+	return err
+}
+
 func (d *Database) Close() error {
 	return d.db.Close()
 }
@@ -253,7 +162,7 @@ func (d *Database) Close() error {
 // User operations
 func (d *Database) GetUserByUsername(username string) (*User, error) {
 	var user User
-	err := d.db.QueryRow(`
+	err := d.queryRow(`
 		SELECT id, username, password_hash, role, created_at
 		FROM users WHERE username = ?
 	`, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
@@ -265,7 +174,7 @@ func (d *Database) GetUserByUsername(username string) (*User, error) {
 
 func (d *Database) GetUserByID(id int64) (*User, error) {
 	var user User
-	err := d.db.QueryRow(`
+	err := d.queryRow(`
 		SELECT id, username, password_hash, role, created_at
 		FROM users WHERE id = ?
 	`, id).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.Role, &user.CreatedAt)
@@ -276,7 +185,7 @@ func (d *Database) GetUserByID(id int64) (*User, error) {
 }
 
 func (d *Database) UpdateUserPassword(id int64, newPasswordHash string) error {
-	_, err := d.db.Exec(`UPDATE users SET password_hash = ? WHERE id = ?`, newPasswordHash, id)
+	_, err := d.exec(`UPDATE users SET password_hash = ? WHERE id = ?`, newPasswordHash, id)
 	return err
 }
 
@@ -286,7 +195,7 @@ func (d *Database) CreateUser(username, password string, role string) (*User, er
 		return nil, err
 	}
 
-	result, err := d.db.Exec(`
+	id, err := d.insert(`
 		INSERT INTO users (username, password_hash, role, created_at)
 		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
 	`, username, string(hashedPassword), role)
@@ -294,11 +203,6 @@ func (d *Database) CreateUser(username, password string, role string) (*User, er
 		return nil, err
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
 	return &User{
 		ID:        id,
 		Username:  username,
@@ -308,7 +212,7 @@ func (d *Database) CreateUser(username, password string, role string) (*User, er
 }
 
 func (d *Database) GetAllUsers() ([]*User, error) {
-	rows, err := d.db.Query(`
+	rows, err := d.query(`
 		SELECT id, username, role, created_at
 		FROM users ORDER BY created_at DESC
 	`)
@@ -330,13 +234,13 @@ func (d *Database) GetAllUsers() ([]*User, error) {
 }
 
 func (d *Database) DeleteUser(id int64) error {
-	_, err := d.db.Exec(`DELETE FROM users WHERE id = ?`, id)
+	_, err := d.exec(`DELETE FROM users WHERE id = ?`, id)
 	return err
 }
 
 // Image operations
 func (d *Database) CreateImage(name, tag, digest string, size int64) (*Image, error) {
-	result, err := d.db.Exec(`
+	id, err := d.insert(`
 		INSERT INTO images (name, tag, digest, size, created_at)
 		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
 		ON CONFLICT(name, tag) DO UPDATE SET
@@ -348,11 +252,6 @@ func (d *Database) CreateImage(name, tag, digest string, size int64) (*Image, er
 		return nil, err
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return nil, err
-	}
-
 	return &Image{
 		ID:        id,
 		Name:      name,
@@ -365,7 +264,7 @@ func (d *Database) CreateImage(name, tag, digest string, size int64) (*Image, er
 
 func (d *Database) GetImage(name, tag string) (*Image, error) {
 	var img Image
-	err := d.db.QueryRow(`
+	err := d.queryRow(`
 		SELECT id, name, tag, digest, size, created_at
 		FROM images WHERE name = ? AND tag = ?
 	`, name, tag).Scan(&img.ID, &img.Name, &img.Tag, &img.Digest, &img.Size, &img.CreatedAt)
@@ -377,7 +276,7 @@ func (d *Database) GetImage(name, tag string) (*Image, error) {
 
 func (d *Database) GetImageByDigest(digest string) (*Image, error) {
 	var img Image
-	err := d.db.QueryRow(`
+	err := d.queryRow(`
 		SELECT id, name, tag, digest, size, created_at
 		FROM images WHERE digest = ?
 	`, digest).Scan(&img.ID, &img.Name, &img.Tag, &img.Digest, &img.Size, &img.CreatedAt)
@@ -388,7 +287,7 @@ func (d *Database) GetImageByDigest(digest string) (*Image, error) {
 }
 
 func (d *Database) GetAllImages() ([]*Image, error) {
-	rows, err := d.db.Query(`
+	rows, err := d.query(`
 		SELECT id, name, tag, digest, size, created_at
 		FROM images ORDER BY created_at DESC
 	`)
@@ -410,25 +309,107 @@ func (d *Database) GetAllImages() ([]*Image, error) {
 }
 
 func (d *Database) DeleteImage(name, tag string) error {
-	_, err := d.db.Exec(`DELETE FROM images WHERE name = ? AND tag = ?`, name, tag)
+	_, err := d.exec(`DELETE FROM images WHERE name = ? AND tag = ?`, name, tag)
 	return err
 }
 
+// ReplaceImage records an image with its layers and manifest in one transaction, replacing any
+// rows already stored for name:tag.
+func (d *Database) ReplaceImage(name, tag, digest string, size int64, layers []*Layer, manifest string) (*Image, error) {
+	tx, err := d.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.exec(`
+		INSERT INTO images (name, tag, digest, size, created_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(name, tag) DO UPDATE SET
+			digest = excluded.digest,
+			size = excluded.size
+	`, name, tag, digest, size)
+	if err != nil {
+		return nil, err
+	}
+	var img Image
+	err = tx.queryRow(`
+		SELECT id, name, tag, digest, size, created_at
+		FROM images WHERE name = ? AND tag = ?
+	`, name, tag).Scan(&img.ID, &img.Name, &img.Tag, &img.Digest, &img.Size, &img.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.exec(`DELETE FROM layers WHERE image_id = ?`, img.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.exec(`DELETE FROM manifests WHERE image_id = ?`, img.ID); err != nil {
+		return nil, err
+	}
+	for _, l := range layers {
+		_, err := tx.exec(`
+			INSERT INTO layers (image_id, digest, size, media_type)
+			VALUES (?, ?, ?, ?)
+		`, img.ID, l.Digest, l.Size, l.MediaType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = tx.exec(`
+		INSERT INTO manifests (image_id, digest, content)
+		VALUES (?, ?, ?)
+	`, img.ID, digest, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &img, tx.Commit()
+}
+
+// DeleteOrphanedImageRows removes layer and manifest rows whose image no longer exists, returning
+// how many were removed. With dryRun it only counts them.
+func (d *Database) DeleteOrphanedImageRows(dryRun bool) (int64, error) {
+	var total int64
+	for _, table := range []string{"layers", "manifests"} {
+		if dryRun {
+			var n int64
+			err := d.queryRow(`SELECT COUNT(*) FROM ` + table + ` WHERE image_id NOT IN (SELECT id FROM images)`).Scan(&n)
+			if err != nil {
+				return total, err
+			}
+			total += n
+			continue
+		}
+		result, err := d.exec(`DELETE FROM ` + table + ` WHERE image_id NOT IN (SELECT id FROM images)`)
+		if err != nil {
+			return total, err
+		}
+		n, _ := result.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
 func (d *Database) DeleteRepository(name string) error {
 	// Delete from repositories table
-	_, err := d.db.Exec(`DELETE FROM repositories WHERE name = ?`, name)
+	_, err := d.exec(`DELETE FROM repositories WHERE name = ?`, name)
 	if err != nil {
 		return err
 	}
 
 	// Delete all images for this repository
-	_, err = d.db.Exec(`DELETE FROM images WHERE name = ?`, name)
+	_, err = d.exec(`DELETE FROM images WHERE name = ?`, name)
+	if err != nil {
+		return err
+	}
+
+	// Its manifests are gone with it, so there is nothing left to roll back to
+	_, err = d.exec(`DELETE FROM tag_history WHERE name = ?`, name)
 	return err
 }
 
 // Layer operations
 func (d *Database) CreateLayer(imageID int64, digest, mediaType string, size int64) error {
-	_, err := d.db.Exec(`
+	_, err := d.exec(`
 		INSERT INTO layers (image_id, digest, size, media_type)
 		VALUES (?, ?, ?, ?)
 	`, imageID, digest, size, mediaType)
@@ -436,7 +417,7 @@ func (d *Database) CreateLayer(imageID int64, digest, mediaType string, size int
 }
 
 func (d *Database) GetLayersByImageID(imageID int64) ([]*Layer, error) {
-	rows, err := d.db.Query(`
+	rows, err := d.query(`
 		SELECT id, image_id, digest, size, media_type
 		FROM layers WHERE image_id = ?
 	`, imageID)
@@ -459,7 +440,7 @@ func (d *Database) GetLayersByImageID(imageID int64) ([]*Layer, error) {
 
 // Manifest operations
 func (d *Database) CreateManifest(imageID int64, digest, content string) error {
-	_, err := d.db.Exec(`
+	_, err := d.exec(`
 		INSERT INTO manifests (image_id, digest, content)
 		VALUES (?, ?, ?)
 	`, imageID, digest, content)
@@ -468,7 +449,7 @@ func (d *Database) CreateManifest(imageID int64, digest, content string) error {
 
 func (d *Database) GetManifestByImageID(imageID int64) (*Manifest, error) {
 	var manifest Manifest
-	err := d.db.QueryRow(`
+	err := d.queryRow(`
 		SELECT id, image_id, digest, content
 		FROM manifests WHERE image_id = ?
 	`, imageID).Scan(&manifest.ID, &manifest.ImageID, &manifest.Digest, &manifest.Content)
@@ -483,7 +464,7 @@ func (d *Database) GetStatistics() (int, int64, error) {
 	var totalImages int
 	var totalSize int64
 
-	err := d.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM images`).Scan(&totalImages, &totalSize)
+	err := d.queryRow(`SELECT COUNT(*), CAST(COALESCE(SUM(size), 0) AS BIGINT) FROM images`).Scan(&totalImages, &totalSize)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -493,9 +474,10 @@ func (d *Database) GetStatistics() (int, int64, error) {
 
 // Repository operations
 func (d *Database) CreateRepository(name string) (*Repository, error) {
-	_, err := d.db.Exec(`
-		INSERT OR IGNORE INTO repositories (name, created_at)
+	_, err := d.exec(`
+		INSERT INTO repositories (name, created_at)
 		VALUES (?, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO NOTHING
 	`, name)
 	if err != nil {
 		return nil, err
@@ -505,7 +487,7 @@ func (d *Database) CreateRepository(name string) (*Repository, error) {
 
 func (d *Database) GetRepository(name string) (*Repository, error) {
 	var repo Repository
-	err := d.db.QueryRow(`
+	err := d.queryRow(`
 		SELECT id, name, created_at
 		FROM repositories WHERE name = ?
 	`, name).Scan(&repo.ID, &repo.Name, &repo.CreatedAt)
@@ -516,7 +498,7 @@ func (d *Database) GetRepository(name string) (*Repository, error) {
 }
 
 func (d *Database) GetAllRepositories() ([]*Repository, error) {
-	rows, err := d.db.Query(`
+	rows, err := d.query(`
 		SELECT id, name, created_at
 		FROM repositories ORDER BY created_at DESC
 	`)
@@ -538,7 +520,7 @@ func (d *Database) GetAllRepositories() ([]*Repository, error) {
 }
 
 func (d *Database) GetRepositories() ([]string, error) {
-	rows, err := d.db.Query(`SELECT DISTINCT name FROM images ORDER BY name`)
+	rows, err := d.query(`SELECT DISTINCT name FROM images ORDER BY name`)
 	if err != nil {
 		return nil, err
 	}
@@ -557,7 +539,7 @@ func (d *Database) GetRepositories() ([]string, error) {
 }
 
 func (d *Database) GetImagesByRepository(name string) ([]*Image, error) {
-	rows, err := d.db.Query(`
+	rows, err := d.query(`
 		SELECT id, name, tag, digest, size, created_at
 		FROM images WHERE name = ? ORDER BY created_at DESC
 	`, name)
@@ -580,7 +562,7 @@ func (d *Database) GetImagesByRepository(name string) ([]*Image, error) {
 
 // CreateGroup creates a new group in the database
 func (d *Database) CreateGroup(name string) error {
-	_, err := d.db.Exec(`
+	_, err := d.exec(`
 		INSERT INTO groups (name, created_at)
 		VALUES (?, CURRENT_TIMESTAMP)
 	`, name)
@@ -589,9 +571,10 @@ func (d *Database) CreateGroup(name string) error {
 
 // EnsureGroup inserts the group row if missing (idempotent). Used when a push uses group/repo before the group exists in the UI.
 func (d *Database) EnsureGroup(name string) error {
-	_, err := d.db.Exec(`
-		INSERT OR IGNORE INTO groups (name, created_at)
+	_, err := d.exec(`
+		INSERT INTO groups (name, created_at)
 		VALUES (?, CURRENT_TIMESTAMP)
+		ON CONFLICT (name) DO NOTHING
 	`, name)
 	return err
 }
@@ -599,7 +582,7 @@ func (d *Database) EnsureGroup(name string) error {
 // GetGroups returns all unique groups from both the groups table and repository names
 func (d *Database) GetGroups() ([]string, error) {
 	// Get groups from groups table
-	rows, err := d.db.Query(`
+	rows, err := d.query(`
 		SELECT name FROM groups ORDER BY name
 	`)
 	if err != nil {
@@ -625,15 +608,7 @@ func (d *Database) GetGroups() ([]string, error) {
 	rows.Close()
 
 	// Get groups from images table (extracted from repository names)
-	rows, err = d.db.Query(`
-		SELECT DISTINCT 
-			CASE 
-				WHEN name LIKE '%/%' THEN substr(name, 1, instr(name, '/') - 1)
-				ELSE name
-			END as group_name
-		FROM images
-		ORDER BY group_name
-	`)
+	rows, err = d.query(`SELECT DISTINCT name FROM images ORDER BY name`)
 	if err != nil {
 		return nil, err
 	}
@@ -641,11 +616,12 @@ func (d *Database) GetGroups() ([]string, error) {
 
 	// Add groups from images table (avoid duplicates)
 	for rows.Next() {
-		var groupName string
-		err := rows.Scan(&groupName)
+		var name string
+		err := rows.Scan(&name)
 		if err != nil {
 			return nil, err
 		}
+		groupName, _, _ := strings.Cut(name, "/")
 		if !groupMap[groupName] {
 			groups = append(groups, groupName)
 			groupMap[groupName] = true
@@ -658,14 +634,14 @@ func (d *Database) GetGroups() ([]string, error) {
 // GetRepositoriesByGroup returns all repositories that belong to a group: from images
 // and from repositories table, so a repo still appears after all its tags are deleted.
 func (d *Database) GetRepositoriesByGroup(groupName string) ([]string, error) {
-	pattern := groupName + "/%"
-	rows, err := d.db.Query(`
+	filter, prefix := inGroup("name", groupName)
+	rows, err := d.query(`
 		SELECT DISTINCT name FROM (
-			SELECT name FROM images WHERE name LIKE ?
+			SELECT name FROM images WHERE `+filter+`
 			UNION
-			SELECT name FROM repositories WHERE name LIKE ?
-		) ORDER BY name
-	`, pattern, pattern)
+			SELECT name FROM repositories WHERE `+filter+`
+) AS names ORDER BY name
+	`, prefix, prefix)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// dialect holds what differs between the SQL engines. Queries are written once, for SQLite, with
+// ? placeholders; the dialect rewrites them for the engine in use.
+type dialect struct {
+	name   string // "sqlite" or "postgres"
+	driver string // database/sql driver name
+	ddl    *strings.Replacer
+}
+
+var (
+	sqliteDialect = &dialect{name: "sqlite", driver: "sqlite3", ddl: strings.NewReplacer()}
+	// PostgreSQL INTEGER is 32-bit; SQLite's is 64-bit, so sizes and ids map to BIGINT.
+	postgresDialect = &dialect{name: "postgres", driver: "pgx", ddl: strings.NewReplacer(
+		"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+		"INTEGER", "BIGINT",
+		"DATETIME", "TIMESTAMPTZ",
+	)}
+)
+
+// dialectFor picks the engine from the DSN: a postgres:// or postgresql:// URL selects
+// PostgreSQL, anything else is an SQLite file path.
+func dialectFor(dsn string) *dialect {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return postgresDialect
+	}
+	return sqliteDialect
+}
+
+// rebind rewrites ? placeholders as $1, $2, ... for PostgreSQL. A ? inside a quoted string or
+// identifier is left alone; doubled quotes close and reopen the literal, so they need no special case.
+func (dl *dialect) rebind(query string) string {
+	if dl != postgresDialect || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// inGroup returns a filter matching names in column that belong to group, and its argument. It
+// compares the prefix rather than using LIKE, where _ and % in the group name are wildcards.
+func inGroup(column, group string) (string, string) {
+	prefix := group + "/"
+	return "substr(" + column + ", 1, " + strconv.Itoa(utf8.RuneCountInString(prefix)) + ") = ?", prefix
+}
+
+// open connects with the dialect's driver.
+func (dl *dialect) open(dsn string) (*sql.DB, error) {
+	return sql.Open(dl.driver, dsn)
+}
+
+// querier runs rebound queries on the database or on a transaction.
+type querier struct {
+	dl *dialect
+	q  interface {
+		Exec(query string, args ...any) (sql.Result, error)
+		Query(query string, args ...any) (*sql.Rows, error)
+		QueryRow(query string, args ...any) *sql.Row
+	}
+}
+
+func (q querier) exec(query string, args ...any) (sql.Result, error) {
+	return q.q.Exec(q.dl.rebind(query), args...)
+}
+
+func (q querier) query(query string, args ...any) (*sql.Rows, error) {
+	return q.q.Query(q.dl.rebind(query), args...)
+}
+
+func (q querier) queryRow(query string, args ...any) *sql.Row {
+	return q.q.QueryRow(q.dl.rebind(query), args...)
+}
+
+// insert runs an INSERT and returns the id of the row. PostgreSQL drivers do not implement
+// LastInsertId, so there the id comes back through RETURNING.
+func (q querier) insert(query string, args ...any) (int64, error) {
+	if q.dl == postgresDialect {
+		var id int64
+		err := q.queryRow(strings.TrimSpace(query)+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	result, err := q.exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// script runs statements separated by semicolons one at a time; not every driver accepts several
+// statements in one Exec. DDL is translated for the dialect first.
+func (q querier) script(statements string) error {
+	for _, stmt := range strings.Split(q.dl.ddl.Replace(statements), ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := q.q.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tx is a transaction that rebinds like the database it came from.
+type tx struct {
+	querier
+	tx *sql.Tx
+}
+
+func (d *Database) begin() (*tx, error) {
+	t, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &tx{querier: querier{dl: d.dl, q: t}, tx: t}, nil
+}
+
+func (t *tx) Commit() error   { return t.tx.Commit() }
+func (t *tx) Rollback() error { return t.tx.Rollback() }
@@ -0,0 +1,45 @@
+package database
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{`SELECT * FROM images WHERE name = ? AND tag = ?`, `SELECT * FROM images WHERE name = $1 AND tag = $2`},
+		{`UPDATE t SET note = 'why?' WHERE id = ?`, `UPDATE t SET note = 'why?' WHERE id = $1`},
+		{`SELECT 'it''s ?', ? FROM "odd?name" WHERE x = ?`, `SELECT 'it''s ?', $1 FROM "odd?name" WHERE x = $2`},
+		{`SELECT 1`, `SELECT 1`},
+	} {
+		if got := postgresDialect.rebind(c.in); got != c.want {
+			t.Errorf("rebind(%q) = %q, want %q", c.in, got, c.want)
+		}
+		if got := sqliteDialect.rebind(c.in); got != c.in {
+			t.Errorf("sqlite rebind(%q) = %q", c.in, got)
+		}
+	}
+}
+
+func TestInGroupIsLiteral(t *testing.T) {
+	d, err := Open(t.TempDir() + "/registry.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	for _, name := range []string{"my_team/app", "myxteam/app", "my_team2/app", "my%/app"} {
+		if _, err := d.CreateRepository(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.CreateImage(name, "v1", "sha256:"+name, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repos, err := d.GetRepositoriesByGroup("my_team")
+	if err != nil || len(repos) != 1 || repos[0] != "my_team/app" {
+		t.Fatalf("repositories of my_team: %v (%v)", repos, err)
+	}
+	if repos, _ := d.GetRepositoriesByGroup("my%"); len(repos) != 1 {
+		t.Fatalf("repositories of my%%: %v", repos)
+	}
+	if n, err := d.GroupUsage("my_team"); err != nil || n != 100 {
+		t.Fatalf("usage of my_team: %d (%v), want 100", n, err)
+	}
+}
@@ -0,0 +1,67 @@
+package database
+
+import "time"
+
+// Tag history actions.
+const (
+	TagPushed     = "push"
+	TagRolledBack = "rollback"
+	TagDeleted    = "delete"
+)
+
+// TagEvent records a tag being pointed at a digest (push, rollback) or removed (delete, with the
+// digest it pointed at).
+type TagEvent struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Tag       string    `json:"tag"`
+	Digest    string    `json:"digest"`
+	Action    string    `json:"action"`
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RecordTagEvent appends e to the tag's history. A push of the digest the tag already points at
+// is not recorded again.
+func (d *Database) RecordTagEvent(e *TagEvent) error {
+	if e.Action == TagPushed {
+		var last TagEvent
+		err := d.queryRow(`
+			SELECT digest, action FROM tag_history
+			WHERE name = ? AND tag = ? ORDER BY id DESC LIMIT 1
+		`, e.Name, e.Tag).Scan(&last.Digest, &last.Action)
+		if err == nil && last.Digest == e.Digest && last.Action != TagDeleted {
+			return nil
+		}
+	}
+	e.CreatedAt = time.Now().UTC()
+	var err error
+	e.ID, err = d.insert(`
+		INSERT INTO tag_history (name, tag, digest, action, username, ip, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, e.Name, e.Tag, e.Digest, e.Action, e.Username, e.IP, e.CreatedAt)
+	return err
+}
+
+// GetTagHistory returns the events of name:tag, newest first.
+func (d *Database) GetTagHistory(name, tag string) ([]*TagEvent, error) {
+	rows, err := d.query(`
+		SELECT id, name, tag, digest, action, username, ip, created_at
+		FROM tag_history WHERE name = ? AND tag = ? ORDER BY id DESC
+	`, name, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*TagEvent
+	for rows.Next() {
+		var e TagEvent
+		if err := rows.Scan(&e.ID, &e.Name, &e.Tag, &e.Digest, &e.Action, &e.Username, &e.IP, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
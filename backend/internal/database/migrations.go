@@ -0,0 +1,261 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// migration is one numbered schema change. Each is applied in its own transaction and recorded
+// in schema_migrations, so it runs exactly once per database. Never edit or renumber a released
+// migration; append a new one instead. DDL is written for SQLite and translated for PostgreSQL
+// (see dialect), so both engines get the same schema from the same list.
+type migration struct {
+	version int
+	name    string
+	up      func(t *tx) error
+}
+
+// migrations are applied in order. Databases created before versioning have no
+// schema_migrations table and start at version 0: migration 1 uses CREATE TABLE IF NOT EXISTS so
+// it adopts their existing tables, and later migrations check the schema they find.
+var migrations = []migration{
+	{1, "initial schema", execSQL(`
+		CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT DEFAULT 'user',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS images (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(name, tag)
+		);
+		CREATE TABLE IF NOT EXISTS repositories (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE TABLE IF NOT EXISTS layers (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			image_id INTEGER NOT NULL,
+			digest TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			media_type TEXT NOT NULL,
+			FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS manifests (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			image_id INTEGER NOT NULL,
+			digest TEXT NOT NULL,
+			content TEXT NOT NULL,
+			FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS groups (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL UNIQUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)},
+	{2, "images: digest no longer unique", dropUniqueImageDigest},
+	{3, "storage scrubber tables", execSQL(`
+		CREATE TABLE IF NOT EXISTS scrub_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			started_at DATETIME NOT NULL,
+			finished_at DATETIME,
+			status TEXT NOT NULL,
+			target TEXT NOT NULL DEFAULT '',
+			cursor TEXT NOT NULL DEFAULT '',
+			objects INTEGER NOT NULL DEFAULT 0,
+			bytes INTEGER NOT NULL DEFAULT 0,
+			corrupt INTEGER NOT NULL DEFAULT 0,
+			missing INTEGER NOT NULL DEFAULT 0,
+			unreadable INTEGER NOT NULL DEFAULT 0,
+			repaired INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT ''
+		);
+		CREATE TABLE IF NOT EXISTS scrub_findings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER NOT NULL,
+			target TEXT NOT NULL,
+			path TEXT NOT NULL,
+			problem TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT '',
+			repaired_from TEXT NOT NULL DEFAULT '',
+			found_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (run_id) REFERENCES scrub_runs (id) ON DELETE CASCADE
+		);
+	`)},
+	{4, "indexes for image lookups", execSQL(`
+		CREATE INDEX IF NOT EXISTS idx_layers_image_id ON layers (image_id);
+		CREATE INDEX IF NOT EXISTS idx_manifests_image_id ON manifests (image_id);
+		CREATE INDEX IF NOT EXISTS idx_images_digest ON images (digest);
+	`)},
+	{5, "tag history", execSQL(`
+		CREATE TABLE IF NOT EXISTS tag_history (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			action TEXT NOT NULL,
+			username TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_tag_history_name_tag ON tag_history (name, tag);
+		INSERT INTO tag_history (name, tag, digest, action, created_at)
+			SELECT name, tag, digest, 'push', created_at FROM images;
+	`)},
+	{6, "tag rules", execSQL(`
+		CREATE TABLE IF NOT EXISTS tag_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			scope TEXT NOT NULL DEFAULT '',
+			pattern TEXT NOT NULL,
+			pattern_type TEXT NOT NULL DEFAULT 'glob',
+			mode TEXT NOT NULL,
+			roles TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)},
+	{7, "retention policies", execSQL(`
+		CREATE TABLE IF NOT EXISTS retention_policies (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			scope TEXT NOT NULL UNIQUE,
+			keep_last INTEGER NOT NULL DEFAULT 0,
+			keep_days INTEGER NOT NULL DEFAULT 0,
+			keep_patterns TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`)},
+	{8, "storage quotas", execSQL(`
+		CREATE TABLE IF NOT EXISTS quotas (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			kind TEXT NOT NULL,
+			name TEXT NOT NULL,
+			limit_bytes INTEGER NOT NULL,
+			soft_bytes INTEGER NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(kind, name)
+		);
+	`)},
+}
+
+// execSQL returns a migration step that runs statements as one script.
+func execSQL(statements string) func(t *tx) error {
+	return func(t *tx) error {
+		return t.script(statements)
+	}
+}
+
+// dropUniqueImageDigest rebuilds the images table of early databases, whose digest column was
+// UNIQUE so two tags could not share a manifest. SQLite cannot drop a constraint in place.
+// PostgreSQL support came later, so its images table never had the constraint.
+func dropUniqueImageDigest(t *tx) error {
+	if t.dl != sqliteDialect {
+		return nil
+	}
+	var ddl string
+	if err := t.queryRow(`SELECT sql FROM sqlite_master WHERE type='table' AND name='images'`).Scan(&ddl); err != nil {
+		return err
+	}
+	if !strings.Contains(ddl, "digest TEXT NOT NULL UNIQUE") {
+		return nil
+	}
+	return t.script(`
+		CREATE TABLE images_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			digest TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE(name, tag)
+		);
+		INSERT INTO images_new (id, name, tag, digest, size, created_at)
+			SELECT id, name, tag, digest, size, created_at FROM images;
+		DROP TABLE images;
+		ALTER TABLE images_new RENAME TO images;
+	`)
+}
+
+// SchemaVersion is the schema version this binary migrates databases to.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate applies pending migrations. It refuses a database migrated by a newer binary, whose
+// schema this one does not know.
+func (d *Database) migrate() error {
+	err := d.script(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	current, err := d.Version()
+	if err != nil {
+		return err
+	}
+	if latest := SchemaVersion(); current > latest {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d); upgrade refity or restore a backup made by this version", current, latest)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		applied, err := d.apply(m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+		if applied {
+			log.Printf("Database migrated to version %d: %s", m.version, m.name)
+		}
+	}
+	return nil
+}
+
+// migrationLock is the PostgreSQL advisory lock key held while a migration is applied, so
+// replicas starting together apply each migration once.
+const migrationLock = 0x726566697479 // "refity"
+
+// apply runs m unless another process recorded it first, reporting whether it ran.
+func (d *Database) apply(m migration) (bool, error) {
+	t, err := d.begin()
+	if err != nil {
+		return false, err
+	}
+	defer t.Rollback()
+	if t.dl == postgresDialect {
+		if _, err := t.exec(`SELECT pg_advisory_xact_lock(?)`, migrationLock); err != nil {
+			return false, err
+		}
+	}
+	var n int
+	if err := t.queryRow(`SELECT COUNT(*) FROM schema_migrations WHERE version = ?`, m.version).Scan(&n); err != nil || n > 0 {
+		return false, err
+	}
+	if err := m.up(t); err != nil {
+		return false, err
+	}
+	if _, err := t.exec(`INSERT INTO schema_migrations (version, name) VALUES (?, ?)`, m.version, m.name); err != nil {
+		return false, err
+	}
+	return true, t.Commit()
+}
+
+// Version returns the schema version of the database (0 before any migration).
+func (d *Database) Version() (int, error) {
+	var v int
+	err := d.queryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&v)
+	return v, err
+}
@@ -0,0 +1,240 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// seed fills the tables every schema has.
+const seed = `
+	INSERT INTO users (username, password_hash, role) VALUES ('admin', 'x', 'admin');
+	INSERT INTO groups (name) VALUES ('team');
+	INSERT INTO repositories (name) VALUES ('team/app');
+	INSERT INTO images (id, name, tag, digest, size) VALUES (1, 'team/app', 'v1', 'sha256:aaa', 30), (2, 'team/app', 'v2', 'sha256:bbb', 50);
+	INSERT INTO layers (image_id, digest, size, media_type) VALUES (1, 'sha256:l1', 10, 'layer'), (1, 'sha256:l2', 20, 'layer'), (2, 'sha256:l1', 10, 'layer');
+	INSERT INTO manifests (image_id, digest, content) VALUES (1, 'sha256:aaa', '{}'), (2, 'sha256:bbb', '{}');
+`
+
+func openRaw(t *testing.T, path string) *sql.DB {
+	t.Helper()
+	db, err := sqliteDialect.open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// fixture creates a database from a schema in testdata, as an older release left it.
+func fixture(t *testing.T, name string) string {
+	t.Helper()
+	ddl, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "registry.db")
+	db := openRaw(t, path)
+	defer db.Close()
+	if _, err := db.Exec(string(ddl) + seed); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return path
+}
+
+// migratedTo creates a database at schema version n, as the release that introduced migration n
+// left it.
+func migratedTo(t *testing.T, n int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "registry.db")
+	db := openRaw(t, path)
+	defer db.Close()
+	d := &Database{db: db, querier: querier{dl: sqliteDialect, q: db}}
+	all := migrations
+	migrations = migrations[:n]
+	err := d.migrate()
+	migrations = all
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(seed); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// schema describes every table by its columns and every index by name.
+func schema(t *testing.T, db *sql.DB) map[string][]string {
+	t.Helper()
+	rows, err := db.Query(`SELECT type, name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type object struct{ kind, name string }
+	var objects []object
+	for rows.Next() {
+		var o object
+		rows.Scan(&o.kind, &o.name)
+		objects = append(objects, o)
+	}
+	rows.Close()
+	out := make(map[string][]string)
+	for _, o := range objects {
+		if o.kind != "table" {
+			out[o.kind+" "+o.name] = nil
+			continue
+		}
+		cols, err := db.Query(`SELECT name, type, "notnull", COALESCE(dflt_value, ''), pk FROM pragma_table_info(?)`, o.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for cols.Next() {
+			var name, typ, dflt string
+			var notNull, pk int
+			cols.Scan(&name, &typ, &notNull, &dflt, &pk)
+			out["table "+o.name] = append(out["table "+o.name], strings.Join([]string{name, typ, dflt}, " ")+map[bool]string{true: " NOT NULL", false: ""}[notNull == 1]+map[bool]string{true: " PK", false: ""}[pk == 1])
+		}
+		cols.Close()
+	}
+	return out
+}
+
+func freshSchema(t *testing.T) map[string][]string {
+	t.Helper()
+	d, err := Open(filepath.Join(t.TempDir(), "fresh.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	return schema(t, d.db)
+}
+
+// checkUpgraded opens the database at path with migrations and checks it ends up like a fresh
+// one with its rows intact.
+func checkUpgraded(t *testing.T, path string, want map[string][]string) {
+	t.Helper()
+	d, err := Open(path)
+	if err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	defer d.Close()
+	if v, err := d.Version(); err != nil || v != SchemaVersion() {
+		t.Fatalf("version %d (%v), want %d", v, err, SchemaVersion())
+	}
+	if got := schema(t, d.db); !reflect.DeepEqual(got, want) {
+		t.Fatalf("schema differs from a fresh database:\n got %v\nwant %v", got, want)
+	}
+
+	images, err := d.GetImagesByRepository("team/app")
+	if err != nil || len(images) != 2 {
+		t.Fatalf("images: %d, %v", len(images), err)
+	}
+	var layers, manifests int
+	d.queryRow(`SELECT COUNT(*) FROM layers`).Scan(&layers)
+	d.queryRow(`SELECT COUNT(*) FROM manifests`).Scan(&manifests)
+	if layers != 3 || manifests != 2 {
+		t.Fatalf("%d layers and %d manifests after migrating, want 3 and 2", layers, manifests)
+	}
+	// Tags pushed before tag history existed are backfilled; later ones were seeded without it.
+	var history int
+	d.queryRow(`SELECT COUNT(*) FROM tag_history WHERE action = 'push'`).Scan(&history)
+	if history != 0 && history != 2 {
+		t.Fatalf("%d tag history entries, want 2 from the backfill or none", history)
+	}
+	// Tags may share a manifest once migration 2 ran.
+	if _, err := d.exec(`INSERT INTO images (name, tag, digest, size) VALUES ('team/app', 'latest', 'sha256:bbb', 50)`); err != nil {
+		t.Fatalf("second tag for a digest: %v", err)
+	}
+	d.Close()
+
+	// Migrations are recorded: opening again applies none.
+	d, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer d.Close()
+	var n int
+	d.queryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&n)
+	if n != len(migrations) {
+		t.Fatalf("%d migrations recorded, want %d", n, len(migrations))
+	}
+}
+
+func TestMigrateUnversionedFixtures(t *testing.T) {
+	want := freshSchema(t)
+	for _, name := range []string{"unversioned-unique-digest.sql", "unversioned.sql", "unversioned-scrub.sql"} {
+		t.Run(strings.TrimSuffix(name, ".sql"), func(t *testing.T) {
+			checkUpgraded(t, fixture(t, name), want)
+		})
+	}
+}
+
+func TestMigrateEveryVersion(t *testing.T) {
+	want := freshSchema(t)
+	for n := 1; n < len(migrations); n++ {
+		t.Run(migrations[n-1].name, func(t *testing.T) {
+			path := migratedTo(t, n)
+			checkUpgraded(t, path, want)
+			if n >= 5 {
+				return
+			}
+			d, err := Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			var history int
+			d.queryRow(`SELECT COUNT(*) FROM tag_history WHERE name = 'team/app' AND tag IN ('v1', 'v2')`).Scan(&history)
+			if history != 2 {
+				t.Fatalf("%d tag history entries backfilled, want 2", history)
+			}
+		})
+	}
+}
+
+func TestDropUniqueImageDigest(t *testing.T) {
+	path := fixture(t, "unversioned-unique-digest.sql")
+	d, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var ddl string
+	if err := d.queryRow(`SELECT sql FROM sqlite_master WHERE type='table' AND name='images'`).Scan(&ddl); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(ddl, "UNIQUE,") || !strings.Contains(ddl, "UNIQUE(name, tag)") {
+		t.Fatalf("images after migration 2:\n%s", ddl)
+	}
+	// Ids survive the rebuild, so layers and manifests still point at their image.
+	var tag string
+	if err := d.queryRow(`SELECT i.tag FROM layers l JOIN images i ON i.id = l.image_id WHERE l.digest = 'sha256:l2'`).Scan(&tag); err != nil || tag != "v1" {
+		t.Fatalf("layer of v1 belongs to %q (%v)", tag, err)
+	}
+	// The scrub history of tables adopted by migration 3 is kept.
+	d.Close()
+	d, err = Open(fixture(t, "unversioned-scrub.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var objects int
+	if err := d.queryRow(`SELECT objects FROM scrub_runs`).Scan(&objects); err != nil || objects != 3 {
+		t.Fatalf("scrub run after migrating: %d objects (%v)", objects, err)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := migratedTo(t, len(migrations))
+	db := openRaw(t, path)
+	if _, err := db.Exec(`INSERT INTO schema_migrations (version, name) VALUES (?, 'from the future')`, SchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if d, err := Open(path); err == nil {
+		d.Close()
+		t.Fatal("opened a database migrated by a newer build")
+	}
+}
@@ -0,0 +1,4 @@
+package database
+
+// Registers the "pgx" database/sql driver, so every build can use a postgres:// DATABASE_URL.
+import _ "github.com/jackc/pgx/v5/stdlib"
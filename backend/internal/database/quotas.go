@@ -0,0 +1,140 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Quota caps the storage a group's repositories or a user's tags may use.
+type Quota struct {
+	ID         int64     `json:"id"`
+	Kind       string    `json:"kind"`        // "group" or "user"
+	Name       string    `json:"name"`        // group or username
+	LimitBytes int64     `json:"limit_bytes"` // pushes that would go over are rejected
+	SoftBytes  int64     `json:"soft_bytes"`  // pushes that go over are logged as a warning
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SetQuota creates the quota of q.Kind/q.Name or replaces its limits.
+func (d *Database) SetQuota(q *Quota) error {
+	existing, err := d.GetQuota(q.Kind, q.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		q.ID, q.CreatedAt = existing.ID, existing.CreatedAt
+		_, err := d.exec(`UPDATE quotas SET limit_bytes = ?, soft_bytes = ? WHERE id = ?`, q.LimitBytes, q.SoftBytes, q.ID)
+		return err
+	}
+	q.CreatedAt = time.Now().UTC()
+	q.ID, err = d.insert(`
+		INSERT INTO quotas (kind, name, limit_bytes, soft_bytes, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, q.Kind, q.Name, q.LimitBytes, q.SoftBytes, q.CreatedAt)
+	return err
+}
+
+// GetQuota returns the quota of kind/name, or nil if it has none.
+func (d *Database) GetQuota(kind, name string) (*Quota, error) {
+	var q Quota
+	err := d.queryRow(`
+		SELECT id, kind, name, limit_bytes, soft_bytes, created_at
+		FROM quotas WHERE kind = ? AND name = ?
+	`, kind, name).Scan(&q.ID, &q.Kind, &q.Name, &q.LimitBytes, &q.SoftBytes, &q.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+func (d *Database) GetQuotas() ([]*Quota, error) {
+	rows, err := d.query(`
+		SELECT id, kind, name, limit_bytes, soft_bytes, created_at
+		FROM quotas ORDER BY kind, name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var quotas []*Quota
+	for rows.Next() {
+		var q Quota
+		if err := rows.Scan(&q.ID, &q.Kind, &q.Name, &q.LimitBytes, &q.SoftBytes, &q.CreatedAt); err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, &q)
+	}
+	return quotas, rows.Err()
+}
+
+// DeleteQuota removes a quota, reporting whether it existed.
+func (d *Database) DeleteQuota(id int64) (bool, error) {
+	result, err := d.exec(`DELETE FROM quotas WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GroupUsage returns the bytes stored for the repositories of group.
+func (d *Database) GroupUsage(group string) (int64, error) {
+	filter, arg := inGroup("i.name", group)
+	return d.usage(filter, arg)
+}
+
+// UserUsage returns the bytes stored for the tags username pushed or rolled back last.
+func (d *Database) UserUsage(username string) (int64, error) {
+	return d.usage(`(
+		SELECT h.username FROM tag_history h
+		WHERE h.name = i.name AND h.tag = i.tag ORDER BY h.id DESC LIMIT 1
+	) = ?`, username)
+}
+
+// usage sums the size of the images matching filter the way storage holds them: blobs are
+// stored per repository, so a layer counts once per repository however many tags share it.
+// Images without layer rows (multi-arch indexes) count their recorded size once per digest.
+func (d *Database) usage(filter string, arg any) (int64, error) {
+	var n int64
+	err := d.queryRow(`
+		SELECT CAST(COALESCE(SUM(size), 0) AS BIGINT) FROM (
+			SELECT i.name, l.digest, MAX(l.size) AS size
+			FROM layers l JOIN images i ON i.id = l.image_id
+			WHERE `+filter+`
+			GROUP BY i.name, l.digest
+			UNION ALL
+			SELECT i.name, i.digest, MAX(i.size) AS size
+			FROM images i
+			WHERE `+filter+` AND NOT EXISTS (SELECT 1 FROM layers l WHERE l.image_id = i.id)
+			GROUP BY i.name, i.digest
+		) AS stored
+	`, arg, arg).Scan(&n)
+	return n, err
+}
+
+// GetRepositoryLayerDigests returns the digests of the layers recorded for repository name.
+func (d *Database) GetRepositoryLayerDigests(name string) (map[string]bool, error) {
+	rows, err := d.query(`
+		SELECT DISTINCT l.digest FROM layers l JOIN images i ON i.id = l.image_id
+		WHERE i.name = ?
+	`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	digests := make(map[string]bool)
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			return nil, err
+		}
+		digests[digest] = true
+	}
+	return digests, rows.Err()
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"strings"
+	"time"
+)
+
+// RetentionPolicy decides which tags of a group or repository are kept. A tag is kept if any
+// criterion keeps it; the rest are deleted when the policy is applied.
+type RetentionPolicy struct {
+	ID           int64     `json:"id"`
+	Scope        string    `json:"scope"`         // group ("team"), repository ("team/app") or "" for all
+	KeepLast     int       `json:"keep_last"`     // most recently pushed tags kept per repository; 0 = none
+	KeepDays     int       `json:"keep_days"`     // tags pushed within this many days are kept; 0 = none
+	KeepPatterns []string  `json:"keep_patterns"` // tags matching any of these globs are kept
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (d *Database) CreateRetentionPolicy(p *RetentionPolicy) error {
+	p.CreatedAt = time.Now().UTC()
+	var err error
+	p.ID, err = d.insert(`
+		INSERT INTO retention_policies (scope, keep_last, keep_days, keep_patterns, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, p.Scope, p.KeepLast, p.KeepDays, strings.Join(p.KeepPatterns, ","), p.CreatedAt)
+	return err
+}
+
+func (d *Database) GetRetentionPolicies() ([]*RetentionPolicy, error) {
+	rows, err := d.query(`
+		SELECT id, scope, keep_last, keep_days, keep_patterns, created_at
+		FROM retention_policies ORDER BY scope
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []*RetentionPolicy
+	for rows.Next() {
+		var p RetentionPolicy
+		var patterns string
+		if err := rows.Scan(&p.ID, &p.Scope, &p.KeepLast, &p.KeepDays, &patterns, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		p.KeepPatterns = []string{}
+		if patterns != "" {
+			p.KeepPatterns = strings.Split(patterns, ",")
+		}
+		policies = append(policies, &p)
+	}
+	return policies, rows.Err()
+}
+
+// DeleteRetentionPolicy removes a policy, reporting whether it existed.
+func (d *Database) DeleteRetentionPolicy(id int64) (bool, error) {
+	result, err := d.exec(`DELETE FROM retention_policies WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
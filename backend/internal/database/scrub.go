@@ -0,0 +1,134 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// scrubRunsKept is how many scrub runs (with their findings) are kept for the report.
+const scrubRunsKept = 20
+
+// ScrubRun is one pass of the storage scrubber. Target and Cursor record the last object verified,
+// so an interrupted run resumes after it.
+type ScrubRun struct {
+	ID         int64      `json:"id"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Status     string     `json:"status"` // running, completed, cancelled or failed
+	Target     string     `json:"target"`
+	Cursor     string     `json:"cursor"`
+	Objects    int64      `json:"objects"`
+	Bytes      int64      `json:"bytes"`
+	Corrupt    int        `json:"corrupt"`
+	Missing    int        `json:"missing"`
+	Unreadable int        `json:"unreadable"`
+	Repaired   int        `json:"repaired"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// ScrubFinding is an object a scrub run found corrupt, missing or unreadable.
+type ScrubFinding struct {
+	ID           int64     `json:"id"`
+	RunID        int64     `json:"run_id"`
+	Target       string    `json:"target"`
+	Path         string    `json:"path"`
+	Problem      string    `json:"problem"` // corrupt, missing or unreadable
+	Detail       string    `json:"detail"`
+	RepairedFrom string    `json:"repaired_from,omitempty"`
+	FoundAt      time.Time `json:"found_at"`
+}
+
+// CreateScrubRun starts a new run and drops the oldest runs beyond scrubRunsKept.
+func (d *Database) CreateScrubRun() (*ScrubRun, error) {
+	run := &ScrubRun{StartedAt: time.Now().UTC(), Status: "running"}
+	var err error
+	run.ID, err = d.insert(`INSERT INTO scrub_runs (started_at, status) VALUES (?, ?)`, run.StartedAt, run.Status)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.exec(`DELETE FROM scrub_findings WHERE run_id <= ?`, run.ID-scrubRunsKept)
+	if err == nil {
+		_, err = d.exec(`DELETE FROM scrub_runs WHERE id <= ?`, run.ID-scrubRunsKept)
+	}
+	return run, err
+}
+
+// UpdateScrubRun saves the progress, counters and status of run.
+func (d *Database) UpdateScrubRun(run *ScrubRun) error {
+	_, err := d.exec(`
+		UPDATE scrub_runs SET finished_at = ?, status = ?, target = ?, cursor = ?, objects = ?, bytes = ?,
+			corrupt = ?, missing = ?, unreadable = ?, repaired = ?, error = ?
+		WHERE id = ?
+	`, run.FinishedAt, run.Status, run.Target, run.Cursor, run.Objects, run.Bytes,
+		run.Corrupt, run.Missing, run.Unreadable, run.Repaired, run.Error, run.ID)
+	return err
+}
+
+// GetScrubRuns returns the most recent runs, newest first.
+func (d *Database) GetScrubRuns(limit int) ([]*ScrubRun, error) {
+	rows, err := d.query(`
+		SELECT id, started_at, finished_at, status, target, cursor, objects, bytes,
+			corrupt, missing, unreadable, repaired, error
+		FROM scrub_runs ORDER BY id DESC LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []*ScrubRun
+	for rows.Next() {
+		var run ScrubRun
+		var finished sql.NullTime
+		err := rows.Scan(&run.ID, &run.StartedAt, &finished, &run.Status, &run.Target, &run.Cursor, &run.Objects, &run.Bytes,
+			&run.Corrupt, &run.Missing, &run.Unreadable, &run.Repaired, &run.Error)
+		if err != nil {
+			return nil, err
+		}
+		if finished.Valid {
+			run.FinishedAt = &finished.Time
+		}
+		runs = append(runs, &run)
+	}
+	return runs, rows.Err()
+}
+
+// GetLatestScrubRun returns the newest run, or nil if the scrubber never ran.
+func (d *Database) GetLatestScrubRun() (*ScrubRun, error) {
+	runs, err := d.GetScrubRuns(1)
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return runs[0], nil
+}
+
+func (d *Database) CreateScrubFinding(f *ScrubFinding) error {
+	f.FoundAt = time.Now().UTC()
+	var err error
+	f.ID, err = d.insert(`
+		INSERT INTO scrub_findings (run_id, target, path, problem, detail, repaired_from, found_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, f.RunID, f.Target, f.Path, f.Problem, f.Detail, f.RepairedFrom, f.FoundAt)
+	return err
+}
+
+func (d *Database) GetScrubFindings(runID int64) ([]*ScrubFinding, error) {
+	rows, err := d.query(`
+		SELECT id, run_id, target, path, problem, detail, repaired_from, found_at
+		FROM scrub_findings WHERE run_id = ? ORDER BY id
+	`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var findings []*ScrubFinding
+	for rows.Next() {
+		var f ScrubFinding
+		if err := rows.Scan(&f.ID, &f.RunID, &f.Target, &f.Path, &f.Problem, &f.Detail, &f.RepairedFrom, &f.FoundAt); err != nil {
+			return nil, err
+		}
+		findings = append(findings, &f)
+	}
+	return findings, rows.Err()
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TagRule guards the tags of a group or repository whose names match Pattern.
+type TagRule struct {
+	ID          int64     `json:"id"`
+	Scope       string    `json:"scope"`        // group ("team"), repository ("team/app") or "" for all
+	Pattern     string    `json:"pattern"`      // tag names the rule covers
+	PatternType string    `json:"pattern_type"` // glob or regex
+	Mode        string    `json:"mode"`         // immutable or protected
+	Roles       []string  `json:"roles"`        // protected: roles that may still overwrite or delete
+	CreatedAt   time.Time `json:"created_at"`
+
+	Regexp *regexp.Regexp `json:"-"` // compiled regex Pattern, set by tagrule.Validate and tagrule.Load
+}
+
+func (d *Database) CreateTagRule(rule *TagRule) error {
+	rule.CreatedAt = time.Now().UTC()
+	var err error
+	rule.ID, err = d.insert(`
+		INSERT INTO tag_rules (scope, pattern, pattern_type, mode, roles, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, rule.Scope, rule.Pattern, rule.PatternType, rule.Mode, strings.Join(rule.Roles, ","), rule.CreatedAt)
+	return err
+}
+
+func (d *Database) GetTagRules() ([]*TagRule, error) {
+	rows, err := d.query(`
+		SELECT id, scope, pattern, pattern_type, mode, roles, created_at
+		FROM tag_rules ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []*TagRule
+	for rows.Next() {
+		var rule TagRule
+		var roles string
+		if err := rows.Scan(&rule.ID, &rule.Scope, &rule.Pattern, &rule.PatternType, &rule.Mode, &roles, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		rule.Roles = []string{}
+		if roles != "" {
+			rule.Roles = strings.Split(roles, ",")
+		}
+		rules = append(rules, &rule)
+	}
+	return rules, rows.Err()
+}
+
+// DeleteTagRule removes a rule, reporting whether it existed.
+func (d *Database) DeleteTagRule(id int64) (bool, error) {
+	result, err := d.exec(`DELETE FROM tag_rules WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
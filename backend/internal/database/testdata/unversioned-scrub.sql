@@ -0,0 +1,69 @@
+-- The schema before versioning with the storage scrubber tables, which it created at startup.
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	role TEXT DEFAULT 'user',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE images (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	tag TEXT NOT NULL,
+	digest TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(name, tag)
+);
+CREATE TABLE repositories (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE layers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	image_id INTEGER NOT NULL,
+	digest TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	media_type TEXT NOT NULL,
+	FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+);
+CREATE TABLE manifests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	image_id INTEGER NOT NULL,
+	digest TEXT NOT NULL,
+	content TEXT NOT NULL,
+	FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+);
+CREATE TABLE groups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE scrub_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at DATETIME NOT NULL,
+	finished_at DATETIME,
+	status TEXT NOT NULL,
+	target TEXT NOT NULL DEFAULT '',
+	cursor TEXT NOT NULL DEFAULT '',
+	objects INTEGER NOT NULL DEFAULT 0,
+	bytes INTEGER NOT NULL DEFAULT 0,
+	corrupt INTEGER NOT NULL DEFAULT 0,
+	missing INTEGER NOT NULL DEFAULT 0,
+	unreadable INTEGER NOT NULL DEFAULT 0,
+	repaired INTEGER NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE scrub_findings (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	run_id INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	path TEXT NOT NULL,
+	problem TEXT NOT NULL,
+	detail TEXT NOT NULL DEFAULT '',
+	repaired_from TEXT NOT NULL DEFAULT '',
+	found_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY (run_id) REFERENCES scrub_runs (id) ON DELETE CASCADE
+);
+INSERT INTO scrub_runs (started_at, status, objects) VALUES ('2025-01-01 00:00:00', 'done', 3);
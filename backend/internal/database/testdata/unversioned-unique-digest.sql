@@ -0,0 +1,42 @@
+-- The first released schema: one tag per manifest (images.digest UNIQUE), no schema_migrations.
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	role TEXT DEFAULT 'user',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE images (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	tag TEXT NOT NULL,
+	digest TEXT NOT NULL UNIQUE,
+	size INTEGER NOT NULL,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(name, tag)
+);
+CREATE TABLE repositories (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE layers (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	image_id INTEGER NOT NULL,
+	digest TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	media_type TEXT NOT NULL,
+	FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+);
+CREATE TABLE manifests (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	image_id INTEGER NOT NULL,
+	digest TEXT NOT NULL,
+	content TEXT NOT NULL,
+	FOREIGN KEY (image_id) REFERENCES images (id) ON DELETE CASCADE
+);
+CREATE TABLE groups (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE,
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
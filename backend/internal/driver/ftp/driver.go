@@ -0,0 +1,560 @@
+package ftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/textproto"
+	"os"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
+)
+
+func init() {
+	storage.Register("ftp", func(cfg *config.Config) (storage.Driver, error) {
+		return NewStorageDriver(cfg, false)
+	})
+	storage.Register("ftps", func(cfg *config.Config) (storage.Driver, error) {
+		return NewStorageDriver(cfg, true)
+	})
+}
+
+// readRetries is how often Reader resumes (REST) after a broken data connection.
+const readRetries = 3
+
+// StorageDriver stores registry objects on an FTP or FTPS server. All paths are relative to Root
+// (FTP_ROOT); a relative Root is resolved against the login directory so CWD never matters.
+type StorageDriver struct {
+	Pool *ConnPool
+	Root string
+	name string
+}
+
+func NewStorageDriver(cfg *config.Config, useTLS bool) (*StorageDriver, error) {
+	pool, err := NewConnPool(cfg, useTLS)
+	if err != nil {
+		return nil, err
+	}
+	root := cfg.FTPRoot
+	if root == "" {
+		root = "registry"
+	}
+	if !strings.HasPrefix(root, "/") {
+		root = pathpkg.Join(pool.home, root)
+	}
+	name := "ftp"
+	if useTLS {
+		name = "ftps"
+	}
+	return &StorageDriver{Pool: pool, Root: root, name: name}, nil
+}
+
+func (d *StorageDriver) Name() string { return d.name }
+
+// remote maps a registry-relative path to its absolute location under Root.
+func (d *StorageDriver) remote(p string) string {
+	return pathpkg.Join(d.Root, p)
+}
+
+// Close shuts down the connection pool.
+func (d *StorageDriver) Close() error {
+	d.Pool.Close()
+	return nil
+}
+
+// CheckRoot creates Root if needed and verifies it is writable with a probe file.
+func (d *StorageDriver) CheckRoot(ctx context.Context) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Pool.putConn(c)
+	mkdirAll(c, d.Root)
+	if err := c.ChangeDir(d.Root); err != nil {
+		return fmt.Errorf("FTP_ROOT %s: %w", d.Root, err)
+	}
+	probe := pathpkg.Join(d.Root, fmt.Sprintf(".refity-write-test-%d", time.Now().UnixNano()))
+	if err := c.Stor(probe, strings.NewReader("ok")); err != nil {
+		return fmt.Errorf("FTP_ROOT %s: not writable: %w", d.Root, err)
+	}
+	if err := c.Delete(probe); err != nil {
+		log.Printf("[%s] CheckRoot: failed to remove probe %s: %v", d.Pool.label, probe, err)
+	}
+	return nil
+}
+
+func (d *StorageDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rc, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// PutContent stores content under a temp name and renames it over path, so readers never see a
+// partial object.
+func (d *StorageDriver) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	remote := d.remote(path)
+	mkdirAll(c, pathpkg.Dir(remote))
+	var cb func(written, total int64)
+	if len(progressCb) > 0 {
+		cb = progressCb[0]
+	}
+	body := storage.ProgressReader(bytes.NewReader(content), int64(len(content)), cb)
+	tmp := tempName(remote)
+	if err := c.Stor(tmp, body); err != nil {
+		d.Pool.discardConn(c)
+		d.removeTemp(tmp)
+		return mapErr("put", path, err)
+	}
+	defer d.Pool.putConn(c)
+	// RNTO onto an existing file fails on some servers.
+	_ = c.Delete(remote)
+	if err := c.Rename(tmp, remote); err != nil {
+		_ = c.Delete(tmp)
+		return mapErr("put", path, err)
+	}
+	return nil
+}
+
+// partialSuffix marks an upload in progress; such files are hidden from List and Walk.
+const partialSuffix = ".partial"
+
+// tempName returns a temp file next to remote for one upload to it.
+func tempName(remote string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return remote + "." + hex.EncodeToString(b) + partialSuffix
+}
+
+// removeTemp deletes the temp file of a failed upload on a fresh connection: the upload's was
+// discarded, and its context may be what was cancelled.
+func (d *StorageDriver) removeTemp(tmp string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		log.Printf("[%s] Failed to remove temp upload %s: %v", d.Pool.label, tmp, err)
+		return
+	}
+	defer d.Pool.putConn(c)
+	if err := c.Delete(tmp); err != nil && !isNotFound(err) {
+		log.Printf("[%s] Failed to remove temp upload %s: %v", d.Pool.label, tmp, err)
+	}
+}
+
+// Reader streams path from offset using REST. If the data connection breaks mid-transfer it
+// reconnects and resumes from the bytes already delivered.
+func (d *StorageDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	r := &resumableReader{d: d, ctx: ctx, path: path, offset: offset}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Writer streams an upload (STOR, or APPE with appendMode) on a dedicated connection. The
+// transfer completes on Commit/Close; Cancel aborts it and removes the partial file.
+func (d *StorageDriver) Writer(ctx context.Context, path string, appendMode bool) (storage.FileWriter, error) {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	remote := d.remote(path)
+	mkdirAll(c, pathpkg.Dir(remote))
+	var size int64
+	if appendMode {
+		if n, err := c.FileSize(remote); err == nil {
+			size = n
+		}
+	}
+	pr, pw := io.Pipe()
+	w := &fileWriter{d: d, remote: remote, pw: pw, size: size, done: make(chan error, 1)}
+	go func() {
+		var err error
+		if appendMode {
+			err = c.Append(remote, pr)
+		} else {
+			err = c.Stor(remote, pr)
+		}
+		pr.CloseWithError(err)
+		if err != nil {
+			d.Pool.discardConn(c)
+		} else {
+			d.Pool.putConn(c)
+		}
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (d *StorageDriver) Stat(ctx context.Context, path string) (storage.FileInfo, error) {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return storage.FileInfo{}, err
+	}
+	defer d.Pool.putConn(c)
+	remote := d.remote(path)
+
+	// MLST gives type, size and time in one round trip where supported.
+	if e, err := c.GetEntry(remote); err == nil {
+		return toFileInfo(path, e), nil
+	} else if !isNotImplemented(err) && !isNotFound(err) {
+		return storage.FileInfo{}, mapErr("stat", path, err)
+	}
+	if size, err := c.FileSize(remote); err == nil {
+		fi := storage.FileInfo{Path: path, Size: size}
+		if t, err := c.GetTime(remote); err == nil {
+			fi.ModTime = t
+		}
+		return fi, nil
+	}
+	// SIZE fails on directories; CWD tells them apart from missing paths. Paths are absolute, so changing CWD is harmless.
+	if err := c.ChangeDir(remote); err == nil {
+		return storage.FileInfo{Path: path, IsDir: true}, nil
+	}
+	return storage.FileInfo{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+}
+
+func (d *StorageDriver) List(ctx context.Context, path string) ([]string, error) {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Pool.putConn(c)
+	entries, err := listDir(c, d.remote(path))
+	if err != nil {
+		return nil, mapErr("list", path, err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	return names, nil
+}
+
+func (d *StorageDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Pool.putConn(c)
+	dst := d.remote(destPath)
+	mkdirAll(c, pathpkg.Dir(dst))
+	// RNTO onto an existing file fails on some servers.
+	_ = c.Delete(dst)
+	return mapErr("move", sourcePath, c.Rename(d.remote(sourcePath), dst))
+}
+
+func (d *StorageDriver) Delete(ctx context.Context, path string) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Pool.putConn(c)
+	return mapErr("delete", path, c.Delete(d.remote(path)))
+}
+
+func (d *StorageDriver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "", nil
+}
+
+func (d *StorageDriver) Walk(ctx context.Context, path string, f storage.WalkFn, options ...func(*storage.WalkOptions)) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Pool.putConn(c)
+	return walkRecursive(c, d.remote(path), strings.Trim(path, "/"), f)
+}
+
+func (d *StorageDriver) CreateRepositoryFolder(ctx context.Context, repoName string) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Pool.putConn(c)
+	repoPath := d.remote(repoName)
+	for _, sub := range []string{"/blobs/uploads", "/manifests"} {
+		mkdirAll(c, repoPath+sub)
+	}
+	if err := c.ChangeDir(repoPath + "/manifests"); err != nil {
+		return fmt.Errorf("create repo folder: %w", err)
+	}
+	return nil
+}
+
+func (d *StorageDriver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Pool.putConn(c)
+	return mapErr("delete", repoName, c.RemoveDirRecur(d.remote(repoName)))
+}
+
+func (d *StorageDriver) CreateGroupFolder(ctx context.Context, groupName string) error {
+	c, err := d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer d.Pool.putConn(c)
+	dir := d.remote(groupName)
+	mkdirAll(c, dir)
+	return c.ChangeDir(dir)
+}
+
+// ---------------------------------------------------------------------------
+// Reader and writer
+// ---------------------------------------------------------------------------
+
+// resumableReader holds a connection for a RETR and resumes with REST on data-connection errors.
+type resumableReader struct {
+	d      *StorageDriver
+	ctx    context.Context
+	path   string
+	offset int64
+	conn   *ftp.ServerConn
+	resp   *ftp.Response
+	closed bool
+}
+
+func (r *resumableReader) open() error {
+	c, err := r.d.Pool.getConn(r.ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := c.RetrFrom(r.d.remote(r.path), uint64(r.offset))
+	if err != nil {
+		if isNotFound(err) {
+			r.d.Pool.putConn(c)
+		} else {
+			r.d.Pool.discardConn(c)
+		}
+		return mapErr("open", r.path, err)
+	}
+	r.conn, r.resp = c, resp
+	return nil
+}
+
+// release drops the connection of a broken transfer, if a reopen left one set.
+func (r *resumableReader) release() {
+	if r.resp == nil {
+		return
+	}
+	r.resp.Close()
+	r.d.Pool.discardConn(r.conn)
+	r.conn, r.resp = nil, nil
+}
+
+// fail ends the reader with err.
+func (r *resumableReader) fail(err error) error {
+	r.release()
+	r.closed = true
+	return err
+}
+
+func (r *resumableReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("ftp: read after close")
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > readRetries || errors.Is(err, os.ErrNotExist) {
+				return 0, r.fail(err)
+			}
+			log.Printf("[%s] Read %s broken at offset %d (%v), resuming (attempt %d/%d)", r.d.Pool.label, r.path, r.offset, err, attempt, readRetries)
+			r.release()
+			if attempt > 1 {
+				select {
+				case <-r.ctx.Done():
+					return 0, r.fail(r.ctx.Err())
+				case <-time.After(time.Duration(attempt-1) * time.Second):
+				}
+			}
+		}
+		if r.resp == nil {
+			if err = r.open(); err != nil {
+				continue
+			}
+		}
+		n, rerr := r.resp.Read(p)
+		r.offset += int64(n)
+		if rerr == nil || rerr == io.EOF {
+			return n, rerr
+		}
+		if n > 0 {
+			// Hand out what arrived; the next Read resumes from r.offset.
+			r.release()
+			return n, nil
+		}
+		err = rerr
+	}
+}
+
+func (r *resumableReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.resp == nil {
+		return nil
+	}
+	if err := r.resp.Close(); err != nil {
+		// Closing before EOF aborts the transfer and leaves the control connection mid-reply.
+		r.d.Pool.discardConn(r.conn)
+		return nil
+	}
+	r.d.Pool.putConn(r.conn)
+	return nil
+}
+
+// fileWriter feeds the body of an in-flight STOR/APPE.
+type fileWriter struct {
+	d        *StorageDriver
+	remote   string
+	pw       *io.PipeWriter
+	size     int64
+	done     chan error
+	finished bool
+	err      error
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *fileWriter) Size() int64 { return w.size }
+
+func (w *fileWriter) Close() error { return w.Commit(context.Background()) }
+
+// Commit ends the data stream and waits for the server to confirm the transfer.
+func (w *fileWriter) Commit(ctx context.Context) error {
+	if w.finished {
+		return w.err
+	}
+	w.finished = true
+	w.pw.Close()
+	w.err = <-w.done
+	return w.err
+}
+
+// Cancel aborts the transfer and removes whatever the server already stored.
+func (w *fileWriter) Cancel(ctx context.Context) error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+	w.pw.CloseWithError(errors.New("ftp: upload cancelled"))
+	<-w.done
+	c, err := w.d.Pool.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	defer w.d.Pool.putConn(c)
+	_ = c.Delete(w.remote)
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Shared helpers
+// ---------------------------------------------------------------------------
+
+// mkdirAll creates dir and its parents. MKD errors are ignored: they usually mean the directory
+// exists, and a real failure surfaces on the following transfer.
+func mkdirAll(c *ftp.ServerConn, dir string) {
+	if dir == "" || dir == "." || dir == "/" {
+		return
+	}
+	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		current = pathpkg.Join(current, part)
+		_ = c.MakeDir(current)
+	}
+}
+
+// listDir returns the entries of dir without "." and "..".
+func listDir(c *ftp.ServerConn, dir string) ([]*ftp.Entry, error) {
+	entries, err := c.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := entries[:0]
+	for _, e := range entries {
+		if e.Name == "." || e.Name == ".." || e.Name == "" {
+			continue
+		}
+		if e.Type != ftp.EntryTypeFolder && strings.HasSuffix(e.Name, partialSuffix) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+func walkRecursive(c *ftp.ServerConn, remotePath, rel string, fn storage.WalkFn) error {
+	entries, err := listDir(c, remotePath)
+	if err != nil {
+		return mapErr("walk", rel, err)
+	}
+	for _, e := range entries {
+		relChild := pathpkg.Join(rel, e.Name)
+		if err := fn(toFileInfo(relChild, e)); err != nil {
+			return err
+		}
+		if e.Type == ftp.EntryTypeFolder {
+			if err := walkRecursive(c, remotePath+"/"+e.Name, relChild, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func toFileInfo(p string, e *ftp.Entry) storage.FileInfo {
+	return storage.FileInfo{Path: p, Size: int64(e.Size), ModTime: e.Time, IsDir: e.Type == ftp.EntryTypeFolder}
+}
+
+// isNotFound reports a 550 reply ("file unavailable"), which servers use for missing paths.
+func isNotFound(err error) bool {
+	var te *textproto.Error
+	return errors.As(err, &te) && te.Code == ftp.StatusFileUnavailable
+}
+
+func isNotImplemented(err error) bool {
+	var te *textproto.Error
+	return errors.As(err, &te) && (te.Code == ftp.StatusNotImplemented || te.Code == ftp.StatusCommandNotImplemented || te.Code == ftp.StatusBadCommand)
+}
+
+// mapErr turns a 550 reply into an os.ErrNotExist path error so storage.IsNotExist works.
+func mapErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if isNotFound(err) {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+	}
+	return err
+}
@@ -0,0 +1,275 @@
+package ftp
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"refity/backend/internal/config"
+)
+
+var ErrPoolTimeout = errors.New("FTP pool: timed out waiting for a free connection")
+
+// ConnPool keeps logged-in FTP control connections. An FTP connection runs one transfer at a time,
+// so readers and writers hold their connection until closed, like the SFTP DriverPool.
+type ConnPool struct {
+	label    string // "FTP" or "FTPS" in log lines
+	conns    chan *ftp.ServerConn
+	cfg      *config.Config
+	addr     string
+	options  []ftp.DialOption
+	poolSize int
+	timeout  time.Duration
+	alive    atomic.Int32
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	home     string // login directory, used to make relative roots absolute
+}
+
+// NewConnPool dials poolSize connections. With useTLS the control and data channels are encrypted,
+// via AUTH TLS (FTP_TLS_MODE=explicit) or TLS from the first byte (implicit, usually port 990).
+func NewConnPool(cfg *config.Config, useTLS bool) (*ConnPool, error) {
+	poolSize := cfg.FTPPoolSize
+	if poolSize < 1 {
+		poolSize = 1
+	}
+	port := cfg.FTPPort
+	if port == "" {
+		port = "21"
+		if useTLS && cfg.FTPTLSMode == "implicit" {
+			port = "990"
+		}
+	}
+	p := &ConnPool{
+		label:    "FTP",
+		conns:    make(chan *ftp.ServerConn, poolSize),
+		cfg:      cfg,
+		addr:     net.JoinHostPort(cfg.FTPHost, port),
+		poolSize: poolSize,
+		timeout:  cfg.FTPPoolTimeout,
+		stopCh:   make(chan struct{}),
+	}
+	p.options = []ftp.DialOption{
+		ftp.DialWithTimeout(10 * time.Second),
+		ftp.DialWithDisabledEPSV(cfg.FTPDisableEPSV),
+	}
+	if useTLS {
+		p.label = "FTPS"
+		tlsConfig := &tls.Config{
+			ServerName:         cfg.FTPHost,
+			InsecureSkipVerify: cfg.FTPTLSInsecure,
+			// Many servers (vsftpd require_ssl_reuse) only accept data connections that resume the control session.
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+		if cfg.FTPTLSMode == "implicit" {
+			p.options = append(p.options, ftp.DialWithTLS(tlsConfig))
+		} else {
+			p.options = append(p.options, ftp.DialWithExplicitTLS(tlsConfig))
+		}
+		if cfg.FTPTLSInsecure {
+			log.Println("WARNING: FTP_TLS_INSECURE_SKIP_VERIFY is set. FTPS certificate verification is DISABLED.")
+		}
+	}
+
+	connected := 0
+	for i := 0; i < poolSize; i++ {
+		c, err := p.newConn()
+		if err != nil {
+			log.Printf("[%s] Pool: initial connection %d/%d failed: %v", p.label, i+1, poolSize, err)
+			continue
+		}
+		if p.home == "" {
+			if dir, err := c.CurrentDir(); err == nil {
+				p.home = dir
+			}
+		}
+		p.conns <- c
+		connected++
+	}
+	if connected == 0 {
+		return nil, fmt.Errorf("%s pool: no connections established to %s", p.label, p.addr)
+	}
+	if p.home == "" {
+		p.home = "/"
+	}
+	p.alive.Store(int32(connected))
+	log.Printf("[%s] Pool: initialized %d/%d connections", p.label, connected, poolSize)
+
+	if connected < poolSize {
+		go p.fillPool(poolSize - connected)
+	}
+	go p.keepalive()
+	return p, nil
+}
+
+func (p *ConnPool) newConn() (*ftp.ServerConn, error) {
+	c, err := ftp.Dial(p.addr, p.options...)
+	if err != nil {
+		return nil, fmt.Errorf("ftp dial %s: %w", p.addr, err)
+	}
+	if err := c.Login(p.cfg.FTPUsername, p.cfg.FTPPassword); err != nil {
+		c.Quit()
+		return nil, fmt.Errorf("ftp login %s@%s: %w", p.cfg.FTPUsername, p.addr, err)
+	}
+	return c, nil
+}
+
+// fillPool tries to bring the pool back to full capacity in background.
+func (p *ConnPool) fillPool(count int) {
+	for i := 0; i < count; i++ {
+		for attempt := 1; attempt <= 10; attempt++ {
+			select {
+			case <-p.stopCh:
+				return
+			default:
+			}
+			c, err := p.newConn()
+			if err != nil {
+				log.Printf("[%s] Pool: background fill attempt %d failed: %v", p.label, attempt, err)
+				time.Sleep(time.Duration(attempt) * 5 * time.Second)
+				continue
+			}
+			p.conns <- c
+			p.alive.Add(1)
+			break
+		}
+	}
+}
+
+// keepalive sends NOOP on idle connections; FTP servers commonly drop idle control connections after a few minutes.
+func (p *ConnPool) keepalive() {
+	ticker := time.NewTicker(2 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			p.healthCheckAll()
+		}
+	}
+}
+
+func (p *ConnPool) healthCheckAll() {
+	count := len(p.conns)
+	var healthy []*ftp.ServerConn
+	dead := 0
+	for i := 0; i < count; i++ {
+		select {
+		case c := <-p.conns:
+			if err := c.NoOp(); err != nil {
+				c.Quit()
+				dead++
+			} else {
+				healthy = append(healthy, c)
+			}
+		default:
+		}
+	}
+	for _, c := range healthy {
+		p.conns <- c
+	}
+	if dead > 0 {
+		log.Printf("[%s] Pool keepalive: %d dead connections, reconnecting...", p.label, dead)
+		p.alive.Add(-int32(dead))
+		go p.fillPool(dead)
+	}
+}
+
+// getConn checks out a connection, waiting at most the pool timeout or until ctx is done.
+// A stale connection is replaced before being handed out.
+func (p *ConnPool) getConn(ctx context.Context) (*ftp.ServerConn, error) {
+	var timeoutCh <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	var c *ftp.ServerConn
+	select {
+	case c = <-p.conns:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeoutCh:
+		return nil, fmt.Errorf("%w (%d alive, waited %s)", ErrPoolTimeout, p.alive.Load(), p.timeout)
+	case <-p.stopCh:
+		return nil, fmt.Errorf("%s pool: closed", p.label)
+	}
+
+	if err := c.NoOp(); err == nil {
+		return c, nil
+	}
+	log.Printf("[%s] Pool: stale connection on checkout, reconnecting...", p.label)
+	c.Quit()
+	for attempt := 1; attempt <= 3; attempt++ {
+		nc, err := p.newConn()
+		if err == nil {
+			return nc, nil
+		}
+		log.Printf("[%s] Pool: reconnect attempt %d/3 failed: %v", p.label, attempt, err)
+		select {
+		case <-ctx.Done():
+			p.alive.Add(-1)
+			go p.fillPool(1)
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		}
+	}
+	p.alive.Add(-1)
+	go p.fillPool(1)
+	return nil, fmt.Errorf("%s unavailable: reconnect failed", p.label)
+}
+
+// putConn returns a healthy connection to the pool.
+func (p *ConnPool) putConn(c *ftp.ServerConn) {
+	select {
+	case <-p.stopCh:
+		c.Quit()
+		return
+	default:
+	}
+	p.conns <- c
+}
+
+// discardConn drops a connection left in an unknown state (e.g. a transfer failed midway) and replaces it.
+func (p *ConnPool) discardConn(c *ftp.ServerConn) {
+	c.Quit()
+	select {
+	case <-p.stopCh:
+		return
+	default:
+	}
+	nc, err := p.newConn()
+	if err != nil {
+		p.alive.Add(-1)
+		go p.fillPool(1)
+		return
+	}
+	p.conns <- nc
+}
+
+func (p *ConnPool) Close() {
+	p.stopOnce.Do(func() {
+		close(p.stopCh)
+		for {
+			select {
+			case c := <-p.conns:
+				c.Quit()
+			default:
+				return
+			}
+		}
+	})
+}
+
+func (p *ConnPool) Alive() int {
+	return int(p.alive.Load())
+}
@@ -3,27 +3,32 @@ package local
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
 )
 
 var ErrPathTraversal = errors.New("path escapes root")
 
-type StorageDriver interface {
-	Name() string
-	GetContent(ctx context.Context, path string) ([]byte, error)
-	PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error
-	Writer(ctx context.Context, path string) (io.WriteCloser, error)
-	WriterAppend(ctx context.Context, path string) (io.WriteCloser, error)
-	Size(ctx context.Context, path string) (int64, error)
-	List(ctx context.Context, path string) ([]string, error)
-	Move(ctx context.Context, sourcePath string, destPath string) error
-	Delete(ctx context.Context, path string) error
+func init() {
+	storage.Register("local", func(cfg *config.Config) (storage.Driver, error) {
+		if cfg.LocalStorageRoot == "" {
+			return nil, errors.New("LOCAL_STORAGE_ROOT must be set for the local storage driver")
+		}
+		return NewDriver(cfg.LocalStorageRoot), nil
+	})
 }
 
+// Driver stores objects on the local filesystem under root. It serves as upload staging for
+// every backend and as the primary backend for small installs and tests (STORAGE_DRIVER=local).
 type Driver struct {
 	root string
 }
@@ -70,7 +75,9 @@ func (d *Driver) PutContent(ctx context.Context, path string, content []byte, pr
 	return os.WriteFile(fp, content, 0o644)
 }
 
-func (d *Driver) Writer(ctx context.Context, path string) (io.WriteCloser, error) {
+// Writer opens path for writing. With appendMode the file is created if missing and extended,
+// which is how chunked blob uploads (multiple PATCHes) accumulate; otherwise it is truncated.
+func (d *Driver) Writer(ctx context.Context, path string, appendMode bool) (storage.FileWriter, error) {
 	fp, err := d.fullPath(path)
 	if err != nil {
 		return nil, err
@@ -79,36 +86,47 @@ func (d *Driver) Writer(ctx context.Context, path string) (io.WriteCloser, error
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, err
 	}
-	return os.Create(fp)
+	flag := os.O_WRONLY | os.O_CREATE
+	if appendMode {
+		flag |= os.O_APPEND
+	} else {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(fp, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{file: f}, nil
 }
 
-// WriterAppend opens path for appending (creates if not exists). Use for chunked blob uploads (multiple PATCHes).
-func (d *Driver) WriterAppend(ctx context.Context, path string) (io.WriteCloser, error) {
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
 	fp, err := d.fullPath(path)
 	if err != nil {
 		return nil, err
 	}
-	dir := filepath.Dir(fp)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+	f, err := os.Open(fp)
+	if err != nil {
 		return nil, err
 	}
-	return os.OpenFile(fp, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
 }
 
-// Size returns the size in bytes of the file at path. Returns 0, nil if file does not exist.
-func (d *Driver) Size(ctx context.Context, path string) (int64, error) {
+func (d *Driver) Stat(ctx context.Context, path string) (storage.FileInfo, error) {
 	fp, err := d.fullPath(path)
 	if err != nil {
-		return 0, err
+		return storage.FileInfo{}, err
 	}
 	fi, err := os.Stat(fp)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, nil
-		}
-		return 0, err
+		return storage.FileInfo{}, err
 	}
-	return fi.Size(), nil
+	return storage.FileInfo{Path: path, Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()}, nil
 }
 
 func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
@@ -149,4 +167,98 @@ func (d *Driver) Delete(ctx context.Context, path string) error {
 		return err
 	}
 	return os.RemoveAll(fp)
-} 
\ No newline at end of file
+} 
+
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "", nil
+}
+
+func (d *Driver) Walk(ctx context.Context, path string, f storage.WalkFn, options ...func(*storage.WalkOptions)) error {
+	fp, err := d.fullPath(path)
+	if err != nil {
+		return err
+	}
+	rootAbs, err := filepath.Abs(d.root)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(fp, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == fp {
+			return nil
+		}
+		abs, _ := filepath.Abs(p)
+		rel, err := filepath.Rel(rootAbs, abs)
+		if err != nil {
+			return err
+		}
+		return f(storage.FileInfo{Path: filepath.ToSlash(rel), Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()})
+	})
+}
+
+func (d *Driver) CreateRepositoryFolder(ctx context.Context, repoName string) error {
+	for _, sub := range []string{"", "/blobs", "/blobs/uploads", "/manifests"} {
+		fp, err := d.fullPath(repoName + sub)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(fp, 0o755); err != nil {
+			return fmt.Errorf("create %s: %w", repoName+sub, err)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
+	return d.Delete(ctx, repoName)
+}
+
+func (d *Driver) CreateGroupFolder(ctx context.Context, groupName string) error {
+	fp, err := d.fullPath(groupName)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(fp, 0o755)
+}
+
+// CheckRoot creates the root directory if needed and verifies it is writable.
+func (d *Driver) CheckRoot(ctx context.Context) error {
+	if err := os.MkdirAll(d.root, 0o755); err != nil {
+		return fmt.Errorf("local storage root %s: %w", d.root, err)
+	}
+	probe := filepath.Join(d.root, fmt.Sprintf(".refity-write-test-%d", time.Now().UnixNano()))
+	if err := os.WriteFile(probe, []byte("ok"), 0o644); err != nil {
+		return fmt.Errorf("local storage root %s: not writable: %w", d.root, err)
+	}
+	return os.Remove(probe)
+}
+
+// fileWriter adapts *os.File to storage.FileWriter. Writes land in place, so Commit only closes.
+type fileWriter struct {
+	file   *os.File
+	closed bool
+}
+
+func (fw *fileWriter) Write(p []byte) (int, error) { return fw.file.Write(p) }
+func (fw *fileWriter) Size() int64 {
+	fi, err := fw.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+func (fw *fileWriter) Close() error {
+	if fw.closed {
+		return nil
+	}
+	fw.closed = true
+	return fw.file.Close()
+}
+func (fw *fileWriter) Cancel(ctx context.Context) error {
+	name := fw.file.Name()
+	fw.Close()
+	return os.Remove(name)
+}
+func (fw *fileWriter) Commit(ctx context.Context) error { return fw.Close() }
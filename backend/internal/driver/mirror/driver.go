@@ -0,0 +1,517 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
+)
+
+// healthProbeInterval is how often replicas with recent failures are probed to clear their state.
+const healthProbeInterval = 30 * time.Second
+
+func init() {
+	storage.Register("mirror", func(cfg *config.Config) (storage.Driver, error) {
+		var replicas []*Replica
+		for _, entry := range cfg.MirrorBackends {
+			name, driver := config.ParseMirrorBackend(entry)
+			d, err := storage.New(driver, cfg.ForReplica(name, driver))
+			if err != nil {
+				closeReplicas(replicas)
+				return nil, fmt.Errorf("mirror replica %s: %w", name, err)
+			}
+			replicas = append(replicas, &Replica{Name: name, Driver: d})
+		}
+		return New(replicas, cfg.MirrorWriteQuorum, cfg.MirrorRepairInterval)
+	})
+}
+
+// Replica is one backend of a mirror with its observed health.
+type Replica struct {
+	Name   string
+	Driver storage.Driver
+
+	failures atomic.Int32 // consecutive failed operations; 0 = healthy
+	latency  atomic.Int64 // moving average of successful read latency, in ns
+}
+
+// Healthy reports whether the last operation on the replica succeeded.
+func (r *Replica) Healthy() bool { return r.failures.Load() == 0 }
+
+func (r *Replica) observe(start time.Time, err error) {
+	if err != nil && !storage.IsNotExist(err) {
+		if r.failures.Add(1) == 1 {
+			log.Printf("[Mirror] Replica %s marked unhealthy: %v", r.Name, err)
+		}
+		return
+	}
+	if r.failures.Swap(0) > 0 {
+		log.Printf("[Mirror] Replica %s healthy again", r.Name)
+	}
+	elapsed := int64(time.Since(start))
+	old := r.latency.Load()
+	if old == 0 {
+		r.latency.Store(elapsed)
+	} else {
+		r.latency.Store(old + (elapsed-old)/8)
+	}
+}
+
+// Driver replicates every write to all replicas and serves reads from the healthiest one.
+// A write succeeds once Quorum replicas accepted it; replicas that missed it are fixed by Repair.
+type Driver struct {
+	Replicas []*Replica
+	Quorum   int
+
+	mu      sync.Mutex
+	dirty   map[string]bool      // paths a replica failed to write since the last repair
+	deleted map[string]time.Time // recent deletes, so repair does not resurrect them
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// New wraps replicas. quorum <= 0 means every replica must accept a write. With repairInterval > 0
+// a background job copies missing objects between replicas.
+func New(replicas []*Replica, quorum int, repairInterval time.Duration) (*Driver, error) {
+	if len(replicas) == 0 {
+		return nil, errors.New("mirror: no replicas")
+	}
+	if quorum <= 0 || quorum > len(replicas) {
+		quorum = len(replicas)
+	}
+	d := &Driver{
+		Replicas: replicas,
+		Quorum:   quorum,
+		dirty:    make(map[string]bool),
+		deleted:  make(map[string]time.Time),
+		stopCh:   make(chan struct{}),
+	}
+	go d.probeLoop()
+	if repairInterval > 0 {
+		go d.repairLoop(repairInterval)
+	}
+	return d, nil
+}
+
+func (d *Driver) Name() string {
+	names := make([]string, len(d.Replicas))
+	for i, r := range d.Replicas {
+		names[i] = r.Name + ":" + r.Driver.Name()
+	}
+	return "mirror(" + strings.Join(names, ",") + ")"
+}
+
+// Close stops background jobs and closes replicas that hold connections.
+func (d *Driver) Close() error {
+	d.stopOnce.Do(func() { close(d.stopCh) })
+	closeReplicas(d.Replicas)
+	return nil
+}
+
+func closeReplicas(replicas []*Replica) {
+	for _, r := range replicas {
+		if c, ok := r.Driver.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// CheckRoot requires at least Quorum replicas to pass their own root check.
+func (d *Driver) CheckRoot(ctx context.Context) error {
+	ok := 0
+	var errs []string
+	for _, r := range d.Replicas {
+		rc, isChecker := r.Driver.(storage.RootChecker)
+		if !isChecker {
+			ok++
+			continue
+		}
+		start := time.Now()
+		err := rc.CheckRoot(ctx)
+		r.observe(start, err)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", r.Name, err))
+			continue
+		}
+		ok++
+	}
+	if ok < d.Quorum {
+		return fmt.Errorf("mirror: only %d of %d replicas usable, quorum is %d: %s", ok, len(d.Replicas), d.Quorum, strings.Join(errs, "; "))
+	}
+	for _, e := range errs {
+		log.Printf("[Mirror] WARNING: replica %s", e)
+	}
+	return nil
+}
+
+// Capacity reports the replica with the least free space: writes fail once it is full.
+func (d *Driver) Capacity(ctx context.Context) (storage.Capacity, error) {
+	var tightest *storage.Capacity
+	for _, r := range d.Replicas {
+		cr, ok := r.Driver.(storage.CapacityReporter)
+		if !ok {
+			continue
+		}
+		c, err := cr.Capacity(ctx)
+		if err != nil {
+			if !errors.Is(err, storage.ErrNoCapacity) {
+				log.Printf("[Mirror] Capacity of replica %s: %v", r.Name, err)
+			}
+			continue
+		}
+		if tightest == nil || c.Free < tightest.Free {
+			tightest = &c
+		}
+	}
+	if tightest == nil {
+		return storage.Capacity{}, storage.ErrNoCapacity
+	}
+	return *tightest, nil
+}
+
+// ---------------------------------------------------------------------------
+// Reads: healthiest replica first, fail over on error
+// ---------------------------------------------------------------------------
+
+// ordered returns replicas healthiest first: fewest consecutive failures, then lowest latency.
+func (d *Driver) ordered() []*Replica {
+	out := append([]*Replica(nil), d.Replicas...)
+	sort.SliceStable(out, func(i, j int) bool {
+		fi, fj := out[i].failures.Load(), out[j].failures.Load()
+		if fi != fj {
+			return fi < fj
+		}
+		return out[i].latency.Load() < out[j].latency.Load()
+	})
+	return out
+}
+
+// read runs fn on each replica in health order until one succeeds. If none does, a not-exist
+// error wins over others so callers still see 404s for missing objects.
+func (d *Driver) read(path string, fn func(r *Replica) error) error {
+	var notExist, lastErr error
+	for i, r := range d.ordered() {
+		start := time.Now()
+		err := fn(r)
+		r.observe(start, err)
+		if err == nil {
+			if i > 0 || notExist != nil {
+				d.markDirty(path)
+			}
+			return nil
+		}
+		if storage.IsNotExist(err) {
+			notExist = err
+		} else {
+			lastErr = err
+			log.Printf("[Mirror] Read %s from %s failed, failing over: %v", path, r.Name, err)
+		}
+	}
+	if notExist != nil {
+		return notExist
+	}
+	return lastErr
+}
+
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	var out []byte
+	err := d.read(path, func(r *Replica) error {
+		b, err := r.Driver.GetContent(ctx, path)
+		out = b
+		return err
+	})
+	return out, err
+}
+
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	var out io.ReadCloser
+	err := d.read(path, func(r *Replica) error {
+		rc, err := r.Driver.Reader(ctx, path, offset)
+		out = rc
+		return err
+	})
+	return out, err
+}
+
+func (d *Driver) Stat(ctx context.Context, path string) (storage.FileInfo, error) {
+	var out storage.FileInfo
+	err := d.read(path, func(r *Replica) error {
+		fi, err := r.Driver.Stat(ctx, path)
+		out = fi
+		return err
+	})
+	return out, err
+}
+
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	var out []string
+	err := d.read("", func(r *Replica) error {
+		names, err := r.Driver.List(ctx, path)
+		out = names
+		return err
+	})
+	return out, err
+}
+
+func (d *Driver) Walk(ctx context.Context, path string, f storage.WalkFn, options ...func(*storage.WalkOptions)) error {
+	best := d.ordered()[0]
+	return best.Driver.Walk(ctx, path, f, options...)
+}
+
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	return d.ordered()[0].Driver.RedirectURL(r, path)
+}
+
+// ---------------------------------------------------------------------------
+// Writes: every replica, succeed at quorum
+// ---------------------------------------------------------------------------
+
+// write runs fn on all replicas concurrently and succeeds once Quorum of them did.
+// Replicas that failed while quorum was met are remembered for repair under path.
+func (d *Driver) write(op, path string, fn func(r *Replica) error) error {
+	errs := make([]error, len(d.Replicas))
+	var wg sync.WaitGroup
+	for i, r := range d.Replicas {
+		wg.Add(1)
+		go func(i int, r *Replica) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = fn(r)
+			r.observe(start, errs[i])
+		}(i, r)
+	}
+	wg.Wait()
+	return d.quorumResult(op, path, errs)
+}
+
+func (d *Driver) quorumResult(op, path string, errs []error) error {
+	ok := 0
+	var failed []string
+	var firstErr error
+	for i, err := range errs {
+		if err == nil {
+			ok++
+			continue
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed = append(failed, fmt.Sprintf("%s: %v", d.Replicas[i].Name, err))
+	}
+	if ok < d.Quorum {
+		if ok == 0 {
+			return firstErr
+		}
+		return fmt.Errorf("mirror: %s %s reached %d of %d replicas, quorum is %d: %s", op, path, ok, len(d.Replicas), d.Quorum, strings.Join(failed, "; "))
+	}
+	if len(failed) > 0 {
+		log.Printf("[Mirror] %s %s succeeded on %d/%d replicas; will repair: %s", op, path, ok, len(d.Replicas), strings.Join(failed, "; "))
+		if path != "" {
+			d.markDirty(path)
+		}
+	}
+	return nil
+}
+
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
+	var once sync.Once
+	return d.write("put", path, func(r *Replica) error {
+		// Report progress from a single replica; the others move in lockstep closely enough.
+		var cbs []func(written, total int64)
+		once.Do(func() { cbs = progressCb })
+		return r.Driver.PutContent(ctx, path, content, cbs...)
+	})
+}
+
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	err := d.write("move", destPath, func(r *Replica) error {
+		return r.Driver.Move(ctx, sourcePath, destPath)
+	})
+	if err == nil {
+		d.markDeleted(sourcePath)
+	}
+	return err
+}
+
+// Delete treats a path already missing on a replica as deleted there.
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	d.markDeleted(path)
+	errs := make([]error, len(d.Replicas))
+	notExist := 0
+	var wg sync.WaitGroup
+	for i, r := range d.Replicas {
+		wg.Add(1)
+		go func(i int, r *Replica) {
+			defer wg.Done()
+			start := time.Now()
+			errs[i] = r.Driver.Delete(ctx, path)
+			r.observe(start, errs[i])
+		}(i, r)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if storage.IsNotExist(err) {
+			notExist++
+			errs[i] = nil
+		}
+	}
+	if notExist == len(d.Replicas) {
+		return &os.PathError{Op: "delete", Path: path, Err: os.ErrNotExist}
+	}
+	return d.quorumResult("delete", "", errs)
+}
+
+func (d *Driver) CreateRepositoryFolder(ctx context.Context, repoName string) error {
+	return d.write("create repository folder", "", func(r *Replica) error {
+		return r.Driver.CreateRepositoryFolder(ctx, repoName)
+	})
+}
+
+func (d *Driver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
+	d.markDeleted(repoName)
+	return d.write("delete repository folder", "", func(r *Replica) error {
+		err := r.Driver.DeleteRepositoryFolder(ctx, repoName)
+		if storage.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+func (d *Driver) CreateGroupFolder(ctx context.Context, groupName string) error {
+	return d.write("create group folder", "", func(r *Replica) error {
+		return r.Driver.CreateGroupFolder(ctx, groupName)
+	})
+}
+
+// Writer opens a writer on every replica and fans each Write out to them. A replica whose
+// writer fails is dropped; Commit succeeds if Quorum replicas committed.
+func (d *Driver) Writer(ctx context.Context, path string, appendMode bool) (storage.FileWriter, error) {
+	mw := &multiWriter{d: d, ctx: ctx, path: path, writers: make([]storage.FileWriter, len(d.Replicas)), errs: make([]error, len(d.Replicas))}
+	for i, r := range d.Replicas {
+		w, err := r.Driver.Writer(ctx, path, appendMode)
+		if err != nil {
+			r.observe(time.Now(), err)
+		}
+		mw.writers[i], mw.errs[i] = w, err
+	}
+	if mw.alive() < d.Quorum {
+		mw.Cancel(ctx)
+		return nil, d.quorumResult("open writer", path, mw.errs)
+	}
+	return mw, nil
+}
+
+type multiWriter struct {
+	d       *Driver
+	ctx     context.Context
+	path    string
+	writers []storage.FileWriter
+	errs    []error
+	size    int64
+	done    bool
+}
+
+func (mw *multiWriter) alive() int {
+	n := 0
+	for _, err := range mw.errs {
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (mw *multiWriter) Write(p []byte) (int, error) {
+	for i, w := range mw.writers {
+		if mw.errs[i] != nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			mw.errs[i] = err
+			mw.d.Replicas[i].observe(time.Now(), err)
+			w.Cancel(mw.ctx)
+		}
+	}
+	if mw.alive() < mw.d.Quorum {
+		return 0, mw.d.quorumResult("write", mw.path, mw.errs)
+	}
+	mw.size += int64(len(p))
+	return len(p), nil
+}
+
+func (mw *multiWriter) Size() int64 { return mw.size }
+
+func (mw *multiWriter) Close() error { return mw.Commit(mw.ctx) }
+
+func (mw *multiWriter) Commit(ctx context.Context) error {
+	if mw.done {
+		return nil
+	}
+	mw.done = true
+	for i, w := range mw.writers {
+		if mw.errs[i] != nil {
+			continue
+		}
+		start := time.Now()
+		mw.errs[i] = w.Commit(ctx)
+		mw.d.Replicas[i].observe(start, mw.errs[i])
+	}
+	return mw.d.quorumResult("write", mw.path, mw.errs)
+}
+
+func (mw *multiWriter) Cancel(ctx context.Context) error {
+	if mw.done {
+		return nil
+	}
+	mw.done = true
+	for i, w := range mw.writers {
+		if w != nil && mw.errs[i] == nil {
+			w.Cancel(ctx)
+		}
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Health probing
+// ---------------------------------------------------------------------------
+
+// probeLoop lists the root of unhealthy replicas so they return to the front once they recover,
+// then repairs paths that a replica missed while it was failing.
+func (d *Driver) probeLoop() {
+	ticker := time.NewTicker(healthProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+			for _, r := range d.Replicas {
+				if r.Healthy() {
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), healthProbeInterval)
+				start := time.Now()
+				_, err := r.Driver.List(ctx, "")
+				cancel()
+				r.observe(start, err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*healthProbeInterval)
+			d.repairDirty(ctx)
+			cancel()
+		}
+	}
+}
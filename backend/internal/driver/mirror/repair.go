@@ -0,0 +1,260 @@
+package mirror
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"refity/backend/internal/storage"
+)
+
+// RepairReport summarizes one repair pass.
+type RepairReport struct {
+	Scanned int // distinct files seen across replicas
+	Copied  int // files copied to a replica that lacked them (or had a different size)
+	Failed  int // copies that failed; retried on the next pass
+	Elapsed time.Duration
+}
+
+func (d *Driver) markDirty(path string) {
+	if path == "" {
+		return
+	}
+	d.mu.Lock()
+	d.dirty[path] = true
+	d.mu.Unlock()
+}
+
+// markDeleted records a delete so a repair pass that listed the path earlier does not copy it back.
+func (d *Driver) markDeleted(path string) {
+	d.mu.Lock()
+	d.deleted[strings.Trim(path, "/")] = time.Now()
+	delete(d.dirty, path)
+	d.mu.Unlock()
+}
+
+// repairDirty copies the paths a replica missed at write time, without a full walk. Paths stay
+// dirty while any replica is unreachable.
+func (d *Driver) repairDirty(ctx context.Context) {
+	d.mu.Lock()
+	paths := make([]string, 0, len(d.dirty))
+	for p := range d.dirty {
+		paths = append(paths, p)
+	}
+	d.mu.Unlock()
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+		start := time.Now()
+		sizes := make([]int64, len(d.Replicas))
+		state := make([]error, len(d.Replicas))
+		src := -1
+		for i, r := range d.Replicas {
+			fi, err := r.Driver.Stat(ctx, path)
+			state[i] = err
+			if err == nil {
+				sizes[i] = fi.Size
+				if src < 0 || fi.Size > sizes[src] {
+					src = i
+				}
+			}
+		}
+		ok := true
+		for i := range d.Replicas {
+			if src < 0 || i == src || d.deletedSince(path, start) {
+				break
+			}
+			switch {
+			case state[i] == nil && sizes[i] == sizes[src]:
+				continue
+			case state[i] != nil && !storage.IsNotExist(state[i]):
+				ok = false // unreachable; retry once it is back
+				continue
+			}
+			if err := d.copyObject(ctx, d.Replicas[src], d.Replicas[i], path); err != nil {
+				log.Printf("[Mirror] Repair: copy %s %s -> %s failed: %v", path, d.Replicas[src].Name, d.Replicas[i].Name, err)
+				ok = false
+				continue
+			}
+			log.Printf("[Mirror] Repaired %s on %s", path, d.Replicas[i].Name)
+		}
+		if ok {
+			d.mu.Lock()
+			delete(d.dirty, path)
+			d.mu.Unlock()
+		}
+	}
+}
+
+// deletedSince reports whether path, or a folder containing it, was deleted after t.
+func (d *Driver) deletedSince(path string, t time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for p := strings.Trim(path, "/"); ; {
+		if at, ok := d.deleted[p]; ok && !at.Before(t) {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
+
+func (d *Driver) repairLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-d.stopCh:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			rep, err := d.Repair(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("[Mirror] Repair failed: %v", err)
+				continue
+			}
+			if rep.Copied > 0 || rep.Failed > 0 {
+				log.Printf("[Mirror] Repair: scanned %d files, copied %d, failed %d in %s", rep.Scanned, rep.Copied, rep.Failed, rep.Elapsed.Round(time.Second))
+			}
+		}
+	}
+}
+
+// Repair walks every healthy replica and copies each file that is missing on a replica, or has
+// a different size there, from one that has it. Replicas that cannot be walked are skipped.
+func (d *Driver) Repair(ctx context.Context) (RepairReport, error) {
+	start := time.Now()
+	var rep RepairReport
+
+	// inventory[i] maps path -> size for replica i; nil if the replica could not be listed.
+	inventory := make([]map[string]int64, len(d.Replicas))
+	all := make(map[string]bool)
+	listed := 0
+	for i, r := range d.Replicas {
+		files := make(map[string]int64)
+		err := r.Driver.Walk(ctx, "", func(fi storage.FileInfo) error {
+			if !fi.IsDir {
+				files[fi.Path] = fi.Size
+				all[fi.Path] = true
+			}
+			return nil
+		})
+		if err != nil && !storage.IsNotExist(err) {
+			log.Printf("[Mirror] Repair: cannot list replica %s, skipping it: %v", r.Name, err)
+			continue
+		}
+		inventory[i] = files
+		listed++
+	}
+	if listed < 2 {
+		return rep, fmt.Errorf("mirror repair: need at least two reachable replicas, have %d", listed)
+	}
+	rep.Scanned = len(all)
+
+	for path := range all {
+		if ctx.Err() != nil {
+			return rep, ctx.Err()
+		}
+		if d.deletedSince(path, start) {
+			continue
+		}
+		// Source: the healthiest replica that has the file; the most common size wins on disagreement.
+		src, size := d.pickSource(inventory, path)
+		if src < 0 {
+			continue
+		}
+		for i, inv := range inventory {
+			if inv == nil || i == src {
+				continue
+			}
+			if got, ok := inv[path]; ok && got == size {
+				continue
+			}
+			if err := d.copyObject(ctx, d.Replicas[src], d.Replicas[i], path); err != nil {
+				log.Printf("[Mirror] Repair: copy %s %s -> %s failed: %v", path, d.Replicas[src].Name, d.Replicas[i].Name, err)
+				rep.Failed++
+				continue
+			}
+			rep.Copied++
+		}
+	}
+
+	d.mu.Lock()
+	if rep.Failed == 0 && listed == len(d.Replicas) {
+		d.dirty = make(map[string]bool)
+	}
+	for p, at := range d.deleted {
+		if at.Before(start) {
+			delete(d.deleted, p)
+		}
+	}
+	d.mu.Unlock()
+	rep.Elapsed = time.Since(start)
+	return rep, nil
+}
+
+func (d *Driver) pickSource(inventory []map[string]int64, path string) (int, int64) {
+	votes := make(map[int64]int)
+	for _, inv := range inventory {
+		if size, ok := inv[path]; ok {
+			votes[size]++
+		}
+	}
+	var size int64
+	best := 0
+	for s, n := range votes {
+		if n > best || (n == best && s > size) {
+			size, best = s, n
+		}
+	}
+	order := d.ordered()
+	for _, r := range order {
+		for i, cand := range d.Replicas {
+			if cand != r || inventory[i] == nil {
+				continue
+			}
+			if got, ok := inventory[i][path]; ok && got == size {
+				return i, size
+			}
+		}
+	}
+	return -1, 0
+}
+
+// copyObject streams path from src to dst, re-checking the source first so a file deleted
+// since the walk is not recreated.
+func (d *Driver) copyObject(ctx context.Context, src, dst *Replica, path string) error {
+	if _, err := src.Driver.Stat(ctx, path); err != nil {
+		return err
+	}
+	rc, err := src.Driver.Reader(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w, err := dst.Driver.Writer(ctx, path, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		w.Cancel(ctx)
+		return err
+	}
+	return w.Commit(ctx)
+}
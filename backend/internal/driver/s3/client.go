@@ -0,0 +1,455 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client is a minimal S3 REST client signing requests with AWS Signature Version 4.
+// It covers the calls the driver needs and works with AWS S3 and S3-compatible servers (MinIO, Ceph, Wasabi, R2...).
+type client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	http      *http.Client
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Error is the XML error body returned by S3.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Key        string `xml:"Key"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s (HTTP %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// Is makes errors.Is(err, os.ErrNotExist) true for missing keys, like the other drivers.
+func (e *s3Error) Is(target error) bool {
+	return target == os.ErrNotExist && (e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey")
+}
+
+func (c *client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	escapedKey := uriEncode(key, false)
+	if c.pathStyle {
+		u.Path = "/" + c.bucket + "/" + key
+		u.RawPath = "/" + c.bucket + "/" + escapedKey
+	} else {
+		u.Host = c.bucket + "." + c.endpoint.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escapedKey
+	}
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	return &u
+}
+
+// do sends a signed request for key (empty key = bucket). Non-2xx responses are returned as *s3Error.
+func (c *client) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := c.objectURL(key, query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	c.sign(req, time.Now().UTC())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, parseError(resp)
+	}
+	return resp, nil
+}
+
+func parseError(resp *http.Response) error {
+	e := &s3Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if len(data) > 0 {
+		_ = xml.Unmarshal(data, e)
+	}
+	return e
+}
+
+// sign adds SigV4 Authorization headers. The payload is sent unsigned so bodies can be streamed.
+func (c *client) sign(req *http.Request, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", unsignedPayload)
+	req.Host = req.URL.Host
+
+	var names []string
+	canonHeaders := map[string]string{"host": req.URL.Host}
+	names = append(names, "host")
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-md5" || lk == "content-type" || lk == "range" {
+			canonHeaders[lk] = strings.TrimSpace(strings.Join(vs, ","))
+			names = append(names, lk)
+		}
+	}
+	sort.Strings(names)
+	var hb strings.Builder
+	for _, n := range names {
+		hb.WriteString(n + ":" + canonHeaders[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		hb.String(),
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := c.scope(t)
+	signature := c.signature(t, amzDate, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a query-signed URL for method on key, valid for expires.
+func (c *client) presign(method, key string, expires time.Duration, t time.Time) string {
+	amzDate := t.Format("20060102T150405Z")
+	scope := c.scope(t)
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", c.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u := c.objectURL(key, q)
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	signature := c.signature(t, amzDate, scope, canonicalRequest)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+func (c *client) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + c.region + "/s3/aws4_request"
+}
+
+func (c *client) signature(t time.Time, amzDate, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// uriEncode percent-encodes s as SigV4 requires: everything except unreserved characters (and '/' unless encodeSlash).
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && !encodeSlash) {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// ---------------------------------------------------------------------------
+// Object operations
+// ---------------------------------------------------------------------------
+
+type objectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+func (c *client) headObject(ctx context.Context, key string) (objectInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return objectInfo{}, err
+	}
+	resp.Body.Close()
+	info := objectInfo{Key: key, Size: resp.ContentLength}
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lm
+	}
+	return info, nil
+}
+
+func (c *client) getObject(ctx context.Context, key string, offset int64) (io.ReadCloser, error) {
+	var h http.Header
+	if offset > 0 {
+		h = http.Header{"Range": []string{fmt.Sprintf("bytes=%d-", offset)}}
+	}
+	resp, err := c.do(ctx, http.MethodGet, key, nil, h, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *client) putObject(ctx context.Context, key string, body io.Reader, size int64) error {
+	h := http.Header{"Content-Type": []string{"application/octet-stream"}}
+	resp, err := c.do(ctx, http.MethodPut, key, nil, h, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *client) deleteObject(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *client) copyObject(ctx context.Context, srcKey, dstKey string) error {
+	h := http.Header{"X-Amz-Copy-Source": []string{"/" + c.bucket + "/" + uriEncode(srcKey, false)}}
+	resp, err := c.do(ctx, http.MethodPut, dstKey, nil, h, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// CopyObject can fail after sending 200; the error is then in the body.
+	data, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{StatusCode: resp.StatusCode}
+		_ = xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// listObjects pages through ListObjectsV2 under prefix, calling fn for every page.
+func (c *client) listObjects(ctx context.Context, prefix, delimiter string, fn func(*listResult) error) error {
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		if delimiter != "" {
+			q.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", q, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: decode list response: %w", err)
+		}
+		if err := fn(&res); err != nil {
+			return err
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// deleteObjects removes up to 1000 keys per request with the multi-object delete API.
+func (c *client) deleteObjects(ctx context.Context, keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		batch := keys[:n]
+		keys = keys[n:]
+		var body bytes.Buffer
+		body.WriteString(`<Delete><Quiet>true</Quiet>`)
+		for _, k := range batch {
+			body.WriteString("<Object><Key>")
+			xml.EscapeText(&body, []byte(k))
+			body.WriteString("</Key></Object>")
+		}
+		body.WriteString(`</Delete>`)
+		sum := md5.Sum(body.Bytes())
+		h := http.Header{
+			"Content-Md5":  []string{base64.StdEncoding.EncodeToString(sum[:])},
+			"Content-Type": []string{"application/xml"},
+		}
+		q := url.Values{"delete": []string{""}}
+		resp, err := c.do(ctx, http.MethodPost, "", q, h, bytes.NewReader(body.Bytes()), int64(body.Len()))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------
+// Multipart upload
+// ---------------------------------------------------------------------------
+
+func (c *client) createMultipartUpload(ctx context.Context, key string) (string, error) {
+	h := http.Header{"Content-Type": []string{"application/octet-stream"}}
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": []string{""}}, h, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("s3: decode CreateMultipartUpload: %w", err)
+	}
+	return res.UploadID, nil
+}
+
+func (c *client) uploadPart(ctx context.Context, key, uploadID string, partNumber int, data []byte) (string, error) {
+	q := url.Values{"partNumber": []string{strconv.Itoa(partNumber)}, "uploadId": []string{uploadID}}
+	resp, err := c.do(ctx, http.MethodPut, key, q, nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+// uploadPartCopy copies bytes [first, last] of srcKey into a part of a multipart upload.
+func (c *client) uploadPartCopy(ctx context.Context, key, uploadID string, partNumber int, srcKey string, first, last int64) (string, error) {
+	q := url.Values{"partNumber": []string{strconv.Itoa(partNumber)}, "uploadId": []string{uploadID}}
+	h := http.Header{
+		"X-Amz-Copy-Source":       []string{"/" + c.bucket + "/" + uriEncode(srcKey, false)},
+		"X-Amz-Copy-Source-Range": []string{fmt.Sprintf("bytes=%d-%d", first, last)},
+	}
+	resp, err := c.do(ctx, http.MethodPut, key, q, h, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", fmt.Errorf("s3: decode UploadPartCopy: %w", err)
+	}
+	return res.ETag, nil
+}
+
+func (c *client) completeMultipartUpload(ctx context.Context, key, uploadID string, etags []string) error {
+	var body bytes.Buffer
+	body.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range etags {
+		fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>", i+1)
+		xml.EscapeText(&body, []byte(etag))
+		body.WriteString("</ETag></Part>")
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	h := http.Header{"Content-Type": []string{"application/xml"}}
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": []string{uploadID}}, h, bytes.NewReader(body.Bytes()), int64(body.Len()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{StatusCode: resp.StatusCode}
+		_ = xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+func (c *client) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, url.Values{"uploadId": []string{uploadID}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
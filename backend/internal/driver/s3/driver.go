@@ -0,0 +1,415 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
+)
+
+const (
+	// maxCopySize is the largest object CopyObject accepts; bigger moves use multipart copy.
+	maxCopySize  = 5 << 30
+	copyPartSize = 512 << 20
+	minPartSize  = 5 << 20
+)
+
+func init() {
+	storage.Register("s3", func(cfg *config.Config) (storage.Driver, error) {
+		return NewDriver(cfg)
+	})
+}
+
+// Driver stores registry objects in an S3-compatible bucket under Prefix. S3 has no directories,
+// so the folder hooks are no-ops and List/Walk derive directories from key prefixes.
+type Driver struct {
+	client         *client
+	prefix         string
+	partSize       int64
+	redirect       bool
+	presignExpires time.Duration
+}
+
+func NewDriver(cfg *config.Config) (*Driver, error) {
+	endpoint := cfg.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.S3Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("S3_ENDPOINT %q: invalid URL", endpoint)
+	}
+	u.Path = ""
+	partSize := cfg.S3PartSize
+	if partSize < minPartSize {
+		partSize = minPartSize
+	}
+	return &Driver{
+		client: &client{
+			endpoint:  u,
+			region:    cfg.S3Region,
+			bucket:    cfg.S3Bucket,
+			accessKey: cfg.S3AccessKey,
+			secretKey: cfg.S3SecretKey,
+			pathStyle: cfg.S3PathStyle,
+			http:      &http.Client{},
+		},
+		prefix:         strings.Trim(cfg.S3Prefix, "/"),
+		partSize:       partSize,
+		redirect:       cfg.S3Redirect,
+		presignExpires: cfg.S3PresignExpiry,
+	}, nil
+}
+
+func (d *Driver) Name() string { return "s3" }
+
+// key maps a registry-relative path to its object key under the prefix.
+func (d *Driver) key(p string) string {
+	p = strings.Trim(p, "/")
+	if d.prefix == "" {
+		return p
+	}
+	if p == "" {
+		return d.prefix
+	}
+	return d.prefix + "/" + p
+}
+
+// dirPrefix is the key prefix listing the children of p.
+func (d *Driver) dirPrefix(p string) string {
+	k := d.key(p)
+	if k == "" {
+		return ""
+	}
+	return k + "/"
+}
+
+// CheckRoot verifies the bucket is reachable and writable with a probe object.
+func (d *Driver) CheckRoot(ctx context.Context) error {
+	probe := d.key(fmt.Sprintf(".refity-write-test-%d", time.Now().UnixNano()))
+	if err := d.client.putObject(ctx, probe, strings.NewReader("ok"), 2); err != nil {
+		return fmt.Errorf("S3 bucket %s: not writable: %w", d.client.bucket, err)
+	}
+	if err := d.client.deleteObject(ctx, probe); err != nil {
+		log.Printf("[S3] CheckRoot: failed to remove probe %s: %v", probe, err)
+	}
+	return nil
+}
+
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rc, err := d.client.getObject(ctx, d.key(path), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
+	var cb func(written, total int64)
+	if len(progressCb) > 0 {
+		cb = progressCb[0]
+	}
+	if int64(len(content)) <= d.partSize {
+		body := storage.ProgressReader(bytes.NewReader(content), int64(len(content)), cb)
+		return d.client.putObject(ctx, d.key(path), body, int64(len(content)))
+	}
+	w := d.newWriter(ctx, path)
+	w.cb = cb
+	w.total = int64(len(content))
+	if _, err := w.Write(content); err != nil {
+		w.Cancel(ctx)
+		return err
+	}
+	return w.Commit(ctx)
+}
+
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return d.client.getObject(ctx, d.key(path), offset)
+}
+
+// Writer streams to a multipart upload in S3_PART_SIZE parts; small objects become a single PUT.
+// S3 objects cannot be appended to, so appendMode is unsupported.
+func (d *Driver) Writer(ctx context.Context, path string, appendMode bool) (storage.FileWriter, error) {
+	if appendMode {
+		return nil, errors.New("s3: append writes are not supported")
+	}
+	return d.newWriter(ctx, path), nil
+}
+
+func (d *Driver) newWriter(ctx context.Context, path string) *writer {
+	return &writer{d: d, ctx: ctx, key: d.key(path), buf: make([]byte, 0, d.partSize)}
+}
+
+func (d *Driver) Stat(ctx context.Context, path string) (storage.FileInfo, error) {
+	info, err := d.client.headObject(ctx, d.key(path))
+	if err == nil {
+		return storage.FileInfo{Path: path, Size: info.Size, ModTime: info.LastModified}, nil
+	}
+	if !storage.IsNotExist(err) {
+		return storage.FileInfo{}, err
+	}
+	// No object: it is a "directory" if any key lives under it.
+	found := false
+	lerr := d.client.listObjects(ctx, d.dirPrefix(path), "/", func(res *listResult) error {
+		found = len(res.Contents) > 0 || len(res.CommonPrefixes) > 0
+		return errStopList
+	})
+	if lerr != nil && lerr != errStopList {
+		return storage.FileInfo{}, lerr
+	}
+	if !found {
+		return storage.FileInfo{}, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return storage.FileInfo{Path: path, IsDir: true}, nil
+}
+
+var errStopList = errors.New("stop listing")
+
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	prefix := d.dirPrefix(path)
+	var out []string
+	err := d.client.listObjects(ctx, prefix, "/", func(res *listResult) error {
+		for _, cp := range res.CommonPrefixes {
+			out = append(out, strings.TrimSuffix(strings.TrimPrefix(cp.Prefix, prefix), "/"))
+		}
+		for _, obj := range res.Contents {
+			if name := strings.TrimPrefix(obj.Key, prefix); name != "" {
+				out = append(out, name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 && strings.Trim(path, "/") != "" {
+		return nil, &os.PathError{Op: "list", Path: path, Err: os.ErrNotExist}
+	}
+	return out, nil
+}
+
+// Move copies then deletes the source; objects over 5 GiB are copied in parts.
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	src, dst := d.key(sourcePath), d.key(destPath)
+	info, err := d.client.headObject(ctx, src)
+	if err != nil {
+		return err
+	}
+	if info.Size <= maxCopySize {
+		if err := d.client.copyObject(ctx, src, dst); err != nil {
+			return err
+		}
+	} else if err := d.multipartCopy(ctx, src, dst, info.Size); err != nil {
+		return err
+	}
+	return d.client.deleteObject(ctx, src)
+}
+
+func (d *Driver) multipartCopy(ctx context.Context, src, dst string, size int64) error {
+	uploadID, err := d.client.createMultipartUpload(ctx, dst)
+	if err != nil {
+		return err
+	}
+	var etags []string
+	for first := int64(0); first < size; first += copyPartSize {
+		last := first + copyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		etag, err := d.client.uploadPartCopy(ctx, dst, uploadID, len(etags)+1, src, first, last)
+		if err != nil {
+			_ = d.client.abortMultipartUpload(ctx, dst, uploadID)
+			return err
+		}
+		etags = append(etags, etag)
+	}
+	return d.client.completeMultipartUpload(ctx, dst, uploadID, etags)
+}
+
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	return d.client.deleteObject(ctx, d.key(path))
+}
+
+// RedirectURL returns a presigned GET URL so clients download straight from the bucket (S3_REDIRECT).
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	if !d.redirect {
+		return "", nil
+	}
+	if r != nil && r.Method != http.MethodGet {
+		return "", nil
+	}
+	return d.client.presign(http.MethodGet, d.key(path), d.presignExpires, time.Now().UTC()), nil
+}
+
+// Walk lists every key under path; directories are synthesized from key prefixes and reported before their contents.
+func (d *Driver) Walk(ctx context.Context, path string, f storage.WalkFn, options ...func(*storage.WalkOptions)) error {
+	prefix := d.dirPrefix(path)
+	base := strings.Trim(path, "/")
+	seenDirs := make(map[string]bool)
+	return d.client.listObjects(ctx, prefix, "", func(res *listResult) error {
+		for _, obj := range res.Contents {
+			rel := strings.TrimPrefix(obj.Key, prefix)
+			if rel == "" {
+				continue
+			}
+			parts := strings.Split(rel, "/")
+			for i := 1; i < len(parts); i++ {
+				dir := pathpkg.Join(base, strings.Join(parts[:i], "/"))
+				if seenDirs[dir] {
+					continue
+				}
+				seenDirs[dir] = true
+				if err := f(storage.FileInfo{Path: dir, IsDir: true}); err != nil {
+					return err
+				}
+			}
+			if err := f(storage.FileInfo{Path: pathpkg.Join(base, rel), Size: obj.Size, ModTime: obj.LastModified}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Driver) CreateRepositoryFolder(ctx context.Context, repoName string) error { return nil }
+func (d *Driver) CreateGroupFolder(ctx context.Context, groupName string) error     { return nil }
+
+// DeleteRepositoryFolder removes every object under the repository prefix.
+func (d *Driver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
+	var keys []string
+	err := d.client.listObjects(ctx, d.dirPrefix(repoName), "", func(res *listResult) error {
+		for _, obj := range res.Contents {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return d.client.deleteObjects(ctx, keys)
+}
+
+// ---------------------------------------------------------------------------
+// Multipart writer
+// ---------------------------------------------------------------------------
+
+// writer buffers one part at a time. The multipart upload starts only once a full part is
+// buffered, so small objects are a single PUT. Close commits, like the SFTP writer.
+type writer struct {
+	d        *Driver
+	ctx      context.Context
+	key      string
+	buf      []byte
+	uploadID string
+	etags    []string
+	size     int64
+	done     bool
+
+	cb          func(written, total int64)
+	total       int64
+	nextPercent int64
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, errors.New("s3: write after close")
+	}
+	n := 0
+	for len(p) > 0 {
+		room := int(w.d.partSize) - len(w.buf)
+		chunk := p
+		if len(chunk) > room {
+			chunk = chunk[:room]
+		}
+		w.buf = append(w.buf, chunk...)
+		p = p[len(chunk):]
+		n += len(chunk)
+		w.size += int64(len(chunk))
+		if int64(len(w.buf)) == w.d.partSize {
+			if err := w.flushPart(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *writer) flushPart() error {
+	if w.uploadID == "" {
+		id, err := w.d.client.createMultipartUpload(w.ctx, w.key)
+		if err != nil {
+			return err
+		}
+		w.uploadID = id
+	}
+	etag, err := w.d.client.uploadPart(w.ctx, w.key, w.uploadID, len(w.etags)+1, w.buf)
+	if err != nil {
+		return err
+	}
+	w.etags = append(w.etags, etag)
+	w.buf = w.buf[:0]
+	w.reportProgress()
+	return nil
+}
+
+func (w *writer) reportProgress() {
+	if w.cb == nil || w.total <= 0 {
+		return
+	}
+	written := w.size - int64(len(w.buf))
+	if w.nextPercent == 0 {
+		w.nextPercent = 10
+	}
+	if written*100/w.total >= w.nextPercent || written == w.total {
+		w.cb(written, w.total)
+		w.nextPercent = written*100/w.total + 10
+	}
+}
+
+func (w *writer) Size() int64 { return w.size }
+
+func (w *writer) Close() error { return w.Commit(w.ctx) }
+
+func (w *writer) Commit(ctx context.Context) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.uploadID == "" {
+		return w.d.client.putObject(ctx, w.key, bytes.NewReader(w.buf), int64(len(w.buf)))
+	}
+	if len(w.buf) > 0 {
+		if err := w.flushPart(); err != nil {
+			_ = w.d.client.abortMultipartUpload(ctx, w.key, w.uploadID)
+			return err
+		}
+	}
+	if err := w.d.client.completeMultipartUpload(ctx, w.key, w.uploadID, w.etags); err != nil {
+		_ = w.d.client.abortMultipartUpload(ctx, w.key, w.uploadID)
+		return err
+	}
+	return nil
+}
+
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.uploadID != "" {
+		return w.d.client.abortMultipartUpload(ctx, w.key, w.uploadID)
+	}
+	return nil
+}
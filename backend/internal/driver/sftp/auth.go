@@ -0,0 +1,126 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"refity/backend/internal/config"
+)
+
+// authMethods builds the SSH auth methods enabled in cfg, in the order the server is offered them:
+// public keys (private key file, OpenSSH certificate, ssh-agent), password, keyboard-interactive.
+// The returned closer releases the ssh-agent connection and must be called once the handshake is done.
+func authMethods(cfg *config.Config) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	closer := func() {}
+
+	// x/crypto/ssh tries each method name once, so every key source goes into a single publickey method.
+	var signers []ssh.Signer
+	if cfg.FTPPrivateKey != "" {
+		signer, err := loadPrivateKey(cfg.FTPPrivateKey, cfg.FTPPrivateKeyPassphrase)
+		if err != nil {
+			return nil, closer, err
+		}
+		if cfg.FTPCertificate != "" {
+			certSigner, err := loadCertificate(cfg.FTPCertificate, signer)
+			if err != nil {
+				return nil, closer, err
+			}
+			// Offer the certificate first; servers without a trusted CA fall back to the plain key.
+			signers = append(signers, certSigner)
+		}
+		signers = append(signers, signer)
+	}
+	var agentSigners func() ([]ssh.Signer, error)
+	if cfg.FTPUseAgent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, closer, errors.New("SFTP_USE_AGENT is set but SSH_AUTH_SOCK is empty")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, closer, fmt.Errorf("ssh-agent %s: %w", sock, err)
+		}
+		closer = func() { conn.Close() }
+		agentSigners = agent.NewClient(conn).Signers
+	}
+	if len(signers) > 0 || agentSigners != nil {
+		methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			all := append([]ssh.Signer(nil), signers...)
+			if agentSigners != nil {
+				fromAgent, err := agentSigners()
+				if err != nil {
+					return all, nil
+				}
+				all = append(all, fromAgent...)
+			}
+			return all, nil
+		}))
+	}
+
+	if cfg.FTPPassword != "" {
+		password := cfg.FTPPassword
+		methods = append(methods, ssh.Password(password))
+		// Some servers (and Hetzner with 2FA disabled) only advertise keyboard-interactive for passwords.
+		methods = append(methods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+
+	if len(methods) == 0 {
+		closer()
+		return nil, func() {}, errors.New("no SFTP authentication configured: set FTP_PASSWORD, SFTP_PRIVATE_KEY or SFTP_USE_AGENT")
+	}
+	return methods, closer, nil
+}
+
+func loadPrivateKey(path, passphrase string) (ssh.Signer, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP_PRIVATE_KEY: %w", err)
+	}
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("SFTP_PRIVATE_KEY %s: %w", path, err)
+		}
+		return signer, nil
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			return nil, fmt.Errorf("SFTP_PRIVATE_KEY %s is passphrase-protected: set SFTP_PRIVATE_KEY_PASSPHRASE", path)
+		}
+		return nil, fmt.Errorf("SFTP_PRIVATE_KEY %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+func loadCertificate(path string, signer ssh.Signer) (ssh.Signer, error) {
+	certBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP_CERTIFICATE: %w", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP_CERTIFICATE %s: %w", path, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("SFTP_CERTIFICATE %s is not an OpenSSH certificate", path)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, fmt.Errorf("SFTP_CERTIFICATE %s does not match SFTP_PRIVATE_KEY: %w", path, err)
+	}
+	return certSigner, nil
+}
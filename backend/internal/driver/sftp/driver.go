@@ -1,7 +1,11 @@
 package sftp
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -18,52 +22,28 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/knownhosts"
 	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
 )
 
-type StorageDriver interface {
-	Name() string
-	GetContent(ctx context.Context, path string) ([]byte, error)
-	PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error
-	Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error)
-	Writer(ctx context.Context, path string, append bool) (FileWriter, error)
-	Stat(ctx context.Context, path string) (FileInfo, error)
-	List(ctx context.Context, path string) ([]string, error)
-	Move(ctx context.Context, sourcePath string, destPath string) error
-	Delete(ctx context.Context, path string) error
-	RedirectURL(r *http.Request, path string) (string, error)
-	Walk(ctx context.Context, path string, f WalkFn, options ...func(*WalkOptions)) error
-	CreateRepositoryFolder(ctx context.Context, repoName string) error
-	DeleteRepositoryFolder(ctx context.Context, repoName string) error
-	CreateGroupFolder(ctx context.Context, groupName string) error
-}
-
-type FileWriter interface {
-	io.WriteCloser
-	Size() int64
-	Cancel(context.Context) error
-	Commit(context.Context) error
+func init() {
+	storage.Register("sftp", func(cfg *config.Config) (storage.Driver, error) {
+		return NewPoolStorageDriver(cfg)
+	})
 }
 
-type FileInfo interface{}
-type WalkFn func(fileInfo FileInfo) error
-type WalkOptions struct{}
-
-var ErrUnsupportedMethod = func(driverName string) error { return &unsupportedMethodError{DriverName: driverName} }
-
-type unsupportedMethodError struct{ DriverName string }
-
-func (e *unsupportedMethodError) Error() string { return e.DriverName + ": unsupported method" }
-
-var ErrRepoNotFound = errors.New("repository not found")
+// ErrPoolTimeout is returned when no pooled connection becomes available within the checkout timeout.
+var ErrPoolTimeout = errors.New("SFTP pool: timed out waiting for a free connection")
 
 // ---------------------------------------------------------------------------
 // Connection Pool with keepalive, auto-reconnect, and safe client lifecycle
 // ---------------------------------------------------------------------------
 
 type DriverPool struct {
+	name     string
 	clients  chan *sftp.Client
 	cfg      *config.Config
 	poolSize int
+	timeout  time.Duration // max wait for a free connection on checkout; 0 = wait until ctx is done
 	alive    atomic.Int32
 	stopOnce sync.Once
 	stopCh   chan struct{}
@@ -77,11 +57,17 @@ func hostKeyCallback(cfg *config.Config) (ssh.HostKeyCallback, error) {
 	return ssh.InsecureIgnoreHostKey(), nil
 }
 
-func NewDriverPool(cfg *config.Config, poolSize int) (*DriverPool, error) {
+// NewDriverPool opens poolSize connections; name only labels log lines (e.g. "read", "upload").
+func NewDriverPool(cfg *config.Config, name string, poolSize int) (*DriverPool, error) {
+	if poolSize < 1 {
+		poolSize = 1
+	}
 	pool := &DriverPool{
+		name:     name,
 		clients:  make(chan *sftp.Client, poolSize),
 		cfg:      cfg,
 		poolSize: poolSize,
+		timeout:  cfg.SFTPPoolTimeout,
 		stopCh:   make(chan struct{}),
 	}
 
@@ -89,7 +75,7 @@ func NewDriverPool(cfg *config.Config, poolSize int) (*DriverPool, error) {
 	for i := 0; i < poolSize; i++ {
 		client, err := pool.newClient()
 		if err != nil {
-			log.Printf("[SFTP] Pool: initial connection %d/%d failed: %v", i+1, poolSize, err)
+			log.Printf("[SFTP] Pool %s: initial connection %d/%d failed: %v", name, i+1, poolSize, err)
 			continue
 		}
 		pool.clients <- client
@@ -97,11 +83,11 @@ func NewDriverPool(cfg *config.Config, poolSize int) (*DriverPool, error) {
 	}
 
 	if connected == 0 {
-		return nil, fmt.Errorf("SFTP pool: no connections established to %s:%s", cfg.FTPHost, cfg.FTPPort)
+		return nil, fmt.Errorf("SFTP pool %s: no connections established to %s:%s", name, cfg.FTPHost, cfg.FTPPort)
 	}
 
 	pool.alive.Store(int32(connected))
-	log.Printf("[SFTP] Pool: initialized %d/%d connections", connected, poolSize)
+	log.Printf("[SFTP] Pool %s: initialized %d/%d connections", name, connected, poolSize)
 
 	// Fill remaining slots in background
 	if connected < poolSize {
@@ -119,10 +105,15 @@ func (p *DriverPool) newClient() (*sftp.Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	auth, closeAuth, err := authMethods(p.cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAuth()
 	addr := p.cfg.FTPHost + ":" + p.cfg.FTPPort
 	sshConfig := &ssh.ClientConfig{
 		User:            p.cfg.FTPUsername,
-		Auth:            []ssh.AuthMethod{ssh.Password(p.cfg.FTPPassword)},
+		Auth:            auth,
 		HostKeyCallback: hk,
 		Timeout:         10 * time.Second,
 	}
@@ -215,11 +206,29 @@ func (p *DriverPool) healthCheckAll() {
 	}
 }
 
-func (p *DriverPool) getClient() *sftp.Client {
-	client := <-p.clients
+// getClient checks out a connection, waiting at most the pool timeout or until ctx is done.
+// A stale connection is replaced before being handed out. On error nothing is checked out.
+func (p *DriverPool) getClient(ctx context.Context) (*sftp.Client, error) {
+	var timeoutCh <-chan time.Time
+	if p.timeout > 0 {
+		timer := time.NewTimer(p.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	var client *sftp.Client
+	select {
+	case client = <-p.clients:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeoutCh:
+		return nil, fmt.Errorf("%w (pool %s, %d alive, waited %s)", ErrPoolTimeout, p.name, p.alive.Load(), p.timeout)
+	case <-p.stopCh:
+		return nil, fmt.Errorf("SFTP pool %s: closed", p.name)
+	}
 
 	if _, err := client.Getwd(); err != nil {
-		log.Printf("[SFTP] Pool: stale connection on checkout, reconnecting...")
+		log.Printf("[SFTP] Pool %s: stale connection on checkout, reconnecting...", p.name)
 		client.Close()
 		p.alive.Add(-1)
 
@@ -227,34 +236,39 @@ func (p *DriverPool) getClient() *sftp.Client {
 			newClient, err := p.newClient()
 			if err == nil {
 				p.alive.Add(1)
-				log.Printf("[SFTP] Pool: reconnected on attempt %d (pool: %d alive)", attempt, p.alive.Load())
-				return newClient
+				log.Printf("[SFTP] Pool %s: reconnected on attempt %d (pool: %d alive)", p.name, attempt, p.alive.Load())
+				return newClient, nil
+			}
+			log.Printf("[SFTP] Pool %s: reconnect attempt %d/3 failed: %v", p.name, attempt, err)
+			select {
+			case <-ctx.Done():
+				go p.fillPool(1)
+				return nil, ctx.Err()
+			case <-time.After(time.Duration(attempt) * 2 * time.Second):
 			}
-			log.Printf("[SFTP] Pool: reconnect attempt %d/3 failed: %v", attempt, err)
-			time.Sleep(time.Duration(attempt) * 2 * time.Second)
 		}
 
 		// All retries exhausted — one final attempt
 		finalClient, err := p.newClient()
 		if err != nil {
-			log.Printf("[SFTP] Pool: all reconnects failed, pool degraded to %d", p.alive.Load())
-			// Spawn background recovery
+			log.Printf("[SFTP] Pool %s: all reconnects failed, pool degraded to %d", p.name, p.alive.Load())
+			// Spawn background recovery so the slot is not lost
 			go p.fillPool(1)
-			// Return nil — callers must handle this
-			return nil
+			return nil, fmt.Errorf("SFTP unavailable: reconnect failed: %w", err)
 		}
 		p.alive.Add(1)
-		return finalClient
+		return finalClient, nil
 	}
 
-	return client
+	return client, nil
 }
 
 func (p *DriverPool) putClient(c *sftp.Client) {
-	if c == nil {
-		// nil client from failed getClient — try to restore pool
-		go p.fillPool(1)
+	select {
+	case <-p.stopCh:
+		c.Close()
 		return
+	default:
 	}
 
 	if _, err := c.Getwd(); err != nil {
@@ -290,19 +304,150 @@ func (p *DriverPool) Alive() int {
 // PoolStorageDriver — uses pool for all operations
 // ---------------------------------------------------------------------------
 
+// PoolStorageDriver serves reads and metadata operations from Pool and blob/manifest writes
+// from UploadPool, so a large push cannot occupy every connection a pull needs.
+// UploadPool may be nil, in which case writes share Pool.
+// All paths are relative to Root (SFTP_ROOT), which is applied here and nowhere else.
 type PoolStorageDriver struct {
-	Pool *DriverPool
+	Pool       *DriverPool
+	UploadPool *DriverPool
+	Root       string
+
+	Streams   int   // concurrent ranges for large transfers; <= 1 disables them
+	ChunkSize int64 // range size
+	Threshold int64 // smaller objects use a single stream
+}
+
+// NewPoolStorageDriver connects the read and upload pools sized from cfg (SFTP_POOL_SIZE, SFTP_UPLOAD_POOL_SIZE).
+func NewPoolStorageDriver(cfg *config.Config) (*PoolStorageDriver, error) {
+	readPool, err := NewDriverPool(cfg, "read", cfg.SFTPPoolSize)
+	if err != nil {
+		return nil, err
+	}
+	d := &PoolStorageDriver{
+		Pool:      readPool,
+		Root:      cfg.SFTPRoot,
+		Streams:   cfg.SFTPParallelStreams,
+		ChunkSize: cfg.SFTPParallelChunkSize,
+		Threshold: cfg.SFTPParallelThreshold,
+	}
+	if cfg.SFTPUploadPoolSize > 0 {
+		uploadPool, err := NewDriverPool(cfg, "upload", cfg.SFTPUploadPoolSize)
+		if err != nil {
+			readPool.Close()
+			return nil, err
+		}
+		d.UploadPool = uploadPool
+	}
+	return d, nil
+}
+
+// remote maps a registry-relative path (e.g. "group/app/blobs/sha256:...") to its location under Root.
+func (d *PoolStorageDriver) remote(p string) string {
+	root := d.Root
+	if root == "" {
+		root = "registry"
+	}
+	return pathpkg.Join(root, p)
+}
+
+// CheckRoot creates Root if needed and verifies it is writable by creating and removing a probe file.
+func (d *PoolStorageDriver) CheckRoot(ctx context.Context) error {
+	pool := d.uploadPool()
+	client, err := pool.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.putClient(client)
+	root := d.remote("")
+	if err := createDirRecursiveWithClient(client, root); err != nil {
+		return fmt.Errorf("SFTP_ROOT %s: create: %w", root, err)
+	}
+	fi, err := client.Stat(root)
+	if err != nil {
+		return fmt.Errorf("SFTP_ROOT %s: %w", root, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("SFTP_ROOT %s: not a directory", root)
+	}
+	probe := pathpkg.Join(root, fmt.Sprintf(".refity-write-test-%d", time.Now().UnixNano()))
+	f, err := client.Create(probe)
+	if err != nil {
+		return fmt.Errorf("SFTP_ROOT %s: not writable: %w", root, err)
+	}
+	_, werr := f.Write([]byte("ok"))
+	f.Close()
+	if rerr := client.Remove(probe); rerr != nil {
+		log.Printf("[SFTP] CheckRoot: failed to remove probe %s: %v", probe, rerr)
+	}
+	if werr != nil {
+		return fmt.Errorf("SFTP_ROOT %s: not writable: %w", root, werr)
+	}
+	go d.removeStalePartials(root)
+	return nil
+}
+
+// Capacity reports the filesystem holding Root through the statvfs@openssh.com extension.
+func (d *PoolStorageDriver) Capacity(ctx context.Context) (storage.Capacity, error) {
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return storage.Capacity{}, err
+	}
+	defer d.Pool.putClient(client)
+	if _, ok := client.HasExtension("statvfs@openssh.com"); !ok {
+		return storage.Capacity{}, storage.ErrNoCapacity
+	}
+	fs, err := client.StatVFS(d.remote(""))
+	if err != nil {
+		return storage.Capacity{}, err
+	}
+	return storage.Capacity{Total: int64(fs.TotalSpace()), Free: int64(fs.Frsize * fs.Bavail)}, nil
+}
+
+// removeStalePartials deletes temp files of uploads abandoned more than partialMaxAge ago
+// (crashes, attempts never retried). Younger ones are kept for replayed uploads to resume.
+// It runs in the background since listing a large tree takes a while.
+func (d *PoolStorageDriver) removeStalePartials(root string) {
+	client, err := d.Pool.getClient(context.Background())
+	if err != nil {
+		log.Printf("[SFTP] Partial cleanup skipped: %v", err)
+		return
+	}
+	defer d.Pool.putClient(client)
+	n, err := removePartialsWithClient(client, root, time.Now().Add(-partialMaxAge))
+	if err != nil {
+		log.Printf("[SFTP] Partial cleanup: %v", err)
+	}
+	if n > 0 {
+		log.Printf("[SFTP] Partial cleanup: removed %d abandoned upload temp file(s)", n)
+	}
+}
+
+func (d *PoolStorageDriver) uploadPool() *DriverPool {
+	if d.UploadPool != nil {
+		return d.UploadPool
+	}
+	return d.Pool
+}
+
+// Close shuts down both pools.
+func (d *PoolStorageDriver) Close() error {
+	d.Pool.Close()
+	if d.UploadPool != nil {
+		d.UploadPool.Close()
+	}
+	return nil
 }
 
 func (d *PoolStorageDriver) Name() string { return "sftp-pool" }
 
 func (d *PoolStorageDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
-	client := d.Pool.getClient()
-	if client == nil {
-		return nil, fmt.Errorf("SFTP unavailable: no connections in pool")
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return nil, err
 	}
 	defer d.Pool.putClient(client)
-	f, err := client.Open(path)
+	f, err := client.Open(d.remote(path))
 	if err != nil {
 		return nil, err
 	}
@@ -310,42 +455,70 @@ func (d *PoolStorageDriver) GetContent(ctx context.Context, path string) ([]byte
 	return io.ReadAll(f)
 }
 
+// PutContent writes content to a temp file and renames it into place once its size is verified, so
+// readers never see a partial object. Blobs and by-digest manifests are hashed before anything is
+// sent and refused if they do not match their path. The temp file is named after the upload
+// (storage.WithUploadID): one left by an interrupted attempt of the same upload is resumed (see
+// resumeOffset), so a retry after a dropped connection only sends the remainder. Without an
+// upload the name is random and a failed attempt removes its temp file. Large objects are written
+// in parallel ranges instead (see putParallel).
 func (d *PoolStorageDriver) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
-	client := d.Pool.getClient()
-	if client == nil {
-		return fmt.Errorf("SFTP unavailable: no connections in pool")
+	if d.parallel(int64(len(content))) {
+		var cb func(written, total int64)
+		if len(progressCb) > 0 {
+			cb = progressCb[0]
+		}
+		return d.putParallel(ctx, d.remote(path), content, cb)
 	}
-	defer d.Pool.putClient(client)
+	if err := checkDigest(ctx, d.remote(path), content); err != nil {
+		return err
+	}
+	pool := d.uploadPool()
+	client, err := pool.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.putClient(client)
+	path = d.remote(path)
+	uploadID := storage.UploadID(ctx)
+	tmp := tempName(path, uploadTag(uploadID))
 	dir := pathpkg.Dir(path)
 	if err := ensureDirWithClient(client, dir); err != nil {
 		return err
 	}
-	f, err := client.Create(path)
+	total := int64(len(content))
+	var written int64
+	if uploadID != "" {
+		written = resumeOffset(client, tmp, content)
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if written > 0 {
+		// Seek rather than O_APPEND: the client writes at explicit offsets, which not every server appends to.
+		flag = os.O_WRONLY
+		log.Printf("[SFTP] Resuming upload of %s at %d/%d bytes", path, written, total)
+	}
+	f, err := client.OpenFile(tmp, flag)
 	if err != nil {
 		return err
 	}
-	var writeErr error
-	defer func() {
+	if _, err := f.Seek(written, io.SeekStart); err != nil {
 		f.Close()
-		if writeErr != nil {
-			_ = client.Remove(path)
-		}
-	}()
-	total := int64(len(content))
-	written := int64(0)
+		return err
+	}
 	chunk := int64(256 * 1024)
-	nextPercent := int64(10)
+	nextPercent := written*100/max(total, 1)/10*10 + 10
+	var writeErr error
 	for written < total {
 		toWrite := chunk
 		if total-written < chunk {
 			toWrite = total - written
 		}
 		n, err := f.Write(content[written : written+toWrite])
+		written += int64(n)
 		if err != nil {
 			writeErr = err
 			break
 		}
-		written += int64(n)
 		if len(progressCb) > 0 && progressCb[0] != nil {
 			percent := written * 100 / total
 			if percent >= nextPercent || written == total {
@@ -354,6 +527,9 @@ func (d *PoolStorageDriver) PutContent(ctx context.Context, path string, content
 			}
 		}
 	}
+	if err := f.Close(); writeErr == nil {
+		writeErr = err
+	}
 	if writeErr != nil {
 		if se, ok := writeErr.(*sftp.StatusError); ok && se.Code == uint32(sftp.ErrSSHFxFailure) {
 			if _, hasExt := client.HasExtension("statvfs@openssh.com"); hasExt {
@@ -361,24 +537,119 @@ func (d *PoolStorageDriver) PutContent(ctx context.Context, path string, content
 				if ferr == nil {
 					fmt.Printf("[SFTP] StatVFS: Free=%d, Favail=%d, Files=%d\n", fsinfo.FreeSpace(), fsinfo.Favail, fsinfo.Files)
 					if fsinfo.Favail == 0 || fsinfo.Frsize*fsinfo.Bavail < uint64(len(content)) {
+						_ = client.Remove(tmp)
 						return fmt.Errorf("SFTP: no space left on device (ENOSPC)")
 					}
 				}
 			}
 		}
 		checkNoSpace(client, dir, int64(len(content)), writeErr)
+		if uploadID == "" {
+			_ = client.Remove(tmp)
+		}
+		// Otherwise the partial file stays for the next attempt of the upload to resume.
 		return writeErr
 	}
+	fi, err := client.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != total {
+		_ = client.Remove(tmp)
+		return fmt.Errorf("SFTP: %s has %d bytes after upload, expected %d", tmp, fi.Size(), total)
+	}
+	return renameIntoPlace(client, tmp, path)
+}
+
+// partialSuffix marks an upload in progress. Such files are hidden from List and Walk, and removed
+// by CheckRoot once older than partialMaxAge.
+const (
+	partialSuffix = ".partial"
+	partialMaxAge = 24 * time.Hour
+)
+
+// tempName returns the temp file for an upload to path. Writers never share one: tag names the
+// upload where it can be resumed, and is random otherwise.
+func tempName(path, tag string) string {
+	if tag == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		tag = hex.EncodeToString(b)
+	}
+	return path + "." + tag + partialSuffix
+}
+
+// uploadTag turns an upload ID into a temp file tag, or "" without one.
+func uploadTag(uploadID string) string {
+	if uploadID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(uploadID))
+	return hex.EncodeToString(sum[:8])
+}
+
+// resumeWindow is how much of the end of a partial file resumeOffset compares with content. The
+// temp name already ties the file to the upload, so only a torn last write is looked for, without
+// reading back a partial file that may be gigabytes over a slow link.
+const resumeWindow = 64 << 10
+
+// resumeOffset returns how many bytes of content the partial file tmp already holds, or 0 if it
+// does not exist, is longer than content or its last bytes differ from content (e.g. a torn write).
+func resumeOffset(client *sftp.Client, tmp string, content []byte) int64 {
+	fi, err := client.Stat(tmp)
+	if err != nil || fi.Size() == 0 || fi.Size() > int64(len(content)) {
+		return 0
+	}
+	size := fi.Size()
+	f, err := client.Open(tmp)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	from := max(size-resumeWindow, 0)
+	tail := make([]byte, size-from)
+	if _, err := f.ReadAt(tail, from); err != nil && err != io.EOF {
+		return 0
+	}
+	if !bytes.Equal(tail, content[from:size]) {
+		return 0
+	}
+	return size
+}
+
+// checkDigest refuses content that does not hash to the digest in remote, the path it is to be
+// stored at. Paths without a digest and encoded content (crypt) are not checked.
+func checkDigest(ctx context.Context, remote string, content []byte) error {
+	m := digestPath.FindStringSubmatch("/" + remote)
+	if m == nil || storage.IsEncodedContent(ctx) {
+		return nil
+	}
+	sum := sha256.Sum256(content)
+	if got := hex.EncodeToString(sum[:]); got != m[1] {
+		return fmt.Errorf("%w: %s hashes to sha256:%s", storage.ErrDigestMismatch, remote, got)
+	}
 	return nil
 }
 
+// renameIntoPlace replaces dst with src, atomically where the server supports posix-rename
+// (plain SFTP rename fails if dst exists).
+func renameIntoPlace(client *sftp.Client, src, dst string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(src, dst)
+	}
+	if err := client.Remove(dst); err != nil && !isNotExist(err) {
+		return err
+	}
+	return client.Rename(src, dst)
+}
+
 func (d *PoolStorageDriver) CreateRepositoryFolder(ctx context.Context, repoName string) error {
-	client := d.Pool.getClient()
-	if client == nil {
-		return fmt.Errorf("SFTP unavailable")
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return err
 	}
 	defer d.Pool.putClient(client)
-	repoPath := "registry/" + repoName
+	repoPath := d.remote(repoName)
 	if err := createDirRecursiveWithClient(client, repoPath); err != nil {
 		return fmt.Errorf("create repo folder: %w", err)
 	}
@@ -391,430 +662,318 @@ func (d *PoolStorageDriver) CreateRepositoryFolder(ctx context.Context, repoName
 }
 
 func (d *PoolStorageDriver) CreateGroupFolder(ctx context.Context, groupName string) error {
-	client := d.Pool.getClient()
-	if client == nil {
-		return fmt.Errorf("SFTP unavailable")
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return err
 	}
 	defer d.Pool.putClient(client)
-	return createDirRecursiveWithClient(client, "registry/"+groupName)
+	return createDirRecursiveWithClient(client, d.remote(groupName))
 }
 
 func (d *PoolStorageDriver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
-	client := d.Pool.getClient()
-	if client == nil {
-		return fmt.Errorf("SFTP unavailable")
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return err
 	}
 	defer d.Pool.putClient(client)
-	return deleteDirRecursiveWithClient(client, "registry/"+repoName)
+	return deleteDirRecursiveWithClient(client, d.remote(repoName))
 }
 
-func (d *PoolStorageDriver) Stat(ctx context.Context, path string) (FileInfo, error) {
-	client := d.Pool.getClient()
-	if client == nil {
-		return nil, fmt.Errorf("SFTP unavailable")
+func (d *PoolStorageDriver) Stat(ctx context.Context, path string) (storage.FileInfo, error) {
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return storage.FileInfo{}, err
 	}
 	defer d.Pool.putClient(client)
-	return client.Stat(path)
+	fi, err := client.Stat(d.remote(path))
+	if err != nil {
+		return storage.FileInfo{}, err
+	}
+	return toFileInfo(path, fi), nil
 }
 
 func (d *PoolStorageDriver) List(ctx context.Context, path string) ([]string, error) {
-	client := d.Pool.getClient()
-	if client == nil {
-		return nil, fmt.Errorf("SFTP unavailable")
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return nil, err
 	}
 	defer d.Pool.putClient(client)
-	fis, err := client.ReadDir(path)
+	fis, err := client.ReadDir(d.remote(path))
 	if err != nil {
 		return nil, err
 	}
 	var out []string
 	for _, fi := range fis {
+		if strings.HasSuffix(fi.Name(), partialSuffix) {
+			continue
+		}
 		out = append(out, fi.Name())
 	}
 	return out, nil
 }
 
 func (d *PoolStorageDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
-	client := d.Pool.getClient()
-	if client == nil {
-		return fmt.Errorf("SFTP unavailable")
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return err
 	}
 	defer d.Pool.putClient(client)
+	destPath = d.remote(destPath)
 	if err := ensureDirWithClient(client, pathpkg.Dir(destPath)); err != nil {
 		return err
 	}
-	return client.Rename(sourcePath, destPath)
+	return client.Rename(d.remote(sourcePath), destPath)
 }
 
 func (d *PoolStorageDriver) Delete(ctx context.Context, path string) error {
-	client := d.Pool.getClient()
-	if client == nil {
-		return fmt.Errorf("SFTP unavailable")
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return err
 	}
 	defer d.Pool.putClient(client)
-	return client.Remove(path)
+	return client.Remove(d.remote(path))
 }
 
 func (d *PoolStorageDriver) RedirectURL(r *http.Request, path string) (string, error) {
 	return "", nil
 }
 
-func (d *PoolStorageDriver) Walk(ctx context.Context, path string, f WalkFn, options ...func(*WalkOptions)) error {
-	client := d.Pool.getClient()
-	if client == nil {
-		return fmt.Errorf("SFTP unavailable")
+func (d *PoolStorageDriver) Walk(ctx context.Context, path string, f storage.WalkFn, options ...func(*storage.WalkOptions)) error {
+	client, err := d.Pool.getClient(ctx)
+	if err != nil {
+		return err
 	}
 	defer d.Pool.putClient(client)
-	return walkRecursiveWithClient(client, path, f)
+	return walkRecursiveWithClient(client, d.remote(path), strings.Trim(path, "/"), f)
 }
 
-// Reader checks out a client and wraps it so client returns to pool on Close.
+// Reader streams path from offset. If the connection breaks mid-transfer it reopens the file on
+// another pooled connection and resumes from the bytes already delivered. Large objects are read
+// in parallel ranges (see parallelReader).
 func (d *PoolStorageDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
-	client := d.Pool.getClient()
-	if client == nil {
-		return nil, fmt.Errorf("SFTP unavailable")
-	}
-	f, err := client.Open(path)
-	if err != nil {
-		d.Pool.putClient(client)
+	r := &resumableReader{d: d, ctx: ctx, path: path, offset: offset}
+	if err := r.open(); err != nil {
 		return nil, err
 	}
-	if offset > 0 {
-		if _, err := f.Seek(offset, io.SeekStart); err != nil {
-			f.Close()
-			d.Pool.putClient(client)
-			return nil, err
+	if d.Streams > 1 {
+		if fi, err := r.file.Stat(); err == nil && d.parallel(fi.Size()-offset) {
+			return newParallelReader(d, ctx, r, fi.Size()), nil
 		}
 	}
-	return &poolReadCloser{file: f, pool: d.Pool, client: client}, nil
+	return r, nil
 }
 
-// Writer checks out a client and wraps it so client returns to pool on Close/Commit.
-func (d *PoolStorageDriver) Writer(ctx context.Context, path string, appendMode bool) (FileWriter, error) {
-	client := d.Pool.getClient()
-	if client == nil {
-		return nil, fmt.Errorf("SFTP unavailable")
+// Writer streams to a temp file that Commit (or Close) renames over path, so readers never see a
+// partial object; Cancel removes it. With appendMode the writer appends to path in place (not
+// atomic; the registry only appends to the local staging driver).
+func (d *PoolStorageDriver) Writer(ctx context.Context, path string, appendMode bool) (storage.FileWriter, error) {
+	pool := d.uploadPool()
+	client, err := pool.getClient(ctx)
+	if err != nil {
+		return nil, err
 	}
-	dir := strings.TrimSuffix(path, "/"+filepathBase(path))
-	if err := ensureDirWithClient(client, dir); err != nil {
-		d.Pool.putClient(client)
+	path = d.remote(path)
+	if err := ensureDirWithClient(client, pathpkg.Dir(path)); err != nil {
+		pool.putClient(client)
 		return nil, err
 	}
-	flag := os.O_WRONLY | os.O_CREATE
+	fw := &poolFileWriter{pool: pool, client: client, path: path}
+	target := tempName(path, "")
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 	if appendMode {
-		flag |= os.O_APPEND
+		target, flag = path, os.O_WRONLY|os.O_CREATE
 	} else {
-		flag |= os.O_TRUNC
+		fw.tmp = target
 	}
-	f, err := client.OpenFile(path, flag)
+	f, err := client.OpenFile(target, flag)
 	if err != nil {
-		d.Pool.putClient(client)
+		pool.putClient(client)
 		return nil, err
 	}
-	return &poolFileWriter{file: f, pool: d.Pool, client: client}, nil
+	if appendMode {
+		// Seek rather than O_APPEND, as in PutContent.
+		if fw.size, err = f.Seek(0, io.SeekEnd); err != nil {
+			f.Close()
+			pool.putClient(client)
+			return nil, err
+		}
+	}
+	fw.file = f
+	return fw, nil
 }
 
-// poolReadCloser returns the SFTP client to the pool when the reader is closed.
-type poolReadCloser struct {
-	file   *sftp.File
-	pool   *DriverPool
-	client *sftp.Client
-}
+// readRetries is how often a broken read is resumed before the error is returned; the nth retry
+// waits (n-1)*readBackoff first.
+const readRetries = 3
 
-func (r *poolReadCloser) Read(p []byte) (int, error) { return r.file.Read(p) }
-func (r *poolReadCloser) Close() error {
-	err := r.file.Close()
-	r.pool.putClient(r.client)
-	return err
-}
+var readBackoff = time.Second
 
-// poolFileWriter returns the SFTP client to the pool when closed.
-type poolFileWriter struct {
-	file   *sftp.File
-	pool   *DriverPool
+// resumableReader holds a pooled client while reading and returns it on Close.
+type resumableReader struct {
+	d      *PoolStorageDriver
+	ctx    context.Context
+	path   string
+	offset int64
 	client *sftp.Client
+	file   *sftp.File
 	closed bool
 }
 
-func (fw *poolFileWriter) Write(p []byte) (int, error) { return fw.file.Write(p) }
-func (fw *poolFileWriter) Size() int64 {
-	fi, err := fw.file.Stat()
-	if err != nil {
-		return 0
-	}
-	return fi.Size()
-}
-func (fw *poolFileWriter) Close() error {
-	if fw.closed {
-		return nil
-	}
-	fw.closed = true
-	err := fw.file.Close()
-	fw.pool.putClient(fw.client)
-	return err
-}
-func (fw *poolFileWriter) Cancel(ctx context.Context) error { return fw.Close() }
-func (fw *poolFileWriter) Commit(ctx context.Context) error { return nil }
-
-// ---------------------------------------------------------------------------
-// Single-connection Driver (legacy, non-pooled)
-// ---------------------------------------------------------------------------
-
-type Driver struct {
-	client *sftp.Client
-}
-
-func NewDriverWithConfig(cfg *config.Config) (*Driver, error) {
-	hk, err := hostKeyCallback(cfg)
+func (r *resumableReader) open() error {
+	client, err := r.d.Pool.getClient(r.ctx)
 	if err != nil {
-		return nil, fmt.Errorf("FTP_KNOWN_HOSTS: %w", err)
-	}
-	addr := cfg.FTPHost + ":" + cfg.FTPPort
-	sshConfig := &ssh.ClientConfig{
-		User:            cfg.FTPUsername,
-		Auth:            []ssh.AuthMethod{ssh.Password(cfg.FTPPassword)},
-		HostKeyCallback: hk,
-		Timeout:         10 * time.Second,
+		return err
 	}
-	conn, err := ssh.Dial("tcp", addr, sshConfig)
+	f, err := client.Open(r.d.remote(r.path))
 	if err != nil {
-		return nil, err
+		r.d.Pool.putClient(client)
+		return err
 	}
-	client, err := sftp.NewClient(conn)
-	if err != nil {
-		return nil, err
+	if r.offset > 0 {
+		if _, err := f.Seek(r.offset, io.SeekStart); err != nil {
+			f.Close()
+			r.d.Pool.putClient(client)
+			return err
+		}
 	}
-	return &Driver{client: client}, nil
-}
-
-func NewDriver() (*Driver, error) {
-	return NewDriverWithConfig(&config.Config{
-		FTPHost: "localhost", FTPPort: "22", FTPUsername: "user", FTPPassword: "password",
-	})
+	r.client, r.file = client, f
+	return nil
 }
 
-func (d *Driver) Name() string                                                              { return "sftp" }
-func (d *Driver) RedirectURL(r *http.Request, path string) (string, error)                  { return "", nil }
-func (d *Driver) Stat(ctx context.Context, path string) (FileInfo, error)                   { return d.client.Stat(path) }
-func (d *Driver) Delete(ctx context.Context, path string) error                             { return d.client.Remove(path) }
-func (d *Driver) Move(ctx context.Context, src string, dst string) error {
-	d.ensureDir(pathpkg.Dir(dst))
-	return d.client.Rename(src, dst)
+// release closes the file and returns the client, if a reopen left them set.
+func (r *resumableReader) release() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.d.Pool.putClient(r.client)
+	r.client, r.file = nil, nil
+	return err
 }
 
-func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
-	f, err := d.client.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-	return io.ReadAll(f)
+// fail ends the reader with err.
+func (r *resumableReader) fail(err error) error {
+	r.release()
+	r.closed = true
+	return err
 }
 
-func (d *Driver) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
-	dir := pathpkg.Dir(path)
-	if err := d.ensureDir(dir); err != nil {
-		return err
+func (r *resumableReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("sftp: read after close")
 	}
-	f, err := d.client.Create(path)
-	if err != nil {
-		return err
-	}
-	var writeErr error
-	defer func() {
-		f.Close()
-		if writeErr != nil {
-			_ = d.client.Remove(path)
-		}
-	}()
-	total := int64(len(content))
-	written := int64(0)
-	chunk := int64(256 * 1024)
-	nextPercent := int64(10)
-	for written < total {
-		toWrite := chunk
-		if total-written < chunk {
-			toWrite = total - written
-		}
-		n, err := f.Write(content[written : written+toWrite])
-		if err != nil {
-			writeErr = err
-			break
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if attempt > readRetries || isNotExist(err) {
+				return 0, r.fail(err)
+			}
+			log.Printf("[SFTP] Read %s broken at offset %d (%v), resuming (attempt %d/%d)", r.path, r.offset, err, attempt, readRetries)
+			// putClient discards the connection if it is dead.
+			r.release()
+			if attempt > 1 {
+				select {
+				case <-r.ctx.Done():
+					return 0, r.fail(r.ctx.Err())
+				case <-time.After(time.Duration(attempt-1) * readBackoff):
+				}
+			}
 		}
-		written += int64(n)
-		if len(progressCb) > 0 && progressCb[0] != nil {
-			percent := written * 100 / total
-			if percent >= nextPercent || written == total {
-				progressCb[0](written, total)
-				nextPercent += 10
+		if r.file == nil {
+			if err = r.open(); err != nil {
+				continue
 			}
 		}
-	}
-	if writeErr != nil {
-		checkNoSpace(d.client, dir, int64(len(content)), writeErr)
-		return writeErr
-	}
-	return nil
-}
-
-func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
-	f, err := d.client.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	if offset > 0 {
-		if _, err = f.Seek(offset, io.SeekStart); err != nil {
-			f.Close()
-			return nil, err
+		n, rerr := r.file.Read(p)
+		r.offset += int64(n)
+		if rerr == nil || rerr == io.EOF {
+			return n, rerr
 		}
+		if n > 0 {
+			// Hand out what arrived; the next Read resumes from r.offset.
+			r.release()
+			return n, nil
+		}
+		err = rerr
 	}
-	return f, nil
-}
-
-func (d *Driver) Writer(ctx context.Context, path string, appendMode bool) (FileWriter, error) {
-	dir := strings.TrimSuffix(path, "/"+filepathBase(path))
-	if err := d.ensureDir(dir); err != nil {
-		return nil, err
-	}
-	flag := os.O_WRONLY | os.O_CREATE
-	if appendMode {
-		flag |= os.O_APPEND
-	} else {
-		flag |= os.O_TRUNC
-	}
-	f, err := d.client.OpenFile(path, flag)
-	if err != nil {
-		return nil, err
-	}
-	return &sftpFileWriter{file: f}, nil
 }
 
-func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
-	fis, err := d.client.ReadDir(path)
-	if err != nil {
-		return nil, err
-	}
-	var out []string
-	for _, fi := range fis {
-		out = append(out, fi.Name())
+func (r *resumableReader) Close() error {
+	if r.closed {
+		return nil
 	}
-	return out, nil
+	r.closed = true
+	return r.release()
 }
 
-func (d *Driver) Walk(ctx context.Context, path string, f WalkFn, options ...func(*WalkOptions)) error {
-	return d.walkRecursive(path, f)
+// poolFileWriter holds a pooled client until it is committed or cancelled.
+type poolFileWriter struct {
+	file   *sftp.File
+	pool   *DriverPool
+	client *sftp.Client
+	path   string
+	tmp    string // temp file renamed over path on Commit; empty when appending in place
+	size   int64
+	done   bool
 }
 
-func (d *Driver) CreateRepositoryFolder(ctx context.Context, repoName string) error {
-	repoPath := "registry/" + repoName
-	if err := d.createDirRecursive(repoPath); err != nil {
-		return fmt.Errorf("create repo folder: %w", err)
-	}
-	for _, sub := range []string{"/blobs", "/blobs/uploads", "/manifests"} {
-		if err := d.createDirRecursive(repoPath + sub); err != nil {
-			return fmt.Errorf("create %s: %w", sub, err)
-		}
-	}
-	return nil
+func (fw *poolFileWriter) Write(p []byte) (int, error) {
+	n, err := fw.file.Write(p)
+	fw.size += int64(n)
+	return n, err
 }
 
-func (d *Driver) CreateGroupFolder(ctx context.Context, groupName string) error {
-	return d.createDirRecursive("registry/" + groupName)
-}
+func (fw *poolFileWriter) Size() int64 { return fw.size }
 
-func (d *Driver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
-	return d.deleteDirRecursive("registry/" + repoName)
-}
+// Close commits; use Cancel to discard.
+func (fw *poolFileWriter) Close() error { return fw.Commit(context.Background()) }
 
-func (d *Driver) walkRecursive(path string, fn WalkFn) error {
-	fis, err := d.client.ReadDir(path)
-	if err != nil {
+func (fw *poolFileWriter) Commit(ctx context.Context) error {
+	if fw.done {
+		return nil
+	}
+	fw.done = true
+	defer fw.pool.putClient(fw.client)
+	err := fw.file.Close()
+	if fw.tmp == "" {
 		return err
 	}
-	for _, fi := range fis {
-		full := path + "/" + fi.Name()
-		if err := fn(fi); err != nil {
-			return err
-		}
-		if fi.IsDir() {
-			if err := d.walkRecursive(full, fn); err != nil {
-				return err
-			}
-		}
+	if err == nil {
+		err = renameIntoPlace(fw.client, fw.tmp, fw.path)
 	}
-	return nil
+	if err != nil {
+		_ = fw.client.Remove(fw.tmp)
+	}
+	return err
 }
 
-func (d *Driver) deleteDirRecursive(dir string) error {
-	if dir == "" || dir == "." || dir == "/" {
+func (fw *poolFileWriter) Cancel(ctx context.Context) error {
+	if fw.done {
 		return nil
 	}
-	fis, err := d.client.ReadDir(dir)
-	if err != nil {
-		if isNotExist(err) {
-			return nil
-		}
-		return err
-	}
-	for _, fi := range fis {
-		fullPath := dir + "/" + fi.Name()
-		if fi.IsDir() {
-			if err := d.deleteDirRecursive(fullPath); err != nil {
-				return err
-			}
-		} else {
-			if err := d.client.Remove(fullPath); err != nil && !isNotExist(err) {
-				return err
-			}
-		}
+	fw.done = true
+	defer fw.pool.putClient(fw.client)
+	fw.file.Close()
+	if fw.tmp == "" {
+		return nil
 	}
-	if err := d.client.Remove(dir); err != nil && !isNotExist(err) {
+	if err := fw.client.Remove(fw.tmp); err != nil && !isNotExist(err) {
 		return err
 	}
 	return nil
 }
 
-func (d *Driver) createDirRecursive(dir string) error {
-	return createDirRecursiveWithClient(d.client, dir)
-}
-
-func (d *Driver) ensureDir(dir string) error {
-	return ensureDirWithClient(d.client, dir)
-}
-
 // ---------------------------------------------------------------------------
 // Shared helpers
 // ---------------------------------------------------------------------------
 
-type sftpFileWriter struct {
-	file   *sftp.File
-	closed bool
+func isNotExist(err error) bool {
+	return storage.IsNotExist(err)
 }
 
-func (fw *sftpFileWriter) Write(p []byte) (int, error) { return fw.file.Write(p) }
-func (fw *sftpFileWriter) Size() int64 {
-	fi, err := fw.file.Stat()
-	if err != nil {
-		return 0
-	}
-	return fi.Size()
-}
-func (fw *sftpFileWriter) Close() error {
-	fw.closed = true
-	return fw.file.Close()
-}
-func (fw *sftpFileWriter) Cancel(ctx context.Context) error { return fw.Close() }
-func (fw *sftpFileWriter) Commit(ctx context.Context) error { return nil }
-
-func isNotExist(err error) bool {
-	if err == nil {
-		return false
-	}
-	if errors.Is(err, os.ErrNotExist) {
-		return true
-	}
-	s := err.Error()
-	return strings.Contains(s, "does not exist") || strings.Contains(s, "no such file")
+// toFileInfo converts an SFTP stat result; p is the registry-relative path the caller asked for.
+func toFileInfo(p string, fi os.FileInfo) storage.FileInfo {
+	return storage.FileInfo{Path: p, Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()}
 }
 
 func createDirRecursiveWithClient(client *sftp.Client, dir string) error {
@@ -823,6 +982,9 @@ func createDirRecursiveWithClient(client *sftp.Client, dir string) error {
 	}
 	parts := strings.Split(dir, "/")
 	current := ""
+	if strings.HasPrefix(dir, "/") {
+		current = "/"
+	}
 	for _, p := range parts {
 		if p == "" {
 			continue
@@ -870,18 +1032,49 @@ func deleteDirRecursiveWithClient(client *sftp.Client, dir string) error {
 	return nil
 }
 
-func walkRecursiveWithClient(client *sftp.Client, path string, fn WalkFn) error {
-	fis, err := client.ReadDir(path)
+func removePartialsWithClient(client *sftp.Client, dir string, cutoff time.Time) (int, error) {
+	fis, err := client.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, fi := range fis {
+		full := dir + "/" + fi.Name()
+		if fi.IsDir() {
+			n, err := removePartialsWithClient(client, full, cutoff)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+			continue
+		}
+		if strings.HasSuffix(fi.Name(), partialSuffix) && fi.ModTime().Before(cutoff) {
+			if err := client.Remove(full); err != nil && !isNotExist(err) {
+				return removed, err
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// walkRecursiveWithClient walks remotePath; rel is the same directory relative to the registry root, used for FileInfo.Path.
+func walkRecursiveWithClient(client *sftp.Client, remotePath, rel string, fn storage.WalkFn) error {
+	fis, err := client.ReadDir(remotePath)
 	if err != nil {
 		return err
 	}
 	for _, fi := range fis {
-		full := path + "/" + fi.Name()
-		if err := fn(fi); err != nil {
+		if strings.HasSuffix(fi.Name(), partialSuffix) {
+			continue
+		}
+		full := remotePath + "/" + fi.Name()
+		relChild := pathpkg.Join(rel, fi.Name())
+		if err := fn(toFileInfo(relChild, fi)); err != nil {
 			return err
 		}
 		if fi.IsDir() {
-			if err := walkRecursiveWithClient(client, full, fn); err != nil {
+			if err := walkRecursiveWithClient(client, full, relChild, fn); err != nil {
 				return err
 			}
 		}
@@ -889,14 +1082,6 @@ func walkRecursiveWithClient(client *sftp.Client, path string, fn WalkFn) error
 	return nil
 }
 
-func filepathBase(p string) string {
-	if p == "" {
-		return ""
-	}
-	parts := strings.Split(p, "/")
-	return parts[len(parts)-1]
-}
-
 func checkNoSpace(client *sftp.Client, dir string, size int64, origErr error) {
 	e, ok := origErr.(*sftp.StatusError)
 	if !ok || e.Code != uint32(sftp.ErrSSHFxFailure) {
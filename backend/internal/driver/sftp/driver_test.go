@@ -0,0 +1,241 @@
+package sftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/pkg/sftp"
+	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
+	"refity/backend/internal/storage/crypt"
+)
+
+// pipeClient connects a client to an in-memory SFTP server serving h.
+func pipeClient(t *testing.T, h sftp.Handlers) *sftp.Client {
+	t.Helper()
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	srv := sftp.NewRequestServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{sr, sw}, h)
+	go func() {
+		// Hang up once the client does, so closing it does not block.
+		srv.Serve()
+		sw.Close()
+	}()
+	c, err := sftp.NewClientPipe(cr, cw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// blobClient connects a client to a new in-memory SFTP server holding /registry/blob. Each server
+// has its own files: the in-memory handler fails a file for good once a transfer of it breaks.
+func blobClient(t *testing.T, content string) *sftp.Client {
+	t.Helper()
+	c := pipeClient(t, sftp.InMemHandler())
+	if err := c.MkdirAll("/registry"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Create("/registry/blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return c
+}
+
+// testDriver reads through a pool holding c. The pool has no credentials, so it cannot replace
+// clients that die.
+func testDriver(c *sftp.Client) *PoolStorageDriver {
+	pool := &DriverPool{name: "test", clients: make(chan *sftp.Client, 2), cfg: &config.Config{}, timeout: 20 * time.Millisecond, stopCh: make(chan struct{})}
+	pool.clients <- c
+	pool.alive.Store(1)
+	return &PoolStorageDriver{Pool: pool, Root: "/registry"}
+}
+
+func shortBackoff(t *testing.T) {
+	prev := readBackoff
+	readBackoff = 200 * time.Millisecond
+	t.Cleanup(func() { readBackoff = prev })
+}
+
+func TestResumableReaderReopenFailsTwice(t *testing.T) {
+	shortBackoff(t)
+	c := blobClient(t, "hello world")
+	d := testDriver(c)
+	rc, err := d.Reader(context.Background(), "blob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(rc, head); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill the connection. The first reopen times out on the empty pool at once, the second
+	// after one backoff; a client arrives before the third, two backoffs later.
+	c.Close()
+	fresh := blobClient(t, "hello world")
+	go func() {
+		time.Sleep(2 * readBackoff)
+		d.Pool.clients <- fresh
+	}()
+	rest, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read after reconnect: %v", err)
+	}
+	if got := string(head) + string(rest); got != "hello world" {
+		t.Fatalf("read %q, want %q", got, "hello world")
+	}
+}
+
+func TestResumableReaderGivesUp(t *testing.T) {
+	shortBackoff(t)
+	c := blobClient(t, "hello world")
+	d := testDriver(c)
+	rc, err := d.Reader(context.Background(), "blob", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if _, err := rc.Read(make([]byte, 5)); err == nil {
+		t.Fatal("read succeeded without a connection")
+	}
+	if _, err := rc.Read(make([]byte, 5)); err == nil {
+		t.Fatal("read succeeded after the reader gave up")
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("close after giving up: %v", err)
+	}
+}
+
+func TestPutContentVerifiesDigest(t *testing.T) {
+	d := testDriver(blobClient(t, ""))
+	ctx := storage.WithUploadID(context.Background(), "1")
+	content := []byte("layer")
+	good := "repo/blobs/" + godigest.FromBytes(content).String()
+	bad := "repo/blobs/" + godigest.FromString("other").String()
+
+	if err := d.PutContent(ctx, bad, content); !errors.Is(err, storage.ErrDigestMismatch) {
+		t.Fatalf("put under the wrong digest: %v, want ErrDigestMismatch", err)
+	}
+	if _, err := d.Stat(ctx, bad); !storage.IsNotExist(err) {
+		t.Fatalf("object stored under the wrong digest: %v", err)
+	}
+	if err := d.PutContent(storage.WithEncodedContent(ctx), bad, content); err != nil {
+		t.Fatalf("encoded content is not checked: %v", err)
+	}
+
+	// A partial file of the same upload that differs past its first bytes is not resumed.
+	c, _ := d.Pool.getClient(ctx)
+	f, err := c.Create(tempName(d.remote(good), uploadTag("1")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("laXe"))
+	f.Close()
+	d.Pool.putClient(c)
+	if err := d.PutContent(ctx, good, content); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	got, err := d.GetContent(ctx, good)
+	if err != nil || string(got) != "layer" {
+		t.Fatalf("stored %q (%v), want %q", got, err, "layer")
+	}
+}
+
+func TestPutParallelVerifiesDigest(t *testing.T) {
+	h := sftp.InMemHandler()
+	d := testDriver(pipeClient(t, h))
+	d.Pool.clients <- pipeClient(t, h)
+	d.Streams, d.ChunkSize, d.Threshold = 2, 2, 1
+	ctx := context.Background()
+	content := []byte("layer")
+	bad := "repo/blobs/" + godigest.FromString("other").String()
+	if err := d.PutContent(ctx, bad, content); !errors.Is(err, storage.ErrDigestMismatch) {
+		t.Fatalf("parallel put under the wrong digest: %v, want ErrDigestMismatch", err)
+	}
+	if _, err := d.Stat(ctx, bad); !storage.IsNotExist(err) {
+		t.Fatalf("object stored under the wrong digest: %v", err)
+	}
+}
+
+// droppedUpload stands in for the backend of an upload attempt that fails: it keeps what it was
+// given to store.
+type droppedUpload struct {
+	storage.Driver
+	sealed []byte
+}
+
+func (d *droppedUpload) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
+	d.sealed = content
+	return errors.New("connection lost")
+}
+
+func TestEncryptedUploadResumes(t *testing.T) {
+	keys, err := crypt.LoadKeyring("k1:"+strings.Repeat("ab", 32), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := testDriver(blobClient(t, ""))
+	content := make([]byte, 2<<20)
+	rand.Read(content)
+	path := "repo/blobs/" + godigest.FromBytes(content).String()
+	ctx := storage.WithUploadID(context.Background(), "42")
+
+	// Every attempt of an upload seals the same bytes; another upload seals different ones.
+	first, again, other := &droppedUpload{Driver: d}, &droppedUpload{Driver: d}, &droppedUpload{Driver: d}
+	crypt.New(first, keys).PutContent(ctx, path, content)
+	crypt.New(again, keys).PutContent(ctx, path, content)
+	crypt.New(other, keys).PutContent(storage.WithUploadID(context.Background(), "43"), path, content)
+	if !bytes.Equal(first.sealed, again.sealed) {
+		t.Fatal("two attempts of one upload sealed different ciphertext")
+	}
+	if bytes.Equal(first.sealed, other.sealed) {
+		t.Fatal("two uploads sealed the same ciphertext")
+	}
+
+	// The first attempt got half way before the connection dropped.
+	c, _ := d.Pool.getClient(ctx)
+	c.MkdirAll("/registry/repo/blobs")
+	f, err := c.Create(tempName(d.remote(path), uploadTag("42")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := int64(len(first.sealed) / 2)
+	f.Write(first.sealed[:half])
+	f.Close()
+	d.Pool.putClient(c)
+
+	var resumedAt int64 = -1
+	err = crypt.New(d, keys).PutContent(ctx, path, content, func(written, total int64) {
+		if resumedAt < 0 {
+			resumedAt = written
+		}
+	})
+	if err != nil {
+		t.Fatalf("resumed put: %v", err)
+	}
+	if resumedAt <= half {
+		t.Fatalf("first progress at %d bytes: the upload restarted instead of resuming at %d", resumedAt, half)
+	}
+	got, err := crypt.New(d, keys).GetContent(ctx, path)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("read back %d bytes (%v), want the %d bytes put", len(got), err, len(content))
+	}
+}
@@ -0,0 +1,339 @@
+package sftp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	pathpkg "path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"refity/backend/internal/storage"
+)
+
+// Large objects are transferred as ranges over several pooled connections at once: a single SSH
+// channel is limited by its window, so on high-latency links one stream stays far below the
+// available bandwidth. Each range checks out its own connection, so parallel transfers share
+// the pools fairly with other requests.
+
+// transferRetries is how often one range is retried before the whole transfer fails.
+const transferRetries = 3
+
+var digestPath = regexp.MustCompile(`/(?:blobs|manifests)/sha256:([a-f0-9]{64})$`)
+
+func (d *PoolStorageDriver) parallel(size int64) bool {
+	return d.Streams > 1 && d.ChunkSize > 0 && size >= d.Threshold
+}
+
+// putParallel writes content to a temp file in ranges, verifies its size and renames it into
+// place. Like PutContent it checks the digest of content before sending it (see checkDigest),
+// never by reading the object back. Failed ranges are retried individually. The temp name is
+// random rather than the one sequential uploads resume from, since a failed parallel upload
+// leaves holes.
+func (d *PoolStorageDriver) putParallel(ctx context.Context, remote string, content []byte, progressCb func(written, total int64)) error {
+	if err := checkDigest(ctx, remote, content); err != nil {
+		return err
+	}
+	pool := d.uploadPool()
+	tmp := tempName(remote, "")
+	total := int64(len(content))
+
+	client, err := pool.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	err = ensureDirWithClient(client, pathpkg.Dir(remote))
+	if err == nil {
+		var f *sftp.File
+		if f, err = client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC); err == nil {
+			err = f.Close()
+		}
+	}
+	pool.putClient(client)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg          sync.WaitGroup
+		mu          sync.Mutex
+		firstErr    error
+		written     int64
+		nextPercent int64 = 10
+	)
+	jobs := make(chan int64)
+	for i := 0; i < d.Streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range jobs {
+				data := content[off:min(off+d.ChunkSize, total)]
+				err := retryRange(ctx, "Write", remote, off, len(data), func() error {
+					return writeRange(ctx, pool, tmp, off, data)
+				})
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					cancel()
+					continue
+				}
+				written += int64(len(data))
+				if progressCb != nil && (written*100/total >= nextPercent || written == total) {
+					progressCb(written, total)
+					nextPercent = written*100/total/10*10 + 10
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for off := int64(0); off < total; off += d.ChunkSize {
+		select {
+		case jobs <- off:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	client, err = pool.getClient(context.WithoutCancel(ctx))
+	if err != nil {
+		return err
+	}
+	defer pool.putClient(client)
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	if firstErr != nil {
+		_ = client.Remove(tmp)
+		return firstErr
+	}
+	fi, err := client.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != total {
+		_ = client.Remove(tmp)
+		return fmt.Errorf("SFTP: %s has %d bytes after parallel upload, expected %d", tmp, fi.Size(), total)
+	}
+	return renameIntoPlace(client, tmp, remote)
+}
+
+func writeRange(ctx context.Context, pool *DriverPool, tmp string, off int64, data []byte) error {
+	client, err := pool.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.putClient(client)
+	f, err := client.OpenFile(tmp, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, off); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func readRange(ctx context.Context, pool *DriverPool, remote string, off int64, buf []byte) error {
+	client, err := pool.getClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer pool.putClient(client)
+	f, err := client.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := f.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = fmt.Errorf("SFTP: %s shrank during read (got %d of %d bytes at offset %d)", remote, n, len(buf), off)
+	}
+	return err
+}
+
+// retryRange runs fn until it succeeds, the object turns out not to exist, or ctx is done.
+func retryRange(ctx context.Context, op, path string, off int64, n int, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || isNotExist(err) || ctx.Err() != nil || attempt > transferRetries {
+			return err
+		}
+		log.Printf("[SFTP] %s %s range %d+%d failed (%v), retrying (attempt %d/%d)", op, path, off, n, err, attempt, transferRetries)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+// parallelReader streams the first chunk sequentially, so short reads such as header probes
+// cost no more than before, then switches to concurrent ranged reads delivered in order. At most
+// Streams ranges are buffered ahead of the reader. Reads of a whole blob or by-digest manifest are
+// checked against the digest in the path before EOF is returned.
+type parallelReader struct {
+	d      *PoolStorageDriver
+	ctx    context.Context
+	cancel context.CancelFunc
+	path   string
+	size   int64
+	offset int64
+
+	seq      *resumableReader // sequential phase; nil once parallel
+	seqUntil int64
+
+	order chan *rangeJob // ranges in delivery order
+	cur   *rangeJob
+	buf   []byte
+
+	hash   hash.Hash // nil unless verifying
+	digest string
+	err    error
+}
+
+type rangeJob struct {
+	off  int64
+	buf  []byte
+	err  error
+	done chan struct{}
+}
+
+func newParallelReader(d *PoolStorageDriver, ctx context.Context, seq *resumableReader, size int64) *parallelReader {
+	r := &parallelReader{d: d, path: seq.path, size: size, offset: seq.offset, seq: seq, seqUntil: seq.offset + d.ChunkSize}
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	if m := digestPath.FindStringSubmatch("/" + seq.path); m != nil && seq.offset == 0 && !storage.IsEncodedContent(ctx) {
+		r.hash, r.digest = sha256.New(), m[1]
+	}
+	return r
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	var n int
+	var err error
+	if r.seq != nil && r.offset < r.seqUntil {
+		n, err = r.seq.Read(p[:min(int64(len(p)), r.seqUntil-r.offset)])
+	} else {
+		n, err = r.readParallel(p)
+	}
+	r.offset += int64(n)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if err == nil && r.offset >= r.size {
+		err = io.EOF
+	}
+	if err == io.EOF && r.hash != nil {
+		if got := hex.EncodeToString(r.hash.Sum(nil)); got != r.digest {
+			err = fmt.Errorf("SFTP: %s: %w: content hashes to sha256:%s", r.path, storage.ErrDigestMismatch, got)
+		}
+	}
+	if err != nil {
+		r.err = err
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+	}
+	return n, err
+}
+
+func (r *parallelReader) readParallel(p []byte) (int, error) {
+	if r.seq != nil {
+		r.seq.Close()
+		r.seq = nil
+		r.start()
+	}
+	for len(r.buf) == 0 {
+		if r.offset >= r.size {
+			return 0, io.EOF
+		}
+		var ok bool
+		select {
+		case r.cur, ok = <-r.order:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+		if !ok {
+			return 0, io.EOF
+		}
+		select {
+		case <-r.cur.done:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+		if r.cur.err != nil {
+			return 0, r.cur.err
+		}
+		r.buf = r.cur.buf
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// start launches the producer and workers for the rest of the object.
+func (r *parallelReader) start() {
+	remote := r.d.remote(r.path)
+	r.order = make(chan *rangeJob, r.d.Streams)
+	work := make(chan *rangeJob)
+	go func() {
+		defer close(work)
+		defer close(r.order)
+		for off := r.offset; off < r.size; off += r.d.ChunkSize {
+			j := &rangeJob{off: off, buf: make([]byte, min(r.d.ChunkSize, r.size-off)), done: make(chan struct{})}
+			select {
+			case r.order <- j:
+			case <-r.ctx.Done():
+				return
+			}
+			select {
+			case work <- j:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < r.d.Streams; i++ {
+		go func() {
+			for j := range work {
+				j.err = retryRange(r.ctx, "Read", r.path, j.off, len(j.buf), func() error {
+					return readRange(r.ctx, r.d.Pool, remote, j.off, j.buf)
+				})
+				close(j.done)
+			}
+		}()
+	}
+}
+
+func (r *parallelReader) Close() error {
+	r.cancel()
+	if r.err == nil {
+		r.err = errors.New("sftp: read after close")
+	}
+	if r.seq != nil {
+		return r.seq.Close()
+	}
+	return nil
+}
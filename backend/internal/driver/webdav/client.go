@@ -0,0 +1,267 @@
+package webdav
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client is a minimal WebDAV (RFC 4918) client: PROPFIND, MKCOL, MOVE, GET, PUT and DELETE
+// with HTTP basic auth. It works with Hetzner Storage Boxes, Nextcloud, Apache mod_dav and x/net/webdav.
+type client struct {
+	base     *url.URL // collection URL all paths are relative to; Path ends without "/"
+	username string
+	password string
+	http     *http.Client
+}
+
+// davError is a non-success HTTP status for a WebDAV request.
+type davError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+func (e *davError) Error() string {
+	return fmt.Sprintf("webdav: %s %s: HTTP %d %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Is makes errors.Is(err, os.ErrNotExist) true for 404, like the other drivers.
+func (e *davError) Is(target error) bool {
+	return target == os.ErrNotExist && e.StatusCode == http.StatusNotFound
+}
+
+// url returns the absolute URL of p (slash-separated, relative to base). dir adds a trailing slash,
+// which some servers require for collections.
+func (c *client) url(p string, dir bool) *url.URL {
+	u := *c.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.Trim(p, "/")
+	if dir && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	return &u
+}
+
+func (c *client) do(ctx context.Context, method, p string, dir bool, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(p, dir).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && size >= 0 {
+		req.ContentLength = size
+	}
+	if c.username != "" || c.password != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return c.http.Do(req)
+}
+
+// expect drains and closes resp and returns a davError unless its status is one of ok.
+func expect(resp *http.Response, method, p string, ok ...int) error {
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	return &davError{Method: method, Path: p, StatusCode: resp.StatusCode}
+}
+
+// ---------------------------------------------------------------------------
+// PROPFIND
+// ---------------------------------------------------------------------------
+
+type multistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href     string        `xml:"DAV: href"`
+	Propstat []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string  `xml:"DAV: status"`
+	Prop   davProp `xml:"DAV: prop"`
+}
+
+type davProp struct {
+	ContentLength string `xml:"DAV: getcontentlength"`
+	LastModified  string `xml:"DAV: getlastmodified"`
+	ResourceType  struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+}
+
+// entry is one PROPFIND result; Path is relative to the client base.
+type entry struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>`
+
+// propfind returns p itself (first) followed by its children when depth is "1".
+func (c *client) propfind(ctx context.Context, p string, depth string) ([]entry, error) {
+	header := http.Header{}
+	header.Set("Depth", depth)
+	header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := c.do(ctx, "PROPFIND", p, false, header, strings.NewReader(propfindBody), int64(len(propfindBody)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, expect(resp, "PROPFIND", p)
+	}
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("webdav: PROPFIND %s: decode response: %w", p, err)
+	}
+	self := strings.Trim(p, "/")
+	var selfEntry *entry
+	var children []entry
+	for _, r := range ms.Responses {
+		e, ok := c.toEntry(r)
+		if !ok {
+			continue
+		}
+		if e.Path == self {
+			ec := e
+			selfEntry = &ec
+			continue
+		}
+		children = append(children, e)
+	}
+	if selfEntry == nil {
+		// Servers always report the requested resource; fall back to a directory if its href was unusual.
+		selfEntry = &entry{Path: self, IsDir: len(children) > 0}
+	}
+	return append([]entry{*selfEntry}, children...), nil
+}
+
+// toEntry converts a PROPFIND response, mapping its href back to a base-relative path.
+func (c *client) toEntry(r davResponse) (entry, bool) {
+	u, err := url.Parse(r.Href)
+	if err != nil {
+		return entry{}, false
+	}
+	basePath := strings.TrimSuffix(c.base.Path, "/")
+	rel := strings.TrimPrefix(u.Path, basePath)
+	if len(rel) == len(u.Path) && basePath != "" {
+		return entry{}, false
+	}
+	e := entry{Path: strings.Trim(rel, "/")}
+	for _, ps := range r.Propstat {
+		if ps.Status != "" && !strings.Contains(ps.Status, " 200") {
+			continue
+		}
+		if ps.Prop.ResourceType.Collection != nil {
+			e.IsDir = true
+		}
+		if ps.Prop.ContentLength != "" {
+			e.Size, _ = strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+		}
+		if ps.Prop.LastModified != "" {
+			e.ModTime, _ = http.ParseTime(ps.Prop.LastModified)
+		}
+	}
+	return e, true
+}
+
+// ---------------------------------------------------------------------------
+// Collections and objects
+// ---------------------------------------------------------------------------
+
+// mkcolAll creates p and its missing parents. 405 means the collection already exists.
+func (c *client) mkcolAll(ctx context.Context, p string) error {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		dir := strings.Join(parts[:i+1], "/")
+		resp, err := c.do(ctx, "MKCOL", dir, true, nil, nil, -1)
+		if err != nil {
+			return err
+		}
+		if err := expect(resp, "MKCOL", dir, http.StatusCreated, http.StatusOK, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) get(ctx context.Context, p string, offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(ctx, http.MethodGet, p, false, header, nil, -1)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			// Server ignored Range: skip to offset ourselves.
+			if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	return nil, expect(resp, http.MethodGet, p)
+}
+
+func (c *client) put(ctx context.Context, p string, body io.Reader, size int64) error {
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	resp, err := c.do(ctx, http.MethodPut, p, false, header, body, size)
+	if err != nil {
+		return err
+	}
+	return expect(resp, http.MethodPut, p, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+}
+
+func (c *client) move(ctx context.Context, src, dst string) error {
+	header := http.Header{}
+	header.Set("Destination", c.url(dst, false).String())
+	header.Set("Overwrite", "T")
+	resp, err := c.do(ctx, "MOVE", src, false, header, nil, -1)
+	if err != nil {
+		return err
+	}
+	return expect(resp, "MOVE", src, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+}
+
+func (c *client) delete(ctx context.Context, p string, dir bool) error {
+	resp, err := c.do(ctx, http.MethodDelete, p, dir, nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	return expect(resp, http.MethodDelete, p, http.StatusNoContent, http.StatusOK, http.StatusAccepted)
+}
@@ -0,0 +1,293 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"strings"
+	"time"
+
+	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
+)
+
+func init() {
+	storage.Register("webdav", func(cfg *config.Config) (storage.Driver, error) {
+		return NewDriver(cfg)
+	})
+}
+
+// Driver stores registry objects on a WebDAV server under Root (relative to WEBDAV_URL).
+type Driver struct {
+	client *client
+	Root   string
+}
+
+func NewDriver(cfg *config.Config) (*Driver, error) {
+	u, err := url.Parse(cfg.WebDAVURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("WEBDAV_URL %q: must be an http(s) URL", cfg.WebDAVURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return &Driver{
+		client: &client{
+			base:     u,
+			username: cfg.WebDAVUsername,
+			password: cfg.WebDAVPassword,
+			http:     &http.Client{},
+		},
+		Root: strings.Trim(cfg.WebDAVRoot, "/"),
+	}, nil
+}
+
+func (d *Driver) Name() string { return "webdav" }
+
+// remote maps a registry-relative path to its path under the server URL.
+func (d *Driver) remote(p string) string {
+	return strings.Trim(pathpkg.Join(d.Root, p), "/")
+}
+
+// rel maps a server path from PROPFIND back to a registry-relative path.
+func (d *Driver) rel(p string) string {
+	if d.Root == "" {
+		return p
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(p, d.Root), "/")
+}
+
+// CheckRoot creates the root collection if missing and verifies it is writable with a probe file.
+func (d *Driver) CheckRoot(ctx context.Context) error {
+	if err := d.client.mkcolAll(ctx, d.Root); err != nil {
+		return fmt.Errorf("WebDAV root %q: %w", d.Root, err)
+	}
+	probe := d.remote(fmt.Sprintf(".refity-write-test-%d", time.Now().UnixNano()))
+	if err := d.client.put(ctx, probe, strings.NewReader("ok"), 2); err != nil {
+		return fmt.Errorf("WebDAV root %q is not writable: %w", d.Root, err)
+	}
+	if err := d.client.delete(ctx, probe, false); err != nil {
+		log.Printf("[WebDAV] CheckRoot: failed to remove probe %s: %v", probe, err)
+	}
+	return nil
+}
+
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	rc, err := d.client.get(ctx, d.remote(path), 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// PutContent uploads content to a temp name and MOVEs it over path, so readers never see a
+// partial object.
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
+	remote := d.remote(path)
+	if err := d.client.mkcolAll(ctx, pathpkg.Dir(remote)); err != nil {
+		return err
+	}
+	var cb func(written, total int64)
+	if len(progressCb) > 0 {
+		cb = progressCb[0]
+	}
+	body := storage.ProgressReader(bytes.NewReader(content), int64(len(content)), cb)
+	tmp := tempName(remote)
+	err := d.client.put(ctx, tmp, body, int64(len(content)))
+	if err == nil {
+		err = d.client.move(ctx, tmp, remote)
+	}
+	if err != nil {
+		d.removeTemp(tmp)
+	}
+	return err
+}
+
+// partialSuffix marks an upload in progress; such objects are hidden from List and Walk.
+const partialSuffix = ".partial"
+
+// tempName returns a temp object next to remote for one upload to it.
+func tempName(remote string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return remote + "." + hex.EncodeToString(b) + partialSuffix
+}
+
+// removeTemp deletes the temp object of a failed or cancelled upload. It runs on a fresh context:
+// the upload's may be what was cancelled.
+func (d *Driver) removeTemp(tmp string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := d.client.delete(ctx, tmp, false); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("[WebDAV] Failed to remove temp upload %s: %v", tmp, err)
+	}
+}
+
+// Reader uses a ranged GET to start at offset.
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	return d.client.get(ctx, d.remote(path), offset)
+}
+
+// Writer streams a single PUT (chunked transfer encoding) of a temp object fed by the returned
+// writer. Commit/Close finishes the request and MOVEs the temp object over path; Cancel aborts it
+// and deletes the temp object. WebDAV has no append, so appendMode is unsupported.
+func (d *Driver) Writer(ctx context.Context, path string, appendMode bool) (storage.FileWriter, error) {
+	if appendMode {
+		return nil, errors.New("webdav: append writes are not supported")
+	}
+	remote := d.remote(path)
+	if err := d.client.mkcolAll(ctx, pathpkg.Dir(remote)); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	w := &writer{d: d, tmp: tempName(remote), remote: remote, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := d.client.put(ctx, w.tmp, pr, -1)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+func (d *Driver) Stat(ctx context.Context, path string) (storage.FileInfo, error) {
+	entries, err := d.client.propfind(ctx, d.remote(path), "0")
+	if err != nil {
+		return storage.FileInfo{}, err
+	}
+	e := entries[0]
+	return storage.FileInfo{Path: path, Size: e.Size, ModTime: e.ModTime, IsDir: e.IsDir}, nil
+}
+
+func (d *Driver) List(ctx context.Context, path string) ([]string, error) {
+	entries, err := d.client.propfind(ctx, d.remote(path), "1")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries)-1)
+	for _, e := range entries[1:] {
+		if !e.IsDir && strings.HasSuffix(e.Path, partialSuffix) {
+			continue
+		}
+		names = append(names, pathpkg.Base(e.Path))
+	}
+	return names, nil
+}
+
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	dst := d.remote(destPath)
+	if err := d.client.mkcolAll(ctx, pathpkg.Dir(dst)); err != nil {
+		return err
+	}
+	return d.client.move(ctx, d.remote(sourcePath), dst)
+}
+
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	return d.client.delete(ctx, d.remote(path), false)
+}
+
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "", nil
+}
+
+// Walk visits path recursively with Depth: 1 PROPFINDs (many servers reject Depth: infinity),
+// reporting each directory before its contents.
+func (d *Driver) Walk(ctx context.Context, path string, f storage.WalkFn, options ...func(*storage.WalkOptions)) error {
+	entries, err := d.client.propfind(ctx, d.remote(path), "1")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries[1:] {
+		if !e.IsDir && strings.HasSuffix(e.Path, partialSuffix) {
+			continue
+		}
+		fi := storage.FileInfo{Path: d.rel(e.Path), Size: e.Size, ModTime: e.ModTime, IsDir: e.IsDir}
+		if err := f(fi); err != nil {
+			return err
+		}
+		if e.IsDir {
+			if err := d.Walk(ctx, fi.Path, f, options...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Driver) CreateRepositoryFolder(ctx context.Context, repoName string) error {
+	base := d.remote(repoName)
+	for _, sub := range []string{"blobs/uploads", "manifests"} {
+		if err := d.client.mkcolAll(ctx, base+"/"+sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Driver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
+	return d.client.delete(ctx, d.remote(repoName), true)
+}
+
+func (d *Driver) CreateGroupFolder(ctx context.Context, groupName string) error {
+	return d.client.mkcolAll(ctx, d.remote(groupName))
+}
+
+// writer feeds the body of an in-flight PUT of tmp, which Commit moves to remote.
+type writer struct {
+	d        *Driver
+	tmp      string
+	remote   string
+	pw       *io.PipeWriter
+	size     int64
+	done     chan error
+	finished bool
+	err      error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *writer) Size() int64 { return w.size }
+
+func (w *writer) Close() error { return w.Commit(context.Background()) }
+
+// Commit ends the request body, waits for the server to store the temp object and moves it into
+// place.
+func (w *writer) Commit(ctx context.Context) error {
+	if w.finished {
+		return w.err
+	}
+	w.finished = true
+	w.pw.Close()
+	w.err = <-w.done
+	if w.err == nil {
+		w.err = w.d.client.move(ctx, w.tmp, w.remote)
+	}
+	if w.err != nil {
+		w.d.removeTemp(w.tmp)
+	}
+	return w.err
+}
+
+// Cancel aborts the PUT and deletes whatever the server already stored of the temp object.
+func (w *writer) Cancel(ctx context.Context) error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+	w.pw.CloseWithError(errors.New("webdav: upload cancelled"))
+	<-w.done
+	w.d.removeTemp(w.tmp)
+	return nil
+}
@@ -0,0 +1,176 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+	"refity/backend/internal/config"
+	"refity/backend/internal/storage"
+)
+
+// testDriver serves an in-memory WebDAV tree under /dav behind basic auth.
+func testDriver(t *testing.T) *Driver {
+	t.Helper()
+	dav := &webdav.Handler{Prefix: "/dav", FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "user" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	d, err := NewDriver(&config.Config{WebDAVURL: srv.URL + "/dav/", WebDAVUsername: "user", WebDAVPassword: "secret", WebDAVRoot: "/registry/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CheckRoot(context.Background()); err != nil {
+		t.Fatalf("CheckRoot: %v", err)
+	}
+	return d
+}
+
+// rawNames lists dir on the server, temp files included.
+func rawNames(t *testing.T, d *Driver, dir string) []string {
+	t.Helper()
+	entries, err := d.client.propfind(context.Background(), d.remote(dir), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries[1:] {
+		names = append(names, e.Path[strings.LastIndex(e.Path, "/")+1:])
+	}
+	return names
+}
+
+func TestRoundTrip(t *testing.T) {
+	d := testDriver(t)
+	ctx := context.Background()
+	if err := d.CreateRepositoryFolder(ctx, "team/app"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := d.Stat(ctx, "team/app/blobs/uploads"); err != nil || !fi.IsDir {
+		t.Fatalf("Stat blobs/uploads: %+v, %v", fi, err)
+	}
+
+	var progress []int64
+	if err := d.PutContent(ctx, "team/app/manifests/latest", []byte("hello world"), func(written, total int64) {
+		progress = append(progress, written)
+	}); err != nil {
+		t.Fatalf("PutContent: %v", err)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 11 {
+		t.Fatalf("progress %v, want it to end at 11", progress)
+	}
+	got, err := d.GetContent(ctx, "team/app/manifests/latest")
+	if err != nil || string(got) != "hello world" {
+		t.Fatalf("GetContent: %q, %v", got, err)
+	}
+	fi, err := d.Stat(ctx, "team/app/manifests/latest")
+	if err != nil || fi.Size != 11 || fi.IsDir || fi.ModTime.IsZero() {
+		t.Fatalf("Stat: %+v, %v", fi, err)
+	}
+	rc, err := d.Reader(ctx, "team/app/manifests/latest", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tail, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(tail) != "world" {
+		t.Fatalf("Reader at 6: %q", tail)
+	}
+
+	if err := d.Move(ctx, "team/app/manifests/latest", "team/app/manifests/v1"); err != nil {
+		t.Fatalf("Move: %v", err)
+	}
+	names, err := d.List(ctx, "team/app/manifests")
+	if err != nil || !reflect.DeepEqual(names, []string{"v1"}) {
+		t.Fatalf("List: %v, %v", names, err)
+	}
+
+	var walked []string
+	if err := d.Walk(ctx, "team", func(fi storage.FileInfo) error {
+		walked = append(walked, fi.Path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(walked)
+	want := []string{"team/app", "team/app/blobs", "team/app/blobs/uploads", "team/app/manifests", "team/app/manifests/v1"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Fatalf("Walk: %v, want %v", walked, want)
+	}
+
+	if err := d.Delete(ctx, "team/app/manifests/v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Stat(ctx, "team/app/manifests/v1"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat after Delete: %v", err)
+	}
+}
+
+func TestWriterStagesUnderTempName(t *testing.T) {
+	d := testDriver(t)
+	ctx := context.Background()
+
+	w, err := d.Writer(ctx, "repo/blobs/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "partial")
+	if err := w.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := rawNames(t, d, "repo/blobs"); len(names) != 0 {
+		t.Fatalf("left behind after Cancel: %v", names)
+	}
+
+	w, err = d.Writer(ctx, "repo/blobs/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "complete")
+	if err := w.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := rawNames(t, d, "repo/blobs"); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("after Commit: %v", names)
+	}
+	if got, err := d.GetContent(ctx, "repo/blobs/a"); err != nil || string(got) != "complete" {
+		t.Fatalf("GetContent: %q, %v", got, err)
+	}
+}
+
+func TestPropfindHidesTempFiles(t *testing.T) {
+	d := testDriver(t)
+	ctx := context.Background()
+	if err := d.PutContent(ctx, "repo/blobs/a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.client.put(ctx, d.remote("repo/blobs/b.0123.partial"), strings.NewReader("b"), 1); err != nil {
+		t.Fatal(err)
+	}
+	names, err := d.List(ctx, "repo/blobs")
+	if err != nil || !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("List: %v, %v", names, err)
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	d := testDriver(t)
+	d.client.password = "wrong"
+	var de *davError
+	if _, err := d.Stat(context.Background(), ""); !errors.As(err, &de) || de.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Stat with a wrong password: %v", err)
+	}
+}
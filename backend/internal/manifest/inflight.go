@@ -0,0 +1,71 @@
+package manifest
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	mu        sync.Mutex
+	pushed    = make(map[string]time.Time) // blob path -> last time a push uploaded or checked it
+	pruned    time.Time
+	uploading = make(map[string]int) // blob path -> background uploads still storing it
+)
+
+// openPushWindow is how long a blob a push uploaded, or found already stored, counts as part of
+// that push: its manifest may follow hours later when the other layers upload over a slow link.
+const openPushWindow = 24 * time.Hour
+
+// NotePushedBlob records that a push uploaded blobPath or was told it is already stored.
+func NotePushedBlob(blobPath string) {
+	now := time.Now()
+	mu.Lock()
+	defer mu.Unlock()
+	pushed[blobPath] = now
+	if now.Sub(pruned) > time.Hour {
+		for p, at := range pushed {
+			if now.Sub(at) > openPushWindow {
+				delete(pushed, p)
+			}
+		}
+		pruned = now
+	}
+}
+
+// BeginBlobUpload records that a background upload is storing blobPath until the returned func
+// is called.
+func BeginBlobUpload(blobPath string) (done func()) {
+	mu.Lock()
+	uploading[blobPath]++
+	mu.Unlock()
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if uploading[blobPath]--; uploading[blobPath] == 0 {
+			delete(uploading, blobPath)
+		}
+	}
+}
+
+// InFlightBlobs returns the digests of the blobs of repo a push in progress may still reference:
+// those uploaded or found already stored within openPushWindow, and those a background upload is
+// still storing. Garbage collection must keep them even when no manifest references them yet.
+func InFlightBlobs(repo string) map[string]bool {
+	dir := strings.TrimLeft(repo, "/") + "/blobs"
+	out := make(map[string]bool)
+	mu.Lock()
+	defer mu.Unlock()
+	for p, at := range pushed {
+		if path.Dir(p) == dir && time.Since(at) <= openPushWindow {
+			out[path.Base(p)] = true
+		}
+	}
+	for p := range uploading {
+		if path.Dir(p) == dir {
+			out[path.Base(p)] = true
+		}
+	}
+	return out
+}
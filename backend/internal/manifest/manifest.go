@@ -0,0 +1,17 @@
+// Package manifest holds what the registry and garbage collection must agree on about manifests:
+// the OCI copy pulls store beside a pushed manifest, and the blobs pushes in progress may still
+// reference from a manifest not put yet.
+package manifest
+
+import "strings"
+
+// ToOCI rewrites Docker v2 manifest media types to OCI so pull works with daemons that require OCI.
+// Pulls store the rewritten copy by its own digest beside the pushed manifest.
+func ToOCI(manifest []byte) []byte {
+	s := string(manifest)
+	s = strings.ReplaceAll(s, "application/vnd.docker.distribution.manifest.v2+json", "application/vnd.oci.image.manifest.v1+json")
+	s = strings.ReplaceAll(s, "application/vnd.docker.distribution.manifest.list.v2+json", "application/vnd.oci.image.index.v1+json")
+	s = strings.ReplaceAll(s, "application/vnd.docker.container.image.v1+json", "application/vnd.oci.image.config.v1+json")
+	s = strings.ReplaceAll(s, "application/vnd.docker.image.rootfs.diff.tar.gzip", "application/vnd.oci.image.layer.v1.tar+gzip")
+	return []byte(s)
+}
@@ -0,0 +1,207 @@
+// Package quota enforces the storage quotas admins set per group or user. Usage is computed from
+// the images and layers tables: a layer counts once per repository, as storage holds it, and a
+// user's usage covers the tags they pushed last. Pushes that would go over a limit are denied
+// when a blob is committed and when a manifest is put; going over a soft limit is logged.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"refity/backend/internal/database"
+)
+
+// Quota kinds.
+const (
+	Group = "group"
+	User  = "user"
+)
+
+// Usage states.
+const (
+	OK       = "ok"
+	Warning  = "warning" // over the soft limit
+	Exceeded = "exceeded"
+)
+
+// ErrExceeded is wrapped by the error Check returns when a push would go over a limit.
+var ErrExceeded = errors.New("storage quota exceeded")
+
+// Usage is what a group or user stores against its quota.
+type Usage struct {
+	ID         int64  `json:"id,omitempty"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	UsedBytes  int64  `json:"used_bytes"`
+	LimitBytes int64  `json:"limit_bytes"` // 0 = no quota
+	SoftBytes  int64  `json:"soft_bytes"`
+	State      string `json:"state,omitempty"` // ok, warning or exceeded; empty without a quota
+}
+
+// Validate checks a quota before it is stored. A soft limit left at 0 defaults to softPercent
+// of the limit.
+func Validate(q *database.Quota, softPercent int) error {
+	q.Name = strings.TrimSpace(q.Name)
+	switch q.Kind {
+	case Group:
+		if q.Name == "" || strings.Contains(q.Name, "/") {
+			return errors.New("group quota needs a group name without slashes")
+		}
+	case User:
+		if q.Name == "" {
+			return errors.New("user quota needs a username")
+		}
+	default:
+		return fmt.Errorf("kind must be %s or %s, not %q", Group, User, q.Kind)
+	}
+	if q.LimitBytes <= 0 {
+		return errors.New("limit_bytes must be positive")
+	}
+	if q.SoftBytes < 0 || q.SoftBytes > q.LimitBytes {
+		return errors.New("soft_bytes must be between 0 and limit_bytes")
+	}
+	if q.SoftBytes == 0 {
+		q.SoftBytes = q.LimitBytes / 100 * int64(softPercent)
+	}
+	return nil
+}
+
+// GroupOf returns the group of a repository: the part of its name before the first slash.
+func GroupOf(repo string) string {
+	group, _, _ := strings.Cut(repo, "/")
+	return group
+}
+
+func used(db *database.Database, kind, name string) (int64, error) {
+	if kind == User {
+		return db.UserUsage(name)
+	}
+	return db.GroupUsage(name)
+}
+
+func usageOf(q *database.Quota, usedBytes int64) Usage {
+	u := Usage{ID: q.ID, Kind: q.Kind, Name: q.Name, UsedBytes: usedBytes, LimitBytes: q.LimitBytes, SoftBytes: q.SoftBytes, State: OK}
+	switch {
+	case usedBytes > q.LimitBytes:
+		u.State = Exceeded
+	case q.SoftBytes > 0 && usedBytes > q.SoftBytes:
+		u.State = Warning
+	}
+	return u
+}
+
+// Get returns the usage of a group or user, with its quota if it has one.
+func Get(db *database.Database, kind, name string) (Usage, error) {
+	n, err := used(db, kind, name)
+	if err != nil {
+		return Usage{}, err
+	}
+	q, err := db.GetQuota(kind, name)
+	if err != nil {
+		return Usage{}, err
+	}
+	if q == nil {
+		return Usage{Kind: kind, Name: name, UsedBytes: n}, nil
+	}
+	return usageOf(q, n), nil
+}
+
+// All returns every quota with its usage.
+func All(db *database.Database) ([]Usage, error) {
+	quotas, err := db.GetQuotas()
+	if err != nil {
+		return nil, err
+	}
+	out := []Usage{}
+	for _, q := range quotas {
+		n, err := used(db, q.Kind, q.Name)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, usageOf(q, n))
+	}
+	return out, nil
+}
+
+// ManifestLayers returns the layers an image manifest references, by digest. An index has none:
+// its platform manifests are checked when they are pushed.
+func ManifestLayers(manifest []byte) map[string]int64 {
+	var m struct {
+		Layers []struct {
+			Digest string `json:"digest"`
+			Size   int64  `json:"size"`
+		} `json:"layers"`
+	}
+	layers := make(map[string]int64)
+	if json.Unmarshal(manifest, &m) != nil {
+		return layers
+	}
+	for _, l := range m.Layers {
+		layers[l.Digest] = l.Size
+	}
+	return layers
+}
+
+// Added returns the bytes blobs add to repo: the size of those it does not hold yet.
+func Added(db *database.Database, repo string, blobs map[string]int64) (int64, error) {
+	held, err := db.GetRepositoryLayerDigests(repo)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for digest, size := range blobs {
+		if !held[digest] {
+			n += size
+		}
+	}
+	return n, nil
+}
+
+// Check returns an error wrapping ErrExceeded if storing add more bytes in repo, pushed by
+// username, would take the repository's group or the user over quota.
+func Check(db *database.Database, repo, username string, add int64) error {
+	if add <= 0 {
+		return nil
+	}
+	targets := [][2]string{{Group, GroupOf(repo)}}
+	if username != "" {
+		targets = append(targets, [2]string{User, username})
+	}
+	for _, t := range targets {
+		q, err := db.GetQuota(t[0], t[1])
+		if err != nil {
+			return fmt.Errorf("load %s quota: %w", t[0], err)
+		}
+		if q == nil {
+			continue
+		}
+		n, err := used(db, q.Kind, q.Name)
+		if err != nil {
+			return fmt.Errorf("%s %s usage: %w", q.Kind, q.Name, err)
+		}
+		if n+add > q.LimitBytes {
+			return fmt.Errorf("%w: %s %s would use %s of its %s quota", ErrExceeded, q.Kind, q.Name, Size(n+add), Size(q.LimitBytes))
+		}
+		if q.SoftBytes > 0 && n+add > q.SoftBytes {
+			log.Printf("[Quota] %s %s over its soft limit: %s of %s (quota %s)", q.Kind, q.Name, Size(n+add), Size(q.SoftBytes), Size(q.LimitBytes))
+		}
+	}
+	return nil
+}
+
+// Size formats a byte count for messages, e.g. "1.5 GiB".
+func Size(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
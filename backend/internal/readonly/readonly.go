@@ -0,0 +1,125 @@
+// Package readonly holds the registry's read-only state. Maintenance mode, switched by an admin
+// or READ_ONLY, refuses every write through /v2 and /api and pauses the scheduled jobs that write,
+// e.g. during Storage Box maintenance or a database restore. Low-space mode, switched by the capacity monitor, refuses only pushes:
+// deletes free space. Reads are always served.
+package readonly
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Mode is one reason the registry is read-only.
+type Mode struct {
+	Reason string    `json:"reason"`
+	By     string    `json:"by,omitempty"` // admin who enabled it, "config" for READ_ONLY
+	Since  time.Time `json:"since"`
+}
+
+// State is whether, and why, writes are refused.
+type State struct {
+	ReadOnly    bool  `json:"read_only"`
+	Maintenance *Mode `json:"maintenance"`
+	LowSpace    *Mode `json:"low_space"`
+}
+
+var (
+	mu          sync.RWMutex
+	maintenance *Mode
+	lowSpace    *Mode
+)
+
+// Enable starts maintenance mode, or updates its reason.
+func Enable(reason, by string) {
+	if reason == "" {
+		reason = "maintenance"
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maintenance == nil {
+		log.Printf("Read-only mode enabled by %s: %s", by, reason)
+		maintenance = &Mode{Since: time.Now().UTC()}
+	}
+	maintenance.Reason, maintenance.By = reason, by
+}
+
+// Disable ends maintenance mode.
+func Disable(by string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if maintenance != nil {
+		log.Printf("Read-only mode disabled by %s", by)
+	}
+	maintenance = nil
+}
+
+// SetLowSpace refuses pushes while reason is not empty; "" lifts it.
+func SetLowSpace(reason string) {
+	mu.Lock()
+	defer mu.Unlock()
+	switch {
+	case reason == "":
+		if lowSpace != nil {
+			log.Printf("Registry accepting pushes again")
+		}
+		lowSpace = nil
+	case lowSpace == nil:
+		log.Printf("Registry read-only: %s", reason)
+		lowSpace = &Mode{Reason: reason, By: "capacity", Since: time.Now().UTC()}
+	default:
+		lowSpace.Reason = reason
+	}
+}
+
+// ErrReadOnly is wrapped by the errors of background writes refused in maintenance mode.
+var ErrReadOnly = errors.New("registry is read-only")
+
+// CheckMaintenance returns an error wrapping ErrReadOnly while maintenance mode is on. Scheduled
+// jobs that write to the database or storage on their own (retention, repairs, backups, upload
+// replay) call it before they write. Low-space mode does not stop them.
+func CheckMaintenance() error {
+	mu.RLock()
+	defer mu.RUnlock()
+	if maintenance != nil {
+		return fmt.Errorf("%w: %s", ErrReadOnly, maintenance.Reason)
+	}
+	return nil
+}
+
+// Get returns the current state.
+func Get() State {
+	mu.RLock()
+	defer mu.RUnlock()
+	st := State{ReadOnly: maintenance != nil || lowSpace != nil}
+	if maintenance != nil {
+		m := *maintenance
+		st.Maintenance = &m
+	}
+	if lowSpace != nil {
+		m := *lowSpace
+		st.LowSpace = &m
+	}
+	return st
+}
+
+// Refusal returns why a request with method must be refused, or "" to serve it. push is set for
+// registry requests, which low-space mode also refuses unless they delete.
+func Refusal(method string, push bool) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return ""
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if maintenance != nil {
+		return "registry is read-only: " + maintenance.Reason
+	}
+	if lowSpace != nil && push && method != http.MethodDelete {
+		return "registry is read-only: " + lowSpace.Reason
+	}
+	return ""
+}
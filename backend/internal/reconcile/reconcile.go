@@ -0,0 +1,469 @@
+// Package reconcile compares the tags held in storage with the database and repairs the database
+// from storage. Storage is authoritative: tag manifests there are what clients pull, while the
+// database only indexes them for the UI and can drift (failed background saves, deletes that
+// missed a side, or a lost refity.db).
+package reconcile
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"refity/backend/internal/database"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/storage"
+)
+
+// pushGrace is how old a database-only tag must be before it is reported: a fresh push may still
+// be uploading its manifest in the background.
+const pushGrace = time.Hour
+
+// ErrRunning is returned by Run while another run is active.
+var ErrRunning = errors.New("a reconciliation is already running")
+
+// Options tune scheduled and startup runs.
+type Options struct {
+	Interval  time.Duration // time between scheduled runs; 0 = off
+	OnStartup bool          // run once at startup (an empty database is always rebuilt)
+	Repair    bool          // scheduled and startup runs repair instead of only reporting
+
+	// StartupRepair runs a repairing reconciliation at startup regardless of OnStartup and Repair,
+	// e.g. to catch up a database just restored from a backup.
+	StartupRepair bool
+}
+
+// Reconciler runs reconciliations on demand and on a schedule, one at a time.
+type Reconciler struct {
+	driver   storage.Driver
+	db       *database.Database
+	opts     Options
+	onChange func()
+
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *Report
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a reconciler. onChange, if set, is called after a run changed the database.
+func New(driver storage.Driver, db *database.Database, opts Options, onChange func()) *Reconciler {
+	return &Reconciler{driver: driver, db: db, opts: opts, onChange: onChange, stopCh: make(chan struct{})}
+}
+
+// Entry is one tag that differs between storage and the database.
+type Entry struct {
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest,omitempty"`    // digest of the tag manifest in storage
+	DBDigest   string `json:"db_digest,omitempty"` // digest recorded in the database
+	Fixed      bool   `json:"fixed"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Report lists the differences one run found and, when repairing, which were fixed.
+type Report struct {
+	StartedAt    time.Time `json:"started_at"`
+	Elapsed      string    `json:"elapsed"`
+	Repair       bool      `json:"repair"`
+	Repositories int       `json:"repositories"` // repositories found in storage
+	Tags         int       `json:"tags"`         // tag manifests found in storage
+
+	StorageOnly []Entry `json:"storage_only"` // tags in storage the database lacks; added
+	DBOnly      []Entry `json:"db_only"`      // tags in the database whose manifest is gone; removed
+	Mismatched  []Entry `json:"mismatched"`   // database digest differs from storage; updated
+	Incomplete  []Entry `json:"incomplete"`   // layer or manifest rows missing; rebuilt
+
+	StorageOnlyRepositories []string `json:"storage_only_repositories"` // added
+	DBOnlyRepositories      []string `json:"db_only_repositories"`      // reported only
+	OrphanedRows            int64    `json:"orphaned_rows"`             // layer/manifest rows without an image; removed
+
+	Errors []string `json:"errors"`
+}
+
+// Changes is the number of differences found.
+func (rep *Report) Changes() int {
+	return len(rep.StorageOnly) + len(rep.DBOnly) + len(rep.Mismatched) + len(rep.Incomplete) +
+		len(rep.StorageOnlyRepositories) + int(rep.OrphanedRows)
+}
+
+// Start runs the startup reconciliation and, with an interval, schedules runs.
+func (r *Reconciler) Start() {
+	r.wg.Add(1)
+	go r.loop()
+}
+
+// Stop ends the schedule and waits for a scheduled run in progress.
+func (r *Reconciler) Stop() {
+	r.stopOnce.Do(func() { close(r.stopCh) })
+	r.wg.Wait()
+}
+
+func (r *Reconciler) loop() {
+	defer r.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-r.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if images, _, err := r.db.GetStatistics(); err == nil && images == 0 {
+		log.Printf("[Reconcile] Database has no images; rebuilding from storage")
+		r.scheduled(ctx, true)
+	} else if r.opts.OnStartup || r.opts.StartupRepair {
+		r.scheduled(ctx, r.opts.Repair || r.opts.StartupRepair)
+	}
+	if r.opts.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-ticker.C:
+			r.scheduled(ctx, r.opts.Repair)
+		}
+	}
+}
+
+func (r *Reconciler) scheduled(ctx context.Context, repair bool) {
+	if err := readonly.CheckMaintenance(); repair && err != nil {
+		log.Printf("[Reconcile] Skipping repairing run: %v", err)
+		return
+	}
+	if _, err := r.Run(ctx, repair); err != nil && !errors.Is(err, ErrRunning) && ctx.Err() == nil {
+		log.Printf("[Reconcile] Failed: %v", err)
+	}
+}
+
+// Status is the schedule and the report of the most recent run.
+type Status struct {
+	Running  bool    `json:"running"`
+	Interval string  `json:"interval"`
+	Repair   bool    `json:"repair"`
+	Last     *Report `json:"last"`
+}
+
+func (r *Reconciler) Status() Status {
+	st := Status{Interval: r.opts.Interval.String(), Repair: r.opts.Repair}
+	if r.running.TryLock() {
+		r.running.Unlock()
+	} else {
+		st.Running = true
+	}
+	r.mu.Lock()
+	st.Last = r.last
+	r.mu.Unlock()
+	return st
+}
+
+// Run compares storage with the database. With repair it adds, updates and removes database rows
+// so they match storage; without, it only reports. Repairing is refused in maintenance mode.
+func (r *Reconciler) Run(ctx context.Context, repair bool) (*Report, error) {
+	if repair {
+		if err := readonly.CheckMaintenance(); err != nil {
+			return nil, err
+		}
+	}
+	if !r.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer r.running.Unlock()
+
+	rep := &Report{
+		StartedAt:               time.Now().UTC(),
+		Repair:                  repair,
+		StorageOnly:             []Entry{},
+		DBOnly:                  []Entry{},
+		Mismatched:              []Entry{},
+		Incomplete:              []Entry{},
+		StorageOnlyRepositories: []string{},
+		DBOnlyRepositories:      []string{},
+		Errors:                  []string{},
+	}
+	err := r.run(ctx, rep)
+	rep.Elapsed = time.Since(rep.StartedAt).Round(time.Millisecond).String()
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.last = rep
+	r.mu.Unlock()
+
+	verb := "found"
+	if repair {
+		verb = "repaired"
+		if rep.Changes() > 0 && r.onChange != nil {
+			r.onChange()
+		}
+	}
+	log.Printf("[Reconcile] %d repositories, %d tags: %s %d storage-only, %d db-only, %d mismatched, %d incomplete, %d missing repositories, %d orphaned rows (%d errors) in %s",
+		rep.Repositories, rep.Tags, verb, len(rep.StorageOnly), len(rep.DBOnly), len(rep.Mismatched), len(rep.Incomplete),
+		len(rep.StorageOnlyRepositories), rep.OrphanedRows, len(rep.Errors), rep.Elapsed)
+	return rep, nil
+}
+
+func (r *Reconciler) run(ctx context.Context, rep *Report) error {
+	repos, err := r.listRepositories(ctx)
+	if err != nil {
+		return fmt.Errorf("list repositories: %w", err)
+	}
+	rep.Repositories = len(repos)
+
+	dbRepos, err := r.db.GetAllRepositories()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(dbRepos))
+	for _, repo := range dbRepos {
+		known[repo.Name] = true
+	}
+
+	stored := make(map[string]bool)   // "repo:tag" present in storage
+	unlisted := make(map[string]bool) // repositories whose tags could not be listed
+	inStorage := make(map[string]bool, len(repos))
+	for _, repo := range repos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		inStorage[repo] = true
+		if !known[repo] {
+			rep.StorageOnlyRepositories = append(rep.StorageOnlyRepositories, repo)
+			if rep.Repair {
+				r.addRepository(repo, rep)
+			}
+		}
+		tags, err := r.listTags(ctx, repo)
+		if err != nil {
+			unlisted[repo] = true
+			rep.Errors = append(rep.Errors, fmt.Sprintf("%s: list tags: %v", repo, err))
+			continue
+		}
+		for _, tag := range tags {
+			stored[repo+":"+tag] = true
+			rep.Tags++
+			r.checkTag(ctx, repo, tag, rep)
+		}
+	}
+
+	images, err := r.db.GetAllImages()
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if stored[img.Name+":"+img.Tag] || unlisted[img.Name] || time.Since(img.CreatedAt) < pushGrace {
+			continue
+		}
+		if _, err := r.driver.Stat(ctx, img.Name+"/manifests/"+img.Tag); !storage.IsNotExist(err) {
+			continue // pushed since the listing, or storage unreachable
+		}
+		e := Entry{Repository: img.Name, Tag: img.Tag, DBDigest: img.Digest}
+		if rep.Repair {
+			r.fix(&e, r.db.DeleteImage(img.Name, img.Tag))
+		}
+		rep.DBOnly = append(rep.DBOnly, e)
+	}
+
+	for _, repo := range dbRepos {
+		if !inStorage[repo.Name] {
+			rep.DBOnlyRepositories = append(rep.DBOnlyRepositories, repo.Name)
+		}
+	}
+
+	n, err := r.db.DeleteOrphanedImageRows(!rep.Repair)
+	if err != nil {
+		rep.Errors = append(rep.Errors, fmt.Sprintf("orphaned rows: %v", err))
+	}
+	rep.OrphanedRows = n
+	return nil
+}
+
+// checkTag compares one tag manifest with its database rows.
+func (r *Reconciler) checkTag(ctx context.Context, repo, tag string, rep *Report) {
+	content, err := r.driver.GetContent(ctx, repo+"/manifests/"+tag)
+	if err != nil {
+		if !storage.IsNotExist(err) {
+			rep.Errors = append(rep.Errors, fmt.Sprintf("%s:%s: read manifest: %v", repo, tag, err))
+		}
+		return
+	}
+	sum := sha256.Sum256(content)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	e := Entry{Repository: repo, Tag: tag, Digest: digest}
+
+	img, err := r.db.GetImage(repo, tag)
+	var list *[]Entry
+	switch {
+	case err != nil:
+		list = &rep.StorageOnly
+	case img.Digest != digest:
+		e.DBDigest = img.Digest
+		list = &rep.Mismatched
+	default:
+		if r.complete(img, content) {
+			return
+		}
+		e.DBDigest = img.Digest
+		list = &rep.Incomplete
+	}
+	if rep.Repair {
+		r.fix(&e, RecordImage(ctx, r.driver, r.db, repo, tag, digest, content))
+	}
+	*list = append(*list, e)
+}
+
+// complete reports whether the image has its manifest row and one layer row per manifest layer.
+func (r *Reconciler) complete(img *database.Image, content []byte) bool {
+	if _, err := r.db.GetManifestByImageID(img.ID); err != nil {
+		return false
+	}
+	m, err := parseManifest(content)
+	if err != nil {
+		return true // nothing better to rebuild from
+	}
+	layers, err := r.db.GetLayersByImageID(img.ID)
+	return err == nil && len(layers) == len(m.Layers)
+}
+
+func (r *Reconciler) fix(e *Entry, err error) {
+	if err != nil {
+		e.Error = err.Error()
+		return
+	}
+	e.Fixed = true
+}
+
+func (r *Reconciler) addRepository(repo string, rep *Report) {
+	if _, err := r.db.CreateRepository(repo); err != nil {
+		rep.Errors = append(rep.Errors, fmt.Sprintf("%s: add repository: %v", repo, err))
+		return
+	}
+	if i := strings.IndexByte(repo, '/'); i > 0 {
+		if err := r.db.EnsureGroup(repo[:i]); err != nil {
+			rep.Errors = append(rep.Errors, fmt.Sprintf("%s: add group: %v", repo, err))
+		}
+	}
+}
+
+type manifest struct {
+	Layers []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+func parseManifest(content []byte) (*manifest, error) {
+	var m manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// RecordImage writes the image rows for a tag manifest read from driver. Like a push, the size of
+// a manifest list is the sum of its platform manifests' layers.
+func RecordImage(ctx context.Context, driver storage.Driver, db *database.Database, repo, tag, digest string, content []byte) error {
+	m, err := parseManifest(content)
+	if err != nil {
+		return err
+	}
+	var size int64
+	layers := make([]*database.Layer, 0, len(m.Layers))
+	for _, l := range m.Layers {
+		size += l.Size
+		layers = append(layers, &database.Layer{Digest: l.Digest, Size: l.Size, MediaType: l.MediaType})
+	}
+	if size == 0 {
+		for _, sub := range m.Manifests {
+			b, err := driver.GetContent(ctx, repo+"/manifests/"+sub.Digest)
+			if err != nil {
+				continue
+			}
+			if sm, err := parseManifest(b); err == nil {
+				for _, l := range sm.Layers {
+					size += l.Size
+				}
+			}
+		}
+	}
+	_, err = db.ReplaceImage(repo, tag, digest, size, layers, string(content))
+	return err
+}
+
+// listRepositories finds "name" and "group/name" folders that hold a manifests folder.
+func (r *Reconciler) listRepositories(ctx context.Context) ([]string, error) {
+	top, err := r.driver.List(ctx, "")
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var repos []string
+	for _, name := range top {
+		children, err := r.driver.List(ctx, name)
+		if err != nil {
+			continue // a file, or removed since
+		}
+		if contains(children, "manifests") {
+			repos = append(repos, name)
+			continue
+		}
+		for _, child := range children {
+			sub := name + "/" + child
+			if grand, err := r.driver.List(ctx, sub); err == nil && contains(grand, "manifests") {
+				repos = append(repos, sub)
+			}
+		}
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// listTags returns the tag manifests of repo, skipping by-digest manifests.
+func (r *Reconciler) listTags(ctx context.Context, repo string) ([]string, error) {
+	names, err := r.driver.List(ctx, repo+"/manifests")
+	if err != nil {
+		if storage.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tags []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, "sha256:") {
+			tags = append(tags, name)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -18,7 +19,11 @@ import (
 
 	godigest "github.com/opencontainers/go-digest"
 	"refity/backend/internal/database"
-	"refity/backend/internal/driver/sftp"
+	manifestpkg "refity/backend/internal/manifest"
+	"refity/backend/internal/storage"
+	"refity/backend/internal/quota"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/tagrule"
 )
 
 // blobUploadState matches distribution format so Docker client gets _state in Location for chunked uploads.
@@ -70,16 +75,6 @@ func unpackUploadState(secret, token string) (blobUploadState, error) {
 	return state, nil
 }
 
-// rewriteManifestToOCI rewrites Docker v2 manifest media types to OCI so pull works with daemons that require OCI.
-func rewriteManifestToOCI(manifest []byte) []byte {
-	s := string(manifest)
-	s = strings.ReplaceAll(s, "application/vnd.docker.distribution.manifest.v2+json", "application/vnd.oci.image.manifest.v1+json")
-	s = strings.ReplaceAll(s, "application/vnd.docker.distribution.manifest.list.v2+json", "application/vnd.oci.image.index.v1+json")
-	s = strings.ReplaceAll(s, "application/vnd.docker.container.image.v1+json", "application/vnd.oci.image.config.v1+json")
-	s = strings.ReplaceAll(s, "application/vnd.docker.image.rootfs.diff.tar.gzip", "application/vnd.oci.image.layer.v1.tar+gzip")
-	return []byte(s)
-}
-
 // validRepoName restricts repo name to avoid path traversal and invalid chars (Docker: alphanumeric, separators, one optional /)
 var validRepoName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*(/[a-zA-Z0-9][a-zA-Z0-9._-]*)?$`)
 
@@ -111,8 +106,8 @@ func autoEnsureGroupForPush(repoName string) {
 			log.Printf("autoEnsureGroupForPush: EnsureGroup %q: %v", group, err)
 		}
 	}
-	if sftpDriver != nil {
-		if err := sftpDriver.CreateGroupFolder(ctx, group); err != nil {
+	if storageDriver != nil {
+		if err := storageDriver.CreateGroupFolder(ctx, group); err != nil {
 			log.Printf("autoEnsureGroupForPush: CreateGroupFolder %q: %v", group, err)
 		}
 	}
@@ -132,6 +127,15 @@ func validateBlobDigest(digest string) bool {
 var sftpSemaphore = make(chan struct{}, 2) // max 2 upload paralel
 var sftpPathLocks sync.Map // map[string]*sync.Mutex
 
+// stagedSize returns the size of a staged upload, or 0 if nothing has been staged yet.
+func stagedSize(ctx context.Context, path string) int64 {
+	fi, err := localDriver.Stat(ctx, path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size
+}
+
 // Handler untuk endpoint Docker Registry API v2
 func RegistryHandler(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/v2/")
@@ -140,6 +144,12 @@ func RegistryHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("{}"))
 		return
 	}
+	if rejectWhileDraining(w, r) {
+		return
+	}
+	if rejectWhileReadOnly(w, r) {
+		return
+	}
 
 	// /<name>/blobs/uploads/
 	if strings.HasSuffix(path, "/blobs/uploads/") && r.Method == http.MethodPost {
@@ -168,7 +178,7 @@ func RegistryHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// /<name>/blobs/<digest>
 	if strings.Contains(path, "/blobs/") && r.Method == http.MethodGet {
-		handleBlobDownload(w, path)
+		handleBlobDownload(w, r, path)
 		return
 	}
 	// /<name>/manifests/<reference>
@@ -221,8 +231,8 @@ func initiateBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			} else {
 				log.Printf("initiateBlobUpload: auto-created repository %s", name)
 				// Also create SFTP folder structure
-				if sftpDriver != nil {
-					if err := sftpDriver.CreateRepositoryFolder(context.TODO(), name); err != nil {
+				if storageDriver != nil {
+					if err := storageDriver.CreateRepositoryFolder(context.TODO(), name); err != nil {
 						log.Printf("initiateBlobUpload: failed to create SFTP folder for %s: %v", name, err)
 						// Continue anyway, folder will be created when needed
 					}
@@ -235,22 +245,26 @@ func initiateBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 	// completes upload in one request (no PATCH). Docker uses this for small blobs
 	// (config, etc). Must work in both sync and async modes.
 	digest := r.URL.Query().Get("digest")
-	if digest != "" && sftpDriver != nil && r.Body != nil {
+	if digest != "" && storageDriver != nil && r.Body != nil {
 		parsedDigest, parseErr := godigest.Parse(digest)
 		if parseErr != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("invalid checksum digest format (parse)"))
 			return
 		}
-		blobPath := fmt.Sprintf("registry/%s/blobs/%s", name, digest)
+		if !checkQuota(w, r, name, map[string]int64{digest: max(r.ContentLength, 0)}) {
+			return
+		}
+		blobPath := fmt.Sprintf("%s/blobs/%s", name, digest)
 		blobPath = strings.TrimLeft(blobPath, "/")
+		manifestpkg.NotePushedBlob(blobPath)
 		ctx := context.TODO()
 
 		if cfg != nil && cfg.SFTPSyncUpload {
 			// Sync mode: stream body directly to SFTP while hashing.
-			sftpWriter, err := sftpDriver.Writer(ctx, blobPath, false)
+			sftpWriter, err := storageDriver.Writer(ctx, blobPath, false)
 			if err != nil {
-				if err == sftp.ErrRepoNotFound {
+				if err == storage.ErrRepoNotFound {
 					registryError(w, "NAME_INVALID", fmt.Sprintf("repository name %s not found", name), 404)
 					return
 				}
@@ -264,9 +278,17 @@ func initiateBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			buf := make([]byte, 1024*1024)
 			n, copyErr := io.CopyBuffer(multiWriter, r.Body, buf)
 			_ = r.Body.Close()
-			closeErr := sftpWriter.Close()
-			if closeErr != nil {
-				log.Printf("initiateBlobUpload (monolithic sync): Writer close: %v", closeErr)
+			calculated := digester.Digest()
+			// Only a complete body with the expected digest becomes visible at blobPath.
+			if copyErr != nil || calculated != parsedDigest {
+				if err := sftpWriter.Cancel(ctx); err != nil {
+					log.Printf("initiateBlobUpload (monolithic sync): Writer cancel: %v", err)
+				}
+			} else if err := sftpWriter.Commit(ctx); err != nil {
+				log.Printf("initiateBlobUpload (monolithic sync): Writer commit: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Failed to store blob: " + err.Error()))
+				return
 			}
 			if copyErr != nil {
 				log.Printf("initiateBlobUpload (monolithic sync): copy failed: %v", copyErr)
@@ -274,7 +296,6 @@ func initiateBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 				w.Write([]byte("Failed to stream blob: " + copyErr.Error()))
 				return
 			}
-			calculated := digester.Digest()
 			if calculated != parsedDigest {
 				w.WriteHeader(http.StatusBadRequest)
 				w.Write([]byte("invalid checksum digest format (mismatch)"))
@@ -291,7 +312,7 @@ func initiateBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 
 		// Async mode: write to local staging, then upload to SFTP in background.
 		digester := godigest.Canonical.Digester()
-		localWriter, err := localDriver.Writer(ctx, blobPath)
+		localWriter, err := localDriver.Writer(ctx, blobPath, false)
 		if err != nil {
 			log.Printf("initiateBlobUpload (monolithic async): local Writer failed: %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -326,12 +347,11 @@ func initiateBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			w.Write([]byte("Failed to read blob from local"))
 			return
 		}
-		go func() {
-			if err := uploadBlobToSFTP(ctx, blobPath, blobPath, localData); err != nil {
-				log.Printf("initiateBlobUpload (monolithic async): SFTP upload failed: %v", err)
-			}
-		}()
 		uploadID := strconv.FormatInt(time.Now().UnixNano(), 10)
+		uploadCtx := storage.WithUploadID(ctx, uploadID)
+		runBackground(PendingUpload{Kind: "blob", LocalPath: blobPath, RemotePath: blobPath, UploadID: uploadID}, func() error {
+			return uploadBlobToSFTP(uploadCtx, blobPath, blobPath, localData)
+		})
 		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, calculated.String()))
 		w.Header().Set("Docker-Content-Digest", calculated.String())
 		w.Header().Set("Docker-Upload-UUID", uploadID)
@@ -392,14 +412,14 @@ func uploadBlobData(w http.ResponseWriter, r *http.Request, path string) {
 	if idx := strings.Index(uploadID, "?"); idx >= 0 {
 		uploadID = uploadID[:idx]
 	}
-	uploadPath := fmt.Sprintf("registry/%s/blobs/uploads/%s", name, uploadID)
+	uploadPath := fmt.Sprintf("%s/blobs/uploads/%s", name, uploadID)
 	uploadPath = strings.TrimLeft(uploadPath, "/")
 
 	ctx := context.TODO()
 	// Size before this PATCH (for append; 0 if first chunk).
-	sizeBefore, _ := localDriver.Size(ctx, uploadPath)
+	sizeBefore := stagedSize(ctx, uploadPath)
 	// Append so multiple PATCHes (chunked upload) accumulate; first PATCH creates the file.
-	dest, err := localDriver.WriterAppend(ctx, uploadPath)
+	dest, err := localDriver.Writer(ctx, uploadPath, true)
 	if err != nil {
 		log.Printf("uploadBlobData: failed to open writer: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -478,10 +498,10 @@ func handleBlobUploadStatus(w http.ResponseWriter, r *http.Request, path string)
 	if idx := strings.Index(uploadID, "?"); idx >= 0 {
 		uploadID = uploadID[:idx]
 	}
-	uploadPath := fmt.Sprintf("registry/%s/blobs/uploads/%s", name, uploadID)
+	uploadPath := fmt.Sprintf("%s/blobs/uploads/%s", name, uploadID)
 	uploadPath = strings.TrimLeft(uploadPath, "/")
 	ctx := context.TODO()
-	size, _ := localDriver.Size(ctx, uploadPath)
+	size := stagedSize(ctx, uploadPath)
 	endRange := size - 1
 	if size <= 0 {
 		endRange = 0
@@ -523,23 +543,22 @@ func handleBlobHead(w http.ResponseWriter, r *http.Request, path string) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	blobPath := fmt.Sprintf("registry/%s/blobs/%s", name, blobPart)
+	blobPath := fmt.Sprintf("%s/blobs/%s", name, blobPart)
 	blobPath = strings.TrimLeft(blobPath, "/")
 	ctx := context.TODO()
-	fi, err := sftpDriver.Stat(ctx, blobPath)
+	fi, err := storageDriver.Stat(ctx, blobPath)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	type sizeable interface{ Size() int64 }
-	if s, ok := fi.(sizeable); ok {
-		w.Header().Set("Content-Length", strconv.FormatInt(s.Size(), 10))
-	}
+	// A client that finds the blob stored skips uploading it, and its manifest will reference it.
+	manifestpkg.NotePushedBlob(blobPath)
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size, 10))
 	w.Header().Set("Docker-Content-Digest", blobPart)
 	w.WriteHeader(http.StatusOK)
 }
 
-func handleBlobDownload(w http.ResponseWriter, path string) {
+func handleBlobDownload(w http.ResponseWriter, r *http.Request, path string) {
 	name := strings.TrimPrefix(strings.TrimSuffix(strings.Split(path, "/blobs/")[0], "/"), "/")
 	if !validateRepoName(name) {
 		w.WriteHeader(http.StatusBadRequest)
@@ -552,17 +571,37 @@ func handleBlobDownload(w http.ResponseWriter, path string) {
 		w.Write([]byte("invalid blob digest format"))
 		return
 	}
-	blobPath := fmt.Sprintf("registry/%s/blobs/%s", name, blobPart)
+	blobPath := fmt.Sprintf("%s/blobs/%s", name, blobPart)
 	blobPath = strings.TrimLeft(blobPath, "/")
-	blob, err := sftpDriver.GetContent(context.TODO(), blobPath)
+	// Backends that can serve the blob directly (S3 presigned URLs) redirect the client there.
+	if url, err := storageDriver.RedirectURL(r, blobPath); err == nil && url != "" {
+		if _, err := storageDriver.Stat(r.Context(), blobPath); err != nil {
+			registryError(w, "BLOB_UNKNOWN", "blob not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", blobPart)
+		http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		return
+	}
+	// Stream rather than buffer: multi-GB layers stay out of memory, and drivers that resume
+	// broken reads (SFTP, FTP) can recover mid-pull.
+	fi, err := storageDriver.Stat(r.Context(), blobPath)
 	if err != nil {
 		registryError(w, "BLOB_UNKNOWN", "blob not found", http.StatusNotFound)
 		return
 	}
-	w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+	rc, err := storageDriver.Reader(r.Context(), blobPath, 0)
+	if err != nil {
+		registryError(w, "BLOB_UNKNOWN", "blob not found", http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size, 10))
 	w.Header().Set("Docker-Content-Digest", blobPart)
 	w.WriteHeader(http.StatusOK)
-	w.Write(blob)
+	if n, err := io.Copy(w, rc); err != nil {
+		log.Printf("handleBlobDownload: %s: stream failed after %d/%d bytes: %v", blobPath, n, fi.Size, err)
+	}
 }
 
 func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
@@ -578,7 +617,7 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 		w.Write([]byte("invalid manifest reference"))
 		return
 	}
-	manifestPath := fmt.Sprintf("registry/%s/manifests/%s", name, ref)
+	manifestPath := fmt.Sprintf("%s/manifests/%s", name, ref)
 	manifestPath = strings.TrimLeft(manifestPath, "/")
 	switch r.Method {
 	case http.MethodPut:
@@ -598,8 +637,8 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 				} else {
 					log.Printf("handleManifest: auto-created repository %s", name)
 					// Also create SFTP folder structure
-					if sftpDriver != nil {
-						if err := sftpDriver.CreateRepositoryFolder(context.TODO(), name); err != nil {
+					if storageDriver != nil {
+						if err := storageDriver.CreateRepositoryFolder(context.TODO(), name); err != nil {
 							log.Printf("handleManifest: failed to create SFTP folder for %s: %v", name, err)
 							// Continue anyway, folder will be created when needed
 						}
@@ -630,9 +669,9 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 			}
 			missing := []string{}
 			for _, m := range ml.Manifests {
-				manifestPath := fmt.Sprintf("registry/%s/manifests/%s", name, m.Digest)
+				manifestPath := fmt.Sprintf("%s/manifests/%s", name, m.Digest)
 				manifestPath = strings.TrimLeft(manifestPath, "/")
-				_, err := sftpDriver.GetContent(context.TODO(), manifestPath)
+				_, err := storageDriver.GetContent(context.TODO(), manifestPath)
 				if err != nil {
 					missing = append(missing, m.Digest)
 				}
@@ -646,6 +685,22 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 		// Hitung digest manifest
 		manifestDigest := godigest.FromBytes(manifest)
 		digestStr := manifestDigest.String()
+		if !strings.HasPrefix(ref, "sha256:") {
+			for _, current := range tagDigests(name, ref) {
+				if current != digestStr {
+					if !checkTagRule(w, r, name, ref, tagrule.Overwrite) {
+						return
+					}
+					break
+				}
+			}
+		}
+		if !checkBlobsPresent(w, name, manifest) {
+			return
+		}
+		if !checkQuota(w, r, name, quota.ManifestLayers(manifest)) {
+			return
+		}
 		
 		// Simpan manifest dengan nama tag (ref)
 		err = localDriver.PutContent(context.TODO(), manifestPath, manifest, nil)
@@ -656,7 +711,7 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 		}
 		
 		// Simpan juga manifest dengan nama digest untuk akses via digest
-		manifestDigestPath := fmt.Sprintf("registry/%s/manifests/%s", name, digestStr)
+		manifestDigestPath := fmt.Sprintf("%s/manifests/%s", name, digestStr)
 		manifestDigestPath = strings.TrimLeft(manifestDigestPath, "/")
 		err = localDriver.PutContent(context.TODO(), manifestDigestPath, manifest, nil)
 		if err != nil {
@@ -677,17 +732,23 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 				return
 			}
 		} else {
-			go doManifestUpload()
+			runBackground(PendingUpload{Kind: "manifest", LocalPath: manifestPath, RemotePath: manifestPath, DigestPath: manifestDigestPath}, doManifestUpload)
 		}
 
 		// Save image metadata to database only for real tags (not digest refs like sha256:...)
 		// Docker pushes manifest by digest first, then by tag; we only want one row per tag.
 		if db != nil && !strings.HasPrefix(ref, "sha256:") {
-			go func() {
+			event := &database.TagEvent{Name: name, Tag: ref, Digest: digestStr, Action: database.TagPushed, Username: requestUsername(r), IP: clientIP(r)}
+			runBackground(PendingUpload{}, func() error {
 				if err := saveImageToDatabase(name, ref, manifestDigest.String(), manifest); err != nil {
 					log.Printf("Failed to save image to database: %v", err)
+					return nil
 				}
-			}()
+				if err := db.RecordTagEvent(event); err != nil {
+					log.Printf("Failed to record tag history for %s:%s: %v", name, ref, err)
+				}
+				return nil
+			})
 		}
 		
 		w.Header().Set("Docker-Content-Digest", manifestDigest.String())
@@ -695,7 +756,7 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 		w.Write([]byte("Manifest uploaded"))
 	case http.MethodGet:
 		// Coba ambil manifest dengan ref yang diberikan (bisa tag atau digest)
-		manifest, err := sftpDriver.GetContent(context.TODO(), manifestPath)
+		manifest, err := storageDriver.GetContent(context.TODO(), manifestPath)
 		if err != nil {
 			// Fallback: coba cari via database
 			if db != nil {
@@ -712,16 +773,16 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 				
 				if dbErr == nil && img != nil {
 					// Coba ambil manifest dengan nama tag (untuk backward compatibility)
-					tagPath := fmt.Sprintf("registry/%s/manifests/%s", name, img.Tag)
+					tagPath := fmt.Sprintf("%s/manifests/%s", name, img.Tag)
 					tagPath = strings.TrimLeft(tagPath, "/")
-					manifest, err = sftpDriver.GetContent(context.TODO(), tagPath)
+					manifest, err = storageDriver.GetContent(context.TODO(), tagPath)
 					if err == nil {
 						manifestPath = tagPath
 					} else {
 						// Jika tidak ditemukan dengan tag, coba dengan digest
-						digestPath := fmt.Sprintf("registry/%s/manifests/%s", name, img.Digest)
+						digestPath := fmt.Sprintf("%s/manifests/%s", name, img.Digest)
 						digestPath = strings.TrimLeft(digestPath, "/")
-						manifest, err = sftpDriver.GetContent(context.TODO(), digestPath)
+						manifest, err = storageDriver.GetContent(context.TODO(), digestPath)
 						if err == nil {
 							manifestPath = digestPath
 						}
@@ -736,7 +797,7 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 		}
 		
 		// Rewrite Docker v2 media types to OCI so daemon accepts (pull expects OCI when configured).
-		manifest = rewriteManifestToOCI(manifest)
+		manifest = manifestpkg.ToOCI(manifest)
 
 		// Set Content-Type and digest for the bytes we're sending (OCI format).
 		var manifestData map[string]interface{}
@@ -754,20 +815,195 @@ func handleManifest(w http.ResponseWriter, r *http.Request, path string) {
 		w.Header().Set("Docker-Content-Digest", manifestDigest.String())
 		w.Header().Set("Docker-Distribution-Api-Version", "registry/2.0")
 		// Save OCI manifest by digest so pull-by-digest conforms to distribution spec (avoids "falling back to pull by tag" warning).
-		ociDigestPath := fmt.Sprintf("registry/%s/manifests/%s", name, manifestDigest.String())
+		// Pulls are served in read-only mode, which must not write to storage; a later pull stores the copy.
+		ociDigestPath := fmt.Sprintf("%s/manifests/%s", name, manifestDigest.String())
 		ociDigestPath = strings.TrimLeft(ociDigestPath, "/")
-		if _, err := sftpDriver.Stat(context.TODO(), ociDigestPath); err != nil {
-			_ = sftpDriver.PutContent(context.TODO(), ociDigestPath, manifest, nil)
+		if _, err := storageDriver.Stat(context.TODO(), ociDigestPath); err != nil && !readonly.Get().ReadOnly {
+			_ = storageDriver.PutContent(context.TODO(), ociDigestPath, manifest, nil)
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write(manifest)
+	case http.MethodDelete:
+		deleteTag(w, r, name, ref)
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// currentTagDigest returns the digest name:tag points at, or "" for a new tag.
+func currentTagDigest(name, tag string) string {
+	if digests := tagDigests(name, tag); len(digests) > 0 {
+		return digests[0]
+	}
+	return ""
+}
+
+// tagDigests returns the digests name:tag points at in the database, the staging area and
+// storage, in that order. They disagree until a push is written back: the database row and the
+// upload to storage happen in the background, so only the staged tag manifest knows of a push
+// that is still queued.
+func tagDigests(name, tag string) []string {
+	var digests []string
+	if db != nil {
+		if img, err := db.GetImage(name, tag); err == nil {
+			digests = append(digests, img.Digest)
+		}
+	}
+	tagPath := name + "/manifests/" + tag
+	for _, d := range []storage.Driver{localDriver, storageDriver} {
+		if b, err := d.GetContent(context.TODO(), tagPath); err == nil {
+			digests = append(digests, godigest.FromBytes(b).String())
+		}
+	}
+	return digests
+}
+
+func requestUsername(r *http.Request) string {
+	if user := requestUser(r); user != nil {
+		return user.Username
+	}
+	return ""
+}
+
+// checkTagRule answers DENIED and returns false if a tag rule forbids the request's user to do
+// action to name:tag.
+func checkTagRule(w http.ResponseWriter, r *http.Request, name, tag string, action tagrule.Action) bool {
+	if db == nil {
+		return true
+	}
+	role := ""
+	if user := requestUser(r); user != nil {
+		role = user.Role
+	}
+	err := tagrule.Check(db, name, tag, role, action)
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, tagrule.ErrDenied) {
+		log.Printf("handleManifest: %s by %s: %v", action, requestUsername(r), err)
+		registryError(w, "DENIED", err.Error(), http.StatusForbidden)
+	} else {
+		log.Printf("handleManifest: %v", err)
+		registryError(w, "UNKNOWN", "failed to check tag rules", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// checkQuota answers DENIED and returns false if storing blobs in name would take its group or
+// the request's user over quota.
+func checkQuota(w http.ResponseWriter, r *http.Request, name string, blobs map[string]int64) bool {
+	if db == nil {
+		return true
+	}
+	added, err := quota.Added(db, name, blobs)
+	if err == nil {
+		err = quota.Check(db, name, requestUsername(r), added)
+	}
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, quota.ErrExceeded) {
+		log.Printf("Push to %s by %s rejected: %v", name, requestUsername(r), err)
+		registryError(w, "DENIED", err.Error(), http.StatusForbidden)
+	} else {
+		log.Printf("checkQuota: %v", err)
+		registryError(w, "UNKNOWN", "failed to check storage quota", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// checkBlobsPresent answers a manifest referencing a config or layer blob the repository does not
+// hold with MANIFEST_BLOB_UNKNOWN, reporting whether all are present. A blob still uploading in
+// the background is present in local staging. Foreign layers, fetched from their URLs, are not
+// stored by the registry.
+func checkBlobsPresent(w http.ResponseWriter, name string, manifest []byte) bool {
+	var m struct {
+		Config struct {
+			Digest string `json:"digest"`
+		} `json:"config"`
+		Layers []struct {
+			Digest string   `json:"digest"`
+			URLs   []string `json:"urls"`
+		} `json:"layers"`
+	}
+	if json.Unmarshal(manifest, &m) != nil {
+		return true
+	}
+	digests := []string{}
+	if m.Config.Digest != "" {
+		digests = append(digests, m.Config.Digest)
+	}
+	for _, l := range m.Layers {
+		if len(l.URLs) == 0 {
+			digests = append(digests, l.Digest)
+		}
+	}
+	ctx := context.TODO()
+	var missing []string
+	for _, d := range digests {
+		if !validateBlobDigest(d) {
+			missing = append(missing, d)
+			continue
+		}
+		blobPath := strings.TrimLeft(name+"/blobs/"+d, "/")
+		if _, err := storageDriver.Stat(ctx, blobPath); err == nil {
+			continue
+		}
+		if _, err := localDriver.Stat(ctx, blobPath); err == nil {
+			continue
+		}
+		missing = append(missing, d)
+	}
+	if len(missing) == 0 {
+		return true
+	}
+	registryError(w, "MANIFEST_BLOB_UNKNOWN", "manifest references unknown blobs: "+strings.Join(missing, ", "), http.StatusBadRequest)
+	return false
+}
+
+// deleteTag removes a tag. Deleting a manifest by digest is not supported: tags may still point
+// at it.
+func deleteTag(w http.ResponseWriter, r *http.Request, name, ref string) {
+	if strings.HasPrefix(ref, "sha256:") {
+		registryError(w, "UNSUPPORTED", "manifests can only be deleted by tag", http.StatusMethodNotAllowed)
+		return
+	}
+	current := currentTagDigest(name, ref)
+	if current == "" {
+		registryError(w, "MANIFEST_UNKNOWN", "manifest unknown", http.StatusNotFound)
+		return
+	}
+	if !checkTagRule(w, r, name, ref, tagrule.Delete) {
+		return
+	}
+	if db != nil {
+		if err := db.DeleteImage(name, ref); err != nil {
+			log.Printf("deleteTag: %s:%s: %v", name, ref, err)
+			registryError(w, "UNKNOWN", "failed to delete tag", http.StatusInternalServerError)
+			return
+		}
+	}
+	tagPath := name + "/manifests/" + ref
+	if err := storageDriver.Delete(context.TODO(), tagPath); err != nil && !storage.IsNotExist(err) {
+		log.Printf("deleteTag: %s: %v", tagPath, err)
+		registryError(w, "UNKNOWN", "failed to delete tag manifest", http.StatusInternalServerError)
+		return
+	}
+	localDriver.Delete(context.TODO(), tagPath)
+	if db != nil {
+		event := &database.TagEvent{Name: name, Tag: ref, Digest: current, Action: database.TagDeleted, Username: requestUsername(r), IP: clientIP(r)}
+		if err := db.RecordTagEvent(event); err != nil {
+			log.Printf("Failed to record tag history for %s:%s: %v", name, ref, err)
+		}
+	}
+	if onImageSaved != nil {
+		onImageSaved()
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func handleCatalog(w http.ResponseWriter) {
-	entries, err := sftpDriver.List(context.TODO(), "registry")
+	entries, err := storageDriver.List(context.TODO(), "")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("Failed to list repositories"))
@@ -828,8 +1064,8 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			} else {
 				log.Printf("commitBlobUpload: auto-created repository %s", name)
 				// Also create SFTP folder structure
-				if sftpDriver != nil {
-					if err := sftpDriver.CreateRepositoryFolder(context.TODO(), name); err != nil {
+				if storageDriver != nil {
+					if err := storageDriver.CreateRepositoryFolder(context.TODO(), name); err != nil {
 						log.Printf("commitBlobUpload: failed to create SFTP folder for %s: %v", name, err)
 						// Continue anyway, folder will be created when needed
 					}
@@ -838,18 +1074,28 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 		}
 	}
 
-	blobPath := fmt.Sprintf("registry/%s/blobs/%s", name, digest)
+	blobPath := fmt.Sprintf("%s/blobs/%s", name, digest)
 	blobPath = strings.TrimLeft(blobPath, "/")
-	uploadPath := fmt.Sprintf("registry/%s/blobs/uploads/%s", name, uploadID)
+	manifestpkg.NotePushedBlob(blobPath)
+	uploadPath := fmt.Sprintf("%s/blobs/uploads/%s", name, uploadID)
 	uploadPath = strings.TrimLeft(uploadPath, "/")
-	ctx := context.TODO()
+	ctx := storage.WithUploadID(context.TODO(), uploadID)
+
+	// The final PUT may carry the last chunk: count it on top of what the PATCH requests staged.
+	size := stagedSize(ctx, uploadPath)
+	if r.ContentLength > 0 {
+		size += r.ContentLength
+	}
+	if !checkQuota(w, r, name, map[string]int64{digest: size}) {
+		return
+	}
 
 	// Sync mode + monolithic upload: stream r.Body directly to SFTP while hashing.
 	// Client progress bar then moves in sync with our SFTP write (we read body only as fast as we write to SFTP).
 	if cfg != nil && cfg.SFTPSyncUpload && r.Body != nil {
-		sftpWriter, err := sftpDriver.Writer(ctx, blobPath, false)
+		sftpWriter, err := storageDriver.Writer(ctx, blobPath, false)
 		if err != nil {
-			if err == sftp.ErrRepoNotFound {
+			if err == storage.ErrRepoNotFound {
 				registryError(w, "NAME_INVALID", fmt.Sprintf("repository name %s not found", name), 404)
 				return
 			}
@@ -862,9 +1108,19 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 		multiWriter := io.MultiWriter(sftpWriter, digester.Hash())
 		buf := make([]byte, 256*1024)
 		n, copyErr := io.CopyBuffer(multiWriter, r.Body, buf)
-		closeErr := sftpWriter.Close()
-		if closeErr != nil {
-			log.Printf("commitBlobUpload (sync stream): Writer close: %v", closeErr)
+		// Only a complete, non-empty body with the expected digest becomes visible at blobPath;
+		// an empty body means the data arrived via PATCH and is uploaded from staging below.
+		calculated := digester.Digest()
+		parsedDigest, parseErr := godigest.Parse(digest)
+		if copyErr != nil || n == 0 || parseErr != nil || calculated != parsedDigest {
+			if err := sftpWriter.Cancel(ctx); err != nil {
+				log.Printf("commitBlobUpload (sync stream): Writer cancel: %v", err)
+			}
+		} else if err := sftpWriter.Commit(ctx); err != nil {
+			log.Printf("commitBlobUpload (sync stream): Writer commit: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Failed to store blob: " + err.Error()))
+			return
 		}
 		if copyErr != nil {
 			log.Printf("commitBlobUpload (sync stream): copy failed: %v", copyErr)
@@ -873,8 +1129,6 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			return
 		}
 		if n > 0 {
-			calculated := digester.Digest()
-			parsedDigest, parseErr := godigest.Parse(digest)
 			if parseErr != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				w.Write([]byte("invalid checksum digest format (parse)"))
@@ -898,7 +1152,7 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			parsedDigest, parseErr := godigest.Parse(digest)
 			if parseErr == nil && parsedDigest.String() == emptyDigest {
 				localData = []byte{}
-				if putErr := localDriver.PutContent(ctx, blobPath, localData, nil); putErr != nil && putErr != sftp.ErrRepoNotFound {
+				if putErr := localDriver.PutContent(ctx, blobPath, localData, nil); putErr != nil && putErr != storage.ErrRepoNotFound {
 					log.Printf("commitBlobUpload (sync empty): failed to write empty blob: %v", putErr)
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte("Failed to write empty blob"))
@@ -917,8 +1171,8 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 				return
 			}
 			// No local upload file and not empty blob: client may be mounting from existing blob (no PATCH sent). If blob exists on SFTP, accept.
-			if sftpDriver != nil {
-				if _, statErr := sftpDriver.Stat(ctx, blobPath); statErr == nil {
+			if storageDriver != nil {
+				if _, statErr := storageDriver.Stat(ctx, blobPath); statErr == nil {
 					parsedDigest, parseErr := godigest.Parse(digest)
 					if parseErr == nil {
 						w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, parsedDigest.String()))
@@ -934,8 +1188,7 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			w.Write([]byte("Failed to read blob from local: " + err.Error()))
 			return
 		}
-		calculated := godigest.FromBytes(localData)
-		parsedDigest, parseErr := godigest.Parse(digest)
+		calculated = godigest.FromBytes(localData)
 		if parseErr != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("invalid checksum digest format (parse)"))
@@ -977,7 +1230,7 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			parsedDigest, parseErr := godigest.Parse(digest)
 			if parseErr == nil && parsedDigest.String() == emptyDigest {
 				localData = []byte{}
-				if putErr := localDriver.PutContent(ctx, blobPath, localData, nil); putErr != nil && putErr != sftp.ErrRepoNotFound {
+				if putErr := localDriver.PutContent(ctx, blobPath, localData, nil); putErr != nil && putErr != storage.ErrRepoNotFound {
 					log.Printf("commitBlobUpload: failed to write empty blob: %v", putErr)
 					w.WriteHeader(http.StatusInternalServerError)
 					w.Write([]byte("Failed to write empty blob"))
@@ -996,8 +1249,8 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 				return
 			}
 			// Mount from existing blob on SFTP (no PATCH sent).
-			if sftpDriver != nil {
-				if _, statErr := sftpDriver.Stat(ctx, blobPath); statErr == nil {
+			if storageDriver != nil {
+				if _, statErr := storageDriver.Stat(ctx, blobPath); statErr == nil {
 					parsedDigest, parseErr := godigest.Parse(digest)
 					if parseErr == nil {
 						w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, parsedDigest.String()))
@@ -1027,7 +1280,7 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 		}
 		err = localDriver.Move(ctx, uploadPath, blobPath)
 		if err != nil {
-			if err == sftp.ErrRepoNotFound {
+			if err == storage.ErrRepoNotFound {
 				registryError(w, "NAME_INVALID", fmt.Sprintf("repository name %s not found", name), 404)
 				return
 			}
@@ -1039,7 +1292,7 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 	} else {
 		err = localDriver.PutContent(ctx, blobPath, body, nil)
 		if err != nil {
-			if err == sftp.ErrRepoNotFound {
+			if err == storage.ErrRepoNotFound {
 				registryError(w, "NAME_INVALID", fmt.Sprintf("repository name %s not found", name), 404)
 				return
 			}
@@ -1082,7 +1335,7 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 			return
 		}
 	} else {
-		go doBlobUpload()
+		runBackground(PendingUpload{Kind: "blob", LocalPath: blobPath, RemotePath: blobPath, UploadID: uploadID}, doBlobUpload)
 	}
 
 	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, calculated.String()))
@@ -1096,6 +1349,7 @@ func commitBlobUpload(w http.ResponseWriter, r *http.Request, path string) {
 }
 
 // uploadBlobToSFTP uploads blob data to SFTP (with semaphore, lock, retry). Call in goroutine for async or inline for sync.
+// Retries resume from the partial remote file where the driver supports it (see sftp PutContent).
 func uploadBlobToSFTP(ctx context.Context, localPath, sftpPath string, data []byte) error {
 	sftpSemaphore <- struct{}{}
 	defer func() { <-sftpSemaphore }()
@@ -1106,26 +1360,25 @@ func uploadBlobToSFTP(ctx context.Context, localPath, sftpPath string, data []by
 	defer pathLock.Unlock()
 
 	wantSize := int64(len(data))
-	if fi, err := sftpDriver.Stat(ctx, sftpPath); err == nil {
-		type sizeable interface{ Size() int64 }
-		var existing int64
-		if s, ok := fi.(sizeable); ok {
-			existing = s.Size()
-			if existing == wantSize {
-				log.Printf("[SFTP] SKIP: blob already exists (same size): %s", sftpPath)
-				_ = localDriver.Delete(ctx, localPath)
-				return nil
-			}
+	if fi, err := storageDriver.Stat(ctx, sftpPath); err == nil {
+		if fi.Size == wantSize {
+			log.Printf("[SFTP] SKIP: blob already exists (same size): %s", sftpPath)
+			_ = localDriver.Delete(ctx, localPath)
+			return nil
 		}
-		_ = sftpDriver.Delete(ctx, sftpPath)
-		log.Printf("[SFTP] Overwrite: replacing blob (existing %d vs %d): %s", existing, wantSize, sftpPath)
+		_ = storageDriver.Delete(ctx, sftpPath)
+		log.Printf("[SFTP] Overwrite: replacing blob (existing %d vs %d): %s", fi.Size, wantSize, sftpPath)
 	}
 
+	if storage.UploadID(ctx) == "" {
+		// One upload ID for all attempts, so each retry resumes the previous one's temp file.
+		ctx = storage.WithUploadID(ctx, strconv.FormatInt(time.Now().UnixNano(), 10))
+	}
 	log.Printf("[SFTP] Start upload: %s -> %s", localPath, sftpPath)
 	maxRetry := 5
 	var err error
 	for i := 0; i < maxRetry; i++ {
-		err = sftpDriver.PutContent(ctx, sftpPath, data, func(written, total int64) {
+		err = storageDriver.PutContent(ctx, sftpPath, data, func(written, total int64) {
 			percent := int64(0)
 			if total > 0 {
 				percent = written * 100 / total
@@ -1165,7 +1418,7 @@ func uploadManifestToSFTP(ctx context.Context, tagPath, digestPath string, data
 	log.Printf("[SFTP] Start upload manifest (tag): %s", tagPath)
 	var err error
 	for i := 0; i < maxRetry; i++ {
-		err = sftpDriver.PutContent(ctx, tagPath, data, nil)
+		err = storageDriver.PutContent(ctx, tagPath, data, nil)
 		if err == nil {
 			log.Printf("[SFTP] Success manifest (tag): %s (try %d)", tagPath, i+1)
 			break
@@ -1185,7 +1438,7 @@ func uploadManifestToSFTP(ctx context.Context, tagPath, digestPath string, data
 	pathLock2.Lock()
 	log.Printf("[SFTP] Start upload manifest (digest): %s", digestPath)
 	for i := 0; i < maxRetry; i++ {
-		err = sftpDriver.PutContent(ctx, digestPath, data, nil)
+		err = storageDriver.PutContent(ctx, digestPath, data, nil)
 		if err == nil {
 			log.Printf("[SFTP] Success manifest (digest): %s (try %d)", digestPath, i+1)
 			break
@@ -1258,9 +1511,9 @@ func handleTagsList(w http.ResponseWriter, path string) {
 		w.Write([]byte("invalid repository name"))
 		return
 	}
-	manifestDir := "registry/" + repo + "/manifests"
+	manifestDir := repo + "/manifests"
 	manifestDir = strings.TrimLeft(manifestDir, "/")
-	allEntries, err := sftpDriver.List(context.TODO(), manifestDir)
+	allEntries, err := storageDriver.List(context.TODO(), manifestDir)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		resp := map[string]interface{}{
@@ -1311,8 +1564,8 @@ func saveImageToDatabase(name, tag, digest string, manifestData []byte) error {
 	}
 	if totalSize == 0 {
 		// Manifest list (multi-arch): resolve each referenced manifest and sum its layer sizes
-		if manifests, ok := manifest["manifests"].([]interface{}); ok && sftpDriver != nil {
-			manifestPathBase := "registry/" + name + "/manifests/"
+		if manifests, ok := manifest["manifests"].([]interface{}); ok && storageDriver != nil {
+			manifestPathBase := name + "/manifests/"
 			for _, m := range manifests {
 				mMap, ok := m.(map[string]interface{})
 				if !ok {
@@ -1322,7 +1575,7 @@ func saveImageToDatabase(name, tag, digest string, manifestData []byte) error {
 				if digestStr == "" {
 					continue
 				}
-				subManifestBytes, err := sftpDriver.GetContent(context.TODO(), manifestPathBase+digestStr)
+				subManifestBytes, err := storageDriver.GetContent(context.TODO(), manifestPathBase+digestStr)
 				if err != nil {
 					continue
 				}
@@ -0,0 +1,24 @@
+package registry
+
+import (
+	"net/http"
+	"strings"
+
+	"refity/backend/internal/readonly"
+)
+
+// rejectWhileReadOnly answers writes the read-only mode refuses with UNAVAILABLE. Returns true
+// if the request was handled.
+func rejectWhileReadOnly(w http.ResponseWriter, r *http.Request) bool {
+	method := r.Method
+	// A GET with ?digest= on an upload URL commits the upload (see handleBlobUploadStatus).
+	if method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/uploads/") && r.URL.Query().Get("digest") != "" {
+		method = http.MethodPut
+	}
+	msg := readonly.Refusal(method, true)
+	if msg == "" {
+		return false
+	}
+	registryError(w, "UNAVAILABLE", msg, http.StatusServiceUnavailable)
+	return true
+}
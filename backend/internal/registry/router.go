@@ -1,22 +1,22 @@
 package registry
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"strings"
 	"sync"
 	"time"
 	"refity/backend/internal/config"
-	"refity/backend/internal/driver/sftp"
-	"refity/backend/internal/driver/local"
 	"refity/backend/internal/database"
+	"refity/backend/internal/storage"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	localDriver   local.StorageDriver
-	sftpDriver    sftp.StorageDriver
+	localDriver   storage.Driver // local staging for uploads before they reach the backend
+	storageDriver storage.Driver // primary backend (STORAGE_DRIVER)
 	db            *database.Database
 	cfg           *config.Config
 	onImageSaved  func() // optional callback to e.g. invalidate dashboard cache
@@ -46,6 +46,17 @@ func registryRateRecord(ip string) {
 	registryAuthAttempts[ip] = append(registryAuthAttempts[ip], time.Now())
 }
 
+// clientIP is the address a request came from, as reported by a proxy if there is one.
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	if xri := r.Header.Get("X-Real-IP"); xri != "" {
+		return xri
+	}
+	return strings.Split(r.RemoteAddr, ":")[0]
+}
+
 func basicAuth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ip := r.RemoteAddr
@@ -81,22 +92,34 @@ func basicAuth(next http.HandlerFunc) http.HandlerFunc {
 			w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"invalid credentials"}]}`))
 			return
 		}
-		next(w, r)
+		next(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
 	}
 }
 
-func NewRouterWithDeps(localD local.StorageDriver, sftpD sftp.StorageDriver, c *config.Config, database *database.Database, onSaved func()) http.Handler {
+type userKey struct{}
+
+// requestUser is the user basicAuth authenticated, or nil.
+func requestUser(r *http.Request) *database.User {
+	user, _ := r.Context().Value(userKey{}).(*database.User)
+	return user
+}
+
+func NewRouterWithDeps(localD storage.Driver, storageD storage.Driver, c *config.Config, database *database.Database, onSaved func()) http.Handler {
 	localDriver = localD
 	cfg = c
 	onImageSaved = onSaved
-	if sftpD != nil {
-		sftpDriver = sftpD
+	if storageD != nil {
+		storageDriver = storageD
 	} else {
-		pool, err := sftp.NewDriverPool(c, 4)
+		d, err := storage.New(c.StorageDriver, c)
 		if err != nil {
-			panic("failed to init SFTP pool: " + err.Error())
+			panic("failed to init storage driver: " + err.Error())
 		}
-		sftpDriver = &sftp.PoolStorageDriver{Pool: pool}
+		storageDriver = d
+	}
+	// Match concurrent background uploads to the upload pool so they never queue on each other's connections.
+	if c.SFTPUploadPoolSize > 0 {
+		sftpSemaphore = make(chan struct{}, c.SFTPUploadPoolSize)
 	}
 	db = database
 	mux := http.NewServeMux()
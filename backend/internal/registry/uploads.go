@@ -0,0 +1,187 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"refity/backend/internal/manifest"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/storage"
+)
+
+// PendingUpload describes background SFTP work that had not finished at shutdown.
+// LocalPath is the staged copy under the local driver; it must still exist for replay.
+type PendingUpload struct {
+	Kind       string `json:"kind"` // "blob" or "manifest"
+	LocalPath  string `json:"local_path"`
+	RemotePath string `json:"remote_path"`
+	DigestPath string `json:"digest_path,omitempty"` // manifest only: copy stored by digest
+	UploadID   string `json:"upload_id,omitempty"`   // blob only: names the remote temp file a replay resumes
+}
+
+var (
+	draining atomic.Bool
+
+	backgroundMu   sync.Mutex
+	backgroundSeq  int64
+	backgroundJobs = make(map[int64]PendingUpload)
+	backgroundDone = make(chan struct{}) // closed and replaced whenever a job ends
+)
+
+// runBackground runs fn in a goroutine and tracks it so shutdown can wait for it.
+// Jobs with a non-empty Kind are reported as pending if they are still running when the drain deadline expires.
+// Once draining began nothing new is queued: a request accepted just before runs its job inline instead, still
+// tracked, so it is journaled like the others if it outlasts the deadline.
+func runBackground(job PendingUpload, fn func() error) {
+	backgroundMu.Lock()
+	backgroundSeq++
+	id := backgroundSeq
+	backgroundJobs[id] = job
+	inline := draining.Load()
+	backgroundMu.Unlock()
+	stored := func() {}
+	if job.Kind == "blob" {
+		// Garbage collection keeps the blob until it is stored.
+		stored = manifest.BeginBlobUpload(job.RemotePath)
+	}
+
+	run := func() {
+		defer func() {
+			stored()
+			backgroundMu.Lock()
+			delete(backgroundJobs, id)
+			close(backgroundDone)
+			backgroundDone = make(chan struct{})
+			backgroundMu.Unlock()
+		}()
+		if err := fn(); err != nil && job.Kind != "" {
+			log.Printf("background %s upload %s failed: %v", job.Kind, job.RemotePath, err)
+		}
+	}
+	if inline {
+		run()
+	} else {
+		go run()
+	}
+}
+
+// BeginShutdown makes the registry reject new pushes (503) while pulls keep working.
+func BeginShutdown() {
+	draining.Store(true)
+}
+
+// WaitForUploads blocks until all background uploads finish or ctx is done.
+// It returns the uploads that were still running when ctx expired.
+func WaitForUploads(ctx context.Context) []PendingUpload {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	for len(backgroundJobs) > 0 && ctx.Err() == nil {
+		done := backgroundDone
+		backgroundMu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		backgroundMu.Lock()
+	}
+	var pending []PendingUpload
+	for _, job := range backgroundJobs {
+		if job.Kind != "" {
+			pending = append(pending, job)
+		}
+	}
+	return pending
+}
+
+// SavePendingUploads writes pending uploads to path so they can be replayed on next start. Uploads
+// already in the journal, not replayed because the registry started read-only, are kept.
+func SavePendingUploads(path string, pending []PendingUpload) error {
+	if data, err := os.ReadFile(path); err == nil {
+		var earlier []PendingUpload
+		if err := json.Unmarshal(data, &earlier); err != nil {
+			return fmt.Errorf("read %s: %w", path, err)
+		}
+		pending = append(earlier, pending...)
+	}
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// ReplayPendingUploads re-queues uploads saved by SavePendingUploads whose staged local copy still exists,
+// then removes the journal. Call after NewRouterWithDeps. In read-only mode nothing is replayed and the
+// journal is kept for the next start.
+func ReplayPendingUploads(path string) (int, error) {
+	if readonly.Get().ReadOnly {
+		if _, err := os.Stat(path); err == nil {
+			log.Printf("ReplayPendingUploads: registry is read-only, keeping %s for the next start", path)
+		}
+		return 0, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var pending []PendingUpload
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return 0, err
+	}
+	ctx := context.TODO()
+	replayed := 0
+	for _, job := range pending {
+		job := job
+		content, err := localDriver.GetContent(ctx, job.LocalPath)
+		if err != nil {
+			log.Printf("ReplayPendingUploads: staged file for %s is gone, skipping: %v", job.RemotePath, err)
+			continue
+		}
+		switch job.Kind {
+		case "blob":
+			uploadCtx := ctx
+			if job.UploadID != "" {
+				uploadCtx = storage.WithUploadID(ctx, job.UploadID)
+			}
+			runBackground(job, func() error {
+				return uploadBlobToSFTP(uploadCtx, job.LocalPath, job.RemotePath, content)
+			})
+		case "manifest":
+			runBackground(job, func() error {
+				return uploadManifestToSFTP(ctx, job.RemotePath, job.DigestPath, content)
+			})
+		default:
+			log.Printf("ReplayPendingUploads: unknown kind %q for %s, skipping", job.Kind, job.RemotePath)
+			continue
+		}
+		replayed++
+	}
+	if err := os.Remove(path); err != nil {
+		return replayed, err
+	}
+	return replayed, nil
+}
+
+// rejectWhileDraining answers push requests with UNAVAILABLE during shutdown. Returns true if the request was handled.
+func rejectWhileDraining(w http.ResponseWriter, r *http.Request) bool {
+	if !draining.Load() {
+		return false
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return false
+	}
+	w.Header().Set("Retry-After", "30")
+	registryError(w, "UNAVAILABLE", "registry is shutting down, retry the push shortly", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,226 @@
+package retention
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"refity/backend/internal/manifest"
+	"refity/backend/internal/storage"
+)
+
+// refs is what a manifest points at.
+type refs struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string `json:"digest"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// collect finds the manifests and blobs of repo that only the expired tags referenced and, when
+// applying, deletes them. Any manifest it cannot read stops the collection for the repository:
+// a blob is only deleted when every manifest left has been checked.
+func (c *Cleaner) collect(ctx context.Context, repo string, expired []Entry, rep *Report) error {
+	gone := make(map[string]bool)
+	for _, e := range expired {
+		if !rep.Applied || e.Deleted {
+			gone[e.Tag] = true
+		}
+	}
+	if len(gone) == 0 {
+		return nil
+	}
+	manifests, err := c.files(ctx, repo+"/manifests")
+	if err != nil {
+		return fmt.Errorf("list manifests: %w", err)
+	}
+	blobs, err := c.files(ctx, repo+"/blobs")
+	if err != nil {
+		return fmt.Errorf("list blobs: %w", err)
+	}
+
+	// Content of the remaining tags, from storage or, for a push still uploading, the database.
+	var remaining [][]byte
+	tags := make(map[string]bool)
+	for name := range manifests {
+		if !strings.HasPrefix(name, "sha256:") && !gone[name] {
+			tags[name] = true
+		}
+	}
+	images, err := c.db.GetImagesByRepository(repo)
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if gone[img.Tag] || tags[img.Tag] {
+			continue
+		}
+		m, err := c.db.GetManifestByImageID(img.ID)
+		if err != nil {
+			return fmt.Errorf("tag %s: no manifest in storage or database", img.Tag)
+		}
+		remaining = append(remaining, []byte(m.Content))
+	}
+	for tag := range tags {
+		b, err := c.driver.GetContent(ctx, repo+"/manifests/"+tag)
+		if err != nil {
+			return fmt.Errorf("read tag %s: %w", tag, err)
+		}
+		remaining = append(remaining, b)
+	}
+
+	live := make(map[string]bool)
+	for _, b := range remaining {
+		c.mark(ctx, repo, b, live)
+	}
+	dead := make(map[string]bool)
+	for _, e := range expired {
+		if !gone[e.Tag] {
+			continue
+		}
+		if b, err := c.driver.GetContent(ctx, repo+"/manifests/"+e.Digest); err == nil {
+			c.mark(ctx, repo, b, dead)
+		} else {
+			dead[e.Digest] = true
+		}
+	}
+
+	grace := c.opts.Grace
+	if grace <= 0 {
+		grace = defaultGrace
+	}
+	cutoff := time.Now().Add(-grace)
+	deleted := make(map[string]bool)
+	for _, d := range sorted(dead) {
+		fi, ok := manifests[d]
+		if live[d] || !ok || fi.ModTime.After(cutoff) {
+			continue
+		}
+		if c.remove(ctx, fi, rep) {
+			rep.Manifests = append(rep.Manifests, fi.Path)
+			deleted[d] = true
+		}
+	}
+
+	// Blobs stay while any manifest left in the repository references them, tagged or not, or a
+	// push in progress may still reference them.
+	used := manifest.InFlightBlobs(repo)
+	for name := range manifests {
+		if deleted[name] || gone[name] {
+			continue
+		}
+		b, err := c.driver.GetContent(ctx, repo+"/manifests/"+name)
+		if err != nil {
+			return fmt.Errorf("read manifest %s: %w", name, err)
+		}
+		addBlobs(b, used)
+	}
+	for _, b := range remaining {
+		addBlobs(b, used)
+	}
+	for _, d := range sortedKeys(blobs) {
+		fi := blobs[d]
+		if used[d] || fi.ModTime.After(cutoff) {
+			continue
+		}
+		if c.remove(ctx, fi, rep) {
+			rep.Blobs = append(rep.Blobs, fi.Path)
+		}
+	}
+	return nil
+}
+
+// mark adds the digest of a manifest and of its OCI copy to set and, for an index, does the same
+// for each platform manifest it lists.
+func (c *Cleaner) mark(ctx context.Context, repo string, b []byte, set map[string]bool) {
+	set[digestOf(b)] = true
+	set[digestOf(manifest.ToOCI(b))] = true
+	var r refs
+	if json.Unmarshal(b, &r) != nil {
+		return
+	}
+	for _, m := range r.Manifests {
+		if set[m.Digest] {
+			continue
+		}
+		set[m.Digest] = true
+		if sub, err := c.driver.GetContent(ctx, repo+"/manifests/"+m.Digest); err == nil {
+			c.mark(ctx, repo, sub, set)
+		}
+	}
+}
+
+func addBlobs(b []byte, set map[string]bool) {
+	var r refs
+	if json.Unmarshal(b, &r) != nil {
+		return
+	}
+	if r.Config.Digest != "" {
+		set[r.Config.Digest] = true
+	}
+	for _, l := range r.Layers {
+		set[l.Digest] = true
+	}
+}
+
+// remove deletes fi when applying and counts its size, reporting whether it is (or would be) gone.
+func (c *Cleaner) remove(ctx context.Context, fi storage.FileInfo, rep *Report) bool {
+	if rep.Applied {
+		if err := c.driver.Delete(ctx, fi.Path); err != nil && !storage.IsNotExist(err) {
+			rep.Errors = append(rep.Errors, fmt.Sprintf("delete %s: %v", fi.Path, err))
+			return false
+		}
+	}
+	rep.FreedBytes += fi.Size
+	return true
+}
+
+// files lists the files directly in dir by name.
+func (c *Cleaner) files(ctx context.Context, dir string) (map[string]storage.FileInfo, error) {
+	out := make(map[string]storage.FileInfo)
+	err := c.driver.Walk(ctx, dir, func(fi storage.FileInfo) error {
+		fi.Path = strings.TrimPrefix(fi.Path, "/")
+		if !fi.IsDir && path.Dir(fi.Path) == dir {
+			out[path.Base(fi.Path)] = fi
+		}
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return nil, err
+	}
+	return out, nil
+}
+
+func sorted(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for k := range set {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func sortedKeys(m map[string]storage.FileInfo) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
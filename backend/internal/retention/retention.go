@@ -0,0 +1,323 @@
+// Package retention applies the tag retention policies admins define per group or repository: it
+// deletes the tags no policy criterion keeps, then the manifests and blobs in storage that no
+// remaining tag references, so the space is reclaimed.
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"refity/backend/internal/database"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/storage"
+	"refity/backend/internal/tagrule"
+)
+
+// defaultGrace is how old an unreferenced manifest or blob must be before it is deleted when
+// Options.Grace is not set: a push in progress uploads blobs before the manifest that references
+// them, hours before on a slow link.
+const defaultGrace = 24 * time.Hour
+
+// ErrRunning is returned by Run while another run is active.
+var ErrRunning = errors.New("a retention run is already in progress")
+
+// Options configure the schedule.
+type Options struct {
+	Interval time.Duration // time between scheduled runs; 0 = off
+	Grace    time.Duration // minimum age of an unreferenced manifest or blob to delete; 0 = defaultGrace
+}
+
+// Cleaner applies retention policies on demand and on a schedule, one run at a time.
+type Cleaner struct {
+	driver   storage.Driver
+	db       *database.Database
+	opts     Options
+	onChange func()
+
+	running sync.Mutex
+	mu      sync.Mutex
+	last    *Report
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a cleaner. onChange, if set, is called after a run deleted tags.
+func New(driver storage.Driver, db *database.Database, opts Options, onChange func()) *Cleaner {
+	return &Cleaner{driver: driver, db: db, opts: opts, onChange: onChange, stopCh: make(chan struct{})}
+}
+
+// Entry is one tag a policy does not keep.
+type Entry struct {
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest"`
+	PushedAt   time.Time `json:"pushed_at"`
+	Policy     int64     `json:"policy"`
+	Deleted    bool      `json:"deleted"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Report lists what one run deleted or, without apply, would delete.
+type Report struct {
+	StartedAt    time.Time `json:"started_at"`
+	Elapsed      string    `json:"elapsed"`
+	Applied      bool      `json:"applied"`
+	Repositories int       `json:"repositories"` // repositories a policy covers
+	Kept         int       `json:"kept"`         // tags kept in those repositories
+	Tags         []Entry   `json:"tags"`         // tags not kept
+
+	Manifests  []string `json:"manifests"`   // manifest files no remaining tag references
+	Blobs      []string `json:"blobs"`       // blob files no remaining manifest references
+	FreedBytes int64    `json:"freed_bytes"` // size of those files
+
+	Errors []string `json:"errors"`
+}
+
+// Start schedules runs if an interval is set.
+func (c *Cleaner) Start() {
+	if c.opts.Interval <= 0 {
+		return
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-c.stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		ticker := time.NewTicker(c.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stopCh:
+				return
+			case <-ticker.C:
+				if err := readonly.CheckMaintenance(); err != nil {
+					log.Printf("[Retention] Skipping scheduled run: %v", err)
+					continue
+				}
+				if _, err := c.Run(ctx, true); err != nil && !errors.Is(err, ErrRunning) && ctx.Err() == nil {
+					log.Printf("[Retention] Failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop ends the schedule and waits for a scheduled run in progress.
+func (c *Cleaner) Stop() {
+	c.stopOnce.Do(func() { close(c.stopCh) })
+	c.wg.Wait()
+}
+
+// Status is the schedule and the report of the most recent applied run.
+type Status struct {
+	Running  bool    `json:"running"`
+	Interval string  `json:"interval"`
+	Last     *Report `json:"last"`
+}
+
+func (c *Cleaner) Status() Status {
+	st := Status{Interval: c.opts.Interval.String()}
+	if c.running.TryLock() {
+		c.running.Unlock()
+	} else {
+		st.Running = true
+	}
+	c.mu.Lock()
+	st.Last = c.last
+	c.mu.Unlock()
+	return st
+}
+
+// Validate checks a policy before it is stored.
+func Validate(p *database.RetentionPolicy) error {
+	p.Scope = strings.Trim(strings.TrimSpace(p.Scope), "/")
+	if p.KeepLast < 0 || p.KeepDays < 0 {
+		return errors.New("keep_last and keep_days must not be negative")
+	}
+	patterns := p.KeepPatterns[:0]
+	for _, pat := range p.KeepPatterns {
+		if pat = strings.TrimSpace(pat); pat == "" {
+			continue
+		}
+		if _, err := path.Match(pat, ""); err != nil || strings.Contains(pat, ",") {
+			return fmt.Errorf("invalid keep pattern %q", pat)
+		}
+		patterns = append(patterns, pat)
+	}
+	p.KeepPatterns = patterns
+	if p.KeepPatterns == nil {
+		p.KeepPatterns = []string{}
+	}
+	if p.KeepLast == 0 && p.KeepDays == 0 && len(p.KeepPatterns) == 0 {
+		return errors.New("a policy must keep something: set keep_last, keep_days or keep_patterns")
+	}
+	return nil
+}
+
+// policyFor returns the most specific policy covering repo: its own, its group's, or the global one.
+func policyFor(policies []*database.RetentionPolicy, repo string) *database.RetentionPolicy {
+	var best *database.RetentionPolicy
+	for _, p := range policies {
+		switch {
+		case p.Scope == repo:
+			return p
+		case p.Scope != "" && strings.HasPrefix(repo, p.Scope+"/"):
+			best = p
+		case p.Scope == "" && best == nil:
+			best = p
+		}
+	}
+	return best
+}
+
+// Run evaluates every policy. With apply it deletes the tags they do not keep and the files
+// no longer referenced; without, it only reports what would be deleted. Applying is refused in
+// maintenance mode, and a run stops when maintenance mode begins.
+func (c *Cleaner) Run(ctx context.Context, apply bool) (*Report, error) {
+	if apply {
+		if err := readonly.CheckMaintenance(); err != nil {
+			return nil, err
+		}
+	}
+	if !c.running.TryLock() {
+		return nil, ErrRunning
+	}
+	defer c.running.Unlock()
+
+	rep := &Report{StartedAt: time.Now().UTC(), Applied: apply, Tags: []Entry{}, Manifests: []string{}, Blobs: []string{}, Errors: []string{}}
+	err := c.run(ctx, rep)
+	rep.Elapsed = time.Since(rep.StartedAt).Round(time.Millisecond).String()
+	if err != nil {
+		return nil, err
+	}
+	if !apply {
+		return rep, nil
+	}
+	c.mu.Lock()
+	c.last = rep
+	c.mu.Unlock()
+	if len(rep.Tags) > 0 && c.onChange != nil {
+		c.onChange()
+	}
+	log.Printf("[Retention] %d repositories: deleted %d tags (kept %d), %d manifests, %d blobs, freed %d bytes (%d errors) in %s",
+		rep.Repositories, len(rep.Tags), rep.Kept, len(rep.Manifests), len(rep.Blobs), rep.FreedBytes, len(rep.Errors), rep.Elapsed)
+	return rep, nil
+}
+
+func (c *Cleaner) run(ctx context.Context, rep *Report) error {
+	policies, err := c.db.GetRetentionPolicies()
+	if err != nil || len(policies) == 0 {
+		return err
+	}
+	rules, err := tagrule.Load(c.db)
+	if err != nil {
+		return err
+	}
+	images, err := c.db.GetAllImages() // newest first
+	if err != nil {
+		return err
+	}
+	byRepo := make(map[string][]*database.Image)
+	var repos []string
+	for _, img := range images {
+		if _, ok := byRepo[img.Name]; !ok {
+			repos = append(repos, img.Name)
+		}
+		byRepo[img.Name] = append(byRepo[img.Name], img)
+	}
+
+	for _, repo := range repos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if rep.Applied {
+			if err := readonly.CheckMaintenance(); err != nil {
+				return err
+			}
+		}
+		p := policyFor(policies, repo)
+		if p == nil {
+			continue
+		}
+		rep.Repositories++
+		var expired []Entry
+		for i, img := range byRepo[repo] {
+			if keep(p, rules, i, img) {
+				rep.Kept++
+				continue
+			}
+			expired = append(expired, Entry{Repository: repo, Tag: img.Tag, Digest: img.Digest, PushedAt: img.CreatedAt, Policy: p.ID})
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if rep.Applied {
+			for i := range expired {
+				c.deleteTag(ctx, &expired[i])
+			}
+		}
+		rep.Tags = append(rep.Tags, expired...)
+		if err := c.collect(ctx, repo, expired, rep); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			rep.Errors = append(rep.Errors, fmt.Sprintf("%s: %v", repo, err))
+		}
+	}
+	return nil
+}
+
+// keep reports whether the i-th most recently pushed tag of its repository is kept by p, or by a
+// tag rule: immutable and protected tags are never deleted by retention.
+func keep(p *database.RetentionPolicy, rules []*database.TagRule, i int, img *database.Image) bool {
+	if i < p.KeepLast {
+		return true
+	}
+	if p.KeepDays > 0 && time.Since(img.CreatedAt) < time.Duration(p.KeepDays)*24*time.Hour {
+		return true
+	}
+	for _, pat := range p.KeepPatterns {
+		if ok, _ := path.Match(pat, img.Tag); ok {
+			return true
+		}
+	}
+	for _, rule := range rules {
+		if tagrule.Matches(rule, img.Name, img.Tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteTag removes a tag from the database and storage, like DeleteTagHandler.
+func (c *Cleaner) deleteTag(ctx context.Context, e *Entry) {
+	if err := c.db.DeleteImage(e.Repository, e.Tag); err != nil {
+		e.Error = err.Error()
+		return
+	}
+	tagPath := e.Repository + "/manifests/" + e.Tag
+	if err := c.driver.Delete(ctx, tagPath); err != nil && !storage.IsNotExist(err) {
+		e.Error = fmt.Sprintf("delete %s: %v", tagPath, err)
+		return
+	}
+	e.Deleted = true
+	event := &database.TagEvent{Name: e.Repository, Tag: e.Tag, Digest: e.Digest, Action: database.TagDeleted, Username: "retention"}
+	if err := c.db.RecordTagEvent(event); err != nil {
+		log.Printf("[Retention] Failed to record tag history for %s:%s: %v", e.Repository, e.Tag, err)
+	}
+}
@@ -0,0 +1,391 @@
+package scrub
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"refity/backend/internal/database"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/storage"
+)
+
+var (
+	// objectPath matches content-addressed objects: blobs and by-digest manifests.
+	objectPath = regexp.MustCompile(`^(.+)/(blobs|manifests)/(sha256:[a-f0-9]{64})$`)
+	// tagPath matches tag manifests, which are checked against the digest recorded for the tag.
+	tagPath = regexp.MustCompile(`^(.+)/manifests/([^/]+)$`)
+)
+
+// job is the state of one run.
+type job struct {
+	s     *Scrubber
+	run   *database.ScrubRun
+	limit *limiter
+	saved time.Time
+
+	refs []string          // objects the database references, sorted
+	tags map[string]string // tag manifest path -> digest recorded for the tag
+}
+
+func (j *job) scrub(ctx context.Context) error {
+	if err := j.loadReferences(); err != nil {
+		return fmt.Errorf("load references: %w", err)
+	}
+	resuming := j.run.Target != ""
+	var errs []string
+	for i, t := range j.s.targets {
+		if resuming && t.Name != j.run.Target {
+			continue // verified before the interruption
+		}
+		cursor := ""
+		if resuming {
+			cursor, resuming = j.run.Cursor, false
+		}
+		if err := j.scrubTarget(ctx, i, cursor); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("[Scrub] %s: %v", t.Name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", t.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// loadReferences collects the manifests, layers and configs of every image in the database.
+func (j *job) loadReferences() error {
+	images, err := j.s.db.GetAllImages()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	add := func(p string) {
+		if !seen[p] {
+			seen[p] = true
+			j.refs = append(j.refs, p)
+		}
+	}
+	j.tags = make(map[string]string)
+	for _, img := range images {
+		tag := img.Name + "/manifests/" + img.Tag
+		j.tags[tag] = img.Digest
+		add(tag)
+		if img.Digest != "" {
+			add(img.Name + "/manifests/" + img.Digest)
+		}
+		layers, err := j.s.db.GetLayersByImageID(img.ID)
+		if err != nil {
+			return err
+		}
+		for _, l := range layers {
+			add(img.Name + "/blobs/" + l.Digest)
+		}
+		if m, err := j.s.db.GetManifestByImageID(img.ID); err == nil {
+			var parsed struct {
+				Config struct {
+					Digest string `json:"digest"`
+				} `json:"config"`
+			}
+			if json.Unmarshal([]byte(m.Content), &parsed) == nil && parsed.Config.Digest != "" {
+				add(img.Name + "/blobs/" + parsed.Config.Digest)
+			}
+		}
+	}
+	sort.Strings(j.refs)
+	return nil
+}
+
+// scrubTarget verifies every object of target i after cursor, then looks for referenced objects
+// the target lacks.
+func (j *job) scrubTarget(ctx context.Context, i int, cursor string) error {
+	t := j.s.targets[i]
+	present := make(map[string]bool)
+	byDigest := make(map[string][]string) // digest -> content-addressed paths holding it
+	var paths []string
+	err := t.Driver.Walk(ctx, "", func(fi storage.FileInfo) error {
+		if fi.IsDir {
+			return nil
+		}
+		p := strings.TrimPrefix(fi.Path, "/")
+		present[p] = true
+		if m := objectPath.FindStringSubmatch(p); m != nil {
+			byDigest[m[3]] = append(byDigest[m[3]], p)
+			paths = append(paths, p)
+		} else if _, ok := j.tags[p]; ok {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return fmt.Errorf("list objects: %w", err)
+	}
+	sort.Strings(paths)
+
+	j.run.Target = t.Name
+	for _, p := range paths {
+		if p <= cursor {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		j.check(ctx, i, p, byDigest)
+		j.run.Cursor = p
+		j.run.Objects++
+		j.progress(false)
+	}
+
+	for _, p := range j.refs {
+		if present[p] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Pushed since the walk, or still waiting in staging for its upload.
+		if _, err := t.Driver.Stat(ctx, p); !storage.IsNotExist(err) {
+			continue
+		}
+		if _, err := j.s.staging.Stat(ctx, p); err == nil {
+			continue
+		}
+		j.record(ctx, i, p, "missing", "referenced by the database but not in storage", j.want(p), byDigest)
+	}
+	if i+1 < len(j.s.targets) {
+		// Target done; a resume starts with the next one.
+		j.run.Target, j.run.Cursor = j.s.targets[i+1].Name, ""
+	}
+	j.progress(true)
+	return nil
+}
+
+// want returns the digest the object at p must hash to, or "" if unknown.
+func (j *job) want(p string) string {
+	if m := objectPath.FindStringSubmatch(p); m != nil {
+		return m[3]
+	}
+	return j.tags[p]
+}
+
+// check hashes one object and records it if it is corrupt or unreadable.
+func (j *job) check(ctx context.Context, i int, p string, byDigest map[string][]string) {
+	t := j.s.targets[i]
+	want := j.want(p)
+	if want == "" {
+		return
+	}
+	got, n, err := j.hash(ctx, t.Driver, p)
+	j.run.Bytes += n
+	var problem, detail string
+	switch {
+	case err == nil && got == want:
+		return
+	case storage.IsNotExist(err) || ctx.Err() != nil:
+		return // deleted since the walk, or the run is stopping
+	case err == nil || errors.Is(err, storage.ErrDigestMismatch):
+		if m := tagPath.FindStringSubmatch(p); m != nil && objectPath.FindStringSubmatch(p) == nil {
+			// The tag may have been pushed again since the references were loaded.
+			if img, err := j.s.db.GetImage(m[1], m[2]); err != nil || img.Digest != want {
+				return
+			}
+		}
+		problem, detail = "corrupt", fmt.Sprintf("content hashes to %s", got)
+	default:
+		problem, detail = "unreadable", err.Error()
+	}
+	j.record(ctx, i, p, problem, detail, want, byDigest)
+}
+
+// record stores a finding, repairing the object first if enabled and possible.
+func (j *job) record(ctx context.Context, i int, p, problem, detail, want string, byDigest map[string][]string) {
+	t := j.s.targets[i]
+	f := &database.ScrubFinding{RunID: j.run.ID, Target: t.Name, Path: p, Problem: problem, Detail: detail}
+	switch problem {
+	case "corrupt":
+		j.run.Corrupt++
+	case "missing":
+		j.run.Missing++
+	default:
+		j.run.Unreadable++
+	}
+	if j.s.opts.Repair && problem != "unreadable" && want != "" {
+		if err := readonly.CheckMaintenance(); err != nil {
+			f.Detail += "; not repaired: " + err.Error()
+		} else if src, err := j.repair(ctx, i, p, want, byDigest); err != nil {
+			f.Detail += "; repair failed: " + err.Error()
+		} else {
+			f.RepairedFrom = src
+			j.run.Repaired++
+		}
+	}
+	if f.RepairedFrom != "" {
+		log.Printf("[Scrub] %s: %s is %s (%s); repaired from %s", t.Name, p, problem, detail, f.RepairedFrom)
+	} else {
+		log.Printf("[Scrub] %s: %s is %s: %s", t.Name, p, problem, f.Detail)
+	}
+	if err := j.s.db.CreateScrubFinding(f); err != nil {
+		log.Printf("[Scrub] Failed to record finding for %s: %v", p, err)
+	}
+	j.progress(true)
+}
+
+// repair rewrites p on target i from the first source that hashes to want: local staging, the
+// same path on another target, or another path on the same target holding the same content.
+func (j *job) repair(ctx context.Context, i int, p, want string, byDigest map[string][]string) (string, error) {
+	type source struct {
+		name   string
+		driver storage.Driver
+		path   string
+	}
+	sources := []source{{"staging", j.s.staging, p}}
+	for k, t := range j.s.targets {
+		if k != i {
+			sources = append(sources, source{t.Name, t.Driver, p})
+		}
+	}
+	t := j.s.targets[i]
+	for _, other := range byDigest[want] {
+		if other != p {
+			sources = append(sources, source{t.Name + ":" + other, t.Driver, other})
+		}
+	}
+	if m := tagPath.FindStringSubmatch(p); m != nil && objectPath.FindStringSubmatch(p) == nil {
+		sources = append(sources, source{t.Name + ":" + m[1] + "/manifests/" + want, t.Driver, m[1] + "/manifests/" + want})
+	}
+
+	var errs []string
+	for _, src := range sources {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if _, err := src.driver.Stat(ctx, src.path); err != nil {
+			continue
+		}
+		if err := j.copyVerified(ctx, src.driver, src.path, t.Driver, p, want); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", src.name, err))
+			continue
+		}
+		return src.name, nil
+	}
+	if len(errs) == 0 {
+		return "", errors.New("no copy available")
+	}
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+// copyVerified streams src to dst and commits only if the content hashes to want.
+func (j *job) copyVerified(ctx context.Context, src storage.Driver, srcPath string, dst storage.Driver, dstPath, want string) error {
+	rc, err := src.Reader(ctx, srcPath, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w, err := dst.Writer(ctx, dstPath, false)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), j.limit.reader(ctx, rc)); err != nil {
+		w.Cancel(ctx)
+		return err
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); got != want {
+		w.Cancel(ctx)
+		return fmt.Errorf("%w: copy hashes to %s", storage.ErrDigestMismatch, got)
+	}
+	return w.Commit(ctx)
+}
+
+// hash streams the object at p through sha256. Drivers that verify reads themselves report a
+// mismatch as an error wrapping storage.ErrDigestMismatch once the whole object was read.
+func (j *job) hash(ctx context.Context, d storage.Driver, p string) (string, int64, error) {
+	rc, err := d.Reader(ctx, p, 0)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, j.limit.reader(ctx, rc))
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), n, err
+}
+
+// progress publishes the run's counters and saves them every saveInterval, or now if force.
+func (j *job) progress(force bool) {
+	j.s.publish(j.run)
+	if force || time.Since(j.saved) >= saveInterval {
+		j.s.save(j.run)
+		j.saved = time.Now()
+	}
+}
+
+// limiter holds reads to an average rate. Credit for idle time is capped at one second so a
+// stall is not followed by an unthrottled burst.
+type limiter struct {
+	rate  int64
+	start time.Time
+	n     int64
+}
+
+func newLimiter(rate int64) *limiter {
+	return &limiter{rate: rate, start: time.Now()}
+}
+
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.n += int64(n)
+	due := time.Duration(float64(l.n) / float64(l.rate) * float64(time.Second))
+	elapsed := time.Since(l.start)
+	if elapsed > due+time.Second {
+		l.start, l.n = time.Now().Add(-time.Second), int64(n)
+		return nil
+	}
+	if d := due - elapsed; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
+
+func (l *limiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l.rate <= 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, l: l}
+}
+
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *limiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	n, err := lr.r.Read(p)
+	if werr := lr.l.wait(lr.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
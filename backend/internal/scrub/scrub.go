@@ -0,0 +1,278 @@
+// Package scrub re-verifies stored blobs and manifests against their digests. A run streams every
+// object of each target through sha256 at a bounded rate, checks that everything the database
+// references exists, and records problems in the database. Bad objects can be rewritten from a
+// good copy. Runs interrupted by a restart resume after the last object verified.
+package scrub
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"refity/backend/internal/database"
+	"refity/backend/internal/readonly"
+	"refity/backend/internal/storage"
+)
+
+const (
+	checkInterval = 10 * time.Minute // how often the scheduler looks whether a run is due
+	saveInterval  = 10 * time.Second // how often progress of an active run is written to the database
+	runsReported  = 10               // runs listed in the report
+)
+
+// ErrRunning is returned by Trigger while a run is active.
+var ErrRunning = errors.New("a scrub is already running")
+
+// Target is one copy of the registry's objects: the storage backend, or one replica of a mirror.
+// Its driver must return plaintext content (decrypting if needed) and should bypass the read
+// cache, so the scrubber verifies what is actually stored.
+type Target struct {
+	Name   string
+	Driver storage.Driver
+}
+
+// Options tune the scrubber.
+type Options struct {
+	Interval  time.Duration // time between scheduled runs; 0 = only on demand
+	RateLimit int64         // bytes read per second; 0 = unlimited
+	Repair    bool          // rewrite corrupt or missing objects from a verified copy
+}
+
+// Scrubber runs scrubs on demand and on a schedule. At most one run is active at a time.
+type Scrubber struct {
+	targets []Target
+	staging storage.Driver
+	db      *database.Database
+	opts    Options
+
+	mu        sync.Mutex
+	cancel    context.CancelFunc // cancels the active run; nil when idle
+	cancelled bool               // the active run was cancelled rather than interrupted by Stop
+	closed    bool
+	current   *database.ScrubRun // snapshot of the active run
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New creates a scrubber for targets. staging is the local upload staging driver, used to skip
+// objects that are still waiting for upload and as a repair source.
+func New(targets []Target, staging storage.Driver, db *database.Database, opts Options) *Scrubber {
+	return &Scrubber{targets: targets, staging: staging, db: db, opts: opts, stopCh: make(chan struct{})}
+}
+
+// Start resumes a run interrupted by the previous shutdown and, with an interval, schedules runs.
+func (s *Scrubber) Start() {
+	s.wg.Add(1)
+	go s.loop()
+}
+
+func (s *Scrubber) loop() {
+	defer s.wg.Done()
+	if last, err := s.db.GetLatestScrubRun(); err != nil {
+		log.Printf("[Scrub] Failed to load last run: %v", err)
+	} else if last != nil && last.Status == "running" && readonly.CheckMaintenance() == nil {
+		if _, err := s.start(last); err != nil {
+			log.Printf("[Scrub] Failed to resume run %d: %v", last.ID, err)
+		}
+	}
+	if s.opts.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for {
+		s.startIfDue()
+		select {
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Scrubber) startIfDue() {
+	if err := readonly.CheckMaintenance(); err != nil {
+		return
+	}
+	last, err := s.db.GetLatestScrubRun()
+	if err != nil {
+		log.Printf("[Scrub] Failed to load last run: %v", err)
+		return
+	}
+	if last != nil && last.Status == "running" {
+		// Interrupted, or not resumed at startup because maintenance mode was on.
+		if _, err := s.start(last); err != nil && !errors.Is(err, ErrRunning) {
+			log.Printf("[Scrub] Failed to resume run %d: %v", last.ID, err)
+		}
+		return
+	}
+	if last != nil && time.Since(last.StartedAt) < s.opts.Interval {
+		return
+	}
+	if _, err := s.start(nil); err != nil && !errors.Is(err, ErrRunning) {
+		log.Printf("[Scrub] Failed to start scheduled run: %v", err)
+	}
+}
+
+// Trigger starts a run in the background and returns it, or ErrRunning if one is active.
+func (s *Scrubber) Trigger() (*database.ScrubRun, error) {
+	return s.start(nil)
+}
+
+// start runs resume, or a new run if resume is nil, in the background and returns a snapshot of it.
+func (s *Scrubber) start(resume *database.ScrubRun) (*database.ScrubRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errors.New("scrubber is stopped")
+	}
+	if s.cancel != nil {
+		return nil, ErrRunning
+	}
+	run := resume
+	if run == nil {
+		var err error
+		if run, err = s.db.CreateScrubRun(); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	snapshot := *run
+	s.cancel, s.cancelled, s.current = cancel, false, &snapshot
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx, run)
+		s.mu.Lock()
+		s.cancel, s.current = nil, nil
+		s.mu.Unlock()
+		cancel()
+	}()
+	result := snapshot
+	return &result, nil
+}
+
+// Cancel stops the active run, which is recorded as cancelled and not resumed. It reports whether
+// a run was active.
+func (s *Scrubber) Cancel() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel == nil {
+		return false
+	}
+	s.cancelled = true
+	s.cancel()
+	return true
+}
+
+// Stop ends the schedule and interrupts the active run, which resumes on the next Start. It
+// returns once the run has saved its progress.
+func (s *Scrubber) Stop() {
+	s.stopOnce.Do(func() { close(s.stopCh) })
+	s.mu.Lock()
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Scrubber) run(ctx context.Context, run *database.ScrubRun) {
+	if run.Target != "" {
+		log.Printf("[Scrub] Resuming run %d on %s after %q", run.ID, run.Target, run.Cursor)
+	} else {
+		log.Printf("[Scrub] Starting run %d (repair=%v, rate limit %d B/s)", run.ID, s.opts.Repair, s.opts.RateLimit)
+	}
+	j := &job{s: s, run: run, limit: newLimiter(s.opts.RateLimit), saved: time.Now()}
+	err := j.scrub(ctx)
+
+	s.mu.Lock()
+	cancelled := s.cancelled
+	s.mu.Unlock()
+	now := time.Now().UTC()
+	switch {
+	case ctx.Err() != nil && !cancelled:
+		// Shutdown: stay "running" so the next start resumes from the cursor.
+		log.Printf("[Scrub] Run %d interrupted after %d objects; it resumes on next start", run.ID, run.Objects)
+		s.save(run)
+		return
+	case ctx.Err() != nil:
+		run.Status = "cancelled"
+	case err != nil:
+		run.Status, run.Error = "failed", err.Error()
+	default:
+		run.Status = "completed"
+	}
+	run.FinishedAt = &now
+	s.save(run)
+	log.Printf("[Scrub] Run %d %s: %d objects (%d bytes), %d corrupt, %d missing, %d unreadable, %d repaired",
+		run.ID, run.Status, run.Objects, run.Bytes, run.Corrupt, run.Missing, run.Unreadable, run.Repaired)
+}
+
+func (s *Scrubber) save(run *database.ScrubRun) {
+	if err := s.db.UpdateScrubRun(run); err != nil {
+		log.Printf("[Scrub] Failed to save run %d: %v", run.ID, err)
+	}
+}
+
+// publish makes the progress of the active run visible to Report.
+func (s *Scrubber) publish(run *database.ScrubRun) {
+	snapshot := *run
+	s.mu.Lock()
+	s.current = &snapshot
+	s.mu.Unlock()
+}
+
+// Report is the scrubber's configuration, recent runs and the findings of the newest run.
+type Report struct {
+	Running   bool                     `json:"running"`
+	Interval  string                   `json:"interval"`
+	RateLimit int64                    `json:"rate_limit"`
+	Repair    bool                     `json:"repair"`
+	Targets   []string                 `json:"targets"`
+	Runs      []*database.ScrubRun     `json:"runs"`
+	Findings  []*database.ScrubFinding `json:"findings"`
+}
+
+func (s *Scrubber) Report() (*Report, error) {
+	runs, err := s.db.GetScrubRuns(runsReported)
+	if err != nil {
+		return nil, err
+	}
+	rep := &Report{
+		Interval:  s.opts.Interval.String(),
+		RateLimit: s.opts.RateLimit,
+		Repair:    s.opts.Repair,
+		Runs:      runs,
+		Findings:  []*database.ScrubFinding{},
+	}
+	for _, t := range s.targets {
+		rep.Targets = append(rep.Targets, t.Name)
+	}
+	s.mu.Lock()
+	if s.current != nil {
+		rep.Running = true
+		for i, run := range runs {
+			if run.ID == s.current.ID {
+				snapshot := *s.current
+				runs[i] = &snapshot
+			}
+		}
+	}
+	s.mu.Unlock()
+	if len(runs) > 0 {
+		findings, err := s.db.GetScrubFindings(runs[0].ID)
+		if err != nil {
+			return nil, err
+		}
+		if findings != nil {
+			rep.Findings = findings
+		}
+	}
+	return rep, nil
+}
@@ -0,0 +1,393 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"refity/backend/internal/storage"
+)
+
+// digestPath matches blob and by-digest manifest paths, the only immutable objects in the registry.
+var digestPath = regexp.MustCompile(`^(.+)/(?:blobs|manifests)/sha256:([a-f0-9]{64})$`)
+
+// errTooLarge marks objects bigger than the whole cache; they are always read from the backend.
+var errTooLarge = errors.New("object exceeds CACHE_MAX_SIZE")
+
+// Stats are the cache counters exposed by the API.
+type Stats struct {
+	Dir            string  `json:"dir"`
+	MaxBytes       int64   `json:"max_bytes"`
+	Bytes          int64   `json:"bytes"`
+	Entries        int     `json:"entries"`
+	Hits           int64   `json:"hits"`
+	Misses         int64   `json:"misses"`
+	HitRatio       float64 `json:"hit_ratio"`
+	Fills          int64   `json:"fills"`
+	Evictions      int64   `json:"evictions"`
+	VerifyFailures int64   `json:"verify_failures"`
+}
+
+// Driver is a storage.Driver decorator that keeps blobs and by-digest manifests on local disk.
+// Entries are keyed by digest and verified on fill, so the same layer pulled from several
+// repositories is stored once. A cached digest is only served for paths known to hold it on the
+// backend; other paths are checked with Stat first, so deletes and repository permissions still apply.
+type Driver struct {
+	storage.Driver
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	entries  map[string]*entry // digest -> entry
+	lru      *list.List        // of *entry, most recently used first
+	size     int64
+	inflight map[string]*fill
+
+	hits, misses, fills, evictions, verifyFailures atomic.Int64
+}
+
+type entry struct {
+	digest string
+	size   int64
+	paths  map[string]bool // backend paths known to hold this digest
+	elem   *list.Element
+}
+
+type fill struct {
+	done chan struct{}
+	err  error
+}
+
+// New wraps backend with a cache in dir bounded to maxBytes. Existing files in dir are indexed,
+// so the cache survives restarts.
+func New(backend storage.Driver, dir string, maxBytes int64) (*Driver, error) {
+	d := &Driver{
+		Driver:   backend,
+		dir:      dir,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*entry),
+		lru:      list.New(),
+		inflight: make(map[string]*fill),
+	}
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0o755); err != nil {
+		return nil, fmt.Errorf("cache dir %s: %w", dir, err)
+	}
+	if err := d.load(); err != nil {
+		return nil, fmt.Errorf("cache dir %s: %w", dir, err)
+	}
+	d.mu.Lock()
+	d.evictLocked()
+	d.mu.Unlock()
+	log.Printf("[Cache] %s: %d entries, %d/%d bytes", dir, len(d.entries), d.size, maxBytes)
+	return d, nil
+}
+
+// load indexes cached files, oldest modification time least recently used.
+func (d *Driver) load() error {
+	type found struct {
+		digest string
+		size   int64
+		mtime  time.Time
+	}
+	var files []found
+	root := filepath.Join(d.dir, "sha256")
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || len(fi.Name()) != 64 {
+			return nil
+		}
+		files = append(files, found{fi.Name(), fi.Size(), fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Insert oldest first so the newest end up at the front.
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		e := &entry{digest: f.digest, size: f.size, paths: make(map[string]bool)}
+		e.elem = d.lru.PushFront(e)
+		d.entries[f.digest] = e
+		d.size += f.size
+	}
+	return nil
+}
+
+func (d *Driver) file(digest string) string {
+	return filepath.Join(d.dir, "sha256", digest[:2], digest)
+}
+
+// Stats returns a snapshot of the cache counters.
+func (d *Driver) Stats() Stats {
+	d.mu.Lock()
+	s := Stats{Dir: d.dir, MaxBytes: d.maxBytes, Bytes: d.size, Entries: len(d.entries)}
+	d.mu.Unlock()
+	s.Hits, s.Misses = d.hits.Load(), d.misses.Load()
+	s.Fills, s.Evictions, s.VerifyFailures = d.fills.Load(), d.evictions.Load(), d.verifyFailures.Load()
+	if total := s.Hits + s.Misses; total > 0 {
+		s.HitRatio = float64(s.Hits) / float64(total)
+	}
+	return s
+}
+
+// ---------------------------------------------------------------------------
+// Reads
+// ---------------------------------------------------------------------------
+
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	f, err := d.open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return d.Driver.GetContent(ctx, path)
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	f, err := d.open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return d.Driver.Reader(ctx, path, offset)
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// open returns the cached file for path, filling it from the backend on a miss. It returns
+// (nil, nil) when path is not cacheable or the cache cannot be used, so the caller reads the backend.
+func (d *Driver) open(ctx context.Context, path string) (*os.File, error) {
+	path = strings.Trim(path, "/")
+	m := digestPath.FindStringSubmatch(path)
+	if m == nil {
+		return nil, nil
+	}
+	digest := m[2]
+	filled := false // this call downloaded the entry and already counted a miss
+	for attempt := 0; attempt < 3; attempt++ {
+		d.mu.Lock()
+		e := d.entries[digest]
+		if e != nil && e.paths[path] {
+			d.lru.MoveToFront(e.elem)
+			d.mu.Unlock()
+			if f, err := os.Open(d.file(digest)); err == nil {
+				if !filled {
+					d.hits.Add(1)
+				}
+				return f, nil
+			}
+			d.remove(digest)
+			continue
+		}
+		if e != nil {
+			// Cached under another path: confirm this path holds the digest before serving it.
+			d.mu.Unlock()
+			if _, err := d.Driver.Stat(ctx, path); err != nil {
+				return nil, err
+			}
+			d.mu.Lock()
+			if e2 := d.entries[digest]; e2 != nil {
+				e2.paths[path] = true
+			}
+			d.mu.Unlock()
+			continue
+		}
+		fl, leader := d.inflight[digest], false
+		if fl == nil {
+			fl = &fill{done: make(chan struct{})}
+			d.inflight[digest] = fl
+			leader = true
+		}
+		d.mu.Unlock()
+
+		if leader {
+			d.misses.Add(1)
+			// Finish the fill even if this client goes away; others may be waiting for it.
+			fl.err = d.fill(context.WithoutCancel(ctx), path, digest)
+			filled = true
+			d.mu.Lock()
+			delete(d.inflight, digest)
+			d.mu.Unlock()
+			close(fl.done)
+		} else {
+			select {
+			case <-fl.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if fl.err != nil {
+			if storage.IsNotExist(fl.err) && leader {
+				return nil, fl.err
+			}
+			if fl.err != errTooLarge {
+				log.Printf("[Cache] Fill %s failed, reading from backend: %v", path, fl.err)
+			}
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// fill downloads path to a temp file, checks its sha256 against digest and moves it into the cache.
+func (d *Driver) fill(ctx context.Context, path, digest string) error {
+	fi, err := d.Driver.Stat(ctx, path)
+	if err != nil {
+		return err
+	}
+	if fi.Size > d.maxBytes {
+		return errTooLarge
+	}
+	rc, err := d.Driver.Reader(ctx, path, 0)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	tmp, err := os.CreateTemp(filepath.Join(d.dir, "tmp"), digest[:12]+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), rc)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		d.verifyFailures.Add(1)
+		return fmt.Errorf("%w: backend content hashes to sha256:%s", storage.ErrDigestMismatch, got)
+	}
+	final := d.file(digest)
+	if err := os.MkdirAll(filepath.Dir(final), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), final); err != nil {
+		return err
+	}
+	d.fills.Add(1)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := &entry{digest: digest, size: n, paths: map[string]bool{path: true}}
+	e.elem = d.lru.PushFront(e)
+	d.entries[digest] = e
+	d.size += n
+	d.evictLocked()
+	return nil
+}
+
+// evictLocked drops least recently used entries until the cache fits maxBytes. Open readers keep
+// their file until closed.
+func (d *Driver) evictLocked() {
+	for d.size > d.maxBytes && d.lru.Len() > 0 {
+		e := d.lru.Remove(d.lru.Back()).(*entry)
+		delete(d.entries, e.digest)
+		d.size -= e.size
+		d.evictions.Add(1)
+		if err := os.Remove(d.file(e.digest)); err != nil && !os.IsNotExist(err) {
+			log.Printf("[Cache] Evict %s: %v", e.digest, err)
+		}
+	}
+}
+
+func (d *Driver) remove(digest string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e := d.entries[digest]; e != nil {
+		d.lru.Remove(e.elem)
+		delete(d.entries, digest)
+		d.size -= e.size
+	}
+	os.Remove(d.file(digest))
+}
+
+// ---------------------------------------------------------------------------
+// Writes: forget paths that no longer hold their digest
+// ---------------------------------------------------------------------------
+
+// forget drops path, or every path under it with prefix, from the entries' known paths. The
+// data stays cached; other paths may still hold the same digest.
+func (d *Driver) forget(path string, prefix bool) {
+	path = strings.Trim(path, "/")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.entries {
+		for p := range e.paths {
+			if p == path || (prefix && strings.HasPrefix(p, path+"/")) {
+				delete(e.paths, p)
+			}
+		}
+	}
+}
+
+func (d *Driver) Delete(ctx context.Context, path string) error {
+	d.forget(path, true)
+	return d.Driver.Delete(ctx, path)
+}
+
+func (d *Driver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	d.forget(sourcePath, false)
+	d.forget(destPath, false)
+	return d.Driver.Move(ctx, sourcePath, destPath)
+}
+
+func (d *Driver) DeleteRepositoryFolder(ctx context.Context, repoName string) error {
+	d.forget(repoName, true)
+	return d.Driver.DeleteRepositoryFolder(ctx, repoName)
+}
+
+// CheckRoot and Close forward to the backend so startup checks and shutdown see through the cache.
+func (d *Driver) CheckRoot(ctx context.Context) error {
+	if rc, ok := d.Driver.(storage.RootChecker); ok {
+		return rc.CheckRoot(ctx)
+	}
+	return nil
+}
+
+// Capacity forwards to the backend.
+func (d *Driver) Capacity(ctx context.Context) (storage.Capacity, error) {
+	if cr, ok := d.Driver.(storage.CapacityReporter); ok {
+		return cr.Capacity(ctx)
+	}
+	return storage.Capacity{}, storage.ErrNoCapacity
+}
+
+func (d *Driver) Close() error {
+	if c, ok := d.Driver.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
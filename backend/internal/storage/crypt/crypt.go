@@ -0,0 +1,288 @@
+package crypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+
+	"refity/backend/internal/storage"
+)
+
+// Driver is a storage.Driver decorator that encrypts every object before it reaches the backend
+// and decrypts on read. Sizes, ranged reads and digests all refer to the plaintext, so the registry
+// is unaware of it. Objects written before encryption was enabled are read as-is until the
+// re-encrypt tool rewrites them.
+type Driver struct {
+	storage.Driver
+	keys *Keyring
+}
+
+// New wraps backend with encryption using keys.
+func New(backend storage.Driver, keys *Keyring) *Driver {
+	log.Printf("[Crypt] Encrypting objects with key %s (%d key(s) in keyring)", keys.Active(), len(keys.keys))
+	return &Driver{Driver: backend, keys: keys}
+}
+
+// Keyring returns the keys used by the driver.
+func (d *Driver) Keyring() *Keyring { return d.keys }
+
+func (d *Driver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	ctx = storage.WithEncodedContent(ctx)
+	b, err := d.Driver.GetContent(ctx, path)
+	if err != nil || !isEncrypted(b) {
+		return b, err
+	}
+	return d.keys.open(b)
+}
+
+// PutContent seals content into a new object. Retries of a registry upload (storage.WithUploadID)
+// produce the same ciphertext, so the backend can resume them.
+func (d *Driver) PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error {
+	var h *header
+	var err error
+	if id := storage.UploadID(ctx); id != "" {
+		h, err = d.keys.newUploadHeader(id, path, content)
+	} else {
+		h, err = newHeader(d.keys.active)
+	}
+	if err != nil {
+		return err
+	}
+	aead, err := d.keys.aead(h)
+	if err != nil {
+		return err
+	}
+	ctx = storage.WithEncodedContent(ctx)
+	return d.Driver.PutContent(ctx, path, seal(aead, h, content), progressCb...)
+}
+
+// readHeader returns the header of the object at path, or nil if the object is not encrypted.
+func (d *Driver) readHeader(ctx context.Context, path string) (*header, error) {
+	ctx = storage.WithEncodedContent(ctx)
+	rc, err := d.Driver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	buf := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	if !isEncrypted(buf[:n]) {
+		return nil, nil
+	}
+	return parseHeader(buf[:n])
+}
+
+func (d *Driver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	ctx = storage.WithEncodedContent(ctx)
+	rc, err := d.Driver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, headerSize)
+	n, err := io.ReadFull(rc, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	if !isEncrypted(buf[:n]) {
+		// Plaintext object from before encryption was enabled.
+		if offset == 0 {
+			return readCloser{io.MultiReader(bytes.NewReader(buf[:n]), rc), rc}, nil
+		}
+		rc.Close()
+		return d.Driver.Reader(ctx, path, offset)
+	}
+	h, err := parseHeader(buf[:n])
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	aead, err := d.keys.aead(h)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	index := offset / chunkSize
+	if index > 0 {
+		rc.Close()
+		if rc, err = d.Driver.Reader(ctx, path, int64(headerSize)+index*sealedSize); err != nil {
+			return nil, err
+		}
+	}
+	return newDecryptReader(rc, aead, h, uint64(index), int(offset%chunkSize)), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Writer encrypts a stream. Appending is not supported: the registry only appends to the local
+// staging driver, never to the storage backend.
+func (d *Driver) Writer(ctx context.Context, path string, append bool) (storage.FileWriter, error) {
+	if append {
+		return nil, errors.New("encrypted storage does not support appending to objects")
+	}
+	h, err := newHeader(d.keys.active)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := d.keys.aead(h)
+	if err != nil {
+		return nil, err
+	}
+	ctx = storage.WithEncodedContent(ctx)
+	w, err := d.Driver.Writer(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(h.raw); err != nil {
+		w.Cancel(ctx)
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, h: h, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// encryptWriter seals each chunk once it is full and the last, short chunk on Close or Commit.
+type encryptWriter struct {
+	w     storage.FileWriter
+	aead  cipher.AEAD
+	h     *header
+	buf   []byte
+	out   []byte
+	index uint64
+	size  int64
+	done  bool
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.done {
+		return 0, errors.New("write to closed encrypted writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(ew.buf[len(ew.buf):chunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+		ew.size += int64(n)
+		if len(ew.buf) == chunkSize {
+			if err := ew.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) flush(final bool) error {
+	ew.out = ew.aead.Seal(ew.out[:0], chunkNonce(ew.index, final), ew.buf, ew.h.raw)
+	ew.index++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+// Size returns the plaintext bytes written.
+func (ew *encryptWriter) Size() int64 { return ew.size }
+
+func (ew *encryptWriter) finish() error {
+	if ew.done {
+		return nil
+	}
+	ew.done = true
+	return ew.flush(true)
+}
+
+func (ew *encryptWriter) Close() error {
+	if err := ew.finish(); err != nil {
+		ew.w.Close()
+		return err
+	}
+	return ew.w.Close()
+}
+
+func (ew *encryptWriter) Commit(ctx context.Context) error {
+	if err := ew.finish(); err != nil {
+		ew.w.Cancel(ctx)
+		return err
+	}
+	return ew.w.Commit(ctx)
+}
+
+func (ew *encryptWriter) Cancel(ctx context.Context) error {
+	ew.done = true
+	return ew.w.Cancel(ctx)
+}
+
+// Stat reports the plaintext size. Objects large enough to be encrypted have their header read to
+// tell them apart from plaintext ones.
+func (d *Driver) Stat(ctx context.Context, path string) (storage.FileInfo, error) {
+	fi, err := d.Driver.Stat(ctx, path)
+	if err != nil || fi.IsDir {
+		return fi, err
+	}
+	return d.plaintextInfo(ctx, fi)
+}
+
+func (d *Driver) plaintextInfo(ctx context.Context, fi storage.FileInfo) (storage.FileInfo, error) {
+	size, ok := plaintextSize(fi.Size)
+	if !ok {
+		return fi, nil
+	}
+	h, err := d.readHeader(ctx, fi.Path)
+	if err != nil {
+		return fi, err
+	}
+	if h != nil {
+		fi.Size = size
+	}
+	return fi, nil
+}
+
+func (d *Driver) Walk(ctx context.Context, path string, f storage.WalkFn, options ...func(*storage.WalkOptions)) error {
+	return d.Driver.Walk(ctx, path, func(fi storage.FileInfo) error {
+		if !fi.IsDir {
+			var err error
+			if fi, err = d.plaintextInfo(ctx, fi); err != nil {
+				return err
+			}
+		}
+		return f(fi)
+	}, options...)
+}
+
+// RedirectURL never redirects: clients cannot decrypt objects fetched straight from the backend.
+func (d *Driver) RedirectURL(r *http.Request, path string) (string, error) {
+	return "", nil
+}
+
+// CheckRoot and Close forward to the backend so startup checks and shutdown see through the decorator.
+func (d *Driver) CheckRoot(ctx context.Context) error {
+	if rc, ok := d.Driver.(storage.RootChecker); ok {
+		return rc.CheckRoot(ctx)
+	}
+	return nil
+}
+
+// Capacity forwards to the backend.
+func (d *Driver) Capacity(ctx context.Context) (storage.Capacity, error) {
+	if cr, ok := d.Driver.(storage.CapacityReporter); ok {
+		return cr.Capacity(ctx)
+	}
+	return storage.Capacity{}, storage.ErrNoCapacity
+}
+
+func (d *Driver) Close() error {
+	if c, ok := d.Driver.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
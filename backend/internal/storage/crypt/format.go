@@ -0,0 +1,233 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Object layout:
+//
+//	header  magic "RFTYENC1" | key ID length (1) | key ID, zero-padded (32) | salt (32)
+//	chunks  AES-256-GCM(plaintext chunk) | tag (16), repeated
+//
+// Every chunk but the last holds exactly chunkSize plaintext bytes; the last holds fewer (possibly
+// zero) and is sealed with a final flag in its nonce, so truncation at a chunk boundary is detected.
+// The fixed header and chunk sizes let Stat derive the plaintext size from the object size, and a
+// ranged read decrypt from the chunk holding its offset. Each object gets its own key, derived from
+// the master key and the random salt, so chunk counters can serve as nonces.
+const (
+	magic      = "RFTYENC1"
+	keyIDSize  = 32
+	saltSize   = 32
+	headerSize = len(magic) + 1 + keyIDSize + saltSize
+	chunkSize  = 64 << 10
+	tagSize    = 16
+	sealedSize = chunkSize + tagSize
+)
+
+var (
+	errTruncated = errors.New("encrypted object is truncated")
+	errAuth      = errors.New("encrypted object failed authentication (corrupt or wrong key)")
+)
+
+type header struct {
+	raw   []byte
+	keyID string
+	salt  []byte
+}
+
+// newHeader creates the header for a new object encrypted with keyID.
+func newHeader(keyID string) (*header, error) {
+	h := &header{raw: make([]byte, headerSize), keyID: keyID}
+	copy(h.raw, magic)
+	h.raw[len(magic)] = byte(len(keyID))
+	copy(h.raw[len(magic)+1:], keyID)
+	h.salt = h.raw[headerSize-saltSize:]
+	if _, err := rand.Read(h.salt); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// newUploadHeader creates the header for an object written for a registry upload. Its salt is
+// derived from the upload, path and content instead of drawn at random, so every attempt of the
+// upload produces the same ciphertext and the backend can resume an interrupted one. Hashing in
+// the content keeps two plaintexts from ever sharing a salt, and with it a key and nonces.
+func (kr *Keyring) newUploadHeader(uploadID, path string, content []byte) (*header, error) {
+	h, err := newHeader(kr.active)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	mac := hmac.New(sha256.New, kr.keys[kr.active])
+	mac.Write([]byte("refity upload salt"))
+	mac.Write([]byte(uploadID + "\x00" + path + "\x00"))
+	mac.Write(sum[:])
+	copy(h.salt, mac.Sum(nil))
+	return h, nil
+}
+
+// isEncrypted reports whether b starts with the object magic.
+func isEncrypted(b []byte) bool {
+	return len(b) >= len(magic) && string(b[:len(magic)]) == magic
+}
+
+func parseHeader(b []byte) (*header, error) {
+	if len(b) < headerSize || !isEncrypted(b) {
+		return nil, errors.New("not an encrypted object")
+	}
+	n := int(b[len(magic)])
+	if n == 0 || n > keyIDSize {
+		return nil, errors.New("encrypted object has an invalid key ID")
+	}
+	raw := bytes.Clone(b[:headerSize])
+	return &header{
+		raw:   raw,
+		keyID: string(raw[len(magic)+1 : len(magic)+1+n]),
+		salt:  raw[headerSize-saltSize:],
+	}, nil
+}
+
+// aead returns the cipher for the object, keyed by HMAC-SHA256(master key, salt).
+func (kr *Keyring) aead(h *header) (cipher.AEAD, error) {
+	master, ok := kr.keys[h.keyID]
+	if !ok {
+		return nil, fmt.Errorf("object is encrypted with key %q, which is not in the keyring", h.keyID)
+	}
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("refity object key"))
+	mac.Write(h.salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(index uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// plaintextSize returns the plaintext size of an encrypted object of size n, or false if no
+// well-formed object has that size.
+func plaintextSize(n int64) (int64, bool) {
+	body := n - int64(headerSize)
+	if body < tagSize {
+		return 0, false
+	}
+	full, rem := body/sealedSize, body%sealedSize
+	if rem < tagSize {
+		return 0, false
+	}
+	return full*chunkSize + rem - tagSize, true
+}
+
+// encryptedSize is the object size for n plaintext bytes.
+func encryptedSize(n int64) int64 {
+	return int64(headerSize) + n + (n/chunkSize+1)*tagSize
+}
+
+// seal encrypts a whole plaintext into a new object.
+func seal(aead cipher.AEAD, h *header, plaintext []byte) []byte {
+	out := make([]byte, 0, encryptedSize(int64(len(plaintext))))
+	out = append(out, h.raw...)
+	var index uint64
+	for len(plaintext) >= chunkSize {
+		out = aead.Seal(out, chunkNonce(index, false), plaintext[:chunkSize], h.raw)
+		plaintext = plaintext[chunkSize:]
+		index++
+	}
+	return aead.Seal(out, chunkNonce(index, true), plaintext, h.raw)
+}
+
+// decryptReader decrypts chunks read from an object positioned at chunk index, dropping the
+// first skip plaintext bytes.
+type decryptReader struct {
+	src   io.ReadCloser
+	aead  cipher.AEAD
+	h     *header
+	index uint64
+	skip  int
+	in    []byte
+	out   []byte
+	done  bool
+}
+
+func newDecryptReader(src io.ReadCloser, aead cipher.AEAD, h *header, index uint64, skip int) *decryptReader {
+	return &decryptReader{src: src, aead: aead, h: h, index: index, skip: skip, in: make([]byte, sealedSize)}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// next reads and opens one chunk. A full-size chunk is never the last one.
+func (r *decryptReader) next() error {
+	n, err := io.ReadFull(r.src, r.in)
+	final := false
+	switch {
+	case err == io.ErrUnexpectedEOF || (err == io.EOF && n == 0):
+		if n < tagSize {
+			return errTruncated
+		}
+		final = true
+	case err != nil:
+		return err
+	}
+	out, err := r.aead.Open(r.in[:0], chunkNonce(r.index, final), r.in[:n], r.h.raw)
+	if err != nil {
+		return errAuth
+	}
+	r.index++
+	r.done = final
+	if r.skip > 0 {
+		s := min(r.skip, len(out))
+		out, r.skip = out[s:], r.skip-s
+	}
+	r.out = out
+	return nil
+}
+
+func (r *decryptReader) Close() error { return r.src.Close() }
+
+// open decrypts a whole object.
+func (kr *Keyring) open(b []byte) ([]byte, error) {
+	h, err := parseHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := kr.aead(h)
+	if err != nil {
+		return nil, err
+	}
+	r := newDecryptReader(io.NopCloser(bytes.NewReader(b[headerSize:])), aead, h, 0, 0)
+	size, _ := plaintextSize(int64(len(b)))
+	out := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.Copy(out, r); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
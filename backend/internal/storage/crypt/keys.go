@@ -0,0 +1,123 @@
+package crypt
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+// Keyring holds the master keys by ID. New objects are encrypted with the active key; every key in
+// the ring can decrypt, so a rotated-out key stays listed until the re-encrypt tool has moved all
+// content off it.
+type Keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+// LoadKeyring parses keys from a keyfile and from a comma-separated list, both as "id:key" entries
+// with a 32-byte key in base64 or hex. Keyfile lines may also use "id key" and "#" comments. active
+// selects the key for new writes; it defaults to the last key listed. Returns nil when no keys are
+// configured.
+func LoadKeyring(keys, keyFile, active string) (*Keyring, error) {
+	kr := &Keyring{keys: make(map[string][]byte)}
+	var last string
+	add := func(source, entry string) error {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			return nil
+		}
+		id, key, ok := strings.Cut(entry, ":")
+		if !ok {
+			id, key, ok = strings.Cut(entry, " ")
+		}
+		id, key = strings.TrimSpace(id), strings.TrimSpace(key)
+		if !ok || !keyIDPattern.MatchString(id) {
+			return fmt.Errorf("%s: entries must be \"id:key\" with an id of at most 32 letters, digits, '.', '_' or '-'", source)
+		}
+		raw, err := decodeKey(key)
+		if err != nil {
+			return fmt.Errorf("%s: key %s: %w", source, id, err)
+		}
+		if _, dup := kr.keys[id]; dup {
+			return fmt.Errorf("%s: duplicate key id %s", source, id)
+		}
+		kr.keys[id] = raw
+		last = id
+		return nil
+	}
+
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEYFILE: %w", err)
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if err := add("ENCRYPTION_KEYFILE "+keyFile, sc.Text()); err != nil {
+				return nil, err
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, fmt.Errorf("ENCRYPTION_KEYFILE: %w", err)
+		}
+	}
+	for _, entry := range strings.Split(keys, ",") {
+		if err := add("ENCRYPTION_KEYS", entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(kr.keys) == 0 {
+		if active != "" {
+			return nil, fmt.Errorf("ENCRYPTION_ACTIVE_KEY is set but no keys are configured")
+		}
+		return nil, nil
+	}
+	kr.active = last
+	if active != "" {
+		if _, ok := kr.keys[active]; !ok {
+			return nil, fmt.Errorf("ENCRYPTION_ACTIVE_KEY=%s is not in the keyring (have %s)", active, strings.Join(kr.IDs(), ", "))
+		}
+		kr.active = active
+	}
+	return kr, nil
+}
+
+// decodeKey accepts 64 hex characters or standard/URL base64, padded or not, of exactly 32 bytes.
+func decodeKey(s string) ([]byte, error) {
+	if len(s) == 64 {
+		if b, err := hex.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil {
+			if len(b) != 32 {
+				return nil, fmt.Errorf("must be 32 bytes for AES-256, got %d", len(b))
+			}
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("not valid base64 or hex (generate one with: openssl rand -base64 32)")
+}
+
+// Active returns the ID of the key used for new objects.
+func (kr *Keyring) Active() string { return kr.active }
+
+// IDs returns the key IDs, sorted.
+func (kr *Keyring) IDs() []string {
+	ids := make([]string, 0, len(kr.keys))
+	for id := range kr.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,114 @@
+package crypt
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"time"
+
+	"refity/backend/internal/storage"
+)
+
+var digestPath = regexp.MustCompile(`/(?:blobs|manifests)/sha256:([a-f0-9]{64})$`)
+
+// ReencryptReport summarizes one re-encryption pass.
+type ReencryptReport struct {
+	Scanned   int   // objects seen
+	Current   int   // already encrypted with the active key
+	Rewritten int   // plaintext or other-key objects rewritten with the active key (or that would be, in a dry run)
+	Failed    int   // objects that could not be rewritten; see the log
+	Bytes     int64 // plaintext bytes rewritten
+	Elapsed   time.Duration
+}
+
+// Reencrypt rewrites every object that is still plaintext or encrypted with a key other than the
+// active one. Each object is first decrypted to a local temp file and, for blobs and by-digest
+// manifests, checked against its digest, then written back in place. With dryRun only the
+// objects that need rewriting are counted.
+func (d *Driver) Reencrypt(ctx context.Context, dryRun bool) (ReencryptReport, error) {
+	start := time.Now()
+	var rep ReencryptReport
+	var paths []string
+	err := d.Driver.Walk(ctx, "", func(fi storage.FileInfo) error {
+		if !fi.IsDir {
+			paths = append(paths, fi.Path)
+		}
+		return nil
+	})
+	if err != nil && !storage.IsNotExist(err) {
+		return rep, err
+	}
+
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return rep, ctx.Err()
+		}
+		rep.Scanned++
+		h, err := d.readHeader(ctx, path)
+		if err != nil {
+			log.Printf("[Crypt] Re-encrypt %s: %v", path, err)
+			rep.Failed++
+			continue
+		}
+		if h != nil && h.keyID == d.keys.active {
+			rep.Current++
+			continue
+		}
+		if dryRun {
+			rep.Rewritten++
+			continue
+		}
+		n, err := d.rewrite(ctx, path)
+		if err != nil {
+			log.Printf("[Crypt] Re-encrypt %s: %v", path, err)
+			rep.Failed++
+			continue
+		}
+		rep.Rewritten++
+		rep.Bytes += n
+	}
+	rep.Elapsed = time.Since(start)
+	return rep, nil
+}
+
+func (d *Driver) rewrite(ctx context.Context, path string) (int64, error) {
+	rc, err := d.Reader(ctx, path, 0)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp("", "refity-reencrypt-*")
+	if err != nil {
+		rc.Close()
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), rc)
+	rc.Close()
+	if err != nil {
+		return 0, err
+	}
+	if m := digestPath.FindStringSubmatch(path); m != nil {
+		if got := hex.EncodeToString(hash.Sum(nil)); got != m[1] {
+			return 0, fmt.Errorf("content hashes to sha256:%s, leaving the object untouched", got)
+		}
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	w, err := d.Writer(ctx, path, false)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(w, tmp); err != nil {
+		w.Cancel(ctx)
+		return 0, err
+	}
+	return n, w.Close()
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"refity/backend/internal/config"
+)
+
+// Driver is the storage backend used by the registry and API. Paths are relative to the
+// backend's registry root (e.g. "group/app/blobs/sha256:..."); each driver maps them to its own layout.
+type Driver interface {
+	Name() string
+	GetContent(ctx context.Context, path string) ([]byte, error)
+	PutContent(ctx context.Context, path string, content []byte, progressCb ...func(written, total int64)) error
+	Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error)
+	Writer(ctx context.Context, path string, append bool) (FileWriter, error)
+	Stat(ctx context.Context, path string) (FileInfo, error)
+	List(ctx context.Context, path string) ([]string, error)
+	Move(ctx context.Context, sourcePath string, destPath string) error
+	Delete(ctx context.Context, path string) error
+	RedirectURL(r *http.Request, path string) (string, error)
+	Walk(ctx context.Context, path string, f WalkFn, options ...func(*WalkOptions)) error
+	CreateRepositoryFolder(ctx context.Context, repoName string) error
+	DeleteRepositoryFolder(ctx context.Context, repoName string) error
+	CreateGroupFolder(ctx context.Context, groupName string) error
+}
+
+// FileWriter streams content to a path. Commit makes the content visible; Cancel discards it.
+type FileWriter interface {
+	io.WriteCloser
+	Size() int64
+	Cancel(context.Context) error
+	Commit(context.Context) error
+}
+
+// FileInfo describes an object or directory. Path is relative to the registry root, like the paths passed in.
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+type WalkFn func(fileInfo FileInfo) error
+type WalkOptions struct{}
+
+// RootChecker is implemented by drivers that can verify their root exists and is writable at startup.
+type RootChecker interface {
+	CheckRoot(ctx context.Context) error
+}
+
+// Capacity is the space of the filesystem a backend writes to, in bytes.
+type Capacity struct {
+	Total int64
+	Free  int64 // available to the registry
+}
+
+// CapacityReporter is implemented by drivers that can tell how much space their backend has.
+type CapacityReporter interface {
+	Capacity(ctx context.Context) (Capacity, error)
+}
+
+// ErrNoCapacity is returned by a CapacityReporter whose backend cannot report its space.
+var ErrNoCapacity = errors.New("storage backend does not report its capacity")
+
+var ErrRepoNotFound = errors.New("repository not found")
+
+// ErrDigestMismatch is wrapped by drivers that verify reads when content does not hash to the
+// digest in its path.
+var ErrDigestMismatch = errors.New("content does not match digest")
+
+type encodedContentKey struct{}
+
+// WithEncodedContent marks ctx for backend calls whose bytes are an encoding of the registry
+// content (the crypt decorator's ciphertext), so drivers do not check them against digests.
+func WithEncodedContent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, encodedContentKey{}, true)
+}
+
+// IsEncodedContent reports whether ctx was marked with WithEncodedContent.
+func IsEncodedContent(ctx context.Context) bool {
+	v, _ := ctx.Value(encodedContentKey{}).(bool)
+	return v
+}
+
+type uploadIDKey struct{}
+
+// WithUploadID tags ctx with the registry upload an object is written for, so drivers that stage
+// writes in a temp file can name it after the upload and resume it when the write is retried.
+func WithUploadID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, uploadIDKey{}, id)
+}
+
+// UploadID returns the upload ctx was tagged with by WithUploadID, or "".
+func UploadID(ctx context.Context) string {
+	id, _ := ctx.Value(uploadIDKey{}).(string)
+	return id
+}
+
+// IsNotExist reports whether err means the path does not exist on the backend.
+func IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	s := err.Error()
+	return strings.Contains(s, "does not exist") || strings.Contains(s, "no such file")
+}
+
+// ProgressReader wraps an upload body of total bytes read from r and calls cb, if set, at every
+// 10% step and when the last byte is read.
+func ProgressReader(r io.Reader, total int64, cb func(written, total int64)) io.Reader {
+	return &progressReader{r: r, total: total, cb: cb, nextPercent: 10}
+}
+
+type progressReader struct {
+	r           io.Reader
+	read        int64
+	total       int64
+	cb          func(written, total int64)
+	nextPercent int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if p.cb != nil && p.total > 0 && n > 0 && (p.read*100/p.total >= p.nextPercent || p.read == p.total) {
+		p.cb(p.read, p.total)
+		p.nextPercent += 10
+	}
+	return n, err
+}
+
+// ---------------------------------------------------------------------------
+// Backend registry
+// ---------------------------------------------------------------------------
+
+// Factory creates a driver from configuration. Backends register one in init().
+type Factory func(cfg *config.Config) (Driver, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a backend available under name (STORAGE_DRIVER). Panics on duplicates.
+func Register(name string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, dup := factories[name]; dup {
+		panic("storage: Register called twice for backend " + name)
+	}
+	factories[name] = f
+}
+
+// New creates the backend registered under name.
+func New(name string, cfg *config.Config) (Driver, error) {
+	factoriesMu.RLock()
+	f, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %q (available: %s)", name, strings.Join(Backends(), ", "))
+	}
+	return f(cfg)
+}
+
+// Backends returns the registered backend names, sorted.
+func Backends() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
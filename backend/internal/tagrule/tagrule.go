@@ -0,0 +1,150 @@
+// Package tagrule enforces the tag rules admins define per group or repository. An immutable tag
+// cannot be moved to another digest or deleted once pushed, by anyone; a protected tag can only
+// be moved or deleted by the rule's roles. Pushing a tag for the first time is always allowed.
+package tagrule
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"refity/backend/internal/database"
+)
+
+const (
+	Immutable = "immutable"
+	Protected = "protected"
+)
+
+// Action is what a request does to an existing tag.
+type Action string
+
+const (
+	Overwrite Action = "overwrite" // push a different digest, or roll back
+	Delete    Action = "delete"
+)
+
+// ErrDenied is wrapped by the error Check returns when a rule forbids the action.
+var ErrDenied = errors.New("denied by tag rule")
+
+// Validate checks a rule before it is stored and fills in defaults: a glob pattern, and the admin
+// role for protected tags.
+func Validate(rule *database.TagRule) error {
+	rule.Scope = strings.Trim(strings.TrimSpace(rule.Scope), "/")
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+	if rule.Pattern == "" {
+		return errors.New("pattern is required")
+	}
+	if rule.PatternType == "" {
+		rule.PatternType = "glob"
+	}
+	switch rule.PatternType {
+	case "glob":
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", rule.Pattern, err)
+		}
+	case "regex":
+		if err := compile(rule); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("pattern_type must be glob or regex, not %q", rule.PatternType)
+	}
+	switch rule.Mode {
+	case Immutable:
+		rule.Roles = []string{}
+	case Protected:
+		roles := rule.Roles[:0]
+		for _, r := range rule.Roles {
+			if r = strings.TrimSpace(r); r != "" {
+				if strings.Contains(r, ",") {
+					return fmt.Errorf("invalid role %q", r)
+				}
+				roles = append(roles, r)
+			}
+		}
+		if len(roles) == 0 {
+			roles = append(roles, "admin")
+		}
+		rule.Roles = roles
+	default:
+		return fmt.Errorf("mode must be %s or %s, not %q", Immutable, Protected, rule.Mode)
+	}
+	return nil
+}
+
+// anchor makes a regex match whole tag names, as a glob does.
+func anchor(expr string) string {
+	return "^(?:" + expr + ")$"
+}
+
+// compile sets rule.Regexp from its regex pattern.
+func compile(rule *database.TagRule) error {
+	re, err := regexp.Compile(anchor(rule.Pattern))
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", rule.Pattern, err)
+	}
+	rule.Regexp = re
+	return nil
+}
+
+// Load returns the stored rules with their regexes compiled. A rule whose regex no longer
+// compiles is an error rather than skipped, so it cannot silently stop guarding its tags.
+func Load(db *database.Database) ([]*database.TagRule, error) {
+	rules, err := db.GetTagRules()
+	if err != nil {
+		return nil, fmt.Errorf("load tag rules: %w", err)
+	}
+	for _, rule := range rules {
+		if rule.PatternType == "regex" {
+			if err := compile(rule); err != nil {
+				return nil, fmt.Errorf("tag rule %d: %w", rule.ID, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Matches reports whether rule covers repo:tag. A regex rule must come from Validate or Load.
+func Matches(rule *database.TagRule, repo, tag string) bool {
+	if rule.Scope != "" && rule.Scope != repo && !strings.HasPrefix(repo, rule.Scope+"/") {
+		return false
+	}
+	if rule.PatternType == "regex" {
+		return rule.Regexp != nil && rule.Regexp.MatchString(tag)
+	}
+	ok, _ := path.Match(rule.Pattern, tag)
+	return ok
+}
+
+// Check returns an error wrapping ErrDenied if a rule forbids a user with role to do action to
+// the existing tag repo:tag.
+func Check(db *database.Database, repo, tag, role string, action Action) error {
+	rules, err := Load(db)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if !Matches(rule, repo, tag) {
+			continue
+		}
+		if rule.Mode == Immutable {
+			return fmt.Errorf("%w %d: %s:%s is immutable", ErrDenied, rule.ID, repo, tag)
+		}
+		if !contains(rule.Roles, role) {
+			return fmt.Errorf("%w %d: only %s may %s %s:%s", ErrDenied, rule.ID, strings.Join(rule.Roles, ", "), action, repo, tag)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}